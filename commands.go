@@ -0,0 +1,117 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/loadbalancer"
+)
+
+// version is stamped at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+func runVersion(args []string) error {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	fs.Parse(args)
+
+	fmt.Printf("lb %s (%s, %s/%s)\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" || s.Key == "vcs.time" {
+				fmt.Printf("%s: %s\n", s.Key, s.Value)
+			}
+		}
+	}
+	return nil
+}
+
+func runValidate(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	var bf balancerFlags
+	bf.register(fs)
+	if err := bf.parse(fs, args); err != nil {
+		return err
+	}
+
+	if _, err := bf.build(); err != nil {
+		return err
+	}
+	fmt.Println("configuration OK")
+	return nil
+}
+
+// subcommand checks that args start with the only supported action, "list"
+func subcommand(group string, args []string) ([]string, error) {
+	if len(args) == 0 || args[0] != "list" {
+		return nil, fmt.Errorf("usage: %s list [flags]", group)
+	}
+	return args[1:], nil
+}
+
+func runRoutes(args []string) error {
+	args, err := subcommand("routes", args)
+	if err != nil {
+		return err
+	}
+	fs := flag.NewFlagSet("routes list", flag.ExitOnError)
+	var bf balancerFlags
+	bf.register(fs)
+	if err := bf.parse(fs, args); err != nil {
+		return err
+	}
+
+	lb, err := bf.build()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tPATH\tPOOL\tSTRATEGY\tBACKENDS")
+	for _, r := range lb.Routes() {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\n", cmp.Or(r.Host, "*"), cmp.Or(r.PathPrefix, "/"), r.Pool, bf.strategy, r.Backends)
+	}
+	// requests matching no route go to the regular backends
+	fmt.Fprintf(tw, "*\t/\t-\t%s\t%d\n", bf.strategy, len(lb.Servers()))
+	return tw.Flush()
+}
+
+func runBackends(args []string) error {
+	args, err := subcommand("backends", args)
+	if err != nil {
+		return err
+	}
+	fs := flag.NewFlagSet("backends list", flag.ExitOnError)
+	var bf balancerFlags
+	bf.register(fs)
+	check := fs.Bool("check", false, "probe each backend and report its health")
+	timeout := fs.Duration("timeout", 5*time.Second, "probe timeout used with -check")
+	if err := bf.parse(fs, args); err != nil {
+		return err
+	}
+
+	lb, err := bf.build()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDRESS\tWEIGHT\tHEALTH")
+	for _, s := range lb.Servers() {
+		health := "-"
+		if *check {
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			health = "down"
+			if s.IsAlive(ctx) {
+				health = "up"
+			}
+			cancel()
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", s.Address(), loadbalancer.WeightOf(s), health)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/loadbalancer"
+)
+
+// backendSpec is one -backend value: a URL, optionally followed by ;weight=N, ;health-path=/path,
+// the ;tls-verify=, ;tls-ca= and ;tls-server-name= checks of an https backend, ;max-conns=N,
+// ;http-version=http1|h2, ;sign=hmac|sigv4:<region>/<service>|none, the ;auth-bearer=,
+// ;auth-user=, ;auth-password=, ;auth-header= and ;auth-value= credential, ;source-address=ip,
+// ;source-interface=name, ;note=text and any number of ;label.<name>=value. The bearer token,
+// password and header value are secret references, resolved whenever the balancer is built.
+type backendSpec struct {
+	URL             string            `json:"url"`
+	Weight          int               `json:"weight"`
+	HealthPath      string            `json:"health-path"`
+	TLSVerify       *bool             `json:"tls-verify"`
+	TLSCA           string            `json:"tls-ca"`
+	TLSServerName   string            `json:"tls-server-name"`
+	MaxConns        int               `json:"max-conns"`
+	HTTPVersion     string            `json:"http-version"`
+	Sign            string            `json:"sign"`
+	AuthBearer      string            `json:"auth-bearer"`
+	AuthUser        string            `json:"auth-user"`
+	AuthPassword    string            `json:"auth-password"`
+	AuthHeader      string            `json:"auth-header"`
+	AuthValue       string            `json:"auth-value"`
+	SourceAddress   string            `json:"source-address"`
+	SourceInterface string            `json:"source-interface"`
+	Labels          map[string]string `json:"labels"`
+	Note            string            `json:"note"`
+}
+
+// backendList is the repeatable -backend flag
+type backendList []backendSpec
+
+func (l *backendList) String() string {
+	urls := make([]string, len(*l))
+	for i, b := range *l {
+		urls[i] = b.URL
+	}
+	return strings.Join(urls, ",")
+}
+
+func (l *backendList) Set(v string) error {
+	parts := strings.Split(v, ";")
+	b := backendSpec{URL: strings.TrimSpace(parts[0])}
+	for _, part := range parts[1:] {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "weight":
+			w, err := strconv.Atoi(value)
+			if err != nil || w < 1 {
+				return fmt.Errorf("backend %q: weight must be a positive integer", b.URL)
+			}
+			b.Weight = w
+		case "health-path":
+			b.HealthPath = value
+		case "tls-verify":
+			verify, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("backend %q: tls-verify must be true or false", b.URL)
+			}
+			b.TLSVerify = &verify
+		case "tls-ca":
+			b.TLSCA = value
+		case "tls-server-name":
+			b.TLSServerName = value
+		case "max-conns":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return fmt.Errorf("backend %q: max-conns must be a positive integer", b.URL)
+			}
+			b.MaxConns = n
+		case "http-version":
+			if _, err := loadbalancer.ParseHTTPVersion(value); err != nil {
+				return fmt.Errorf("backend %q: %w", b.URL, err)
+			}
+			b.HTTPVersion = value
+		case "sign":
+			if err := checkSignSpec(value); err != nil {
+				return fmt.Errorf("backend %q: %w", b.URL, err)
+			}
+			b.Sign = value
+		case "auth-bearer":
+			b.AuthBearer = value
+		case "auth-user":
+			b.AuthUser = value
+		case "auth-password":
+			b.AuthPassword = value
+		case "auth-header":
+			b.AuthHeader = value
+		case "auth-value":
+			b.AuthValue = value
+		case "source-address":
+			if err := checkSourceAddress(value); err != nil {
+				return fmt.Errorf("backend %q: %w", b.URL, err)
+			}
+			b.SourceAddress = value
+		case "source-interface":
+			b.SourceInterface = value
+		case "note":
+			b.Note = value
+		default:
+			name, ok := strings.CutPrefix(key, "label.")
+			if !ok || name == "" {
+				return fmt.Errorf("backend %q: unknown setting %q", b.URL, key)
+			}
+			if b.Labels == nil {
+				b.Labels = make(map[string]string)
+			}
+			b.Labels[name] = value
+		}
+	}
+	*l = append(*l, b)
+	return nil
+}
+
+// setJSON takes a backend written as an object in the config file
+func (l *backendList) setJSON(raw json.RawMessage) error {
+	var b backendSpec
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&b); err != nil {
+		return err
+	}
+	if b.URL == "" {
+		return errors.New("backend without a url")
+	}
+	if b.Weight < 0 {
+		return fmt.Errorf("backend %q: weight must be a positive integer", b.URL)
+	}
+	if b.MaxConns < 0 {
+		return fmt.Errorf("backend %q: max-conns must be a positive integer", b.URL)
+	}
+	if _, err := loadbalancer.ParseHTTPVersion(b.HTTPVersion); err != nil {
+		return fmt.Errorf("backend %q: %w", b.URL, err)
+	}
+	if err := checkSignSpec(b.Sign); err != nil {
+		return fmt.Errorf("backend %q: %w", b.URL, err)
+	}
+	if b.SourceAddress != "" {
+		if err := checkSourceAddress(b.SourceAddress); err != nil {
+			return fmt.Errorf("backend %q: %w", b.URL, err)
+		}
+	}
+	*l = append(*l, b)
+	return nil
+}
+
+// checkSourceAddress validates a ;source-address= value
+func checkSourceAddress(addr string) error {
+	if net.ParseIP(addr) == nil {
+		return errors.New("source-address must be an IP address")
+	}
+	return nil
+}
+
+// tenantSpec is one -tenant value: name=host,host followed by ;config=file, any number of
+// ;backend=URL, ;max-in-flight=N and ;admin-token=secret. The tenant's balancer is built from
+// its config file and backends like a balancer of its own; the token is a secret reference.
+type tenantSpec struct {
+	Name        string   `json:"name"`
+	Hosts       []string `json:"hosts"`
+	Config      string   `json:"config"`
+	Backends    []string `json:"backends"`
+	MaxInFlight int64    `json:"max-in-flight"`
+	AdminToken  string   `json:"admin-token"`
+}
+
+// tenantList is the repeatable -tenant flag
+type tenantList []tenantSpec
+
+func (l *tenantList) String() string {
+	names := make([]string, len(*l))
+	for i, t := range *l {
+		names[i] = t.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func (l *tenantList) Set(v string) error {
+	parts := strings.Split(v, ";")
+	name, hosts, _ := strings.Cut(strings.TrimSpace(parts[0]), "=")
+	t := tenantSpec{Name: name}
+	if hosts != "" {
+		t.Hosts = strings.Split(hosts, ",")
+	}
+	for _, part := range parts[1:] {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "config":
+			t.Config = value
+		case "backend":
+			t.Backends = append(t.Backends, value)
+		case "max-in-flight":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("tenant %q: max-in-flight must be a non-negative integer", t.Name)
+			}
+			t.MaxInFlight = n
+		case "admin-token":
+			t.AdminToken = value
+		default:
+			return fmt.Errorf("tenant %q: unknown setting %q", t.Name, key)
+		}
+	}
+	return l.add(t)
+}
+
+// setJSON takes a tenant written as an object in the config file
+func (l *tenantList) setJSON(raw json.RawMessage) error {
+	var t tenantSpec
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&t); err != nil {
+		return err
+	}
+	if t.MaxInFlight < 0 {
+		return fmt.Errorf("tenant %q: max-in-flight must be a non-negative integer", t.Name)
+	}
+	return l.add(t)
+}
+
+func (l *tenantList) add(t tenantSpec) error {
+	if t.Name == "" || len(t.Hosts) == 0 {
+		return errors.New("tenant needs a name and at least one host")
+	}
+	*l = append(*l, t)
+	return nil
+}
+
+// parse parses args into fs and then fills in whatever the command line left unset from the
+// -config file
+func (f *balancerFlags) parse(fs *flag.FlagSet, args []string) error {
+	return f.parseWith(fs, args, nil)
+}
+
+// parseWith is parse with data, when non-nil, standing in for the -config file's contents, so a
+// configuration can be rebuilt from a copy kept in memory. The contents used end up in configData.
+func (f *balancerFlags) parseWith(fs *flag.FlagSet, args []string, data []byte) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if f.config == "" {
+		return nil
+	}
+	if data == nil {
+		var err error
+		if data, err = os.ReadFile(f.config); err != nil {
+			return err
+		}
+	}
+	f.configData = data
+	return loadConfig(fs, f.config, data)
+}
+
+// loadConfig applies a JSON config file to the balancer flags of fs. The file is an object keyed
+// by flag name: {"port": "8080", "strategy": "least-connections", "health-interval": "5s"}.
+// A repeatable flag takes an array, and a backend may be an object with url, weight,
+// health-path, labels and the other keys of a -backend value, a tenant one with name, hosts,
+// config, backends, max-in-flight and admin-token. Flags given on the command line win over the file.
+func loadConfig(fs *flag.FlagSet, path string, data []byte) error {
+	var settings map[string]json.RawMessage
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+
+	// only balancer settings belong in the file, not serve's -record or the file's own name
+	known := flag.NewFlagSet("config", flag.ContinueOnError)
+	new(balancerFlags).register(known)
+	explicit := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) { explicit[fl.Name] = true })
+
+	for _, name := range slices.Sorted(maps.Keys(settings)) {
+		fl := fs.Lookup(name)
+		if known.Lookup(name) == nil || fl == nil || name == "config" {
+			return fmt.Errorf("config %s: unknown setting %q", path, name)
+		}
+		if explicit[name] {
+			continue
+		}
+		if err := setFromJSON(fl, settings[name]); err != nil {
+			return fmt.Errorf("config %s: %s: %w", path, name, err)
+		}
+	}
+	return nil
+}
+
+// setFromJSON sets fl from a JSON string, number, boolean or object, or from each element of an array
+func setFromJSON(fl *flag.Flag, raw json.RawMessage) error {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return errors.New("missing value")
+	}
+	switch raw[0] {
+	case '[':
+		var values []json.RawMessage
+		if err := json.Unmarshal(raw, &values); err != nil {
+			return err
+		}
+		for _, v := range values {
+			if err := setFromJSON(fl, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	case '{':
+		js, ok := fl.Value.(interface{ setJSON(json.RawMessage) error })
+		if !ok {
+			return errors.New("does not take an object")
+		}
+		return js.setJSON(raw)
+	case '"':
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return err
+		}
+		return fl.Value.Set(s)
+	case 'n':
+		return nil
+	default:
+		// numbers and booleans read the same in JSON as on the command line
+		return fl.Value.Set(string(raw))
+	}
+}
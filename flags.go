@@ -0,0 +1,1620 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/election"
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/gossip"
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/loadbalancer"
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/redis"
+)
+
+// defaultBackends are used when no -backend flag is given
+var defaultBackends = []string{
+	"https://www.instagram.com/",
+	"https://www.twitter.com/",
+	"https://www.medium.com/",
+}
+
+// stringList is a flag.Value collecting every occurrence of a repeated flag
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// balancerFlags are the settings shared by every command that builds a LoadBalancer
+type balancerFlags struct {
+	config        string
+	configData    []byte
+	shutdownGrace time.Duration
+	// routedOnly leaves out the default backends, for a balancer whose routes come from elsewhere
+	routedOnly bool
+
+	port        string
+	adminPort   string
+	adminToken  string
+	backends    backendList
+	tenants     tenantList
+	strategy    string
+	egress      string
+	sourceIP    string
+	sourceIface string
+	hostRewrite bool
+	tagRequests bool
+	statusPage  string
+	routeLabels stringList
+	respRules   stringList
+	rewrites    stringList
+	gunzip      stringList
+	redirects   stringList
+	budgets     stringList
+	stubs       stringList
+	local       stringList
+	timing      bool
+
+	pools          stringList
+	poolStrategies stringList
+	poolHealthPath stringList
+	poolVersions   stringList
+	routes         stringList
+	spillovers     stringList
+
+	tlsCert        string
+	tlsKey         string
+	tlsTicketKey   string
+	autocertHosts  stringList
+	autocertDir    string
+	autocertEmail  string
+	autocertDNS    string
+	autocertZone   string
+	sniff          bool
+	sniffTimeout   time.Duration
+	tcpBackends    stringList
+	l4Port         string
+	l4Mode         string
+	l4Pools        stringList
+	l4Passthrough  bool
+	l4ClientIP     bool
+	autocertWait   time.Duration
+	httpsRedirect  string
+	backendCA      string
+	backendNoCheck bool
+	sign           string
+	signKeyID      string
+	signSecret     string
+
+	affinity       bool
+	affinityCookie string
+	affinityTTL    time.Duration
+	affinityIPHash bool
+	affinityIdle   time.Duration
+
+	connMaxRequests int
+	connMaxAge      time.Duration
+
+	idleProbeInterval time.Duration
+	keepAliveIdle     time.Duration
+
+	maxClientConns int
+	allow          stringList
+	authBypass     stringList
+
+	maxInFlight      int
+	admissionReserve int
+	admissionSecret  string
+	priorities       stringList
+	lowShare         float64
+
+	clientIdentity string
+	rateLimit      float64
+	rateBurst      int
+	rateHeader     string
+	trustedProxies stringList
+	maxPerBackend  int
+	degradeDepth   int
+
+	autoscale            bool
+	autoscaleWindow      time.Duration
+	autoscaleInFlight    int
+	autoscaleUtilization float64
+
+	abuse            bool
+	abuseBan         time.Duration
+	abuseTarpit      time.Duration
+	abuseMaxRequests int
+	deny             stringList
+	denyJA3          stringList
+
+	canaryBackends     stringList
+	canarySteps        string
+	canaryStepInterval time.Duration
+	canaryTolerance    float64
+	canaryLatencyTol   float64
+	canaryToken        string
+
+	darkBackends stringList
+	darkHeader   string
+	darkCookie   string
+	darkValue    string
+	darkToken    string
+
+	failoverBackends stringList
+	failoverBelow    float64
+	failoverRecover  float64
+	failoverHold     time.Duration
+
+	rolloutLabel      string
+	rolloutMinHealthy int
+
+	maintenance   stringList
+	maintenanceTZ string
+
+	capacityReports bool
+	capacityToken   string
+
+	promURL      string
+	promQuery    string
+	promLabel    string
+	promScale    float64
+	promInverse  bool
+	promInterval time.Duration
+	promToken    string
+
+	warmupPaths       stringList
+	warmupCount       int
+	warmupConcurrency int
+	warmupMaxLatency  time.Duration
+
+	prewarmConns   int
+	prewarmTimeout time.Duration
+
+	overrideToken string
+	overrideFrom  stringList
+
+	traceToken  string
+	traceFrom   stringList
+	traceSample float64
+
+	byteAccounting bool
+
+	reportPeriod time.Duration
+	reportKeep   int
+	cancellation bool
+
+	backendAPI      bool
+	backendAPIToken string
+	backendAPIMin   float64
+
+	snapshotDir      string
+	snapshotInterval time.Duration
+	snapshotKeep     int
+	snapshotToken    string
+
+	healthInterval     time.Duration
+	healthTimeout      time.Duration
+	healthPath         string
+	healthyThreshold   int
+	unhealthyThreshold int
+	healthPassive      bool
+	readyMinBackends   int
+	emptyPool          string
+	emptyPoolPage      string
+	emptyPoolWait      time.Duration
+	healthWebhook      string
+	healthWebhookToken string
+	drainWebhook       string
+	drainWebhookToken  string
+
+	normalizeURLs  bool
+	lowercasePaths bool
+
+	headerHygiene  bool
+	maxHeaders     int
+	maxHeaderBytes int
+	maxValueBytes  int
+
+	coalesce   bool
+	cache      bool
+	cacheBytes int64
+
+	idempotency     bool
+	idempotencyTTL  time.Duration
+	idempotencyWait time.Duration
+
+	retryAttempts int
+	retryMethods  string
+
+	dialTimeout   time.Duration
+	tlsTimeout    time.Duration
+	headerTimeout time.Duration
+	idleTimeout   time.Duration
+
+	adaptiveTimeouts bool
+	adaptiveQuantile float64
+	adaptiveFactor   float64
+	adaptiveMin      time.Duration
+	adaptiveMax      time.Duration
+
+	bandwidth       int64
+	bandwidthHeader string
+	routeBandwidth  stringList
+
+	leaderRedis string
+	leaderKey   string
+	leaderID    string
+	leaderTTL   time.Duration
+
+	gossipBind   string
+	gossipPeers  stringList
+	gossipSecret string
+}
+
+func (f *balancerFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.config, "config", "", "JSON file of settings keyed by flag name; flags on the command line take precedence, and serve re-reads it on SIGHUP or POST /reload")
+	fs.StringVar(&f.port, "port", "8080", "port to listen on, on all IPv4 and IPv6 addresses, or a host:port such as [::1]:8080")
+	fs.StringVar(&f.adminPort, "admin-port", "", "port or host:port for the admin endpoints (/livez, /readyz); disabled when empty")
+	fs.StringVar(&f.adminToken, "admin-token", os.Getenv("LB_ADMIN_TOKEN"), "operator bearer token required by the admin endpoints that act on traffic, such as DELETE /requests/{id}; also accepted by those with a token of their own (default $LB_ADMIN_TOKEN)")
+	fs.Var(&f.backends, "backend", "backend URL, optionally followed by ;weight=N, ;health-path=/path, ;tls-verify=false, ;tls-ca=file, ;tls-server-name=name, ;max-conns=N, ;http-version=http1|h2, ;sign=hmac|sigv4:<region>/<service>|none, ;auth-bearer=secret, ;auth-user=name with ;auth-password=secret, ;auth-header=name with ;auth-value=secret, ;source-address=ip, ;source-interface=name, ;note=text and ;label.<name>=value; may be repeated")
+	fs.Var(&f.tenants, "tenant", "name=host,host: serve the hosts from a balancer of the tenant's own, built from ;config=file and ;backend=URL (repeatable) with the shared settings ahead of it; also ;max-in-flight=N and ;admin-token=secret, which opens the admin port's /tenants/{name}/ to that tenant alone; may be repeated")
+	fs.DurationVar(&f.shutdownGrace, "shutdown-grace", 10*time.Second, "time in-flight requests get to finish on shutdown")
+	fs.StringVar(&f.egress, "egress-proxy", "", "forward proxy for backend traffic (http://, https:// or socks5://); defaults to $HTTPS_PROXY/$HTTP_PROXY")
+	fs.StringVar(&f.sourceIP, "source-address", "", "local IP address backend connections are made from, on multi-homed hosts")
+	fs.StringVar(&f.sourceIface, "source-interface", "", "network interface backend connections go out through, e.g. eth1; binding to it needs CAP_NET_RAW on Linux")
+	fs.BoolVar(&f.tagRequests, "tag-requests", false, "tell backends the balancer instance (-leader-id), route and pool in X-LB-Instance, X-LB-Route and X-LB-Pool")
+	fs.StringVar(&f.statusPage, "status-page", "", "path of a public, cacheable page showing whether the service is up, e.g. /status; disabled when empty")
+	fs.Var(&f.respRules, "response-rule", "check backend responses and replace broken ones with 502, e.g. 'path=/api;content-type=application/json;reject-status=500,503'; also host=, header=, max-bytes=, status= and penalty=; may be repeated")
+	fs.Var(&f.rewrites, "body-rewrite", "rewrite response bodies up to 1 MiB, e.g. 'path=/docs;old=app.internal;new=example.com' or 'banner=<p>Staging</p>'; regexp= instead of old= takes a pattern; also host=, content-type= and max-bytes=; may be repeated")
+	fs.Var(&f.redirects, "upstream-redirects", "what to do with backend redirects, e.g. 'path=/app;mode=rewrite' pointing Locations at a backend to the public host, or 'mode=follow;max-hops=3' following them on the balancer; also host= and mode=pass; may be repeated")
+	fs.Var(&f.gunzip, "gunzip-requests", "inflate gzip request bodies before proxying, e.g. 'path=/ingest' or 'host=api.example.com;max-bytes=1048576'; bodies over max-bytes (10 MiB) get 413; may be repeated")
+	fs.Var(&f.stubs, "stub", "answer matching requests without a backend, e.g. 'path=/healthz;status=200;body=ok'; also host=, header=Name: value, body-file=, and template=true to execute the body as a Go template; may be repeated")
+	fs.Var(&f.local, "local-methods", "answer OPTIONS and HEAD for matching requests at the balancer, e.g. 'path=/api/;allow=GET,POST,OPTIONS;cors-origin=https://app.example.com;head-ttl=30s'; also host=, cors-max-age=; may be repeated")
+	fs.Var(&f.budgets, "latency-budget", "log requests slower than a route's budget at warn level with their timing breakdown, e.g. 'path=/api;budget=300ms'; also host= and name=; may be repeated")
+	fs.BoolVar(&f.timing, "server-timing", false, "add a Server-Timing header to proxied responses with the time spent routing, selecting a backend, connecting and waiting for its first byte")
+	fs.Var(&f.routeLabels, "route-label", "label=Header: send requests carrying the header to backends whose label has its value, e.g. region=X-Region; may be repeated")
+	fs.Var(&f.pools, "pool", "name=URL,URL: a pool of backends for -route to send requests to; may be repeated")
+	fs.Var(&f.poolStrategies, "pool-strategy", "name=strategy: how a -pool picks its backends, in the syntax of -strategy; default -strategy")
+	fs.Var(&f.poolHealthPath, "pool-health-path", "name=/path: health check path of a -pool's backends")
+	fs.Var(&f.poolVersions, "pool-http-version", "name=http1|h2: HTTP version spoken to a -pool's backends instead of negotiating it")
+	fs.Var(&f.routes, "route", "host/path=pool: send matching requests to a -pool, e.g. static.example.com=static or /api=api; the most specific host, then the longest path wins; may be repeated")
+	fs.Var(&f.spillovers, "route-spillover", "host/path=pool;in-flight=N;rps=N: send a -route's requests beyond N in flight or N per second on its pool to another -pool, e.g. '/api=burst;in-flight=100'; also burst=; may be repeated")
+	fs.BoolVar(&f.hostRewrite, "host-rewrite", false, "send each backend its own host as the Host header instead of the client's, which moves to X-Forwarded-Host")
+	fs.StringVar(&f.tlsCert, "tls-cert", "", "PEM certificate chain for terminating TLS on -port; reloaded when the file changes")
+	fs.StringVar(&f.tlsKey, "tls-key", "", "PEM private key for -tls-cert")
+	fs.StringVar(&f.tlsTicketKey, "tls-ticket-secret", os.Getenv("LB_TLS_TICKET_SECRET"), "secret deriving TLS session ticket keys, shared by instances that resume each other's sessions (default $LB_TLS_TICKET_SECRET)")
+	fs.Var(&f.autocertHosts, "autocert-host", "host name to obtain a Let's Encrypt certificate for, terminating TLS on -port; may be repeated")
+	fs.StringVar(&f.autocertDir, "autocert-dir", "autocert", "directory keeping -autocert-host certificates across restarts")
+	fs.StringVar(&f.autocertEmail, "autocert-email", "", "contact address given to Let's Encrypt")
+	fs.StringVar(&f.autocertDNS, "autocert-dns", "", "answer DNS-01 challenges through the DNS API, allowing wildcard -autocert-host names: cloudflare ($CLOUDFLARE_API_TOKEN) or route53 ($AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY)")
+	fs.StringVar(&f.autocertZone, "autocert-dns-zone", "", "ID of the zone holding -autocert-dns records; looked up by name when empty")
+	fs.DurationVar(&f.autocertWait, "autocert-dns-propagation", 2*time.Minute, "longest wait for a DNS-01 record to show up before the CA checks it")
+	fs.StringVar(&f.httpsRedirect, "https-redirect", "", "port answering plain HTTP with a redirect to HTTPS, e.g. 80; disabled when empty")
+	fs.BoolVar(&f.sniff, "sniff", false, "take plain HTTP, TLS and raw TCP connections on -port alike, telling them apart by their first bytes")
+	fs.DurationVar(&f.sniffTimeout, "sniff-timeout", time.Second, "with -sniff, how long a silent connection waits before it goes to the -tcp-backend pool")
+	fs.Var(&f.tcpBackends, "tcp-backend", "host:port taking the -sniff connections that are neither HTTP nor terminated TLS; implies -sniff; may be repeated")
+	fs.StringVar(&f.l4Port, "transparent-port", "", "port balancing TCP connections by their original destination, for a balancer inserted by iptables rules or used as a SOCKS5 proxy; off when empty")
+	fs.StringVar(&f.l4Mode, "transparent-mode", "redirect", "how -transparent-port learns a connection's destination: redirect (iptables REDIRECT/DNAT), tproxy (iptables TPROXY) or socks5")
+	fs.Var(&f.l4Pools, "transparent-pool", "dest=host:port,host:port: TCP backends taking the -transparent-port connections headed to dest, as ip:port or :port for any address; may be repeated")
+	fs.BoolVar(&f.l4Passthrough, "transparent-passthrough", false, "connect -transparent-port connections with no -transparent-pool to their original destination instead of closing them")
+	fs.BoolVar(&f.l4ClientIP, "transparent-client-ip", false, "connect to -transparent-pool backends from the client's address; needs -transparent-mode tproxy")
+	fs.StringVar(&f.backendCA, "backend-tls-ca", "", "PEM bundle of the CAs trusted for https backends instead of the system roots")
+	fs.BoolVar(&f.backendNoCheck, "backend-tls-skip-verify", false, "accept any certificate from https backends; a backend's ;tls-verify= setting overrides it")
+	fs.StringVar(&f.sign, "sign-requests", "", "sign proxied requests: hmac with -sign-secret, or sigv4:<region>/<service> with the $AWS_ACCESS_KEY_ID credentials; a backend's ;sign= setting overrides it")
+	fs.StringVar(&f.signKeyID, "sign-key-id", "lb", "key ID sent with hmac request signatures")
+	fs.StringVar(&f.signSecret, "sign-secret", os.Getenv("LB_SIGN_SECRET"), "key of hmac request signatures (default $LB_SIGN_SECRET)")
+	fs.BoolVar(&f.affinity, "affinity", false, "keep each client on the backend it first reached, remembered in a cookie")
+	fs.StringVar(&f.affinityCookie, "affinity-cookie", "lb_affinity", "name of the -affinity cookie")
+	fs.DurationVar(&f.affinityTTL, "affinity-ttl", 0, "lifetime of the -affinity cookie; it lasts for the browser session when 0")
+	fs.BoolVar(&f.affinityIPHash, "affinity-ip-hash", false, "with -affinity, place clients without the cookie by a hash of their address")
+	fs.DurationVar(&f.affinityIdle, "affinity-session-idle", 10*time.Minute, "with -affinity, how long a client still counts as a session on a draining backend after its last request")
+	fs.IntVar(&f.connMaxRequests, "conn-max-requests", 0, "requests after which an upstream connection is closed and redialled; unlimited when 0")
+	fs.DurationVar(&f.connMaxAge, "conn-max-age", 0, "age after which an upstream connection is closed and redialled; unlimited when 0")
+	fs.DurationVar(&f.idleProbeInterval, "idle-probe-interval", 0, "how often pooled upstream connections are probed, closing a backend's idle ones once a probe finds one dead; off when 0")
+	fs.DurationVar(&f.keepAliveIdle, "upstream-keepalive-idle", 15*time.Second, "with -idle-probe-interval, quiet time before TCP keep-alive probes start on an upstream connection")
+	fs.Var(&f.warmupPaths, "warmup-path", "path requested on new and recovering backends before they take traffic; may be repeated")
+	fs.IntVar(&f.warmupCount, "warmup-count", 1, "times each -warmup-path is requested")
+	fs.IntVar(&f.warmupConcurrency, "warmup-concurrency", 1, "warm-up requests in flight at once")
+	fs.DurationVar(&f.warmupMaxLatency, "warmup-max-latency", 2*time.Second, "slowest acceptable warm-up response")
+	fs.IntVar(&f.prewarmConns, "prewarm-conns", 0, "idle connections opened to each backend on start, reload and when it is added (0 disables)")
+	fs.DurationVar(&f.prewarmTimeout, "prewarm-timeout", 5*time.Second, "time allowed for pre-warming a backend")
+	fs.StringVar(&f.overrideToken, "backend-override-token", os.Getenv("LB_BACKEND_OVERRIDE_TOKEN"), "secret that lets a request pick its backend with X-LB-Backend, sent in X-LB-Backend-Token (default $LB_BACKEND_OVERRIDE_TOKEN)")
+	fs.Var(&f.overrideFrom, "backend-override-from", "client address or CIDR allowed to pick its backend with X-LB-Backend without a token; may be repeated")
+	fs.StringVar(&f.traceToken, "decision-trace-token", os.Getenv("LB_DECISION_TRACE_TOKEN"), "secret that lets a request sending X-LB-Trace get how its backend was chosen in X-LB-Decision, sent in X-LB-Trace-Token (default $LB_DECISION_TRACE_TOKEN)")
+	fs.Var(&f.traceFrom, "decision-trace-from", "client address or CIDR allowed to ask for a decision trace with X-LB-Trace without a token; may be repeated")
+	fs.Float64Var(&f.traceSample, "decision-trace-sample", 0, "fraction of requests, from 0 to 1, whose backend choice is traced into the log")
+	fs.BoolVar(&f.normalizeURLs, "normalize-urls", false, "collapse duplicate slashes, resolve dot segments and normalize percent-encoding in request paths before routing")
+	fs.BoolVar(&f.lowercasePaths, "lowercase-paths", false, "with -normalize-urls, also fold paths to lower case")
+	fs.BoolVar(&f.headerHygiene, "header-hygiene", false, "strip hop-by-hop request headers before any stage sees them, enforce header limits and refuse requests that abuse Connection")
+	fs.IntVar(&f.maxHeaders, "max-headers", 100, "with -header-hygiene, most header fields a request may carry")
+	fs.IntVar(&f.maxHeaderBytes, "max-header-bytes", 64<<10, "with -header-hygiene, largest total size of a request's headers")
+	fs.IntVar(&f.maxValueBytes, "max-header-value-bytes", 8<<10, "with -header-hygiene, largest size of one header value")
+	fs.DurationVar(&f.healthInterval, "health-interval", 10*time.Second, "how often backends are health checked in the background; 0 checks the chosen backend on every request instead")
+	fs.DurationVar(&f.healthTimeout, "health-timeout", 2*time.Second, "time limit of one background health check")
+	fs.StringVar(&f.healthPath, "health-path", "", "path probed by health checks, e.g. /healthz; the backend URL itself when empty")
+	fs.IntVar(&f.healthyThreshold, "healthy-threshold", 2, "consecutive good health checks that bring a backend back")
+	fs.IntVar(&f.unhealthyThreshold, "unhealthy-threshold", 3, "consecutive failed health checks that take a backend out")
+	fs.IntVar(&f.readyMinBackends, "ready-min-backends", 0, "after startup, /readyz fails until this many backends have passed a health check")
+	fs.StringVar(&f.emptyPool, "empty-pool", "", "what requests get before any backend has been healthy: proxy, block, splash or retry")
+	fs.StringVar(&f.emptyPoolPage, "empty-pool-page", "", "with -empty-pool splash, file holding the HTML page served; a short notice when empty")
+	fs.DurationVar(&f.emptyPoolWait, "empty-pool-wait", 10*time.Second, "with -empty-pool block, how long a request is held waiting for a healthy backend")
+	fs.StringVar(&f.healthWebhook, "health-webhook", "", "URL that every backend health transition is POSTed to as a JSON event")
+	fs.StringVar(&f.healthWebhookToken, "health-webhook-token", os.Getenv("LB_HEALTH_WEBHOOK_TOKEN"), "bearer token sent to -health-webhook (default $LB_HEALTH_WEBHOOK_TOKEN)")
+	fs.StringVar(&f.drainWebhook, "drain-webhook", "", "URL that the status of a draining backend is POSTed to once it has no requests in flight and no sticky sessions left")
+	fs.StringVar(&f.drainWebhookToken, "drain-webhook-token", os.Getenv("LB_DRAIN_WEBHOOK_TOKEN"), "bearer token sent to -drain-webhook (default $LB_DRAIN_WEBHOOK_TOKEN)")
+	fs.BoolVar(&f.healthPassive, "health-passive", false, "with -health-interval, also take a backend out as soon as a request can't connect to it")
+	fs.BoolVar(&f.byteAccounting, "byte-accounting", false, "count body bytes by backend, route and client; served by GET /usage on the admin port")
+	fs.DurationVar(&f.reportPeriod, "traffic-reports", 0, "period of the traffic reports by route and backend served by GET /reports on the admin port, such as 1h; off when 0")
+	fs.IntVar(&f.reportKeep, "traffic-reports-keep", 24, "finished -traffic-reports kept")
+	fs.BoolVar(&f.cancellation, "request-cancellation", false, "list the requests in flight with GET /requests on the admin port and cut a stuck one off with DELETE /requests/{id}")
+	fs.BoolVar(&f.backendAPI, "backend-api", false, "add and remove backends at runtime with POST /backends and DELETE /backends/{address} on the admin port")
+	fs.StringVar(&f.backendAPIToken, "backend-api-token", os.Getenv("LB_BACKEND_API_TOKEN"), "bearer token accepted by the -backend-api endpoints besides -admin-token (default $LB_BACKEND_API_TOKEN)")
+	fs.Float64Var(&f.backendAPIMin, "backend-api-min-healthy", 0, "percentage of healthy capacity a DELETE /backends must leave unless it has ?force=true (0 disables)")
+	fs.StringVar(&f.snapshotDir, "snapshot-dir", "", "directory that snapshots of the runtime backend configuration are kept in, served by GET /snapshots on the admin port")
+	fs.DurationVar(&f.snapshotInterval, "snapshot-interval", 5*time.Minute, "how often the runtime configuration is snapshotted when it has changed")
+	fs.IntVar(&f.snapshotKeep, "snapshot-keep", 48, "number of snapshots kept in -snapshot-dir")
+	fs.StringVar(&f.snapshotToken, "snapshot-token", os.Getenv("LB_SNAPSHOT_TOKEN"), "bearer token accepted by the snapshot endpoints besides -admin-token (default $LB_SNAPSHOT_TOKEN)")
+	fs.BoolVar(&f.coalesce, "coalesce", false, "collapse concurrent identical GET and HEAD requests into one upstream call")
+	fs.BoolVar(&f.cache, "cache", false, "cache GET responses that declare their freshness, honouring stale-while-revalidate and stale-if-error")
+	fs.Int64Var(&f.cacheBytes, "cache-bytes", 64<<20, "upper bound on the bytes of cached response bodies")
+	fs.BoolVar(&f.idempotency, "idempotency", false, "answer retries of POST and PATCH requests carrying an Idempotency-Key header with the response to the first attempt")
+	fs.DurationVar(&f.idempotencyTTL, "idempotency-ttl", 24*time.Hour, "how long -idempotency replays a response")
+	fs.DurationVar(&f.idempotencyWait, "idempotency-wait", 30*time.Second, "how long a retry waits for the first attempt still in flight before it is answered 409")
+	fs.IntVar(&f.retryAttempts, "retry-attempts", 1, "backends tried per request when upstream calls fail; retries are off at 1")
+	fs.DurationVar(&f.dialTimeout, "dial-timeout", 0, "time limit for connecting to a backend (default 30s)")
+	fs.DurationVar(&f.tlsTimeout, "tls-handshake-timeout", 0, "time limit for the TLS handshake with an https backend (default 10s)")
+	fs.DurationVar(&f.headerTimeout, "response-header-timeout", 0, "time limit for a backend to start answering once the request is sent; unlimited when 0")
+	fs.DurationVar(&f.idleTimeout, "idle-conn-timeout", 0, "how long an unused backend connection is kept open (default 90s)")
+	fs.BoolVar(&f.adaptiveTimeouts, "adaptive-timeouts", false, "hold each backend to a time-to-headers limit learned from its own response times")
+	fs.Float64Var(&f.adaptiveQuantile, "adaptive-timeout-quantile", 0.99, "quantile of a backend's response times its -adaptive-timeouts limit is derived from")
+	fs.Float64Var(&f.adaptiveFactor, "adaptive-timeout-factor", 3, "multiplier applied to the quantile for -adaptive-timeouts")
+	fs.DurationVar(&f.adaptiveMin, "adaptive-timeout-min", time.Second, "lowest limit -adaptive-timeouts may learn")
+	fs.DurationVar(&f.adaptiveMax, "adaptive-timeout-max", 30*time.Second, "highest limit -adaptive-timeouts may learn, and the limit of backends not learned yet")
+	fs.StringVar(&f.retryMethods, "retry-methods", "GET,HEAD,PUT,DELETE", "comma-separated methods safe to retry; other requests opt in with an Idempotency-Key header")
+	fs.BoolVar(&f.capacityReports, "capacity-reports", false, "accept backend capacity reports on the admin port (POST /capacity)")
+	fs.StringVar(&f.capacityToken, "capacity-token", os.Getenv("LB_CAPACITY_TOKEN"), "bearer token accepted from capacity reporters besides -admin-token (default $LB_CAPACITY_TOKEN)")
+	fs.StringVar(&f.promURL, "prometheus-weights", "", "Prometheus server whose -prometheus-weights-query sets backend weights, e.g. http://prometheus:9090")
+	fs.StringVar(&f.promQuery, "prometheus-weights-query", "", "instant PromQL query returning one sample per backend")
+	fs.StringVar(&f.promLabel, "prometheus-weights-label", "instance", "sample label matched against the backend's address, host:port or host name")
+	fs.Float64Var(&f.promScale, "prometheus-weights-scale", 1, "factor turning a sample into a weight")
+	fs.BoolVar(&f.promInverse, "prometheus-weights-inverse", false, "divide the scale by the sample instead, for metrics where more means busier")
+	fs.DurationVar(&f.promInterval, "prometheus-weights-interval", 15*time.Second, "how often the weight query runs")
+	fs.StringVar(&f.promToken, "prometheus-weights-token", os.Getenv("LB_PROMETHEUS_TOKEN"), "bearer token sent to Prometheus (default $LB_PROMETHEUS_TOKEN)")
+	fs.Var(&f.canaryBackends, "canary-backend", "backend URL of a canary pool ramped up with POST /canary/ramp on the admin port; may be repeated")
+	fs.StringVar(&f.canarySteps, "canary-steps", "1,5,25,100", "comma-separated traffic percentages the canary ramp moves through")
+	fs.DurationVar(&f.canaryStepInterval, "canary-step-interval", 5*time.Minute, "how long each canary step runs before the next")
+	fs.Float64Var(&f.canaryTolerance, "canary-tolerance", 0.01, "error ratio by which the canary may exceed the regular pool before the ramp is rolled back")
+	fs.Float64Var(&f.canaryLatencyTol, "canary-latency-tolerance", 0, "fraction by which the canary's p95 latency may exceed the regular pool's before the ramp is rolled back, e.g. 0.2; latency is not judged at 0")
+	fs.StringVar(&f.canaryToken, "canary-token", os.Getenv("LB_CANARY_TOKEN"), "bearer token required to start or abort a canary ramp; -admin-token is accepted too (default $LB_CANARY_TOKEN)")
+	fs.Var(&f.darkBackends, "dark-backend", "backend URL of a hidden pre-release pool reached only through the dark launch gate; may be repeated")
+	fs.StringVar(&f.darkHeader, "dark-header", "X-Dark-Launch", "request header carrying the dark launch gate value")
+	fs.StringVar(&f.darkCookie, "dark-cookie", "", "cookie carrying the dark launch gate value")
+	fs.StringVar(&f.darkValue, "dark-value", os.Getenv("LB_DARK_LAUNCH_VALUE"), "secret gate value; change it at runtime with PUT /dark-launch (default $LB_DARK_LAUNCH_VALUE)")
+	fs.StringVar(&f.darkToken, "dark-launch-token", os.Getenv("LB_DARK_LAUNCH_TOKEN"), "bearer token required by PUT /dark-launch; -admin-token is accepted too (default $LB_DARK_LAUNCH_TOKEN)")
+	fs.Var(&f.failoverBackends, "failover-backend", "backend URL in a remote region, usually its balancer, that takes the traffic while the local pool is unhealthy; may be repeated")
+	fs.Float64Var(&f.failoverBelow, "failover-below", 0.5, "healthy share of the local backends under which traffic fails over to the remote region")
+	fs.Float64Var(&f.failoverRecover, "failover-recover", 0.8, "healthy share of the local backends at which traffic returns from the remote region")
+	fs.DurationVar(&f.failoverHold, "failover-hold", time.Minute, "least time between two region switches")
+	fs.StringVar(&f.rolloutLabel, "rollout-label", "", "backend label holding its version; sends all traffic to the newest version once -rollout-min-healthy of its backends are healthy")
+	fs.IntVar(&f.rolloutMinHealthy, "rollout-min-healthy", 1, "healthy backends the newest version needs before it takes all traffic")
+	fs.Var(&f.maintenance, "maintenance", "recurring maintenance window as 'backend;cron schedule;duration', e.g. 'http://b1:80;0 2 * * *;1h'; may be repeated")
+	fs.StringVar(&f.maintenanceTZ, "maintenance-tz", "UTC", "time zone maintenance schedules are read in")
+	fs.Var(&f.allow, "allow", "client address or CIDR (IPv4 or IPv6) to admit; when given, all others are refused; may be repeated")
+	fs.Var(&f.deny, "deny", "client address or CIDR (IPv4 or IPv6) to refuse; may be repeated")
+	fs.Var(&f.denyJA3, "deny-ja3", "JA3 fingerprint of TLS clients to refuse whatever their address; may be repeated")
+	fs.Var(&f.authBypass, "auth-bypass", "host/path exempt from -allow and -deny, e.g. /healthz, /.well-known/* or api.example.com/ping; may be repeated")
+	fs.BoolVar(&f.abuse, "abuse-detection", false, "ban clients with a high 4xx rate or request flood; bans are listed by GET /bans on the admin port")
+	fs.DurationVar(&f.abuseBan, "abuse-ban", 10*time.Minute, "how long an abusive client stays banned")
+	fs.DurationVar(&f.abuseTarpit, "abuse-tarpit", 0, "delay abusive clients' requests by this long instead of refusing them")
+	fs.IntVar(&f.abuseMaxRequests, "abuse-max-requests", 0, "requests per minute that make a client abusive whatever its responses; unlimited when 0")
+	fs.IntVar(&f.maxInFlight, "max-in-flight", 0, "requests in flight beyond which new ones get 503 with a retry token; unlimited when 0")
+	fs.IntVar(&f.admissionReserve, "admission-reserve", 0, "extra in-flight slots for clients retrying with a token from X-LB-Retry-Token; a tenth of -max-in-flight when 0")
+	fs.Var(&f.priorities, "priority", "give matching requests a class under load, e.g. 'path=/checkout;class=high' or 'header=X-Batch;class=low'; also host= and value=; the first match wins; may be repeated")
+	fs.Float64Var(&f.lowShare, "priority-low-share", 0.8, "part of -max-in-flight and -backend-max-conns that low-priority requests may fill")
+	fs.StringVar(&f.admissionSecret, "admission-secret", os.Getenv("LB_ADMISSION_SECRET"), "key signing retry tokens, shared by instances that honour each other's tokens (default $LB_ADMISSION_SECRET)")
+	fs.Float64Var(&f.rateLimit, "rate-limit", 0, "requests per second allowed per client before it gets 429; unlimited when 0")
+	fs.IntVar(&f.rateBurst, "rate-burst", 0, "requests a client may send at once under -rate-limit (default the rate, rounded up)")
+	fs.StringVar(&f.clientIdentity, "client-identity", "", "how clients are told apart for rate and bandwidth limits, fairness, bans, accounting and the access log, as a comma-separated fallback chain such as 'header;name=X-Api-Key,jwt-sub': "+strings.Join(loadbalancer.ClientIdentities(), ", ")+"; by address when empty")
+	fs.StringVar(&f.rateHeader, "rate-limit-header", "", "header, e.g. an API key, identifying clients for -rate-limit; by client IP when absent")
+	fs.Var(&f.trustedProxies, "trusted-proxy", "address or CIDR of a proxy in front of the balancer, whose X-Forwarded-For names the client for -rate-limit; may be repeated")
+	fs.IntVar(&f.degradeDepth, "degrade-in-flight", 0, "requests in flight per unit of weight at which a backend is passed over for less busy ones; disabled when 0")
+	fs.BoolVar(&f.autoscale, "autoscale-signals", false, "serve the request rate, latency, queue, healthy backends and utilization for autoscalers at GET /autoscale on the admin port and in /metrics")
+	fs.DurationVar(&f.autoscaleWindow, "autoscale-window", time.Minute, "period the -autoscale-signals rate, latency and utilization are averaged over")
+	fs.IntVar(&f.autoscaleInFlight, "autoscale-target-in-flight", 0, "requests in flight a backend without -backend-max-conns is sized for; utilization is only reported when every backend has a size")
+	fs.Float64Var(&f.autoscaleUtilization, "autoscale-target-utilization", 0.7, "utilization the recommended backend count of -autoscale-signals aims at")
+	fs.IntVar(&f.maxPerBackend, "backend-max-conns", 0, "requests in flight to one backend beyond which it is passed over; unlimited when 0")
+	fs.IntVar(&f.maxClientConns, "max-conns-per-client", 0, "maximum simultaneous connections from one client IP; unlimited when 0")
+	fs.Int64Var(&f.bandwidth, "bandwidth-per-client", 0, "maximum response bytes per second sent to one client; unlimited when 0")
+	fs.Var(&f.routeBandwidth, "route-bandwidth", "maximum response bytes per second for all requests of a route together, e.g. 'path=/downloads;rate=10485760'; also host= and burst=; may be repeated")
+	fs.StringVar(&f.bandwidthHeader, "bandwidth-key-header", "", "request header (e.g. X-API-Key) identifying clients for -bandwidth-per-client instead of their IP")
+	fs.StringVar(&f.leaderRedis, "leader-redis", "", "Redis address used for leader election; enables active-passive mode")
+	fs.StringVar(&f.leaderKey, "leader-key", "lb/leader", "lease key shared by the instances competing for leadership")
+	fs.StringVar(&f.leaderID, "leader-id", defaultInstanceID(), "unique identity of this instance in the election, the gossip cluster and X-LB-Instance")
+	fs.DurationVar(&f.leaderTTL, "leader-ttl", 5*time.Second, "leader lease TTL; bounds failover time")
+	fs.StringVar(&f.gossipBind, "gossip-bind", "", "UDP address for sharing backend health with peers, e.g. :7946; disabled when empty")
+	fs.Var(&f.gossipPeers, "gossip-peer", "UDP address of a peer instance; may be repeated")
+	fs.StringVar(&f.gossipSecret, "gossip-secret", os.Getenv("LB_GOSSIP_SECRET"), "shared key authenticating gossip messages (default $LB_GOSSIP_SECRET)")
+	fs.StringVar(&f.strategy, "strategy", "round-robin", "balancing strategy, or a comma-separated fallback chain such as 'consistent-hash;cookie=session,least-connections': "+strings.Join(loadbalancer.Strategies(), ", "))
+}
+
+// backendOptions adds the configured backends, falling back to the defaults unless routedOnly
+func (f *balancerFlags) backendOptions() ([]loadbalancer.Option, error) {
+	if len(f.backends) == 0 && f.routedOnly {
+		return nil, nil
+	}
+	if len(f.backends) == 0 {
+		return []loadbalancer.Option{loadbalancer.WithBackends(defaultBackends...)}, nil
+	}
+	opts := make([]loadbalancer.Option, 0, len(f.backends))
+	for _, b := range f.backends {
+		var serverOpts []loadbalancer.ServerOption
+		if b.Weight > 0 {
+			serverOpts = append(serverOpts, loadbalancer.WithWeight(b.Weight))
+		}
+		if b.HealthPath != "" {
+			serverOpts = append(serverOpts, loadbalancer.WithHealthPath(b.HealthPath))
+		}
+		if b.Labels != nil {
+			serverOpts = append(serverOpts, loadbalancer.WithLabels(b.Labels))
+		}
+		if b.Note != "" {
+			serverOpts = append(serverOpts, loadbalancer.WithNote(b.Note))
+		}
+		if b.MaxConns > 0 {
+			serverOpts = append(serverOpts, loadbalancer.WithMaxConcurrency(b.MaxConns))
+		}
+		if v, _ := loadbalancer.ParseHTTPVersion(b.HTTPVersion); v != loadbalancer.HTTPAuto {
+			serverOpts = append(serverOpts, loadbalancer.WithHTTPVersion(v))
+		}
+		if b.Sign != "" {
+			signer, err := f.signer(b.Sign)
+			if err != nil {
+				return nil, fmt.Errorf("backend %q: %w", b.URL, err)
+			}
+			serverOpts = append(serverOpts, loadbalancer.WithRequestSigning(signer))
+		}
+		if b.AuthBearer != "" || b.AuthUser != "" || b.AuthHeader != "" {
+			auth, err := b.auth()
+			if err != nil {
+				return nil, fmt.Errorf("backend %q: %w", b.URL, err)
+			}
+			serverOpts = append(serverOpts, loadbalancer.WithBackendAuth(auth))
+		}
+		if b.SourceAddress != "" || b.SourceInterface != "" {
+			serverOpts = append(serverOpts, loadbalancer.WithSource(loadbalancer.Source{IP: b.SourceAddress, Interface: b.SourceInterface}))
+		}
+		if b.TLSVerify != nil || b.TLSCA != "" || b.TLSServerName != "" {
+			cfg := f.backendTLS()
+			if b.TLSVerify != nil {
+				cfg.InsecureSkipVerify = !*b.TLSVerify
+			}
+			if b.TLSCA != "" {
+				cfg.CAFile = b.TLSCA
+			}
+			cfg.ServerName = b.TLSServerName
+			serverOpts = append(serverOpts, loadbalancer.WithBackendTLS(cfg))
+		}
+		opts = append(opts, loadbalancer.WithBackend(b.URL, serverOpts...))
+	}
+	return opts, nil
+}
+
+// tenantBalancers builds the balancer of each -tenant from its own config file and backends
+func (f *balancerFlags) tenantBalancers() ([]loadbalancer.Tenant, error) {
+	tenants := make([]loadbalancer.Tenant, 0, len(f.tenants))
+	for _, t := range f.tenants {
+		fs := flag.NewFlagSet("tenant "+t.Name, flag.ContinueOnError)
+		tf := balancerFlags{routedOnly: true}
+		tf.register(fs)
+		var args []string
+		if t.Config != "" {
+			args = append(args, "-config", t.Config)
+		}
+		for _, b := range t.Backends {
+			args = append(args, "-backend", b)
+		}
+		if err := tf.parse(fs, args); err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", t.Name, err)
+		}
+		if len(tf.tenants) > 0 {
+			return nil, fmt.Errorf("tenant %s: a tenant can't have tenants of its own", t.Name)
+		}
+		lb, err := tf.build(loadbalancer.WithName(t.Name))
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", t.Name, err)
+		}
+		token := t.AdminToken
+		if token != "" {
+			if token, err = loadbalancer.ResolveSecret(token); err != nil {
+				return nil, fmt.Errorf("tenant %s: %w", t.Name, err)
+			}
+		}
+		tenants = append(tenants, loadbalancer.Tenant{
+			Name:        t.Name,
+			Hosts:       t.Hosts,
+			Balancer:    lb,
+			MaxInFlight: t.MaxInFlight,
+			AdminToken:  token,
+		})
+	}
+	return tenants, nil
+}
+
+// auth resolves the secrets of a backend's ;auth- settings
+func (b *backendSpec) auth() (loadbalancer.BackendAuth, error) {
+	auth := loadbalancer.BackendAuth{Username: b.AuthUser, Header: b.AuthHeader}
+	for _, s := range []struct {
+		ref string
+		to  *string
+	}{{b.AuthBearer, &auth.Bearer}, {b.AuthPassword, &auth.Password}, {b.AuthValue, &auth.Value}} {
+		if s.ref == "" {
+			continue
+		}
+		v, err := loadbalancer.ResolveSecret(s.ref)
+		if err != nil {
+			return auth, err
+		}
+		*s.to = v
+	}
+	return auth, nil
+}
+
+// checkSignSpec validates a -sign-requests or ;sign= value without needing its secrets
+func checkSignSpec(spec string) error {
+	switch method, scope, _ := strings.Cut(spec, ":"); method {
+	case "", "none", "hmac":
+		return nil
+	case "sigv4":
+		region, service, _ := strings.Cut(scope, "/")
+		if region == "" || service == "" {
+			return fmt.Errorf("sign %q: want sigv4:<region>/<service>", spec)
+		}
+		return nil
+	}
+	return fmt.Errorf("sign %q: want hmac, sigv4:<region>/<service> or none", spec)
+}
+
+// signer builds the request signer of a -sign-requests or ;sign= value; none gives nil
+func (f *balancerFlags) signer(spec string) (loadbalancer.RequestSigner, error) {
+	if err := checkSignSpec(spec); err != nil {
+		return nil, err
+	}
+	method, scope, _ := strings.Cut(spec, ":")
+	switch method {
+	case "hmac":
+		if f.signSecret == "" {
+			return nil, errors.New("hmac request signing needs -sign-secret")
+		}
+		return &loadbalancer.HMACSigner{KeyID: f.signKeyID, Secret: f.signSecret}, nil
+	case "sigv4":
+		key, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if key == "" || secret == "" {
+			return nil, errors.New("sigv4 request signing needs $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY")
+		}
+		region, service, _ := strings.Cut(scope, "/")
+		return &loadbalancer.SigV4Signer{
+			AccessKey:    key,
+			SecretKey:    secret,
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			Region:       region,
+			Service:      service,
+		}, nil
+	}
+	return nil, nil
+}
+
+// labelRoutes turns -route-label label=Header values into a script rule sending requests that
+// carry the header to backends whose label has its value
+func labelRoutes(routes []string) (loadbalancer.ScriptRule, error) {
+	rule := loadbalancer.ScriptRule{Labels: make(map[string]string, len(routes))}
+	for _, r := range routes {
+		label, header, ok := strings.Cut(r, "=")
+		if !ok || label == "" || header == "" {
+			return rule, fmt.Errorf("route label %q: want label=Header", r)
+		}
+		rule.Labels[label] = "header(" + strconv.Quote(header) + ")"
+	}
+	return rule, nil
+}
+
+// transparentProxy builds the -transparent-port settings
+func (f *balancerFlags) transparentProxy() (loadbalancer.TransparentProxy, error) {
+	t := loadbalancer.TransparentProxy{
+		Port:             f.l4Port,
+		Mode:             f.l4Mode,
+		Pools:            make(map[string][]string),
+		Passthrough:      f.l4Passthrough,
+		PreserveClientIP: f.l4ClientIP,
+	}
+	for _, p := range f.l4Pools {
+		dest, backends, ok := strings.Cut(p, "=")
+		if !ok || dest == "" || backends == "" {
+			return t, fmt.Errorf("transparent pool %q: want dest=host:port,host:port", p)
+		}
+		if _, dup := t.Pools[dest]; dup {
+			return t, fmt.Errorf("transparent pool %q defined twice", dest)
+		}
+		t.Pools[dest] = strings.Split(backends, ",")
+	}
+	return t, nil
+}
+
+// poolOptions builds the -pool and -route settings
+func (f *balancerFlags) poolOptions() ([]loadbalancer.Option, error) {
+	var pools []loadbalancer.Pool
+	index := make(map[string]int)
+	for _, p := range f.pools {
+		name, backends, ok := strings.Cut(p, "=")
+		if !ok || name == "" || backends == "" {
+			return nil, fmt.Errorf("pool %q: want name=URL,URL", p)
+		}
+		if _, dup := index[name]; dup {
+			return nil, fmt.Errorf("pool %q defined twice", name)
+		}
+		index[name] = len(pools)
+		pools = append(pools, loadbalancer.Pool{Name: name, Backends: strings.Split(backends, ",")})
+	}
+	for _, s := range f.poolStrategies {
+		name, spec, _ := strings.Cut(s, "=")
+		i, ok := index[name]
+		if !ok {
+			return nil, fmt.Errorf("pool strategy %q: no -pool %q", s, name)
+		}
+		strategy, err := loadbalancer.ParseStrategy(spec)
+		if err != nil {
+			return nil, fmt.Errorf("pool %q: %w", name, err)
+		}
+		pools[i].Strategy = strategy
+	}
+	for _, h := range f.poolHealthPath {
+		name, path, _ := strings.Cut(h, "=")
+		i, ok := index[name]
+		if !ok {
+			return nil, fmt.Errorf("pool health path %q: no -pool %q", h, name)
+		}
+		pools[i].HealthPath = path
+	}
+	for _, h := range f.poolVersions {
+		name, version, _ := strings.Cut(h, "=")
+		i, ok := index[name]
+		if !ok {
+			return nil, fmt.Errorf("pool http version %q: no -pool %q", h, name)
+		}
+		v, err := loadbalancer.ParseHTTPVersion(version)
+		if err != nil {
+			return nil, fmt.Errorf("pool %q: %w", name, err)
+		}
+		pools[i].HTTPVersion = v
+	}
+	routes := make([]loadbalancer.Route, 0, len(f.routes))
+	routeIndex := make(map[string]int)
+	for _, r := range f.routes {
+		match, pool, ok := strings.Cut(r, "=")
+		if !ok || match == "" || pool == "" {
+			return nil, fmt.Errorf("route %q: want host/path=pool", r)
+		}
+		route := loadbalancer.Route{Host: match, Pool: pool}
+		if i := strings.IndexByte(match, '/'); i >= 0 {
+			route.Host, route.PathPrefix = match[:i], match[i:]
+		}
+		routeIndex[match] = len(routes)
+		routes = append(routes, route)
+	}
+	for _, spec := range f.spillovers {
+		match, rest, _ := strings.Cut(spec, "=")
+		i, ok := routeIndex[match]
+		if !ok {
+			return nil, fmt.Errorf("route spillover %q: no -route %q", spec, match)
+		}
+		sp, err := parseSpillover(rest)
+		if err != nil {
+			return nil, fmt.Errorf("route spillover %q: %w", spec, err)
+		}
+		routes[i].Spillover = sp
+	}
+	var opts []loadbalancer.Option
+	if len(pools) > 0 {
+		opts = append(opts, loadbalancer.WithPools(pools...))
+	}
+	if len(routes) > 0 {
+		opts = append(opts, loadbalancer.WithRoutes(routes...))
+	}
+	return opts, nil
+}
+
+// parseSpillover parses the pool;key=value part of a -route-spillover value
+func parseSpillover(spec string) (*loadbalancer.Spillover, error) {
+	parts := strings.Split(spec, ";")
+	sp := &loadbalancer.Spillover{Pool: strings.TrimSpace(parts[0])}
+	if sp.Pool == "" {
+		return nil, errors.New("want host/path=pool;in-flight=N;rps=N")
+	}
+	for _, part := range parts[1:] {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		var err error
+		switch key {
+		case "in-flight":
+			sp.MaxInFlight, err = strconv.Atoi(value)
+		case "rps":
+			sp.RPS, err = strconv.ParseFloat(value, 64)
+		case "burst":
+			sp.Burst, err = strconv.ParseFloat(value, 64)
+		default:
+			return nil, fmt.Errorf("unknown setting %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return sp, nil
+}
+
+// priorityRules parses -priority values: ;-separated key=value settings
+func priorityRules(specs []string) ([]loadbalancer.PriorityRule, error) {
+	rules := make([]loadbalancer.PriorityRule, 0, len(specs))
+	for _, spec := range specs {
+		var r loadbalancer.PriorityRule
+		class := false
+		for part := range strings.SplitSeq(spec, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			switch key {
+			case "host":
+				r.Host = value
+			case "path":
+				r.PathPrefix = value
+			case "header":
+				r.Header = value
+			case "value":
+				r.Value = value
+			case "class":
+				p, err := loadbalancer.ParsePriority(value)
+				if err != nil {
+					return nil, fmt.Errorf("priority %q: %w", spec, err)
+				}
+				r.Priority, class = p, true
+			default:
+				return nil, fmt.Errorf("priority %q: unknown setting %q", spec, key)
+			}
+		}
+		if !class {
+			return nil, fmt.Errorf("priority %q: missing class=", spec)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// responseRules parses -response-rule values: ;-separated key=value settings, lists
+// separated by commas
+func responseRules(specs []string) ([]loadbalancer.ResponseRule, error) {
+	rules := make([]loadbalancer.ResponseRule, 0, len(specs))
+	for _, spec := range specs {
+		var r loadbalancer.ResponseRule
+		for part := range strings.SplitSeq(spec, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			var err error
+			switch key {
+			case "host":
+				r.Host = value
+			case "path":
+				r.PathPrefix = value
+			case "content-type":
+				r.ContentTypes = strings.Split(value, ",")
+			case "header":
+				r.RequireHeaders = strings.Split(value, ",")
+			case "reject-status":
+				for v := range strings.SplitSeq(value, ",") {
+					var code int
+					if code, err = strconv.Atoi(strings.TrimSpace(v)); err != nil {
+						break
+					}
+					r.RejectStatus = append(r.RejectStatus, code)
+				}
+			case "max-bytes":
+				r.MaxBytes, err = strconv.ParseInt(value, 10, 64)
+			case "status":
+				r.Status, err = strconv.Atoi(value)
+			case "penalty":
+				r.Penalty, err = time.ParseDuration(value)
+			default:
+				return nil, fmt.Errorf("response rule %q: unknown setting %q", spec, key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("response rule %q: %s: %w", spec, key, err)
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// bodyRewrites parses -body-rewrite values: ;-separated key=value settings, where each new=
+// completes the old= or regexp= before it
+func bodyRewrites(specs []string) ([]loadbalancer.BodyRewrite, error) {
+	rules := make([]loadbalancer.BodyRewrite, 0, len(specs))
+	for _, spec := range specs {
+		var (
+			r       loadbalancer.BodyRewrite
+			pending *loadbalancer.Replacement
+		)
+		for part := range strings.SplitSeq(spec, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			var err error
+			switch key {
+			case "host":
+				r.Host = value
+			case "path":
+				r.PathPrefix = value
+			case "content-type":
+				r.ContentTypes = strings.Split(value, ",")
+			case "old", "regexp":
+				if pending != nil {
+					return nil, fmt.Errorf("body rewrite %q: %q has no new=", spec, pending.Old)
+				}
+				pending = &loadbalancer.Replacement{Old: value, Regexp: key == "regexp"}
+			case "new":
+				if pending == nil {
+					return nil, fmt.Errorf("body rewrite %q: new= without old= or regexp=", spec)
+				}
+				pending.New = value
+				r.Replace = append(r.Replace, *pending)
+				pending = nil
+			case "banner":
+				r.Banner = value
+			case "max-bytes":
+				r.MaxBytes, err = strconv.ParseInt(value, 10, 64)
+			default:
+				return nil, fmt.Errorf("body rewrite %q: unknown setting %q", spec, key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("body rewrite %q: %s: %w", spec, key, err)
+			}
+		}
+		if pending != nil {
+			return nil, fmt.Errorf("body rewrite %q: %q has no new=", spec, pending.Old)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// decompressRules parses -gunzip-requests values: ;-separated key=value settings
+func decompressRules(specs []string) ([]loadbalancer.RequestDecompression, error) {
+	rules := make([]loadbalancer.RequestDecompression, 0, len(specs))
+	for _, spec := range specs {
+		var r loadbalancer.RequestDecompression
+		for part := range strings.SplitSeq(spec, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			var err error
+			switch key {
+			case "host":
+				r.Host = value
+			case "path":
+				r.PathPrefix = value
+			case "max-bytes":
+				r.MaxBytes, err = strconv.ParseInt(value, 10, 64)
+			default:
+				return nil, fmt.Errorf("gunzip rule %q: unknown setting %q", spec, key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("gunzip rule %q: %s: %w", spec, key, err)
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// redirectPolicies parses -upstream-redirects values: ;-separated key=value settings
+func redirectPolicies(specs []string) ([]loadbalancer.RedirectPolicy, error) {
+	policies := make([]loadbalancer.RedirectPolicy, 0, len(specs))
+	for _, spec := range specs {
+		var p loadbalancer.RedirectPolicy
+		for part := range strings.SplitSeq(spec, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			var err error
+			switch key {
+			case "host":
+				p.Host = value
+			case "path":
+				p.PathPrefix = value
+			case "mode":
+				p.Mode = value
+			case "max-hops":
+				p.MaxHops, err = strconv.Atoi(value)
+			default:
+				return nil, fmt.Errorf("redirect policy %q: unknown setting %q", spec, key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("redirect policy %q: %s: %w", spec, key, err)
+			}
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
+
+// routeBandwidthLimits parses -route-bandwidth values: ;-separated key=value settings
+func routeBandwidthLimits(specs []string) ([]loadbalancer.RouteBandwidthLimit, error) {
+	limits := make([]loadbalancer.RouteBandwidthLimit, 0, len(specs))
+	for _, spec := range specs {
+		var l loadbalancer.RouteBandwidthLimit
+		for part := range strings.SplitSeq(spec, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			var err error
+			switch key {
+			case "host":
+				l.Host = value
+			case "path":
+				l.PathPrefix = value
+			case "rate":
+				l.BytesPerSecond, err = strconv.ParseInt(value, 10, 64)
+			case "burst":
+				l.Burst, err = strconv.ParseInt(value, 10, 64)
+			default:
+				return nil, fmt.Errorf("route bandwidth %q: unknown setting %q", spec, key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("route bandwidth %q: %s: %w", spec, key, err)
+			}
+		}
+		limits = append(limits, l)
+	}
+	return limits, nil
+}
+
+// latencyBudgets parses -latency-budget values: ;-separated key=value settings
+func latencyBudgets(specs []string) ([]loadbalancer.LatencyBudget, error) {
+	budgets := make([]loadbalancer.LatencyBudget, 0, len(specs))
+	for _, spec := range specs {
+		var b loadbalancer.LatencyBudget
+		for part := range strings.SplitSeq(spec, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			var err error
+			switch key {
+			case "host":
+				b.Host = value
+			case "path":
+				b.PathPrefix = value
+			case "name":
+				b.Name = value
+			case "budget":
+				b.Budget, err = time.ParseDuration(value)
+			default:
+				return nil, fmt.Errorf("latency budget %q: unknown setting %q", spec, key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("latency budget %q: %s: %w", spec, key, err)
+			}
+		}
+		if b.Budget <= 0 {
+			return nil, fmt.Errorf("latency budget %q: missing budget=", spec)
+		}
+		budgets = append(budgets, b)
+	}
+	return budgets, nil
+}
+
+// stubs parses -stub values: ;-separated key=value settings. A body containing ; must come
+// from body-file.
+func stubs(specs []string) ([]loadbalancer.Stub, error) {
+	stubs := make([]loadbalancer.Stub, 0, len(specs))
+	for _, spec := range specs {
+		s := loadbalancer.Stub{Header: make(http.Header)}
+		for part := range strings.SplitSeq(spec, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			var err error
+			switch key {
+			case "host":
+				s.Host = value
+			case "path":
+				s.PathPrefix = value
+			case "status":
+				s.Status, err = strconv.Atoi(value)
+			case "header":
+				name, v, ok := strings.Cut(value, ":")
+				if !ok {
+					return nil, fmt.Errorf("stub %q: header %q: want Name: value", spec, value)
+				}
+				s.Header.Add(strings.TrimSpace(name), strings.TrimSpace(v))
+			case "body":
+				s.Body = value
+			case "body-file":
+				var b []byte
+				b, err = os.ReadFile(value)
+				s.Body = string(b)
+			case "template":
+				s.Template, err = strconv.ParseBool(value)
+			default:
+				return nil, fmt.Errorf("stub %q: unknown setting %q", spec, key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("stub %q: %s: %w", spec, key, err)
+			}
+		}
+		stubs = append(stubs, s)
+	}
+	return stubs, nil
+}
+
+// localMethods parses -local-methods values: ;-separated key=value settings
+func localMethods(specs []string) ([]loadbalancer.LocalMethods, error) {
+	rules := make([]loadbalancer.LocalMethods, 0, len(specs))
+	for _, spec := range specs {
+		var r loadbalancer.LocalMethods
+		for part := range strings.SplitSeq(spec, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			var err error
+			switch key {
+			case "host":
+				r.Host = value
+			case "path":
+				r.PathPrefix = value
+			case "allow":
+				r.Allow = strings.Split(value, ",")
+			case "cors-origin":
+				r.CORSOrigins = append(r.CORSOrigins, strings.Split(value, ",")...)
+			case "cors-max-age":
+				r.CORSMaxAge, err = time.ParseDuration(value)
+			case "head-ttl":
+				r.HeadTTL, err = time.ParseDuration(value)
+			default:
+				return nil, fmt.Errorf("local methods %q: unknown setting %q", spec, key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("local methods %q: %s: %w", spec, key, err)
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// backendTLS is the verification every https backend gets unless it sets its own
+func (f *balancerFlags) backendTLS() loadbalancer.BackendTLS {
+	return loadbalancer.BackendTLS{InsecureSkipVerify: f.backendNoCheck, CAFile: f.backendCA}
+}
+
+// dnsProvider builds the -autocert-dns provider, with credentials from the environment
+func (f *balancerFlags) dnsProvider() (loadbalancer.DNSProvider, error) {
+	switch f.autocertDNS {
+	case "":
+		return nil, nil
+	case "cloudflare":
+		token := os.Getenv("CLOUDFLARE_API_TOKEN")
+		if token == "" {
+			return nil, errors.New("-autocert-dns cloudflare needs $CLOUDFLARE_API_TOKEN")
+		}
+		return &loadbalancer.CloudflareDNS{APIToken: token, ZoneID: f.autocertZone}, nil
+	case "route53":
+		key, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if key == "" || secret == "" {
+			return nil, errors.New("-autocert-dns route53 needs $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY")
+		}
+		return &loadbalancer.Route53DNS{
+			AccessKey:    key,
+			SecretKey:    secret,
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			HostedZoneID: f.autocertZone,
+		}, nil
+	}
+	return nil, fmt.Errorf("-autocert-dns %q: want cloudflare or route53", f.autocertDNS)
+}
+
+// tlsOptions configures TLS termination, the HTTPS redirect, protocol sniffing and backend
+// certificate checks
+func (f *balancerFlags) tlsOptions() ([]loadbalancer.Option, error) {
+	var opts []loadbalancer.Option
+	if (f.tlsCert == "") != (f.tlsKey == "") {
+		return nil, errors.New("-tls-cert and -tls-key go together")
+	}
+	if f.tlsCert != "" && len(f.autocertHosts) > 0 {
+		return nil, errors.New("use -tls-cert or -autocert-host, not both")
+	}
+	if f.tlsCert != "" {
+		opts = append(opts, loadbalancer.WithCertificateFiles(f.tlsCert, f.tlsKey))
+	}
+	if len(f.autocertHosts) > 0 {
+		dns, err := f.dnsProvider()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, loadbalancer.WithAutoCert(loadbalancer.AutoCert{
+			Hosts:          f.autocertHosts,
+			CacheDir:       f.autocertDir,
+			Email:          f.autocertEmail,
+			DNS:            dns,
+			DNSPropagation: f.autocertWait,
+		}))
+	} else if f.autocertDNS != "" {
+		return nil, errors.New("-autocert-dns needs -autocert-host")
+	}
+	terminating := len(opts) > 0
+	if f.httpsRedirect != "" {
+		if !terminating {
+			return nil, errors.New("-https-redirect needs -tls-cert or -autocert-host")
+		}
+		opts = append(opts, loadbalancer.WithHTTPRedirect(f.httpsRedirect))
+	}
+	if f.sniff || len(f.tcpBackends) > 0 {
+		opts = append(opts, loadbalancer.WithProtocolSniffing(loadbalancer.ProtocolSniffing{
+			TCPBackends: f.tcpBackends,
+			Timeout:     f.sniffTimeout,
+		}))
+	}
+	if terminating && f.tlsTicketKey != "" {
+		opts = append(opts, loadbalancer.WithSessionTickets(loadbalancer.SessionTickets{Secret: f.tlsTicketKey}))
+	}
+	if f.backendNoCheck || f.backendCA != "" {
+		opts = append(opts, loadbalancer.WithBackendTLSDefaults(f.backendTLS()))
+	}
+	return opts, nil
+}
+
+// build constructs the LoadBalancer described by the flags
+func (f *balancerFlags) build(extra ...loadbalancer.Option) (*loadbalancer.LoadBalancer, error) {
+	strategy, err := loadbalancer.ParseStrategy(f.strategy)
+	if err != nil {
+		return nil, err
+	}
+	opts := []loadbalancer.Option{
+		loadbalancer.WithPort(f.port),
+		loadbalancer.WithAdminPort(f.adminPort),
+		loadbalancer.WithAdminToken(f.adminToken),
+		loadbalancer.WithStrategy(strategy),
+	}
+	if len(f.tenants) > 0 {
+		tenants, err := f.tenantBalancers()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, loadbalancer.WithTenants(tenants...))
+		// the hosts no tenant owns get the backends given, not the defaults
+		f.routedOnly = true
+	}
+	backendOpts, err := f.backendOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, backendOpts...)
+	if f.sign != "" {
+		signer, err := f.signer(f.sign)
+		if err != nil {
+			return nil, err
+		}
+		if signer != nil {
+			opts = append(opts, loadbalancer.WithRequestSigningDefaults(signer))
+		}
+	}
+	tlsOpts, err := f.tlsOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, tlsOpts...)
+	poolOpts, err := f.poolOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, poolOpts...)
+	if f.l4Port != "" {
+		t, err := f.transparentProxy()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, loadbalancer.WithTransparentProxy(t))
+	} else if len(f.l4Pools) > 0 {
+		return nil, errors.New("-transparent-pool needs -transparent-port")
+	}
+	if f.hostRewrite {
+		opts = append(opts, loadbalancer.WithBackendHostRewrite())
+	}
+	if f.affinity {
+		opts = append(opts, loadbalancer.WithAffinity(loadbalancer.Affinity{
+			Cookie:      f.affinityCookie,
+			TTL:         f.affinityTTL,
+			IPHash:      f.affinityIPHash,
+			SessionIdle: f.affinityIdle,
+		}))
+	}
+	if f.tagRequests {
+		opts = append(opts, loadbalancer.WithRequestTags(loadbalancer.RequestTags{Instance: f.leaderID}))
+	}
+	if f.statusPage != "" {
+		opts = append(opts, loadbalancer.WithStatusPage(loadbalancer.StatusPage{Path: f.statusPage}))
+	}
+	if len(f.respRules) > 0 {
+		rules, err := responseRules(f.respRules)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, loadbalancer.WithResponseRules(rules...))
+	}
+	if len(f.rewrites) > 0 {
+		rules, err := bodyRewrites(f.rewrites)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, loadbalancer.WithBodyRewrites(rules...))
+	}
+	if len(f.redirects) > 0 {
+		policies, err := redirectPolicies(f.redirects)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, loadbalancer.WithRedirectPolicies(policies...))
+	}
+	if len(f.gunzip) > 0 {
+		rules, err := decompressRules(f.gunzip)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, loadbalancer.WithRequestDecompression(rules...))
+	}
+	if len(f.stubs) > 0 {
+		stubs, err := stubs(f.stubs)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, loadbalancer.WithStubs(stubs...))
+	}
+	if len(f.local) > 0 {
+		rules, err := localMethods(f.local)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, loadbalancer.WithLocalMethods(rules...))
+	}
+	if len(f.budgets) > 0 {
+		budgets, err := latencyBudgets(f.budgets)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, loadbalancer.WithLatencyBudgets(budgets...))
+	}
+	if f.timing {
+		opts = append(opts, loadbalancer.WithServerTiming())
+	}
+	if len(f.routeLabels) > 0 {
+		rule, err := labelRoutes(f.routeLabels)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, loadbalancer.WithScript(rule))
+	}
+	if f.connMaxRequests > 0 || f.connMaxAge > 0 {
+		opts = append(opts, loadbalancer.WithUpstreamRecycling(loadbalancer.Recycling{
+			MaxRequests: f.connMaxRequests,
+			MaxAge:      f.connMaxAge,
+		}))
+	}
+	if f.idleProbeInterval > 0 {
+		opts = append(opts, loadbalancer.WithIdleProbing(loadbalancer.IdleProbing{
+			Interval:      f.idleProbeInterval,
+			KeepAliveIdle: f.keepAliveIdle,
+		}))
+	}
+	if len(f.warmupPaths) > 0 {
+		opts = append(opts, loadbalancer.WithWarmUp(loadbalancer.WarmUp{
+			Paths:       f.warmupPaths,
+			Count:       f.warmupCount,
+			Concurrency: f.warmupConcurrency,
+			MaxLatency:  f.warmupMaxLatency,
+		}))
+	}
+	if f.prewarmConns > 0 {
+		opts = append(opts, loadbalancer.WithPrewarm(loadbalancer.Prewarm{Conns: f.prewarmConns, Timeout: f.prewarmTimeout}))
+	}
+	if f.overrideToken != "" || len(f.overrideFrom) > 0 {
+		opts = append(opts, loadbalancer.WithBackendOverride(loadbalancer.BackendOverride{
+			Token:   f.overrideToken,
+			Trusted: f.overrideFrom,
+		}))
+	}
+	if f.traceToken != "" || len(f.traceFrom) > 0 || f.traceSample > 0 {
+		opts = append(opts, loadbalancer.WithDecisionTrace(loadbalancer.DecisionTrace{
+			Token:      f.traceToken,
+			Trusted:    f.traceFrom,
+			SampleRate: f.traceSample,
+		}))
+	}
+	if f.normalizeURLs {
+		opts = append(opts, loadbalancer.WithURLNormalization(loadbalancer.URLNormalization{Lowercase: f.lowercasePaths}))
+	}
+	if f.headerHygiene {
+		opts = append(opts, loadbalancer.WithHeaderHygiene(loadbalancer.HeaderHygiene{
+			MaxHeaders:     f.maxHeaders,
+			MaxHeaderBytes: f.maxHeaderBytes,
+			MaxValueBytes:  f.maxValueBytes,
+		}))
+	}
+	if f.healthInterval > 0 {
+		opts = append(opts, loadbalancer.WithHealthChecks(loadbalancer.HealthChecks{
+			Interval:  f.healthInterval,
+			Timeout:   f.healthTimeout,
+			Path:      f.healthPath,
+			Healthy:   f.healthyThreshold,
+			Unhealthy: f.unhealthyThreshold,
+			Passive:   f.healthPassive,
+		}))
+	}
+	if f.readyMinBackends > 0 {
+		opts = append(opts, loadbalancer.WithStartupGate(f.readyMinBackends))
+	}
+	if f.emptyPool != "" {
+		p := loadbalancer.EmptyPool{Mode: f.emptyPool, Wait: f.emptyPoolWait}
+		if f.emptyPoolPage != "" {
+			if p.Page, err = os.ReadFile(f.emptyPoolPage); err != nil {
+				return nil, fmt.Errorf("empty pool page: %w", err)
+			}
+		}
+		opts = append(opts, loadbalancer.WithEmptyPool(p))
+	}
+	if f.healthWebhook != "" {
+		opts = append(opts, loadbalancer.WithHealthExport(&loadbalancer.Webhook{URL: f.healthWebhook, Token: f.healthWebhookToken}))
+	}
+	if f.drainWebhook != "" {
+		opts = append(opts, loadbalancer.WithDrainWebhook(&loadbalancer.Webhook{URL: f.drainWebhook, Token: f.drainWebhookToken}))
+	}
+	if f.byteAccounting {
+		opts = append(opts, loadbalancer.WithByteAccounting(loadbalancer.ByteAccounting{}))
+	}
+	if f.reportPeriod > 0 {
+		opts = append(opts, loadbalancer.WithTrafficReports(loadbalancer.TrafficReports{Period: f.reportPeriod, Keep: f.reportKeep}))
+	}
+	if f.cancellation {
+		opts = append(opts, loadbalancer.WithRequestCancellation())
+	}
+	if f.backendAPI {
+		opts = append(opts, loadbalancer.WithBackendAPI(loadbalancer.BackendAPI{Token: f.backendAPIToken, MinHealthy: f.backendAPIMin}))
+	}
+	if f.snapshotDir != "" {
+		opts = append(opts, loadbalancer.WithConfigSnapshots(loadbalancer.ConfigSnapshots{
+			Dir: f.snapshotDir, Interval: f.snapshotInterval, Keep: f.snapshotKeep, Token: f.snapshotToken,
+		}))
+	}
+	if f.coalesce {
+		opts = append(opts, loadbalancer.WithCoalescing(loadbalancer.Coalescing{}))
+	}
+	if f.cache {
+		opts = append(opts, loadbalancer.WithCache(loadbalancer.Cache{MaxBytes: f.cacheBytes}))
+	}
+	if f.idempotency {
+		opts = append(opts, loadbalancer.WithIdempotency(loadbalancer.Idempotency{TTL: f.idempotencyTTL, Wait: f.idempotencyWait}))
+	}
+	if f.dialTimeout > 0 || f.tlsTimeout > 0 || f.headerTimeout > 0 || f.idleTimeout > 0 {
+		opts = append(opts, loadbalancer.WithUpstreamTimeouts(loadbalancer.UpstreamTimeouts{
+			Dial:           f.dialTimeout,
+			TLSHandshake:   f.tlsTimeout,
+			ResponseHeader: f.headerTimeout,
+			IdleConn:       f.idleTimeout,
+		}))
+	}
+	if f.adaptiveTimeouts {
+		opts = append(opts, loadbalancer.WithAdaptiveTimeouts(loadbalancer.AdaptiveTimeouts{
+			Quantile: f.adaptiveQuantile,
+			Factor:   f.adaptiveFactor,
+			Min:      f.adaptiveMin,
+			Max:      f.adaptiveMax,
+		}))
+	}
+	if f.retryAttempts > 1 {
+		opts = append(opts, loadbalancer.WithRetry(loadbalancer.RetryPolicy{
+			Attempts: f.retryAttempts,
+			Methods:  strings.Split(strings.ToUpper(f.retryMethods), ","),
+		}))
+	}
+	if f.capacityReports {
+		opts = append(opts, loadbalancer.WithCapacityReports(loadbalancer.CapacityReports{Token: f.capacityToken}))
+	}
+	if f.promURL != "" {
+		opts = append(opts, loadbalancer.WithPrometheusWeights(loadbalancer.PrometheusWeights{
+			URL:      f.promURL,
+			Query:    f.promQuery,
+			Label:    f.promLabel,
+			Scale:    f.promScale,
+			Inverse:  f.promInverse,
+			Interval: f.promInterval,
+			Token:    f.promToken,
+		}))
+	}
+	if len(f.canaryBackends) > 0 {
+		var steps []float64
+		for _, v := range strings.Split(f.canarySteps, ",") {
+			step, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil || step <= 0 || step > 100 {
+				return nil, fmt.Errorf("canary step %q: want a percentage", v)
+			}
+			steps = append(steps, step)
+		}
+		opts = append(opts, loadbalancer.WithCanary(loadbalancer.Canary{
+			Backends:         f.canaryBackends,
+			Steps:            steps,
+			StepInterval:     f.canaryStepInterval,
+			Tolerance:        f.canaryTolerance,
+			LatencyTolerance: f.canaryLatencyTol,
+			Token:            f.canaryToken,
+		}))
+	}
+	if len(f.darkBackends) > 0 {
+		opts = append(opts, loadbalancer.WithDarkLaunch(loadbalancer.DarkLaunch{
+			Header:   f.darkHeader,
+			Cookie:   f.darkCookie,
+			Value:    f.darkValue,
+			Backends: f.darkBackends,
+			Token:    f.darkToken,
+		}))
+	}
+	if len(f.failoverBackends) > 0 {
+		opts = append(opts, loadbalancer.WithRegionFailover(loadbalancer.RegionFailover{
+			Backends:  f.failoverBackends,
+			FailBelow: f.failoverBelow,
+			RecoverAt: f.failoverRecover,
+			Hold:      f.failoverHold,
+		}))
+	}
+	if f.rolloutLabel != "" {
+		opts = append(opts, loadbalancer.WithVersionRollout(loadbalancer.VersionRollout{
+			Label:      f.rolloutLabel,
+			MinHealthy: f.rolloutMinHealthy,
+		}))
+	}
+	if len(f.maintenance) > 0 {
+		windows, err := f.maintenanceWindows()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, loadbalancer.WithMaintenance(windows...))
+	}
+	if len(f.allow) > 0 || len(f.deny) > 0 || len(f.denyJA3) > 0 {
+		opts = append(opts, loadbalancer.WithAccessList(loadbalancer.AccessList{Allow: f.allow, Deny: f.deny, DenyFingerprints: f.denyJA3}))
+	}
+	if len(f.authBypass) > 0 {
+		rules := make([]loadbalancer.AuthBypass, 0, len(f.authBypass))
+		for _, b := range f.authBypass {
+			rule := loadbalancer.AuthBypass{Host: b}
+			if i := strings.IndexByte(b, '/'); i >= 0 {
+				rule.Host, rule.PathPrefix = b[:i], b[i:]
+			}
+			rules = append(rules, rule)
+		}
+		opts = append(opts, loadbalancer.WithAuthBypass(rules...))
+	}
+	if f.abuse {
+		opts = append(opts, loadbalancer.WithAbuseDetection(loadbalancer.AbusePolicy{
+			MaxRequests: f.abuseMaxRequests,
+			BanFor:      f.abuseBan,
+			Tarpit:      f.abuseTarpit,
+		}))
+	}
+	if len(f.priorities) > 0 {
+		rules, err := priorityRules(f.priorities)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, loadbalancer.WithPriorities(loadbalancer.Priorities{Rules: rules, LowShare: f.lowShare}))
+	}
+	if f.maxInFlight > 0 {
+		opts = append(opts, loadbalancer.WithAdmission(loadbalancer.Admission{
+			MaxInFlight: f.maxInFlight,
+			Reserve:     f.admissionReserve,
+			Secret:      f.admissionSecret,
+		}))
+	}
+	if f.clientIdentity != "" {
+		id, err := loadbalancer.ParseClientIdentity(f.clientIdentity)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, loadbalancer.WithClientIdentity(id))
+	}
+	if f.rateLimit > 0 {
+		opts = append(opts, loadbalancer.WithRateLimit(loadbalancer.RateLimit{
+			Rate:           f.rateLimit,
+			Burst:          f.rateBurst,
+			Header:         f.rateHeader,
+			TrustedProxies: f.trustedProxies,
+		}))
+	}
+	if f.maxPerBackend > 0 {
+		opts = append(opts, loadbalancer.WithBackendConcurrency(f.maxPerBackend))
+	}
+	if f.degradeDepth > 0 {
+		opts = append(opts, loadbalancer.WithQueueDepth(loadbalancer.QueueDepth{Degraded: f.degradeDepth}))
+	}
+	if f.autoscale {
+		opts = append(opts, loadbalancer.WithAutoscaling(loadbalancer.Autoscaling{
+			Window:            f.autoscaleWindow,
+			TargetInFlight:    f.autoscaleInFlight,
+			TargetUtilization: f.autoscaleUtilization,
+		}))
+	}
+	if f.maxClientConns > 0 {
+		opts = append(opts, loadbalancer.WithMaxConnsPerClient(f.maxClientConns))
+	}
+	if f.bandwidth > 0 {
+		opts = append(opts, loadbalancer.WithBandwidthLimit(loadbalancer.BandwidthLimit{
+			BytesPerSecond: f.bandwidth,
+			Header:         f.bandwidthHeader,
+		}))
+	}
+	if len(f.routeBandwidth) > 0 {
+		limits, err := routeBandwidthLimits(f.routeBandwidth)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, loadbalancer.WithRouteBandwidthLimits(limits...))
+	}
+	if f.egress != "" {
+		proxyURL, err := url.Parse(f.egress)
+		if err != nil {
+			return nil, fmt.Errorf("egress proxy: %w", err)
+		}
+		opts = append(opts, loadbalancer.WithEgressProxy(proxyURL))
+	}
+	if f.sourceIP != "" || f.sourceIface != "" {
+		opts = append(opts, loadbalancer.WithUpstreamSource(loadbalancer.Source{IP: f.sourceIP, Interface: f.sourceIface}))
+	}
+	if f.leaderRedis != "" {
+		store := election.NewRedisLease(redis.NewClient(redis.Options{Addr: f.leaderRedis}))
+		opts = append(opts, loadbalancer.WithElector(election.New(store, election.Config{
+			Key: f.leaderKey,
+			ID:  f.leaderID,
+			TTL: f.leaderTTL,
+		})))
+	}
+	if f.gossipBind != "" {
+		node, err := gossip.New(gossip.Config{
+			ID:     f.leaderID,
+			Bind:   f.gossipBind,
+			Peers:  f.gossipPeers,
+			Secret: f.gossipSecret,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("gossip: %w", err)
+		}
+		opts = append(opts, loadbalancer.WithGossip(node))
+	}
+	return loadbalancer.New(append(opts, extra...)...)
+}
+
+// maintenanceWindows parses the -maintenance flags
+func (f *balancerFlags) maintenanceWindows() ([]loadbalancer.MaintenanceWindow, error) {
+	loc, err := time.LoadLocation(f.maintenanceTZ)
+	if err != nil {
+		return nil, fmt.Errorf("maintenance time zone: %w", err)
+	}
+	var windows []loadbalancer.MaintenanceWindow
+	for _, spec := range f.maintenance {
+		parts := strings.Split(spec, ";")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("maintenance window %q: want 'backend;schedule;duration'", spec)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(parts[2]))
+		if err != nil {
+			return nil, fmt.Errorf("maintenance window %q: %w", spec, err)
+		}
+		windows = append(windows, loadbalancer.MaintenanceWindow{
+			Backends: []string{strings.TrimSpace(parts[0])},
+			Schedule: strings.TrimSpace(parts[1]),
+			Duration: d,
+			Location: loc,
+		})
+	}
+	return windows, nil
+}
+
+// defaultInstanceID identifies this process as host:pid
+func defaultInstanceID() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/kube"
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/loadbalancer"
+)
+
+// kubeController keeps the balancer's routes and pools in step with the cluster's Ingresses or
+// Gateway API HTTPRoutes, rebuilding it through the reloader whenever they change. Certificates
+// are swapped in place, as the TLS listener outlives every rebuild.
+type kubeController struct {
+	source   *kube.Source
+	interval time.Duration
+	current  *kube.Config
+	certs    atomic.Pointer[[]tls.Certificate]
+}
+
+func newKubeController(sf *serveFlags) (*kubeController, error) {
+	client, err := kube.NewClient(kube.Options{Server: sf.kubeAPI, TokenFile: sf.kubeToken, CAFile: sf.kubeCA})
+	if err != nil {
+		return nil, err
+	}
+	return &kubeController{
+		source: &kube.Source{
+			Client:       client,
+			IngressClass: sf.kubeIngressClass,
+			Gateway:      sf.kubeGateway,
+			Namespace:    sf.kubeNamespace,
+			TLS:          sf.kubeTLS,
+		},
+		interval: sf.kubeInterval,
+	}, nil
+}
+
+// load reads the cluster, returning nil when the routes and pools are those already applied
+func (c *kubeController) load(ctx context.Context) (*kube.Config, error) {
+	cfg, err := c.source.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.certs.Store(&cfg.Certificates)
+	if c.current != nil && c.current.Equal(cfg) {
+		return nil, nil
+	}
+	for _, w := range cfg.Warnings {
+		slog.Warn("kubernetes resource not fully served", "problem", w)
+	}
+	return cfg, nil
+}
+
+// kubeOptions translates cfg into balancer options
+func kubeOptions(cfg *kube.Config) []loadbalancer.Option {
+	pools := make([]loadbalancer.Pool, len(cfg.Pools))
+	for i, p := range cfg.Pools {
+		pools[i] = loadbalancer.Pool{Name: p.Name, Backends: p.Backends}
+	}
+	routes := make([]loadbalancer.Route, len(cfg.Routes))
+	for i, r := range cfg.Routes {
+		routes[i] = loadbalancer.Route{Host: r.Host, PathPrefix: r.PathPrefix, Pool: r.Pool, Name: r.Name}
+	}
+	return []loadbalancer.Option{loadbalancer.WithPools(pools...), loadbalancer.WithRoutes(routes...)}
+}
+
+// tlsConfig serves the certificates of the last load, picked by server name
+func (c *kubeController) tlsConfig() *tls.Config {
+	return &tls.Config{GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		certs := c.certs.Load()
+		if certs == nil || len(*certs) == 0 {
+			return nil, errors.New("no certificate loaded from the cluster")
+		}
+		for i := range *certs {
+			if hello.SupportsCertificate(&(*certs)[i]) == nil {
+				return &(*certs)[i], nil
+			}
+		}
+		return &(*certs)[0], nil
+	}}
+}
+
+// run polls the cluster until ctx is done, rebuilding the balancer when its routes or pools
+// change. A failed poll or rebuild keeps the running configuration, and the rebuild is tried
+// again on the next poll.
+func (c *kubeController) run(ctx context.Context, r *reloader) {
+	tick := time.NewTicker(c.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		cfg, err := c.load(ctx)
+		if err != nil {
+			slog.Error("reading kubernetes resources failed; keeping the running configuration", "error", err)
+			continue
+		}
+		if cfg == nil {
+			continue
+		}
+		if err := r.applyKube(ctx, kubeOptions(cfg)); err != nil {
+			slog.Error("applying kubernetes resources failed; keeping the running configuration", "error", err)
+			continue
+		}
+		c.current = cfg
+		slog.Info("kubernetes resources applied", "routes", len(cfg.Routes), "pools", len(cfg.Pools))
+	}
+}
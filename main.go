@@ -2,118 +2,58 @@ package main
 
 import (
 	"fmt"
-	"log"
-	"net/http"
-	"net/http/httputil"
-	"net/url"
-	"sync"
+	"io"
+	"os"
+	"path/filepath"
 )
 
-// Server interface defines the required methods for a server
-type Server interface {
-	Address() string
-	IsAlive() bool
-	Serve(rw http.ResponseWriter, req *http.Request)
+// command is a subcommand of the lb binary
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
 }
 
-// simpleServer struct represents a single backend server
-type simpleServer struct {
-	addr  string
-	proxy *httputil.ReverseProxy
+var commands = []command{
+	{"serve", "run the load balancer", runServe},
+	{"validate", "check the configuration and exit", runValidate},
+	{"version", "print version information", runVersion},
+	{"routes", "inspect routes (routes list)", runRoutes},
+	{"backends", "inspect backends (backends list)", runBackends},
+	{"replay", "replay recorded traffic against a target and report differences", runReplay},
+	{"service", "install, remove or run as a Windows service", runService},
 }
 
-// newSimpleServer creates a new instance of simpleServer
-func newSimpleServer(addr string) *simpleServer {
-	serverURL, err := url.Parse(addr)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return &simpleServer{
-		addr:  addr,
-		proxy: httputil.NewSingleHostReverseProxy(serverURL),
-	}
-}
-
-func (s *simpleServer) Address() string {
-	return s.addr
-}
-
-// IsAlive checks the server health by sending a GET request
-func (s *simpleServer) IsAlive() bool {
-	resp, err := http.Get(s.addr)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		return false
-	}
-	return true
-}
-
-// Serve forwards the request to the backend server
-func (s *simpleServer) Serve(rw http.ResponseWriter, req *http.Request) {
-	fmt.Printf("Forwarding request to %s\n", s.addr)
-	s.proxy.ServeHTTP(rw, req)
-}
-
-// LoadBalancer struct represents the load balancer
-type LoadBalancer struct {
-	port            string
-	roundRobinIndex int
-	serverList      []Server
-	mu              sync.Mutex
-}
-
-// newLoadBalancer creates a new instance of LoadBalancer
-func newLoadBalancer(port string, serverList []Server) *LoadBalancer {
-	return &LoadBalancer{
-		port:            port,
-		roundRobinIndex: 0,
-		serverList:      serverList,
-	}
-}
-
-// getNextAvailableServer returns the next available server using round-robin algorithm
-func (lb *LoadBalancer) getNextAvailableServer() Server {
-	lb.mu.Lock()
-	defer lb.mu.Unlock()
-	serverCount := len(lb.serverList)
-	for i := 0; i < serverCount; i++ {
-		server := lb.serverList[lb.roundRobinIndex%serverCount]
-		lb.roundRobinIndex++
-		if server.IsAlive() {
-			fmt.Printf("Selected server: %s\n", server.Address())
-			return server
-		}
-	}
-	return nil
-}
-
-// serveProxy forwards the request to the selected backend server
-func (lb *LoadBalancer) serveProxy(rw http.ResponseWriter, req *http.Request) {
-	fmt.Printf("Received request: %s\n", req.URL.Path)
-	targetServer := lb.getNextAvailableServer()
-	if targetServer != nil {
-		targetServer.Serve(rw, req)
-	} else {
-		http.Error(rw, "Service unavailable", http.StatusServiceUnavailable)
+func usage(w io.Writer) {
+	prog := filepath.Base(os.Args[0])
+	fmt.Fprintf(w, "Usage: %s <command> [flags]\n\nCommands:\n", prog)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", c.name, c.summary)
 	}
+	fmt.Fprintf(w, "\nRun '%s <command> -h' for the flags of a command.\n", prog)
 }
 
 func main() {
-	serverList := []Server{
-		newSimpleServer("https://www.instagram.com/"),
-		newSimpleServer("https://www.twitter.com/"),
-		newSimpleServer("https://www.medium.com/"),
-	}
-
-	lb := newLoadBalancer("8080", serverList)
-
-	// Use ServeMux for better request handling
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", lb.serveProxy)
-
-	fmt.Printf("Load Balancer started at :%s\n", lb.port)
-	err := http.ListenAndServe(":"+lb.port, mux)
-	if err != nil {
-		log.Fatal(err)
+	args := os.Args[1:]
+	if len(args) == 0 {
+		// keep the historical behaviour of starting the balancer when run without arguments
+		args = []string{"serve"}
+	}
+	name := args[0]
+	if name == "-h" || name == "-help" || name == "--help" || name == "help" {
+		usage(os.Stdout)
+		return
+	}
+	for _, c := range commands {
+		if c.name == name {
+			if err := c.run(args[1:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+				os.Exit(1)
+			}
+			return
+		}
 	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage(os.Stderr)
+	os.Exit(2)
 }
@@ -0,0 +1,124 @@
+// Package election provides lease-based leader election so that, of several balancer
+// instances run for redundancy, only one performs active probing and state changes.
+// Leadership is a lease with a TTL in a shared store; the leader renews it well before it
+// expires and a standby takes over as soon as renewals stop.
+package election
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LeaseStore is a shared store able to hand a single named lease to one holder at a time
+type LeaseStore interface {
+	// TryAcquire takes the lease for holder, or extends it if holder already owns it,
+	// and reports whether holder owns it afterwards
+	TryAcquire(ctx context.Context, key, holder string, ttl time.Duration) (bool, error)
+	// Release gives the lease up if holder owns it
+	Release(ctx context.Context, key, holder string) error
+}
+
+// Elector campaigns for a lease and tracks whether this instance is the leader
+type Elector struct {
+	store  LeaseStore
+	key    string
+	id     string
+	ttl    time.Duration
+	logger *slog.Logger
+
+	leader atomic.Bool
+	mu     sync.Mutex
+	subs   []func(leader bool)
+}
+
+// Config configures an Elector
+type Config struct {
+	// Key names the lease; instances competing for the same role must share it
+	Key string
+	// ID identifies this instance; it must be unique among the competitors
+	ID string
+	// TTL is how long a lease outlives its last renewal; failover takes at most this long. Default 5s.
+	TTL    time.Duration
+	Logger *slog.Logger
+}
+
+// New creates an Elector; call Run to start campaigning
+func New(store LeaseStore, cfg Config) *Elector {
+	if cfg.TTL <= 0 {
+		cfg.TTL = 5 * time.Second
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	return &Elector{store: store, key: cfg.Key, id: cfg.ID, ttl: cfg.TTL, logger: cfg.Logger}
+}
+
+// IsLeader reports whether this instance currently holds the lease
+func (e *Elector) IsLeader() bool {
+	return e.leader.Load()
+}
+
+// ID returns the identity this instance campaigns with
+func (e *Elector) ID() string {
+	return e.id
+}
+
+// OnChange registers fn to be called whenever leadership is gained or lost
+func (e *Elector) OnChange(fn func(leader bool)) {
+	e.mu.Lock()
+	e.subs = append(e.subs, fn)
+	e.mu.Unlock()
+}
+
+// Run campaigns until ctx is done, then releases the lease if held
+func (e *Elector) Run(ctx context.Context) {
+	// renew three times per TTL so one lost round trip doesn't cost leadership
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+	for {
+		e.campaign(ctx)
+		select {
+		case <-ctx.Done():
+			if e.IsLeader() {
+				releaseCtx, cancel := context.WithTimeout(context.Background(), e.ttl/3)
+				if err := e.store.Release(releaseCtx, e.key, e.id); err != nil {
+					e.logger.Warn("releasing leader lease failed", "error", err)
+				}
+				cancel()
+				e.set(false)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Elector) campaign(ctx context.Context) {
+	attemptCtx, cancel := context.WithTimeout(ctx, e.ttl/3)
+	defer cancel()
+	held, err := e.store.TryAcquire(attemptCtx, e.key, e.id, e.ttl)
+	if err != nil {
+		if ctx.Err() == nil {
+			e.logger.Warn("leader lease renewal failed", "key", e.key, "error", err)
+		}
+		// we can't prove we still hold the lease, so stop acting as leader
+		held = false
+	}
+	e.set(held)
+}
+
+func (e *Elector) set(leader bool) {
+	if e.leader.Swap(leader) == leader {
+		return
+	}
+	e.logger.Info("leadership changed", "key", e.key, "id", e.id, "leader", leader)
+	e.mu.Lock()
+	subs := append([]func(bool){}, e.subs...)
+	e.mu.Unlock()
+	for _, fn := range subs {
+		fn(leader)
+	}
+}
@@ -0,0 +1,46 @@
+package election
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryLease is a LeaseStore local to the process, for tests and single-host setups
+type MemoryLease struct {
+	mu     sync.Mutex
+	leases map[string]memoryLease
+}
+
+type memoryLease struct {
+	holder  string
+	expires time.Time
+}
+
+// NewMemoryLease creates an empty MemoryLease
+func NewMemoryLease() *MemoryLease {
+	return &MemoryLease{leases: make(map[string]memoryLease)}
+}
+
+// TryAcquire implements LeaseStore
+func (l *MemoryLease) TryAcquire(_ context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cur, ok := l.leases[key]
+	now := time.Now()
+	if ok && cur.holder != holder && now.Before(cur.expires) {
+		return false, nil
+	}
+	l.leases[key] = memoryLease{holder: holder, expires: now.Add(ttl)}
+	return true, nil
+}
+
+// Release implements LeaseStore
+func (l *MemoryLease) Release(_ context.Context, key, holder string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.leases[key].holder == holder {
+		delete(l.leases, key)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package election
+
+import (
+	"context"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/redis"
+)
+
+// acquireScript extends the lease when the caller holds it and otherwise takes it if it is free
+const acquireScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return 1
+end
+return 0`
+
+// releaseScript deletes the lease only when the caller holds it
+const releaseScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`
+
+// RedisLease keeps leases in Redis
+type RedisLease struct {
+	client *redis.Client
+}
+
+// NewRedisLease creates a LeaseStore backed by client
+func NewRedisLease(client *redis.Client) *RedisLease {
+	return &RedisLease{client: client}
+}
+
+// TryAcquire implements LeaseStore
+func (l *RedisLease) TryAcquire(ctx context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	n, err := l.client.Int(ctx, "EVAL", acquireScript, 1, key, holder, ttl)
+	return n == 1, err
+}
+
+// Release implements LeaseStore
+func (l *RedisLease) Release(ctx context.Context, key, holder string) error {
+	_, err := l.client.Int(ctx, "EVAL", releaseScript, 1, key, holder)
+	return err
+}
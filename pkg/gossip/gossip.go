@@ -0,0 +1,261 @@
+// Package gossip spreads small pieces of state (backend health, breaker state) between
+// balancer instances over UDP. Every interval each node pushes its full view to a few random
+// peers; receivers keep the newest version of every key, so a fact learned by one instance
+// reaches the whole cluster within a few rounds.
+package gossip
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxPacket is the largest datagram a node sends or accepts
+const maxPacket = 64 << 10
+
+// State is one gossiped fact. Newer versions replace older ones cluster-wide.
+type State struct {
+	Key     string `json:"k"`
+	Value   string `json:"v"`
+	Version int64  `json:"n"`
+	Origin  string `json:"o"`
+}
+
+// Time returns when the state was published
+func (s State) Time() time.Time {
+	return time.Unix(0, s.Version)
+}
+
+// Config configures a Node
+type Config struct {
+	// ID identifies the node; it must be unique in the cluster
+	ID string
+	// Bind is the UDP address to listen on, e.g. ":7946"
+	Bind string
+	// Peers are the UDP addresses of the other nodes
+	Peers []string
+	// Interval between gossip rounds; default 1s
+	Interval time.Duration
+	// Fanout is the number of peers contacted per round; default 3
+	Fanout int
+	// Secret, when set, authenticates messages with HMAC-SHA256 so outsiders can't inject state
+	Secret string
+	Logger *slog.Logger
+}
+
+type message struct {
+	From   string  `json:"from"`
+	States []State `json:"states"`
+}
+
+// Node is a member of the gossip cluster
+type Node struct {
+	cfg   Config
+	laddr *net.UDPAddr
+	conn  *net.UDPConn
+	peers []*net.UDPAddr
+
+	mu     sync.Mutex
+	states map[string]State
+	subs   []func(State)
+}
+
+// New validates cfg and resolves the peers; call Listen and then Run to start gossiping
+func New(cfg Config) (*Node, error) {
+	if cfg.ID == "" {
+		return nil, errors.New("gossip: node ID is required")
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	if cfg.Fanout <= 0 {
+		cfg.Fanout = 3
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	laddr, err := net.ResolveUDPAddr("udp", cfg.Bind)
+	if err != nil {
+		return nil, err
+	}
+	var peers []*net.UDPAddr
+	for _, p := range cfg.Peers {
+		addr, err := net.ResolveUDPAddr("udp", p)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, addr)
+	}
+	return &Node{cfg: cfg, laddr: laddr, peers: peers, states: make(map[string]State)}, nil
+}
+
+// Listen binds the node's UDP socket
+func (n *Node) Listen() error {
+	conn, err := net.ListenUDP("udp", n.laddr)
+	if err != nil {
+		return err
+	}
+	n.conn = conn
+	return nil
+}
+
+// ID returns the node's identity
+func (n *Node) ID() string {
+	return n.cfg.ID
+}
+
+// Set publishes a new value for key originating at this node
+func (n *Node) Set(key, value string) {
+	n.mu.Lock()
+	version := time.Now().UnixNano()
+	if cur, ok := n.states[key]; ok && cur.Version >= version {
+		version = cur.Version + 1
+	}
+	n.states[key] = State{Key: key, Value: value, Version: version, Origin: n.cfg.ID}
+	n.mu.Unlock()
+}
+
+// Get returns the newest known state for key
+func (n *Node) Get(key string) (State, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	s, ok := n.states[key]
+	return s, ok
+}
+
+// States returns a copy of every known state
+func (n *Node) States() []State {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	out := make([]State, 0, len(n.states))
+	for _, s := range n.states {
+		out = append(out, s)
+	}
+	return out
+}
+
+// OnUpdate registers fn to be called for every state learned from a peer
+func (n *Node) OnUpdate(fn func(State)) {
+	n.mu.Lock()
+	n.subs = append(n.subs, fn)
+	n.mu.Unlock()
+}
+
+// Run gossips until ctx is done and then closes the socket, so it can be bound again as soon as
+// Run returns. Listen must have succeeded.
+func (n *Node) Run(ctx context.Context) {
+	go n.receive()
+
+	ticker := time.NewTicker(n.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			n.conn.Close()
+			return
+		case <-ticker.C:
+			n.round()
+		}
+	}
+}
+
+func (n *Node) round() {
+	if len(n.peers) == 0 {
+		return
+	}
+	packet, err := n.encode(message{From: n.cfg.ID, States: n.States()})
+	if err != nil {
+		n.cfg.Logger.Warn("gossip encode failed", "error", err)
+		return
+	}
+	if len(packet) > maxPacket {
+		n.cfg.Logger.Warn("gossip state too large for one datagram", "bytes", len(packet))
+		return
+	}
+	for _, i := range rand.Perm(len(n.peers))[:min(n.cfg.Fanout, len(n.peers))] {
+		if _, err := n.conn.WriteToUDP(packet, n.peers[i]); err != nil {
+			n.cfg.Logger.Debug("gossip send failed", "peer", n.peers[i].String(), "error", err)
+		}
+	}
+}
+
+func (n *Node) receive() {
+	buf := make([]byte, maxPacket+sha256.Size)
+	for {
+		size, from, err := n.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		msg, err := n.decode(buf[:size])
+		if err != nil {
+			n.cfg.Logger.Debug("gossip message rejected", "peer", from.String(), "error", err)
+			continue
+		}
+		n.merge(msg.States)
+	}
+}
+
+func (n *Node) merge(states []State) {
+	var learned []State
+	n.mu.Lock()
+	for _, s := range states {
+		if s.Origin == n.cfg.ID {
+			continue
+		}
+		if cur, ok := n.states[s.Key]; ok && cur.Version >= s.Version {
+			continue
+		}
+		n.states[s.Key] = s
+		learned = append(learned, s)
+	}
+	subs := append([]func(State){}, n.subs...)
+	n.mu.Unlock()
+
+	for _, s := range learned {
+		for _, fn := range subs {
+			fn(s)
+		}
+	}
+}
+
+// encode serializes msg and, with a secret, prefixes it with its HMAC
+func (n *Node) encode(msg message) ([]byte, error) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	if n.cfg.Secret == "" {
+		return body, nil
+	}
+	mac := hmac.New(sha256.New, []byte(n.cfg.Secret))
+	mac.Write(body)
+	return append(mac.Sum(nil), body...), nil
+}
+
+func (n *Node) decode(packet []byte) (message, error) {
+	var msg message
+	body := packet
+	if n.cfg.Secret != "" {
+		if len(packet) < sha256.Size {
+			return msg, errors.New("short packet")
+		}
+		mac := hmac.New(sha256.New, []byte(n.cfg.Secret))
+		mac.Write(packet[sha256.Size:])
+		if !hmac.Equal(mac.Sum(nil), packet[:sha256.Size]) {
+			return msg, errors.New("bad signature")
+		}
+		body = packet[sha256.Size:]
+	}
+	err := json.Unmarshal(body, &msg)
+	return msg, err
+}
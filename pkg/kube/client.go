@@ -0,0 +1,132 @@
+// Package kube is a minimal Kubernetes API client covering what the balancer's ingress
+// controller mode reads: Ingresses, Gateway API Gateways and HTTPRoutes, Services,
+// EndpointSlices and TLS Secrets. It only lists and reads resources, over the REST API with
+// the pod's service account, and never writes to the cluster.
+package kube
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir is where Kubernetes mounts the pod's service account credentials
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Options configures a Client
+type Options struct {
+	// Server is the API server's URL; default the in-cluster address, from
+	// $KUBERNETES_SERVICE_HOST and $KUBERNETES_SERVICE_PORT
+	Server string
+	// TokenFile holds the bearer token sent with every request; default the pod's service
+	// account token when Server is in-cluster, none otherwise. It is read again for every
+	// request, as projected tokens are rotated.
+	TokenFile string
+	// CAFile holds the CAs the API server's certificate is checked against; default the
+	// service account's when Server is in-cluster, the system roots otherwise
+	CAFile string
+	// Timeout bounds each request; default 10s
+	Timeout time.Duration
+}
+
+// Client reads resources from the API server; it is safe for concurrent use
+type Client struct {
+	opts Options
+	http *http.Client
+}
+
+// StatusError is a request the API server refused
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("kube: %d %s", e.Code, e.Message)
+}
+
+// NotFound reports whether err is a 404 from the API server
+func NotFound(err error) bool {
+	var se *StatusError
+	return errors.As(err, &se) && se.Code == http.StatusNotFound
+}
+
+// NewClient creates a Client. Outside a cluster, Server must be set, such as the address of
+// kubectl proxy.
+func NewClient(opts Options) (*Client, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.Server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("kube: not running in a cluster; set the API server address")
+		}
+		opts.Server = "https://" + net.JoinHostPort(host, port)
+		if opts.TokenFile == "" {
+			opts.TokenFile = serviceAccountDir + "/token"
+		}
+		if opts.CAFile == "" {
+			opts.CAFile = serviceAccountDir + "/ca.crt"
+		}
+	}
+	opts.Server = strings.TrimRight(opts.Server, "/")
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("kube: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("kube: %s holds no PEM certificates", opts.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	return &Client{opts: opts, http: &http.Client{Transport: transport, Timeout: opts.Timeout}}, nil
+}
+
+// get reads the resource or list at path into out
+func (c *Client) get(ctx context.Context, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.opts.Server+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.opts.TokenFile != "" {
+		token, err := os.ReadFile(c.opts.TokenFile)
+		if err != nil {
+			return fmt.Errorf("kube: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("kube: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// the API server explains itself in a Status object
+		var status struct {
+			Message string `json:"message"`
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(body, &status) != nil || status.Message == "" {
+			status.Message = http.StatusText(resp.StatusCode)
+		}
+		return &StatusError{Code: resp.StatusCode, Message: status.Message}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("kube: decoding %s: %w", path, err)
+	}
+	return nil
+}
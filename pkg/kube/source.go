@@ -0,0 +1,380 @@
+package kube
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Config is what the cluster's resources translate into for the balancer
+type Config struct {
+	Routes []Route
+	Pools  []Pool
+	// Certificates are the TLS certificates of the Ingresses and the Gateway, when Source.TLS is set
+	Certificates []tls.Certificate
+	// Warnings are the parts of the resources that couldn't be served
+	Warnings []string
+}
+
+// Route sends the requests matching Host and PathPrefix to Pool
+type Route struct {
+	// Name is the namespace/name of the Ingress or HTTPRoute the route comes from
+	Name       string
+	Host       string
+	PathPrefix string
+	Pool       string
+}
+
+// Pool is the ready endpoints of one Service port, or of all the backends of an HTTPRoute rule
+type Pool struct {
+	Name string
+	// Backends are the URLs of the endpoints, sorted
+	Backends []string
+}
+
+// Equal reports whether c and o route the same way to the same backends
+func (c *Config) Equal(o *Config) bool {
+	return slices.Equal(c.Routes, o.Routes) && slices.EqualFunc(c.Pools, o.Pools, func(a, b Pool) bool {
+		return a.Name == b.Name && slices.Equal(a.Backends, b.Backends)
+	})
+}
+
+// Source reads the balancer's configuration from the cluster
+type Source struct {
+	Client *Client
+	// IngressClass selects the Ingresses to serve: those naming it in spec.ingressClassName or
+	// the kubernetes.io/ingress.class annotation. Empty serves no Ingresses.
+	IngressClass string
+	// Gateway is the namespace/name of the Gateway whose HTTPRoutes to serve. Empty serves no
+	// HTTPRoutes.
+	Gateway string
+	// Namespace restricts the Ingresses and HTTPRoutes served to one namespace; default all
+	Namespace string
+	// TLS loads the certificates of the Ingresses' and the Gateway's TLS secrets
+	TLS bool
+}
+
+// Load reads the resources and translates them. Paths of type Exact are served as prefixes,
+// and HTTPRoute matches on anything but the path, such as headers, are ignored. Every endpoint
+// of a rule gets an equal share; only a backend weight of 0 is honoured, by leaving it out.
+func (s *Source) Load(ctx context.Context) (*Config, error) {
+	l := &loader{Source: s, ctx: ctx, cfg: &Config{}, pools: make(map[string]bool), seen: make(map[string]string),
+		endpoints: make(map[string]resolvedPort), certs: make(map[string]bool)}
+	if s.IngressClass != "" {
+		if err := l.ingresses(); err != nil {
+			return nil, err
+		}
+	}
+	if s.Gateway != "" {
+		if err := l.gateway(); err != nil {
+			return nil, err
+		}
+	}
+	slices.SortFunc(l.cfg.Pools, func(a, b Pool) int { return cmp.Compare(a.Name, b.Name) })
+	return l.cfg, nil
+}
+
+// loader holds the state of one Load
+type loader struct {
+	*Source
+	ctx   context.Context
+	cfg   *Config
+	pools map[string]bool
+	// seen maps each host and path routed to the resource that routed it first
+	seen map[string]string
+	// endpoints caches each service port resolved, by the port as referred to
+	endpoints map[string]resolvedPort
+	// certs are the secrets whose certificates were added
+	certs map[string]bool
+}
+
+func (l *loader) warn(format string, args ...any) {
+	l.cfg.Warnings = append(l.cfg.Warnings, fmt.Sprintf(format, args...))
+}
+
+// path returns the API path of a resource collection, in Namespace when it is set
+func (l *loader) path(prefix, resource string) string {
+	if l.Namespace != "" {
+		return prefix + "/namespaces/" + url.PathEscape(l.Namespace) + "/" + resource
+	}
+	return prefix + "/" + resource
+}
+
+func (l *loader) ingresses() error {
+	var list ingressList
+	if err := l.Client.get(l.ctx, l.path("/apis/networking.k8s.io/v1", "ingresses"), &list); err != nil {
+		return fmt.Errorf("listing ingresses: %w", err)
+	}
+	sortByName(list.Items, func(i ingress) objectMeta { return i.Metadata })
+	for _, ing := range list.Items {
+		class := ing.Spec.IngressClassName
+		if class == "" {
+			class = ing.Metadata.Annotations["kubernetes.io/ingress.class"]
+		}
+		if class != l.IngressClass {
+			continue
+		}
+		ns, name := ing.Metadata.Namespace, ing.Metadata.Namespace+"/"+ing.Metadata.Name
+		for _, rule := range ing.Spec.Rules {
+			if rule.HTTP == nil {
+				continue
+			}
+			for _, p := range rule.HTTP.Paths {
+				if pool, ok := l.ingressPool(name, ns, p.Backend); ok {
+					l.route(name, rule.Host, p.Path, pool)
+				}
+			}
+		}
+		if b := ing.Spec.DefaultBackend; b != nil {
+			if pool, ok := l.ingressPool(name, ns, *b); ok {
+				l.route(name, "", "/", pool)
+			}
+		}
+		if l.TLS {
+			for _, t := range ing.Spec.TLS {
+				if t.SecretName != "" {
+					l.certificate(name, ns, t.SecretName)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ingressPool returns the pool of an Ingress backend
+func (l *loader) ingressPool(name, ns string, b ingressBackend) (string, bool) {
+	if b.Service == nil {
+		l.warn("%s: only Service backends are supported", name)
+		return "", false
+	}
+	port := b.Service.Port.Name
+	if port == "" {
+		port = strconv.Itoa(b.Service.Port.Number)
+	}
+	svc, ok := l.service(name, ns, b.Service.Name, port)
+	if !ok {
+		return "", false
+	}
+	return l.pool(svc.name, svc.backends), true
+}
+
+func (l *loader) gateway() error {
+	gwNS, gwName, ok := strings.Cut(l.Gateway, "/")
+	if !ok {
+		return fmt.Errorf("gateway %q is not namespace/name", l.Gateway)
+	}
+	var gw gateway
+	if err := l.Client.get(l.ctx, "/apis/gateway.networking.k8s.io/v1/namespaces/"+url.PathEscape(gwNS)+"/gateways/"+url.PathEscape(gwName), &gw); err != nil {
+		return fmt.Errorf("reading gateway %s: %w", l.Gateway, err)
+	}
+	if l.TLS {
+		for _, listener := range gw.Spec.Listeners {
+			if listener.TLS == nil {
+				continue
+			}
+			for _, ref := range listener.TLS.CertificateRefs {
+				if !ref.is("", "Secret", "", "Secret") {
+					l.warn("%s: listener %s: only Secret certificates are supported", l.Gateway, listener.Name)
+					continue
+				}
+				l.certificate(l.Gateway, cmp.Or(ref.Namespace, gwNS), ref.Name)
+			}
+		}
+	}
+
+	var list httpRouteList
+	if err := l.Client.get(l.ctx, l.path("/apis/gateway.networking.k8s.io/v1", "httproutes"), &list); err != nil {
+		return fmt.Errorf("listing httproutes: %w", err)
+	}
+	sortByName(list.Items, func(r httpRoute) objectMeta { return r.Metadata })
+	for _, hr := range list.Items {
+		ns, name := hr.Metadata.Namespace, hr.Metadata.Namespace+"/"+hr.Metadata.Name
+		attached := slices.ContainsFunc(hr.Spec.ParentRefs, func(ref objectRef) bool {
+			return ref.is("gateway.networking.k8s.io", "Gateway", "gateway.networking.k8s.io", "Gateway") &&
+				ref.Name == gwName && cmp.Or(ref.Namespace, ns) == gwNS
+		})
+		if !attached {
+			continue
+		}
+		hosts := hr.Spec.Hostnames
+		if len(hosts) == 0 {
+			hosts = []string{""}
+		}
+		for i, rule := range hr.Spec.Rules {
+			var backends []string
+			var servicePool string
+			for _, ref := range rule.BackendRefs {
+				if !ref.is("", "Service", "", "Service") {
+					l.warn("%s: rule %d: only Service backends are supported", name, i)
+					continue
+				}
+				if ref.Weight != nil && *ref.Weight == 0 {
+					continue
+				}
+				refNS, port := cmp.Or(ref.Namespace, ns), strconv.Itoa(ref.Port)
+				svc, ok := l.service(name, refNS, ref.Name, port)
+				if !ok {
+					continue
+				}
+				backends = append(backends, svc.backends...)
+				servicePool = svc.name
+			}
+			if servicePool == "" {
+				continue
+			}
+			poolName := servicePool
+			if len(rule.BackendRefs) > 1 {
+				poolName = fmt.Sprintf("%s#%d", name, i)
+			}
+			pool := l.pool(poolName, backends)
+			paths := []string{"/"}
+			if len(rule.Matches) > 0 {
+				paths = paths[:0]
+				for _, m := range rule.Matches {
+					switch {
+					case m.Path == nil:
+						paths = append(paths, "/")
+					case m.Path.Type == "RegularExpression":
+						l.warn("%s: rule %d: regular expression paths are not supported", name, i)
+					default:
+						paths = append(paths, cmp.Or(m.Path.Value, "/"))
+					}
+				}
+			}
+			for _, host := range hosts {
+				for _, p := range paths {
+					l.route(name, host, p, pool)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// route adds a route unless an earlier resource already routes the host and path
+func (l *loader) route(name, host, path, pool string) {
+	path = cmp.Or(path, "/")
+	key := strings.ToLower(host) + path
+	if first, ok := l.seen[key]; ok {
+		if first != name {
+			l.warn("%s: %s%s is already routed by %s", name, host, path, first)
+		}
+		return
+	}
+	l.seen[key] = name
+	l.cfg.Routes = append(l.cfg.Routes, Route{Name: name, Host: host, PathPrefix: path, Pool: pool})
+}
+
+// pool adds the pool name with backends, once, and returns its name
+func (l *loader) pool(name string, backends []string) string {
+	if !l.pools[name] {
+		l.pools[name] = true
+		backends = slices.Clone(backends)
+		slices.Sort(backends)
+		l.cfg.Pools = append(l.cfg.Pools, Pool{Name: name, Backends: slices.Compact(backends)})
+	}
+	return name
+}
+
+// resolvedPort is a Service port resolved to its endpoints
+type resolvedPort struct {
+	// name is namespace/service:port, with the port's number
+	name     string
+	backends []string
+}
+
+// service resolves port of the Service ns/svcName, port being its number or name, to the URLs
+// of its ready endpoints. An ExternalName Service resolves to its external name.
+func (l *loader) service(from, ns, svcName, port string) (resolvedPort, bool) {
+	key := ns + "/" + svcName + ":" + port
+	if r, ok := l.endpoints[key]; ok {
+		return r, true
+	}
+	var svc service
+	if err := l.Client.get(l.ctx, "/api/v1/namespaces/"+url.PathEscape(ns)+"/services/"+url.PathEscape(svcName), &svc); err != nil {
+		l.warn("%s: service %s/%s: %v", from, ns, svcName, err)
+		return resolvedPort{}, false
+	}
+	i := slices.IndexFunc(svc.Spec.Ports, func(p servicePort) bool { return p.Name == port || strconv.Itoa(p.Port) == port })
+	if i < 0 {
+		l.warn("%s: service %s/%s has no port %s", from, ns, svcName, port)
+		return resolvedPort{}, false
+	}
+	sp := svc.Spec.Ports[i]
+	r := resolvedPort{name: ns + "/" + svcName + ":" + strconv.Itoa(sp.Port)}
+	scheme := "http"
+	if sp.AppProtocol == "https" {
+		scheme = "https"
+	}
+	if svc.Spec.Type == "ExternalName" {
+		r.backends = []string{scheme + "://" + net.JoinHostPort(svc.Spec.ExternalName, strconv.Itoa(sp.Port))}
+		l.endpoints[key] = r
+		return r, true
+	}
+
+	var eps endpointSliceList
+	selector := url.QueryEscape("kubernetes.io/service-name=" + svcName)
+	if err := l.Client.get(l.ctx, "/apis/discovery.k8s.io/v1/namespaces/"+url.PathEscape(ns)+"/endpointslices?labelSelector="+selector, &eps); err != nil {
+		l.warn("%s: endpoints of %s/%s: %v", from, ns, svcName, err)
+		return resolvedPort{}, false
+	}
+	for _, es := range eps.Items {
+		target := -1
+		for _, p := range es.Ports {
+			if p.Name == sp.Name {
+				target = p.Port
+			}
+		}
+		if target < 0 {
+			continue
+		}
+		for _, ep := range es.Endpoints {
+			// a missing condition means ready
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			for _, addr := range ep.Addresses {
+				r.backends = append(r.backends, scheme+"://"+net.JoinHostPort(addr, strconv.Itoa(target)))
+			}
+		}
+	}
+	if len(r.backends) == 0 {
+		l.warn("%s: service %s/%s has no ready endpoints", from, ns, svcName)
+	}
+	l.endpoints[key] = r
+	return r, true
+}
+
+// certificate adds the certificate of the TLS secret ns/name
+func (l *loader) certificate(from, ns, name string) {
+	if l.certs[ns+"/"+name] {
+		return
+	}
+	l.certs[ns+"/"+name] = true
+	var sec secret
+	if err := l.Client.get(l.ctx, "/api/v1/namespaces/"+url.PathEscape(ns)+"/secrets/"+url.PathEscape(name), &sec); err != nil {
+		l.warn("%s: secret %s/%s: %v", from, ns, name, err)
+		return
+	}
+	cert, err := tls.X509KeyPair(sec.Data["tls.crt"], sec.Data["tls.key"])
+	if err != nil {
+		l.warn("%s: secret %s/%s: %v", from, ns, name, err)
+		return
+	}
+	l.cfg.Certificates = append(l.cfg.Certificates, cert)
+}
+
+// sortByName orders resources by namespace and name, so the first to claim a route keeps it
+// from one Load to the next
+func sortByName[T any](items []T, meta func(T) objectMeta) {
+	slices.SortFunc(items, func(a, b T) int {
+		ma, mb := meta(a), meta(b)
+		return cmp.Or(cmp.Compare(ma.Namespace, mb.Namespace), cmp.Compare(ma.Name, mb.Name))
+	})
+}
@@ -0,0 +1,138 @@
+package kube
+
+// The fields of the API objects the balancer reads; everything else is ignored when decoding
+
+type objectMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type ingressList struct {
+	Items []ingress `json:"items"`
+}
+
+type ingress struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		IngressClassName string          `json:"ingressClassName"`
+		DefaultBackend   *ingressBackend `json:"defaultBackend"`
+		TLS              []struct {
+			Hosts      []string `json:"hosts"`
+			SecretName string   `json:"secretName"`
+		} `json:"tls"`
+		Rules []struct {
+			Host string `json:"host"`
+			HTTP *struct {
+				Paths []struct {
+					Path     string         `json:"path"`
+					PathType string         `json:"pathType"`
+					Backend  ingressBackend `json:"backend"`
+				} `json:"paths"`
+			} `json:"http"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+type ingressBackend struct {
+	Service *struct {
+		Name string `json:"name"`
+		Port struct {
+			Name   string `json:"name"`
+			Number int    `json:"number"`
+		} `json:"port"`
+	} `json:"service"`
+}
+
+type gateway struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		Listeners []struct {
+			Name string `json:"name"`
+			TLS  *struct {
+				CertificateRefs []objectRef `json:"certificateRefs"`
+			} `json:"tls"`
+		} `json:"listeners"`
+	} `json:"spec"`
+}
+
+type httpRouteList struct {
+	Items []httpRoute `json:"items"`
+}
+
+type httpRoute struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		ParentRefs []objectRef `json:"parentRefs"`
+		Hostnames  []string    `json:"hostnames"`
+		Rules      []struct {
+			Matches []struct {
+				Path *struct {
+					Type  string `json:"type"`
+					Value string `json:"value"`
+				} `json:"path"`
+			} `json:"matches"`
+			BackendRefs []struct {
+				objectRef
+				Port   int  `json:"port"`
+				Weight *int `json:"weight"`
+			} `json:"backendRefs"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+// objectRef names another object, in the namespace of the referring one when Namespace is empty
+type objectRef struct {
+	Group     *string `json:"group"`
+	Kind      string  `json:"kind"`
+	Name      string  `json:"name"`
+	Namespace string  `json:"namespace"`
+}
+
+// is reports whether the reference is to an object of the given group and kind; an unset group
+// and kind take the defaults the API gives them
+func (r objectRef) is(group, kind, defaultGroup, defaultKind string) bool {
+	g, k := defaultGroup, defaultKind
+	if r.Group != nil {
+		g = *r.Group
+	}
+	if r.Kind != "" {
+		k = r.Kind
+	}
+	return g == group && k == kind
+}
+
+type service struct {
+	Spec struct {
+		Type         string        `json:"type"`
+		ClusterIP    string        `json:"clusterIP"`
+		ExternalName string        `json:"externalName"`
+		Ports        []servicePort `json:"ports"`
+	} `json:"spec"`
+}
+
+type servicePort struct {
+	Name        string `json:"name"`
+	Port        int    `json:"port"`
+	AppProtocol string `json:"appProtocol"`
+}
+
+type endpointSliceList struct {
+	Items []struct {
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+		Endpoints []struct {
+			Addresses  []string `json:"addresses"`
+			Conditions struct {
+				Ready *bool `json:"ready"`
+			} `json:"conditions"`
+		} `json:"endpoints"`
+	} `json:"items"`
+}
+
+type secret struct {
+	Type string            `json:"type"`
+	Data map[string][]byte `json:"data"`
+}
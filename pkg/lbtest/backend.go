@@ -0,0 +1,85 @@
+package lbtest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Backend is a real HTTP server on a loopback port whose behavior is scripted
+type Backend struct {
+	*httptest.Server
+	script
+	healthPath atomic.Pointer[string]
+}
+
+// NewBackend starts a healthy Backend; the caller must Close it
+func NewBackend() *Backend {
+	b := &Backend{}
+	b.behavior = Healthy
+	b.Server = httptest.NewServer(http.HandlerFunc(b.serveHTTP))
+	return b
+}
+
+func (b *Backend) serveHTTP(rw http.ResponseWriter, req *http.Request) {
+	b.requests.Add(1)
+	if p := b.healthPath.Load(); p != nil && req.URL.Path == *p {
+		b.checks.Add(1)
+		respond(rw, req, Behavior{Alive: b.get().Alive})
+		return
+	}
+	respond(rw, req, b.next())
+}
+
+// StartBackends starts n healthy backends that are closed when tb finishes
+func StartBackends(tb testing.TB, n int) []*Backend {
+	tb.Helper()
+	out := make([]*Backend, n)
+	for i := range out {
+		out[i] = NewBackend()
+		tb.Cleanup(out[i].Close)
+	}
+	return out
+}
+
+// URLs returns the base URL of every backend, ready for loadbalancer.WithBackends
+func URLs(backends []*Backend) []string {
+	out := make([]string, len(backends))
+	for i, b := range backends {
+		out[i] = b.URL
+	}
+	return out
+}
+
+// SetBehavior replaces the whole script
+func (b *Backend) SetBehavior(behavior Behavior) { b.set(behavior) }
+
+// SetAlive changes whether the backend is healthy; an unhealthy backend answers 503
+func (b *Backend) SetAlive(alive bool) { b.update(func(s *Behavior) { s.Alive = alive }) }
+
+// SetStatus changes the response status code
+func (b *Backend) SetStatus(status int) { b.update(func(s *Behavior) { s.Status = status }) }
+
+// SetLatency changes the response delay
+func (b *Backend) SetLatency(d time.Duration) { b.update(func(s *Behavior) { s.Latency = d }) }
+
+// SetHealthPath marks requests for path as health checks: they are answered by Alive alone,
+// without latency or failures, and don't use up queued behaviors. Point the balancer's health
+// checks at it, e.g. with loadbalancer.WithHealthPath.
+func (b *Backend) SetHealthPath(path string) { b.healthPath.Store(&path) }
+
+// Queue has the next requests follow behaviors, in order, before the script applies again;
+// Drop and DropAfter really close the connection, which the balancer sees as a transport error
+func (b *Backend) Queue(behaviors ...Behavior) { b.enqueue(behaviors...) }
+
+// FailFirst has the next n requests answered with status, or their connection dropped when
+// status is 0, e.g. to check that a retry reaches another backend
+func (b *Backend) FailFirst(n, status int) { b.failFirst(n, status) }
+
+// Requests returns how many HTTP requests the backend received, health checks included
+func (b *Backend) Requests() int64 { return b.requests.Load() }
+
+// HealthChecks returns how many requests went to the health path
+func (b *Backend) HealthChecks() int64 { return b.checks.Load() }
@@ -0,0 +1,248 @@
+// Package lbtest provides fake servers and httptest backends for testing code built on
+// the loadbalancer package, such as strategies, hooks and retry logic. Backends can be
+// scripted to fail their next requests, answer late or drop the connection mid-body, for
+// end-to-end tests of retries, hedging and passive health checks.
+package lbtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/loadbalancer"
+)
+
+// Behavior scripts how a fake backend answers
+type Behavior struct {
+	// Alive is the health check result; a dead backend answers every request with 503
+	Alive bool
+	// Status is the response status code; zero means 200
+	Status int
+	// Latency delays every response, including health checks
+	Latency time.Duration
+	// Body is written as the response body
+	Body string
+	// Drop closes the connection without answering, as a crashed backend would
+	Drop bool
+	// DropAfter, when positive, cuts the connection once that many bytes of Body were sent
+	DropAfter int
+}
+
+// Healthy is the default Behavior: alive, 200 OK, no delay
+var Healthy = Behavior{Alive: true, Status: http.StatusOK}
+
+// script holds a Behavior that can be swapped while requests are in flight, and the behaviors
+// queued for the next requests
+type script struct {
+	mu       sync.Mutex
+	behavior Behavior
+	queue    []Behavior
+	requests atomic.Int64
+	checks   atomic.Int64
+}
+
+func (s *script) get() Behavior {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.behavior
+}
+
+// next returns the behavior of the next request, taking it off the queue if one is queued
+func (s *script) next() Behavior {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) > 0 {
+		b := s.queue[0]
+		s.queue = s.queue[1:]
+		return b
+	}
+	return s.behavior
+}
+
+// enqueue has the next requests follow behaviors, in order, before the script applies again
+func (s *script) enqueue(behaviors ...Behavior) {
+	s.mu.Lock()
+	s.queue = append(s.queue, behaviors...)
+	s.mu.Unlock()
+}
+
+// failFirst queues n copies of the script answering status, or dropping the connection when
+// status is 0
+func (s *script) failFirst(n, status int) {
+	b := s.get()
+	if status == 0 {
+		b.Drop = true
+	} else {
+		b.Status = status
+	}
+	for range n {
+		s.enqueue(b)
+	}
+}
+
+func (s *script) set(b Behavior) {
+	s.mu.Lock()
+	s.behavior = b
+	s.mu.Unlock()
+}
+
+func (s *script) update(fn func(*Behavior)) {
+	s.mu.Lock()
+	fn(&s.behavior)
+	s.mu.Unlock()
+}
+
+// sleep waits for d or until ctx is done, reporting whether the full delay elapsed
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// respond writes b to rw the way a real backend following the script would
+func respond(rw http.ResponseWriter, req *http.Request, b Behavior) {
+	if !sleep(req.Context(), b.Latency) {
+		return
+	}
+	status := b.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if !b.Alive {
+		status = http.StatusServiceUnavailable
+	}
+	if b.Drop {
+		panic(http.ErrAbortHandler)
+	}
+	if b.DropAfter > 0 && b.DropAfter < len(b.Body) {
+		// promise the whole body so the client notices it was cut short
+		rw.Header().Set("Content-Length", strconv.Itoa(len(b.Body)))
+		rw.WriteHeader(status)
+		io.WriteString(rw, b.Body[:b.DropAfter])
+		http.NewResponseController(rw).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	rw.WriteHeader(status)
+	io.WriteString(rw, b.Body)
+}
+
+// FakeServer is an in-memory loadbalancer.Server whose health and responses are scripted.
+// It never opens a socket, which makes it suited to unit-testing strategies.
+type FakeServer struct {
+	addr string
+	script
+
+	weight atomic.Int64
+	active atomic.Int64
+	mu     sync.Mutex
+	labels map[string]string
+}
+
+// NewFakeServer creates a healthy FakeServer reporting addr as its address
+func NewFakeServer(addr string) *FakeServer {
+	f := &FakeServer{addr: addr}
+	f.behavior = Healthy
+	f.weight.Store(1)
+	return f
+}
+
+// NewFakeServers creates n healthy fakes named fake-0, fake-1, ...
+func NewFakeServers(n int) []*FakeServer {
+	out := make([]*FakeServer, n)
+	for i := range out {
+		out[i] = NewFakeServer(fmt.Sprintf("fake-%d", i))
+	}
+	return out
+}
+
+var _ loadbalancer.Server = (*FakeServer)(nil)
+
+// Servers converts fakes to the slice type accepted by loadbalancer.WithServers
+func Servers(fakes []*FakeServer) []loadbalancer.Server {
+	out := make([]loadbalancer.Server, len(fakes))
+	for i, f := range fakes {
+		out[i] = f
+	}
+	return out
+}
+
+// Address returns the fake's address
+func (f *FakeServer) Address() string {
+	return f.addr
+}
+
+// IsAlive reports the scripted health after the scripted latency
+func (f *FakeServer) IsAlive(ctx context.Context) bool {
+	f.checks.Add(1)
+	b := f.get()
+	return sleep(ctx, b.Latency) && b.Alive
+}
+
+// Serve answers the request according to the script. A fake has no connection to drop, so
+// Drop and DropAfter abort the response to the balancer's client instead.
+func (f *FakeServer) Serve(rw http.ResponseWriter, req *http.Request) {
+	f.requests.Add(1)
+	f.active.Add(1)
+	defer f.active.Add(-1)
+	respond(rw, req, f.next())
+}
+
+// SetBehavior replaces the whole script
+func (f *FakeServer) SetBehavior(b Behavior) { f.set(b) }
+
+// SetAlive changes the health check result
+func (f *FakeServer) SetAlive(alive bool) { f.update(func(b *Behavior) { b.Alive = alive }) }
+
+// SetStatus changes the response status code
+func (f *FakeServer) SetStatus(status int) { f.update(func(b *Behavior) { b.Status = status }) }
+
+// SetLatency changes the response delay
+func (f *FakeServer) SetLatency(d time.Duration) { f.update(func(b *Behavior) { b.Latency = d }) }
+
+// Queue has the next requests follow behaviors, in order, before the script applies again
+func (f *FakeServer) Queue(behaviors ...Behavior) { f.enqueue(behaviors...) }
+
+// FailFirst has the next n requests answered with status, or aborted when status is 0
+func (f *FakeServer) FailFirst(n, status int) { f.failFirst(n, status) }
+
+// Requests returns how many requests the fake has served
+func (f *FakeServer) Requests() int64 { return f.requests.Load() }
+
+// HealthChecks returns how many times IsAlive was called
+func (f *FakeServer) HealthChecks() int64 { return f.checks.Load() }
+
+// Weight returns the fake's weight, 1 unless changed with SetWeight
+func (f *FakeServer) Weight() int { return int(f.weight.Load()) }
+
+// SetWeight changes the weight reported to strategies
+func (f *FakeServer) SetWeight(w int) { f.weight.Store(int64(w)) }
+
+// ActiveConnections returns the number of requests currently inside Serve
+func (f *FakeServer) ActiveConnections() int64 { return f.active.Load() }
+
+// Labels returns the fake's labels
+func (f *FakeServer) Labels() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.labels
+}
+
+// SetLabels replaces the fake's labels
+func (f *FakeServer) SetLabels(labels map[string]string) {
+	f.mu.Lock()
+	f.labels = labels
+	f.mu.Unlock()
+}
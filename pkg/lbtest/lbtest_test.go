@@ -0,0 +1,162 @@
+package lbtest_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/lbtest"
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/loadbalancer"
+)
+
+// fetch gets path from b and returns the status and body
+func fetch(t *testing.T, b *lbtest.Backend, path string) (int, string, error) {
+	t.Helper()
+	resp, err := b.Client().Get(b.URL + path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body), err
+}
+
+func TestBackendScript(t *testing.T) {
+	b := lbtest.StartBackends(t, 1)[0]
+	b.SetBehavior(lbtest.Behavior{Alive: true, Body: "ok"})
+	b.SetHealthPath("/healthz")
+	b.Queue(lbtest.Behavior{Alive: true, Status: http.StatusTeapot, Body: "queued"})
+	b.FailFirst(1, http.StatusBadGateway)
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		// health checks don't use up the queue
+		{"/healthz", http.StatusOK, ""},
+		{"/", http.StatusTeapot, "queued"},
+		{"/", http.StatusBadGateway, "ok"},
+		{"/", http.StatusOK, "ok"},
+	}
+	for i, tt := range tests {
+		status, body, err := fetch(t, b, tt.path)
+		if err != nil || status != tt.status || body != tt.body {
+			t.Errorf("request %d to %s: %d %q %v, want %d %q", i, tt.path, status, body, err, tt.status, tt.body)
+		}
+	}
+
+	b.SetAlive(false)
+	if status, _, _ := fetch(t, b, "/healthz"); status != http.StatusServiceUnavailable {
+		t.Errorf("health check of a dead backend: %d, want 503", status)
+	}
+	if status, _, _ := fetch(t, b, "/"); status != http.StatusServiceUnavailable {
+		t.Errorf("request to a dead backend: %d, want 503", status)
+	}
+	if b.Requests() != 6 || b.HealthChecks() != 2 {
+		t.Errorf("counted %d requests and %d health checks, want 6 and 2", b.Requests(), b.HealthChecks())
+	}
+}
+
+func TestBackendDrops(t *testing.T) {
+	b := lbtest.StartBackends(t, 1)[0]
+	b.Queue(
+		lbtest.Behavior{Alive: true, Drop: true},
+		lbtest.Behavior{Alive: true, Body: "0123456789", DropAfter: 4},
+	)
+	if _, _, err := fetch(t, b, "/"); err == nil {
+		t.Error("a dropped connection answered")
+	}
+	if _, body, err := fetch(t, b, "/"); err == nil || body != "0123" {
+		t.Errorf("a body cut short: %q %v, want the first 4 bytes and an error", body, err)
+	}
+}
+
+func TestBackendLatency(t *testing.T) {
+	b := lbtest.StartBackends(t, 1)[0]
+	b.SetLatency(50 * time.Millisecond)
+	start := time.Now()
+	fetch(t, b, "/")
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("answered after %s, want at least 50ms", elapsed)
+	}
+}
+
+func TestFakeServer(t *testing.T) {
+	f := lbtest.NewFakeServers(2)[1]
+	if f.Address() != "fake-1" || f.Weight() != 1 {
+		t.Errorf("new fake: address %q, weight %d", f.Address(), f.Weight())
+	}
+	f.SetWeight(5)
+	f.SetLabels(map[string]string{"zone": "a"})
+	if f.Weight() != 5 || f.Labels()["zone"] != "a" {
+		t.Errorf("weight %d, labels %v", f.Weight(), f.Labels())
+	}
+
+	f.FailFirst(1, http.StatusInternalServerError)
+	for _, want := range []int{http.StatusInternalServerError, http.StatusOK} {
+		rec := httptest.NewRecorder()
+		f.Serve(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != want {
+			t.Errorf("status %d, want %d", rec.Code, want)
+		}
+	}
+
+	if !f.IsAlive(context.Background()) {
+		t.Error("a healthy fake reported dead")
+	}
+	f.SetAlive(false)
+	if f.IsAlive(context.Background()) {
+		t.Error("a dead fake reported alive")
+	}
+	f.SetBehavior(lbtest.Behavior{Alive: true, Latency: time.Second})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if f.IsAlive(ctx) {
+		t.Error("a fake slower than the probe timeout reported alive")
+	}
+	if f.Requests() != 2 || f.HealthChecks() != 3 {
+		t.Errorf("counted %d requests and %d health checks, want 2 and 3", f.Requests(), f.HealthChecks())
+	}
+}
+
+func TestFakeServerActiveConnections(t *testing.T) {
+	f := lbtest.NewFakeServer("fake")
+	f.SetLatency(100 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.Serve(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	for deadline := time.Now().Add(time.Second); f.ActiveConnections() != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the request never counted as active")
+		}
+	}
+	<-done
+	if n := f.ActiveConnections(); n != 0 {
+		t.Errorf("%d active after the request finished", n)
+	}
+}
+
+func TestFakeServersBehindBalancer(t *testing.T) {
+	fakes := lbtest.NewFakeServers(2)
+	fakes[0].SetAlive(false)
+	lb, err := loadbalancer.New(loadbalancer.WithServers(lbtest.Servers(fakes)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 4 {
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("status %d, want 200 from the live fake", rec.Code)
+		}
+	}
+	if fakes[0].Requests() != 0 || fakes[1].Requests() != 4 {
+		t.Errorf("requests: dead fake %d, live fake %d; want 0 and 4", fakes[0].Requests(), fakes[1].Requests())
+	}
+}
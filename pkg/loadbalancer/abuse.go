@@ -0,0 +1,185 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AbusePolicy bans or tarpits clients whose traffic looks abusive: a high share of 4xx
+// responses (scanners, credential stuffing) or a flood of requests within one window.
+// Clients are identified by IP, IPv6 clients by their /64.
+type AbusePolicy struct {
+	// Window is the interval over which a client's requests are counted; default 1m
+	Window time.Duration
+	// MinRequests is how many requests a client must make in a window before its error rate is judged; default 20
+	MinRequests int
+	// MaxErrorRate is the share of 4xx responses, from 0 to 1, above which a client is an offender; default 0.5
+	MaxErrorRate float64
+	// MaxRequests per window makes a client an offender whatever its responses; unlimited when 0
+	MaxRequests int
+	// BanFor is how long an offender is penalised; default 10m
+	BanFor time.Duration
+	// Tarpit, when set, delays each request of an offender by this long instead of refusing it
+	Tarpit time.Duration
+}
+
+// WithAbuseDetection enables automatic bans. Bans are listed by GET /bans on the admin handler
+// and lifted with DELETE /bans?client=...
+func WithAbuseDetection(p AbusePolicy) Option {
+	return func(lb *LoadBalancer) {
+		if p.Window <= 0 {
+			p.Window = time.Minute
+		}
+		if p.MinRequests <= 0 {
+			p.MinRequests = 20
+		}
+		if p.MaxErrorRate <= 0 {
+			p.MaxErrorRate = 0.5
+		}
+		if p.BanFor <= 0 {
+			p.BanFor = 10 * time.Minute
+		}
+		lb.abuse = &abuseTracker{policy: p, clients: make(map[string]*clientActivity), bans: make(map[string]Ban)}
+	}
+}
+
+// Ban is a client currently penalised for abuse
+type Ban struct {
+	Client string    `json:"client"`
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason"`
+}
+
+type clientActivity struct {
+	windowStart time.Time
+	requests    int
+	errors      int
+}
+
+type abuseTracker struct {
+	policy AbusePolicy
+
+	mu        sync.Mutex
+	clients   map[string]*clientActivity
+	bans      map[string]Ban
+	lastSweep time.Time
+}
+
+// banned returns the client's ban, if one is in force
+func (a *abuseTracker) banned(client string, now time.Time) (Ban, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ban, ok := a.bans[client]
+	if ok && !now.Before(ban.Until) {
+		delete(a.bans, client)
+		return Ban{}, false
+	}
+	return ban, ok
+}
+
+// observe counts a finished request and returns a ban when it tips the client over a threshold
+func (a *abuseTracker) observe(client string, status int, now time.Time) (Ban, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.bans[client]; ok {
+		return Ban{}, false
+	}
+	act, ok := a.clients[client]
+	if !ok || now.Sub(act.windowStart) >= a.policy.Window {
+		act = &clientActivity{windowStart: now}
+		a.clients[client] = act
+	}
+	act.requests++
+	if status >= 400 && status < 500 {
+		act.errors++
+	}
+	if now.Sub(a.lastSweep) >= a.policy.Window {
+		a.lastSweep = now
+		for k, other := range a.clients {
+			if now.Sub(other.windowStart) >= a.policy.Window {
+				delete(a.clients, k)
+			}
+		}
+	}
+
+	var reason string
+	switch {
+	case a.policy.MaxRequests > 0 && act.requests > a.policy.MaxRequests:
+		reason = "request flood"
+	case act.requests >= a.policy.MinRequests && float64(act.errors)/float64(act.requests) > a.policy.MaxErrorRate:
+		reason = "client error rate " + strconv.Itoa(act.errors*100/act.requests) + "%"
+	default:
+		return Ban{}, false
+	}
+	ban := Ban{Client: client, Until: now.Add(a.policy.BanFor), Reason: reason}
+	a.bans[client] = ban
+	delete(a.clients, client)
+	return ban, true
+}
+
+func (lb *LoadBalancer) abuseMiddleware(next http.Handler) http.Handler {
+	a := lb.abuse
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ban, ok := a.banned(lb.clientID(req), time.Now())
+		if ok && a.policy.Tarpit <= 0 {
+			rw.Header().Set("Retry-After", strconv.Itoa(int(time.Until(ban.Until).Seconds())+1))
+			http.Error(rw, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		if ok {
+			t := time.NewTimer(a.policy.Tarpit)
+			select {
+			case <-t.C:
+			case <-req.Context().Done():
+				t.Stop()
+				return
+			}
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// observeAbuse is registered as an OnResponse hook
+func (lb *LoadBalancer) observeAbuse(req *http.Request, _ Server, status int, _ time.Duration) {
+	if ban, ok := lb.abuse.observe(lb.clientID(req), status, time.Now()); ok {
+		lb.logger.Warn("client banned", "client", ban.Client, "reason", ban.Reason, "until", ban.Until)
+	}
+}
+
+// serveBans lists the bans in force
+func (lb *LoadBalancer) serveBans(rw http.ResponseWriter, _ *http.Request) {
+	now := time.Now()
+	a := lb.abuse
+	a.mu.Lock()
+	bans := make([]Ban, 0, len(a.bans))
+	for _, ban := range a.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, ban)
+		}
+	}
+	a.mu.Unlock()
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Client < bans[j].Client })
+	writeJSON(rw, bans)
+}
+
+// serveLiftBan handles DELETE /bans?client=..., for callers presenting the admin token
+func (lb *LoadBalancer) serveLiftBan(rw http.ResponseWriter, req *http.Request) {
+	if !lb.authorized(rw, req) {
+		return
+	}
+	client := req.URL.Query().Get("client")
+	a := lb.abuse
+	a.mu.Lock()
+	_, ok := a.bans[client]
+	delete(a.bans, client)
+	a.mu.Unlock()
+	if !ok {
+		http.Error(rw, "no such ban", http.StatusNotFound)
+		return
+	}
+	lb.logger.Info("ban lifted", "client", client)
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,117 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// maxRequestIDLen bounds a request ID taken over from the client
+const maxRequestIDLen = 128
+
+// AccessLog writes one structured line per request: method, path, client IP, backend, upstream
+// and total latency, status, response bytes and a request ID. The ID is also set on the proxied
+// request and the response, so balancer and backend logs can be joined on it.
+type AccessLog struct {
+	// Logger receives the lines; default the balancer's logger
+	Logger *slog.Logger
+	// Level is the level of the lines; default Info
+	Level slog.Level
+	// RequestIDHeader names the request ID header; default X-Request-ID. An ID a client or an
+	// upstream proxy already sent is kept when it is at most 128 printable ASCII characters.
+	RequestIDHeader string
+	// Query adds the query string to the lines, scrubbed as set up with WithScrubbing
+	Query bool
+	// Sink, when set, receives the lines instead of Logger, such as a file, syslog or a log
+	// collector; wrap it in an AsyncSink to keep slow writes off the requests
+	Sink LogSink
+}
+
+// WithAccessLog logs every request and tags it with a request ID
+func WithAccessLog(cfg AccessLog) Option {
+	return func(lb *LoadBalancer) {
+		if cfg.RequestIDHeader == "" {
+			cfg.RequestIDHeader = "X-Request-ID"
+		}
+		lb.accessLog = &cfg
+	}
+}
+
+// tagRequest gives req a request ID, keeping a usable one it already has
+func (a *AccessLog) tagRequest(rw http.ResponseWriter, req *http.Request, st *requestState) {
+	id := req.Header.Get(a.RequestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+		req.Header.Set(a.RequestIDHeader, id)
+	}
+	st.requestID = id
+	rw.Header().Set(a.RequestIDHeader, id)
+}
+
+// validRequestID accepts printable ASCII IDs of a sane length
+func validRequestID(id string) bool {
+	return printableToken(id, maxRequestIDLen)
+}
+
+// printableToken reports whether s is non-empty printable ASCII without spaces, at most maxLen long
+func printableToken(s string, maxLen int) bool {
+	if s == "" || len(s) > maxLen {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x21 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// log writes the access log line of a finished request
+func (a *AccessLog) log(logger *slog.Logger, scrub *Scrub, client string, req *http.Request, st *requestState, status int, written uint64, elapsed time.Duration) {
+	e := LogEntry{
+		Time:           time.Now(),
+		RequestID:      st.requestID,
+		Method:         req.Method,
+		Path:           req.URL.Path,
+		Client:         clientIP(req),
+		ClientID:       client,
+		TLSFingerprint: TLSFingerprint(req),
+		Status:         status,
+		Bytes:          written,
+		Upstream:       st.upstream,
+		Duration:       elapsed,
+	}
+	if st.server != nil {
+		e.Backend = st.server.Address()
+	}
+	if a.Query && req.URL.RawQuery != "" {
+		e.Query = scrub.query(req.URL.RawQuery)
+	}
+	if a.Sink != nil {
+		if err := a.Sink.Write(e); err != nil {
+			logger.Debug("access log entry lost", "request_id", e.RequestID, "error", err)
+		}
+		return
+	}
+	if a.Logger != nil {
+		logger = a.Logger
+	}
+	logger.LogAttrs(context.Background(), a.Level, "request", e.attrs()...)
+}
+
+// writeMetrics writes the counters of a sink that keeps them, such as an AsyncSink
+func (a *AccessLog) writeMetrics(w *bufio.Writer) {
+	if m, ok := a.Sink.(interface{ writeMetrics(*bufio.Writer) }); ok {
+		m.writeMetrics(w)
+	}
+}
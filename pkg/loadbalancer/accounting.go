@@ -0,0 +1,179 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/metrics"
+)
+
+// otherUsage collects the traffic of clients and routes beyond ByteAccounting.MaxClients
+// and MaxRoutes
+const otherUsage = "other"
+
+// ByteAccounting tracks the request and response body bytes of every request by backend,
+// route and client, so bandwidth hogs and asymmetric endpoints show up in GET /usage.
+type ByteAccounting struct {
+	// Route names the route a request belongs to; by default its first path segment, e.g. "/api"
+	Route func(*http.Request) string
+	// MaxClients bounds the clients tracked individually; the rest are summed as "other".
+	// Default 10000.
+	MaxClients int
+	// MaxRoutes bounds the routes tracked individually, as the default route names come from
+	// the client's path; the rest are summed as "other". Default 1000.
+	MaxRoutes int
+}
+
+// WithByteAccounting enables per-backend, per-route and per-client byte counts
+func WithByteAccounting(a ByteAccounting) Option {
+	return func(lb *LoadBalancer) {
+		if a.Route == nil {
+			a.Route = firstPathSegment
+		}
+		if a.MaxClients <= 0 {
+			a.MaxClients = 10000
+		}
+		if a.MaxRoutes <= 0 {
+			a.MaxRoutes = 1000
+		}
+		lb.usage = &usageTracker{
+			cfg:      a,
+			backends: newUsageTable(0),
+			routes:   newUsageTable(a.MaxRoutes),
+			clients:  newUsageTable(a.MaxClients),
+		}
+	}
+}
+
+// firstPathSegment is the default route name: "/api/v1/users" belongs to "/api"
+func firstPathSegment(req *http.Request) string {
+	path := req.URL.Path
+	if i := strings.IndexByte(strings.TrimPrefix(path, "/"), '/'); i >= 0 {
+		return path[:i+1]
+	}
+	return path
+}
+
+// ByteCount is the body traffic of one backend, route or client
+type ByteCount struct {
+	// In counts request body bytes received from clients
+	In uint64 `json:"bytes_in"`
+	// Out counts response body bytes sent to clients
+	Out uint64 `json:"bytes_out"`
+}
+
+// Usage is a snapshot of the byte counts by dimension
+type Usage struct {
+	Backends map[string]ByteCount `json:"backends"`
+	Routes   map[string]ByteCount `json:"routes"`
+	Clients  map[string]ByteCount `json:"clients"`
+}
+
+type byteCounter struct {
+	in, out atomic.Uint64
+}
+
+// usageTable holds the counters of one dimension; with a limit, keys past it share one counter
+type usageTable struct {
+	limit int
+	mu    sync.RWMutex
+	m     map[string]*byteCounter
+}
+
+func newUsageTable(limit int) *usageTable {
+	return &usageTable{limit: limit, m: make(map[string]*byteCounter)}
+}
+
+func (t *usageTable) add(key string, in, out uint64) {
+	t.mu.RLock()
+	c, ok := t.m[key]
+	t.mu.RUnlock()
+	if !ok {
+		t.mu.Lock()
+		if c, ok = t.m[key]; !ok {
+			if t.limit > 0 && len(t.m) >= t.limit {
+				key = otherUsage
+				c = t.m[key]
+			}
+			if c == nil {
+				c = new(byteCounter)
+				t.m[key] = c
+			}
+		}
+		t.mu.Unlock()
+	}
+	c.in.Add(in)
+	c.out.Add(out)
+}
+
+func (t *usageTable) get(key string) (ByteCount, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	c, ok := t.m[key]
+	if !ok {
+		return ByteCount{}, false
+	}
+	return ByteCount{In: c.in.Load(), Out: c.out.Load()}, true
+}
+
+func (t *usageTable) snapshot() map[string]ByteCount {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	out := make(map[string]ByteCount, len(t.m))
+	for k, c := range t.m {
+		out[k] = ByteCount{In: c.in.Load(), Out: c.out.Load()}
+	}
+	return out
+}
+
+type usageTracker struct {
+	cfg                       ByteAccounting
+	backends, routes, clients *usageTable
+}
+
+// record attributes one finished request's traffic
+func (u *usageTracker) record(req *http.Request, client string, server Server, in, out uint64) {
+	if server != nil {
+		u.backends.add(server.Address(), in, out)
+	}
+	route := stateFrom(req.Context()).route
+	if route == "" {
+		route = u.cfg.Route(req)
+	}
+	u.routes.add(route, in, out)
+	u.clients.add(client, in, out)
+}
+
+// Usage returns the byte counts collected so far; it is empty without WithByteAccounting
+func (lb *LoadBalancer) Usage() Usage {
+	if lb.usage == nil {
+		return Usage{}
+	}
+	return Usage{
+		Backends: lb.usage.backends.snapshot(),
+		Routes:   lb.usage.routes.snapshot(),
+		Clients:  lb.usage.clients.snapshot(),
+	}
+}
+
+// serveUsage handles GET /usage
+func (lb *LoadBalancer) serveUsage(rw http.ResponseWriter, _ *http.Request) {
+	writeJSON(rw, lb.Usage())
+}
+
+// countingBody counts the request body bytes read by the proxy
+type countingBody struct {
+	io.ReadCloser
+	n       atomic.Uint64
+	counter *metrics.Counter
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(uint64(n))
+	b.counter.Add(uint64(n))
+	return n, err
+}
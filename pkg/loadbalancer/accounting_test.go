@@ -0,0 +1,26 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUsageRoutesBounded(t *testing.T) {
+	var lb LoadBalancer
+	WithByteAccounting(ByteAccounting{MaxRoutes: 3})(&lb)
+	for i := range 10 {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/random-%d/x", i), nil)
+		lb.usage.record(req, "client", nil, 1, 10)
+	}
+	routes := lb.Usage().Routes
+	if len(routes) != 4 {
+		t.Fatalf("tracked %d routes, want 3 and other: %v", len(routes), routes)
+	}
+	if got := routes[otherUsage]; got != (ByteCount{In: 7, Out: 70}) {
+		t.Errorf("other = %+v, want the 7 routes past the limit", got)
+	}
+	if _, ok := routes["/random-0"]; !ok {
+		t.Errorf("first route not tracked: %v", routes)
+	}
+}
@@ -0,0 +1,215 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/metrics"
+)
+
+// AdaptiveTimeouts gives every backend a timeout learned from its own response times: a
+// quantile of the time it took to answer with headers, times Factor, kept within Min and Max.
+// A fast backend has a slow request cut off long before a fixed timeout would, while a
+// backend that is slow by nature isn't held to the pace of the others.
+//
+// The timeout runs from the start of each attempt to the response headers, so it includes
+// sending the request body; requests with a body of unknown length or over 1MiB are neither
+// bounded nor learned from. Long-polling endpoints answer late on purpose, so Min should be
+// above their wait. A request cut off fails as response_header_timeout and may be retried.
+type AdaptiveTimeouts struct {
+	// Quantile of the response times the timeout is derived from; default 0.99
+	Quantile float64
+	// Factor multiplies the quantile; default 3
+	Factor float64
+	// Min and Max bound the timeouts; default 1s and 30s. Backends start at Max.
+	Min time.Duration
+	Max time.Duration
+	// Interval is how often the timeouts are recomputed from the requests since; default 1m
+	Interval time.Duration
+	// MinSamples is how many requests a backend must have answered within an Interval for its
+	// timeout to be recomputed; default 100
+	MinSamples int
+}
+
+// WithAdaptiveTimeouts bounds each backend's time to answer by a timeout learned from its
+// response times
+func WithAdaptiveTimeouts(cfg AdaptiveTimeouts) Option {
+	return func(lb *LoadBalancer) {
+		if cfg.Quantile <= 0 {
+			cfg.Quantile = 0.99
+		}
+		if cfg.Factor <= 0 {
+			cfg.Factor = 3
+		}
+		if cfg.Min <= 0 {
+			cfg.Min = time.Second
+		}
+		if cfg.Max <= 0 {
+			cfg.Max = 30 * time.Second
+		}
+		if cfg.Interval <= 0 {
+			cfg.Interval = time.Minute
+		}
+		if cfg.MinSamples <= 0 {
+			cfg.MinSamples = 100
+		}
+		lb.adaptiveTimeouts = &adaptiveTimeouts{AdaptiveTimeouts: cfg, backends: make(map[string]*learnedTimeout)}
+	}
+}
+
+// timeoutBuckets extend the default buckets so slow backends can learn timeouts of minutes
+var timeoutBuckets = append(slices.Clone(metrics.DefaultBuckets), 30, 60, 120)
+
+// maxTimedBody is the largest request body whose attempts adaptive timeouts bound
+const maxTimedBody = 1 << 20
+
+// errLearnedTimeout is the cause of an attempt cut off by its backend's learned timeout
+var errLearnedTimeout = fmt.Errorf("backend exceeded its learned timeout awaiting response headers: %w", context.DeadlineExceeded)
+
+// adaptiveTimeouts holds the learned timeout of every backend
+type adaptiveTimeouts struct {
+	AdaptiveTimeouts
+
+	mu       sync.Mutex
+	backends map[string]*learnedTimeout
+}
+
+type learnedTimeout struct {
+	// timeout is the current timeout in nanoseconds
+	timeout atomic.Int64
+	// latency holds the times to headers since the timeout was last recomputed
+	latency atomic.Pointer[metrics.Histogram]
+}
+
+func (a *adaptiveTimeouts) validate() error {
+	switch {
+	case a.Quantile > 1:
+		return errors.New("adaptive timeouts: want a quantile from 0 to 1")
+	case a.Max < a.Min:
+		return errors.New("adaptive timeouts: want min <= max")
+	}
+	return nil
+}
+
+// backend returns the learned timeout of the backend at addr, starting it at Max on first use
+func (a *adaptiveTimeouts) backend(addr string) *learnedTimeout {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b := a.backends[addr]
+	if b == nil {
+		b = &learnedTimeout{}
+		b.timeout.Store(int64(a.Max))
+		b.latency.Store(metrics.NewHistogram(timeoutBuckets))
+		a.backends[addr] = b
+	}
+	return b
+}
+
+// bounds reports whether attempts of req are bounded and learned from
+func (a *adaptiveTimeouts) bounds(req *http.Request) bool {
+	return req.ContentLength >= 0 && req.ContentLength <= maxTimedBody
+}
+
+// timedAttempt bounds one attempt at server by its learned timeout. It returns the request to
+// send, a func the attempt's writer calls when the response headers arrive, and a func to call
+// once the attempt is over, which records its time to headers.
+func (a *adaptiveTimeouts) timedAttempt(req *http.Request, server Server) (*http.Request, func(), func()) {
+	b := a.backend(server.Address())
+	ctx, cancel := context.WithCancelCause(req.Context())
+	var arrived atomic.Bool
+	start := time.Now()
+	timer := time.AfterFunc(time.Duration(b.timeout.Load()), func() {
+		if !arrived.Load() {
+			cancel(errLearnedTimeout)
+		}
+	})
+	var toHeaders atomic.Int64
+	headers := func() {
+		if !arrived.Swap(true) {
+			timer.Stop()
+			toHeaders.Store(int64(time.Since(start)))
+		}
+	}
+	done := func() {
+		timer.Stop()
+		cancel(nil)
+		elapsed := time.Duration(toHeaders.Load())
+		switch {
+		case elapsed > 0:
+		case errors.Is(context.Cause(ctx), errLearnedTimeout):
+			// a cut-off attempt counts as taking its whole timeout, so a backend slowing
+			// down for good has its timeout grow to match
+			elapsed = time.Since(start)
+		default:
+			// failed or abandoned without an answer: nothing learned
+			return
+		}
+		b.latency.Load().Observe(elapsed.Seconds())
+	}
+	return req.WithContext(ctx), headers, done
+}
+
+// adaptiveTimeoutsLoop recomputes the timeouts every Interval until ctx is done
+func (lb *LoadBalancer) adaptiveTimeoutsLoop(ctx context.Context) {
+	a := lb.adaptiveTimeouts
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		a.mu.Lock()
+		backends := maps.Clone(a.backends)
+		a.mu.Unlock()
+		for addr, b := range backends {
+			s := b.latency.Load().Snapshot()
+			if s.Count < uint64(a.MinSamples) {
+				continue
+			}
+			b.latency.Store(metrics.NewHistogram(timeoutBuckets))
+			learned := time.Duration(s.Quantile(a.Quantile) * a.Factor * float64(time.Second))
+			learned = min(max(learned, a.Min), a.Max)
+			if old := time.Duration(b.timeout.Swap(int64(learned))); old != learned {
+				lb.logger.Debug("backend timeout learned", "server", addr, "timeout", learned, "was", old)
+			}
+		}
+	}
+}
+
+// LearnedTimeouts returns the timeout adaptive timeouts currently hold each backend to
+func (lb *LoadBalancer) LearnedTimeouts() map[string]time.Duration {
+	if lb.adaptiveTimeouts == nil {
+		return nil
+	}
+	return lb.adaptiveTimeouts.timeouts()
+}
+
+func (a *adaptiveTimeouts) timeouts() map[string]time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make(map[string]time.Duration, len(a.backends))
+	for addr, b := range a.backends {
+		out[addr] = time.Duration(b.timeout.Load())
+	}
+	return out
+}
+
+// writeMetrics writes the learned timeout of every backend
+func (a *adaptiveTimeouts) writeMetrics(w *bufio.Writer) {
+	timeouts := a.timeouts()
+	writeMetricHeader(w, "lb_backend_learned_timeout_seconds", "gauge", "Time to response headers each backend is currently held to, learned from its response times.")
+	for _, addr := range slices.Sorted(maps.Keys(timeouts)) {
+		fmt.Fprintf(w, "lb_backend_learned_timeout_seconds{backend=%s} %s\n", labelValue(addr), strconv.FormatFloat(timeouts[addr].Seconds(), 'g', -1, 64))
+	}
+}
@@ -0,0 +1,247 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readinessProbeTimeout bounds the backend probes made by /readyz
+const readinessProbeTimeout = 2 * time.Second
+
+var errNotServing = errors.New("load balancer is not serving")
+
+// WithAdminPort serves the admin endpoints (/livez, /readyz, /leader, /backends, /metrics) on a separate port when the
+// balancer is started. They are also available through AdminHandler.
+func WithAdminPort(port string) Option {
+	return func(lb *LoadBalancer) {
+		lb.adminPort = port
+	}
+}
+
+// WithAdminToken sets the operator token: the bearer token the admin endpoints that act on
+// traffic, such as DELETE /requests/{id}, require. It is also accepted wherever a feature has
+// a token of its own. Without it, endpoints that have no other token refuse every call.
+func WithAdminToken(token string) Option {
+	return func(lb *LoadBalancer) {
+		lb.adminToken = token
+	}
+}
+
+// WithStartupGate keeps Ready failing after startup until at least n backends have passed a
+// health check, so an orchestrator doesn't send traffic to a balancer whose pool is still
+// empty. Once the gate has opened, one healthy backend is enough again.
+func WithStartupGate(n int) Option {
+	return func(lb *LoadBalancer) {
+		lb.startupGate = n
+	}
+}
+
+// AdminHandler returns the handler for the admin endpoints, for mounting on a custom server
+func (lb *LoadBalancer) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /livez", lb.serveLivez)
+	mux.HandleFunc("GET /readyz", lb.serveReadyz)
+	mux.HandleFunc("GET /leader", lb.serveLeader)
+	mux.HandleFunc("GET /backends", lb.serveBackends)
+	mux.HandleFunc("GET /metrics", lb.serveMetrics)
+	mux.HandleFunc("GET /debug/state", lb.serveDump)
+	if lb.journal != nil {
+		mux.HandleFunc("GET /debug/inflight", lb.serveInFlight)
+	}
+	if lb.live != nil {
+		mux.HandleFunc("GET /requests", lb.serveLiveRequests)
+		mux.HandleFunc("DELETE /requests/{id}", lb.serveCancelRequest)
+	}
+	mux.HandleFunc("GET /drains", lb.serveDrains)
+	if lb.backendAPI != nil {
+		mux.HandleFunc("POST /drains/{addr...}", lb.serveStartDrain)
+		mux.HandleFunc("DELETE /drains/{addr...}", lb.serveResume)
+		mux.HandleFunc("POST /backends", lb.serveAddBackend)
+		mux.HandleFunc("PATCH /backends/{addr...}", lb.serveUpdateBackend)
+		mux.HandleFunc("DELETE /backends/{addr...}", lb.serveRemoveBackend)
+	}
+	if lb.sessions != nil {
+		mux.HandleFunc("GET /affinity", lb.serveAffinity)
+		mux.HandleFunc("DELETE /affinity", lb.serveResetAffinity)
+	}
+	if lb.abuse != nil {
+		mux.HandleFunc("GET /bans", lb.serveBans)
+		mux.HandleFunc("DELETE /bans", lb.serveLiftBan)
+	}
+	if lb.dark != nil {
+		mux.HandleFunc("PUT /dark-launch", lb.serveDarkLaunchGate)
+	}
+	if lb.capacityCfg != nil {
+		mux.HandleFunc("POST /capacity", lb.serveCapacity)
+	}
+	if lb.canary != nil {
+		mux.HandleFunc("GET /canary", lb.serveCanary)
+		mux.HandleFunc("POST /canary/ramp", lb.serveCanaryRamp)
+		mux.HandleFunc("DELETE /canary/ramp", lb.serveCanaryAbort)
+	}
+	if len(lb.pools) > 0 {
+		mux.HandleFunc("GET /pools", lb.servePools)
+	}
+	if lb.autoscale != nil {
+		mux.HandleFunc("GET /autoscale", lb.serveAutoscale)
+	}
+	if lb.usage != nil {
+		mux.HandleFunc("GET /usage", lb.serveUsage)
+	}
+	if lb.reports != nil {
+		mux.HandleFunc("GET /reports", lb.serveReports)
+	}
+	if lb.reload != nil {
+		mux.HandleFunc("POST /reload", lb.serveReload)
+	}
+	if lb.snapshots != nil {
+		mux.HandleFunc("GET /snapshots", lb.serveSnapshots)
+		mux.HandleFunc("GET /snapshots/{id}", lb.serveSnapshot)
+		mux.HandleFunc("GET /snapshots/{id}/diff", lb.serveSnapshotDiff)
+		mux.HandleFunc("POST /snapshots", lb.serveTakeSnapshot)
+		mux.HandleFunc("POST /snapshots/{id}/restore", lb.serveRestoreSnapshot)
+	}
+	if lb.tenants != nil {
+		tenants := lb.tenants.AdminHandler(lb.adminToken)
+		mux.Handle("GET /tenants", tenants)
+		mux.Handle("/tenants/", tenants)
+	}
+	return mux
+}
+
+// requireToken reports whether req carries one of the non-empty tokens as a bearer token, and
+// answers 403 when it doesn't. Without any token set, every request is refused.
+func requireToken(rw http.ResponseWriter, req *http.Request, tokens ...string) bool {
+	for _, token := range tokens {
+		if token != "" && tokenMatches(req, token) {
+			return true
+		}
+	}
+	http.Error(rw, "Forbidden", http.StatusForbidden)
+	return false
+}
+
+// authorized is requireToken accepting the admin token as well as tokens, and for a
+// tenant's balancer the operator token of the balancer in front of it
+func (lb *LoadBalancer) authorized(rw http.ResponseWriter, req *http.Request, tokens ...string) bool {
+	return requireToken(rw, req, append(tokens, lb.adminToken, lb.operatorToken)...)
+}
+
+// serveLivez reports that the process is up and able to answer HTTP
+func (lb *LoadBalancer) serveLivez(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(rw, "ok")
+}
+
+// serveReadyz reports whether the balancer should receive traffic
+func (lb *LoadBalancer) serveReadyz(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := lb.Ready(req.Context()); err != nil {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(rw, "not ready: %v\n", err)
+		return
+	}
+	fmt.Fprintln(rw, "ok")
+}
+
+// Ready returns nil when the balancer is serving and at least one backend is healthy, or as
+// many as WithStartupGate asks for until that has been met once, and otherwise explains why
+// it is not ready
+func (lb *LoadBalancer) Ready(ctx context.Context) error {
+	if lb.handler == nil {
+		return errors.New("configuration not loaded")
+	}
+	lb.life.mu.Lock()
+	stopping, result := lb.life.stopping, lb.life.result
+	lb.life.mu.Unlock()
+	if stopping {
+		return errors.New("shutting down")
+	}
+	if result != nil {
+		select {
+		case <-result.done:
+			return errNotServing
+		default:
+		}
+	}
+	if lb.tenants != nil && len(lb.readinessServers()) == 0 {
+		// a front that only dispatches to tenants is ready while any of them is
+		return lb.tenants.ready(ctx)
+	}
+	healthy := lb.healthyCount(ctx)
+	if !lb.gateOpen.Load() {
+		if healthy < lb.startupGate {
+			return fmt.Errorf("waiting for %d healthy backends, have %d", lb.startupGate, healthy)
+		}
+		lb.gateOpen.Store(true)
+	}
+	if healthy == 0 {
+		return errors.New("no healthy backends")
+	}
+	return nil
+}
+
+// readinessServers are the backends readiness counts: the regular ones, or the pool members of
+// a balancer that only routes to pools
+func (lb *LoadBalancer) readinessServers() []Server {
+	if servers := lb.Servers(); len(servers) > 0 {
+		return servers
+	}
+	return lb.poolServers()
+}
+
+// healthyCount probes every backend concurrently and returns how many are alive.
+// Followers in active-passive mode don't probe, and neither does a balancer with background
+// health checks; they count the last observed states.
+func (lb *LoadBalancer) healthyCount(ctx context.Context) int {
+	if !lb.IsLeader() || lb.healthChecks != nil {
+		return lb.observedHealthy()
+	}
+	ctx, cancel := context.WithTimeout(ctx, readinessProbeTimeout)
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		healthy int
+	)
+	for _, server := range lb.readinessServers() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			alive := lb.healthCheck(ctx, server)
+			if ctx.Err() == nil {
+				lb.observeHealth(server, alive)
+			}
+			if alive {
+				mu.Lock()
+				healthy++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return healthy
+}
+
+// observedHealthy counts the pool members whose last observed state was alive
+func (lb *LoadBalancer) observedHealthy() int {
+	return lb.observedAlive(lb.readinessServers())
+}
+
+// observedAlive counts the servers last seen alive
+func (lb *LoadBalancer) observedAlive(servers []Server) int {
+	lb.stateMu.Lock()
+	defer lb.stateMu.Unlock()
+	healthy := 0
+	for _, server := range servers {
+		if lb.lastAlive[server.Address()] {
+			healthy++
+		}
+	}
+	return healthy
+}
@@ -0,0 +1,174 @@
+package loadbalancer_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/loadbalancer"
+)
+
+// gateCase is an admin call made with token, and whether it must be refused
+type gateCase struct {
+	method, path, body string
+	token              string
+	forbidden          bool
+}
+
+// testGates builds a balancer with the admin token "admin" and opts, and makes each call
+func testGates(t *testing.T, tests []gateCase, opts ...loadbalancer.Option) {
+	t.Helper()
+	lb, err := loadbalancer.New(append([]loadbalancer.Option{
+		loadbalancer.WithBackends("http://127.0.0.1:1"),
+		loadbalancer.WithAdminToken("admin"),
+	}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := lb.AdminHandler()
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path+" "+tt.token, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			admin.ServeHTTP(rec, req)
+			if got := rec.Code == http.StatusForbidden; got != tt.forbidden {
+				t.Errorf("status %d, forbidden = %v, want %v", rec.Code, got, tt.forbidden)
+			}
+		})
+	}
+}
+
+func TestDarkLaunchGateToken(t *testing.T) {
+	testGates(t, []gateCase{
+		{"PUT", "/dark-launch", `{"value":"x"}`, "", true},
+		{"PUT", "/dark-launch", `{"value":"x"}`, "wrong", true},
+		{"PUT", "/dark-launch", `{"value":"x"}`, "dark", false},
+		{"PUT", "/dark-launch", `{"value":"x"}`, "admin", false},
+	}, loadbalancer.WithDarkLaunch(loadbalancer.DarkLaunch{Header: "X-Dark", Backends: []string{"http://127.0.0.1:2"}, Token: "dark"}))
+}
+
+func TestCanaryRampToken(t *testing.T) {
+	testGates(t, []gateCase{
+		{"POST", "/canary/ramp", "", "", true},
+		{"POST", "/canary/ramp", "", "dark", true},
+		{"DELETE", "/canary/ramp", "", "", true},
+		{"DELETE", "/canary/ramp", "", "canary", false},
+		{"DELETE", "/canary/ramp", "", "admin", false},
+	}, loadbalancer.WithCanary(loadbalancer.Canary{Backends: []string{"http://127.0.0.1:3"}, Token: "canary"}))
+}
+
+func TestCancelRequestToken(t *testing.T) {
+	testGates(t, []gateCase{
+		{"DELETE", "/requests/1", "", "", true},
+		{"DELETE", "/requests/1", "", "wrong", true},
+		{"DELETE", "/requests/1", "", "admin", false},
+	}, loadbalancer.WithRequestCancellation())
+}
+
+func TestReloadToken(t *testing.T) {
+	reload := loadbalancer.WithReload(func(context.Context) error { return nil })
+	testGates(t, []gateCase{
+		{"POST", "/reload", "", "", true},
+		{"POST", "/reload", "", "wrong", true},
+		{"POST", "/reload", "", "admin", false},
+	}, reload)
+
+	// without an admin token no token opens the gate
+	lb, err := loadbalancer.New(loadbalancer.WithBackends("http://127.0.0.1:1"), reload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"", "anything"} {
+		req := httptest.NewRequest("POST", "/reload", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		lb.AdminHandler().ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("token %q without an admin token: status %d, want 403", token, rec.Code)
+		}
+	}
+}
+
+func TestLiftBanToken(t *testing.T) {
+	testGates(t, []gateCase{
+		{"DELETE", "/bans?client=192.0.2.1", "", "", true},
+		{"DELETE", "/bans?client=192.0.2.1", "", "wrong", true},
+		{"DELETE", "/bans?client=192.0.2.1", "", "admin", false},
+	}, loadbalancer.WithAbuseDetection(loadbalancer.AbusePolicy{}))
+}
+
+func TestAffinityToken(t *testing.T) {
+	testGates(t, []gateCase{
+		{"GET", "/affinity?key=k", "", "", true},
+		{"GET", "/affinity?key=k", "", "wrong", true},
+		{"GET", "/affinity?key=k", "", "admin", false},
+		{"DELETE", "/affinity", "", "", true},
+		{"DELETE", "/affinity", "", "admin", false},
+	}, loadbalancer.WithAffinity(loadbalancer.Affinity{}))
+}
+
+func TestStateDumpToken(t *testing.T) {
+	testGates(t, []gateCase{
+		{"GET", "/debug/state", "", "", true},
+		{"GET", "/debug/state", "", "wrong", true},
+		{"GET", "/debug/state", "", "admin", false},
+	})
+}
+
+func TestBackendAPIToken(t *testing.T) {
+	testGates(t, []gateCase{
+		{"POST", "/backends", `{"url":"http://127.0.0.1:4"}`, "", true},
+		{"POST", "/backends", `{"url":"http://127.0.0.1:4"}`, "wrong", true},
+		{"POST", "/backends", `{"url":"http://127.0.0.1:4"}`, "backends", false},
+		{"PATCH", "/backends/127.0.0.1:4", `{"note":"x"}`, "", true},
+		{"PATCH", "/backends/127.0.0.1:4", `{"note":"x"}`, "admin", false},
+		{"DELETE", "/backends/127.0.0.1:4", "", "", true},
+		{"DELETE", "/backends/127.0.0.1:4", "", "admin", false},
+	}, loadbalancer.WithBackendAPI(loadbalancer.BackendAPI{Token: "backends"}))
+}
+
+func TestDrainToken(t *testing.T) {
+	testGates(t, []gateCase{
+		{"POST", "/drains/127.0.0.1:1", "", "", true},
+		{"POST", "/drains/127.0.0.1:1", "", "wrong", true},
+		{"POST", "/drains/127.0.0.1:1", "", "backends", false},
+		{"DELETE", "/drains/127.0.0.1:1", "", "", true},
+		{"DELETE", "/drains/127.0.0.1:1", "", "admin", false},
+	}, loadbalancer.WithBackendAPI(loadbalancer.BackendAPI{Token: "backends"}))
+}
+
+func TestCapacityToken(t *testing.T) {
+	report := `{"backend":"http://127.0.0.1:1","capacity":40}`
+	testGates(t, []gateCase{
+		{"POST", "/capacity", report, "", true},
+		{"POST", "/capacity", report, "wrong", true},
+		{"POST", "/capacity", report, "capacity", false},
+		{"POST", "/capacity", report, "admin", false},
+	}, loadbalancer.WithCapacityReports(loadbalancer.CapacityReports{Token: "capacity"}))
+}
+
+func TestSnapshotToken(t *testing.T) {
+	var tests []gateCase
+	for _, call := range []struct{ method, path string }{
+		{"GET", "/snapshots"},
+		{"GET", "/snapshots/1"},
+		{"GET", "/snapshots/1/diff"},
+		{"POST", "/snapshots"},
+		{"POST", "/snapshots/1/restore"},
+	} {
+		tests = append(tests,
+			gateCase{call.method, call.path, "", "", true},
+			gateCase{call.method, call.path, "", "wrong", true},
+			gateCase{call.method, call.path, "", "snapshots", false},
+			gateCase{call.method, call.path, "", "admin", false},
+		)
+	}
+	testGates(t, tests, loadbalancer.WithConfigSnapshots(loadbalancer.ConfigSnapshots{Dir: t.TempDir(), Token: "snapshots"}))
+}
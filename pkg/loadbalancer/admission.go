@@ -0,0 +1,156 @@
+package loadbalancer
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/metrics"
+)
+
+// retryTokenHeader carries admission tokens, out to clients that were turned away and back in on their retry
+const retryTokenHeader = "X-LB-Retry-Token"
+
+// Admission turns requests away once too many are in flight, so an overload ends with quick
+// 503s instead of every request timing out.
+//
+// Every 429 or 503 sent to a client, the balancer's own or a backend's, carries a short-lived
+// token in X-LB-Retry-Token. A client that sends the token back with its retry may use the
+// Reserve slots above MaxInFlight, so clients that already waited are served first as the
+// overload clears rather than competing with every new arrival.
+type Admission struct {
+	// MaxInFlight is how many requests may be in flight before new ones are refused
+	MaxInFlight int
+	// Reserve is how many more may be in flight for clients presenting a token; default a tenth
+	// of MaxInFlight, at least 1
+	Reserve int
+	// TokenTTL is how long a token stays valid; default 30s
+	TokenTTL time.Duration
+	// RetryAfter is the delay suggested to refused clients; default 1s
+	RetryAfter time.Duration
+	// Secret signs the tokens; instances sharing it honour each other's tokens. Random when empty.
+	Secret string
+}
+
+// WithAdmission limits the requests in flight and hands out retry tokens as configured
+func WithAdmission(a Admission) Option {
+	return func(lb *LoadBalancer) {
+		if a.Reserve <= 0 {
+			a.Reserve = max(a.MaxInFlight/10, 1)
+		}
+		if a.TokenTTL <= 0 {
+			a.TokenTTL = 30 * time.Second
+		}
+		if a.RetryAfter <= 0 {
+			a.RetryAfter = time.Second
+		}
+		if a.Secret == "" {
+			secret := make([]byte, 32)
+			rand.Read(secret)
+			a.Secret = string(secret)
+		}
+		lb.admission = &a
+	}
+}
+
+type admission struct {
+	cfg      Admission
+	prio     *Priorities
+	inFlight atomic.Int64
+	refused  *metrics.Counter
+	lb       *LoadBalancer
+}
+
+// token signs key's right to priority admission until expires
+func (a *admission) token(key string, expires time.Time) string {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(expires.Unix()))
+	return base64.RawURLEncoding.EncodeToString(buf[:]) + "." + base64.RawURLEncoding.EncodeToString(a.mac(key, buf[:]))
+}
+
+func (a *admission) mac(key string, expires []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(a.cfg.Secret))
+	mac.Write([]byte(key))
+	mac.Write(expires)
+	return mac.Sum(nil)[:16]
+}
+
+// valid reports whether token was issued to key and has not expired. Tokens are bound to the
+// client so one can't be passed around to jump the queue.
+func (a *admission) valid(token, key string, now time.Time) bool {
+	expiresPart, macPart, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	expires, err := base64.RawURLEncoding.DecodeString(expiresPart)
+	if err != nil || len(expires) != 8 {
+		return false
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(macPart)
+	if err != nil || !hmac.Equal(sum, a.mac(key, expires)) {
+		return false
+	}
+	return now.Unix() <= int64(binary.BigEndian.Uint64(expires))
+}
+
+func (a *admission) issue(h http.Header, key string) {
+	if h.Get(retryTokenHeader) == "" {
+		h.Set(retryTokenHeader, a.token(key, time.Now().Add(a.cfg.TokenTTL)))
+	}
+}
+
+func (a *admission) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		key := a.lb.clientID(req)
+		prio := stateFrom(req.Context()).priority
+		limit := a.prio.limit(int64(a.cfg.MaxInFlight), prio)
+		reserved := a.prio != nil && prio == PriorityHigh
+		if token := req.Header.Get(retryTokenHeader); token != "" {
+			if a.valid(token, key, time.Now()) {
+				reserved = true
+			}
+			// the token is for us, not the backend
+			req.Header.Del(retryTokenHeader)
+		}
+		if reserved {
+			limit += int64(a.cfg.Reserve)
+		}
+		if a.inFlight.Add(1) > limit {
+			a.inFlight.Add(-1)
+			a.refused.Inc()
+			rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(a.cfg.RetryAfter.Seconds()))))
+			a.issue(rw.Header(), key)
+			http.Error(rw, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		defer a.inFlight.Add(-1)
+		next.ServeHTTP(&admissionWriter{ResponseWriter: rw, a: a, key: key}, req)
+	})
+}
+
+// admissionWriter adds a retry token to 429 and 503 responses from further down the chain
+type admissionWriter struct {
+	http.ResponseWriter
+	a   *admission
+	key string
+}
+
+func (w *admissionWriter) WriteHeader(code int) {
+	if code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable {
+		w.a.issue(w.Header(), w.key)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *admissionWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
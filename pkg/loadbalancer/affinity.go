@@ -0,0 +1,365 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"math"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/metrics"
+)
+
+// Affinity keeps a client on the backend it first reached, for backends holding session state.
+// The backend is remembered in a cookie; clients that don't return it can be kept in place by
+// a hash of their address instead. When the remembered backend is down or has left the pool,
+// the strategy picks another and the cookie moves with the client.
+type Affinity struct {
+	// Cookie names the cookie; default "lb_affinity"
+	Cookie string
+	// TTL is how long the cookie lasts; zero keeps it for the browser session
+	TTL time.Duration
+	// IPHash places clients without the cookie by a hash of their address (their /64 for IPv6)
+	// rather than leaving them to the strategy
+	IPHash bool
+	// SessionIdle is how long a client counts as a session on its backend after its last
+	// request, for DrainStatuses and the affinity metrics; default 10m
+	SessionIdle time.Duration
+}
+
+// WithAffinity enables sticky sessions as configured
+func WithAffinity(a Affinity) Option {
+	return func(lb *LoadBalancer) {
+		if a.Cookie == "" {
+			a.Cookie = "lb_affinity"
+		}
+		if a.SessionIdle <= 0 {
+			a.SessionIdle = 10 * time.Minute
+		}
+		lb.affinity = &a
+	}
+}
+
+// affinityID is what the cookie holds for a backend, so the cookie doesn't reveal addresses
+func affinityID(addr string) string {
+	sum := sha256.Sum256([]byte(addr))
+	return hex.EncodeToString(sum[:8])
+}
+
+// pin chooses the backend the request should stick to, if any, and takes the cookie out of
+// the request so it isn't passed on to the backend
+func (a *Affinity) pin(req *http.Request, st *requestState, client string, servers []Server) string {
+	if c, err := req.Cookie(a.Cookie); err == nil {
+		removeCookie(req, a.Cookie)
+		st.affinity = c.Value
+		for _, s := range servers {
+			if affinityID(s.Address()) == c.Value {
+				return s.Address()
+			}
+		}
+	}
+	if a.IPHash {
+		return hashPick(client, servers)
+	}
+	return ""
+}
+
+// stick points the client's cookie at server unless it already does
+func (a *Affinity) stick(rw http.ResponseWriter, req *http.Request, st *requestState, server Server) {
+	id := affinityID(server.Address())
+	if st.affinity == id {
+		return
+	}
+	// a retry replaces the cookie set for the backend that failed
+	cookies := rw.Header()["Set-Cookie"]
+	prefix := a.Cookie + "="
+	rw.Header()["Set-Cookie"] = cookies[:0]
+	for _, c := range cookies {
+		if !strings.HasPrefix(c, prefix) {
+			rw.Header().Add("Set-Cookie", c)
+		}
+	}
+	cookie := &http.Cookie{
+		Name:     a.Cookie,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if a.TTL > 0 {
+		cookie.MaxAge = int(a.TTL.Seconds())
+	}
+	http.SetCookie(rw, cookie)
+}
+
+// removeCookie deletes the named cookie from req's Cookie header
+func removeCookie(req *http.Request, name string) {
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != name {
+			req.AddCookie(c)
+		}
+	}
+}
+
+// hashPick returns the address of the server that key maps to by rendezvous hashing, so a
+// change to the pool only moves the clients of the servers that came or went
+func hashPick(key string, servers []Server) string {
+	var best string
+	var bestScore float64
+	for _, s := range servers {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(s.Address()))
+		// weighted rendezvous: heavier servers win proportionally more keys
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		score := -float64(max(WeightOf(s), 1)) / math.Log(u)
+		if best == "" || score > bestScore {
+			best, bestScore = s.Address(), score
+		}
+	}
+	return best
+}
+
+// stickySessions remembers which clients are pinned to which backend and when they were last
+// seen, so a draining backend can tell how many sessions it still holds. A nil stickySessions
+// tracks nothing.
+type stickySessions struct {
+	idle time.Duration
+
+	mu      sync.Mutex
+	clients map[string]map[string]time.Time
+	// reset holds the clients to place afresh on their next request, whatever their cookie says
+	reset map[string]time.Time
+	swept time.Time
+
+	hits, misses, migrations *metrics.Counter
+}
+
+func newStickySessions(idle time.Duration) *stickySessions {
+	return &stickySessions{
+		idle:       idle,
+		clients:    make(map[string]map[string]time.Time),
+		reset:      make(map[string]time.Time),
+		hits:       metrics.NewCounter(),
+		misses:     metrics.NewCounter(),
+		migrations: metrics.NewCounter(),
+	}
+}
+
+// pinned counts a request that found the backend it sticks to, or didn't
+func (s *stickySessions) pinned(hit bool) {
+	if s == nil {
+		return
+	}
+	if hit {
+		s.hits.Inc()
+	} else {
+		s.misses.Inc()
+	}
+}
+
+// note records that client was served by addr; a client whose cookie named another backend has
+// moved off that one
+func (s *stickySessions) note(client, addr, previous string, now time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if previous != "" && previous != affinityID(addr) {
+		s.migrations.Inc()
+		for other, clients := range s.clients {
+			if affinityID(other) == previous {
+				delete(clients, client)
+			}
+		}
+	}
+	clients := s.clients[addr]
+	if clients == nil {
+		clients = make(map[string]time.Time)
+		s.clients[addr] = clients
+	}
+	clients[client] = now
+	if now.Sub(s.swept) > s.idle/2 {
+		s.swept = now
+		for addr, clients := range s.clients {
+			maps.DeleteFunc(clients, func(_ string, seen time.Time) bool { return now.Sub(seen) > s.idle })
+			if len(clients) == 0 {
+				delete(s.clients, addr)
+			}
+		}
+		// a client that hasn't been back since its reset has most likely lost its cookie
+		maps.DeleteFunc(s.reset, func(_ string, at time.Time) bool { return now.Sub(at) > s.idle })
+	}
+}
+
+// count returns how many clients addr served within the idle time
+func (s *stickySessions) count(addr string, now time.Time) int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, seen := range s.clients[addr] {
+		if now.Sub(seen) <= s.idle {
+			n++
+		}
+	}
+	return n
+}
+
+// forget drops the sessions of a backend that left the pool
+func (s *stickySessions) forget(addr string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	delete(s.clients, addr)
+	s.mu.Unlock()
+}
+
+// affinitySession is a backend a client was pinned to within the session idle time
+type affinitySession struct {
+	Backend  string    `json:"backend"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// lookup returns the backends client was served by within the idle time, most recent first
+func (s *stickySessions) lookup(client string, now time.Time) []affinitySession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sessions []affinitySession
+	for addr, clients := range s.clients {
+		if seen, ok := clients[client]; ok && now.Sub(seen) <= s.idle {
+			sessions = append(sessions, affinitySession{Backend: addr, LastSeen: seen})
+		}
+	}
+	slices.SortFunc(sessions, func(a, b affinitySession) int { return b.LastSeen.Compare(a.LastSeen) })
+	return sessions
+}
+
+// release forgets client's sessions and has its next request placed afresh
+func (s *stickySessions) release(client string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, clients := range s.clients {
+		delete(clients, client)
+	}
+	s.reset[client] = now
+}
+
+// released reports whether client's next request is to ignore its pin, clearing the mark
+func (s *stickySessions) released(client string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.reset[client]
+	delete(s.reset, client)
+	return ok
+}
+
+// sizes returns how many sessions each backend holds
+func (s *stickySessions) sizes(now time.Time) map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sizes := make(map[string]int, len(s.clients))
+	for addr, clients := range s.clients {
+		for _, seen := range clients {
+			if now.Sub(seen) <= s.idle {
+				sizes[addr]++
+			}
+		}
+	}
+	return sizes
+}
+
+// writeMetrics writes the size of the session table and how often requests stuck or moved
+func (s *stickySessions) writeMetrics(w *bufio.Writer) {
+	sizes := s.sizes(time.Now())
+	writeMetricHeader(w, "lb_affinity_sessions", "gauge", "Sticky clients seen within the session idle time, by backend.")
+	for _, addr := range slices.Sorted(maps.Keys(sizes)) {
+		fmt.Fprintf(w, "lb_affinity_sessions{backend=%s} %d\n", labelValue(addr), sizes[addr])
+	}
+	writeMetricHeader(w, "lb_affinity_hits_total", "counter", "Requests whose cookie or address hash named a backend in the pool.")
+	fmt.Fprintf(w, "lb_affinity_hits_total %d\n", s.hits.Value())
+	writeMetricHeader(w, "lb_affinity_misses_total", "counter", "Requests left to the strategy, having no usable cookie or hash.")
+	fmt.Fprintf(w, "lb_affinity_misses_total %d\n", s.misses.Value())
+	writeMetricHeader(w, "lb_affinity_migrations_total", "counter", "Requests served by a backend other than the one their cookie named.")
+	fmt.Fprintf(w, "lb_affinity_migrations_total %d\n", s.migrations.Value())
+}
+
+// affinityLookup is the answer to GET /affinity
+type affinityLookup struct {
+	Client   string            `json:"client"`
+	Sessions []affinitySession `json:"sessions"`
+	// HashBackend is where the address hash places the client when it has no cookie
+	HashBackend string `json:"hash_backend,omitempty"`
+	// Reset is set while the client's next request is to be placed afresh
+	Reset bool `json:"reset,omitempty"`
+}
+
+// affinityClient turns the client query parameter into a session key: an address becomes the
+// key it is tracked under, anything else is taken as a client identity
+func affinityClient(req *http.Request) string {
+	client := req.URL.Query().Get("client")
+	if _, err := netip.ParseAddr(client); err == nil {
+		return clientKey(client)
+	}
+	return client
+}
+
+// serveAffinity handles GET /affinity?client=..., showing where a client is pinned. Like the
+// reset, it is only for callers presenting the admin token.
+func (lb *LoadBalancer) serveAffinity(rw http.ResponseWriter, req *http.Request) {
+	if !lb.authorized(rw, req) {
+		return
+	}
+	client := affinityClient(req)
+	if client == "" {
+		http.Error(rw, "missing client", http.StatusBadRequest)
+		return
+	}
+	s := lb.sessions
+	out := affinityLookup{Client: client, Sessions: s.lookup(client, time.Now())}
+	if out.Sessions == nil {
+		out.Sessions = []affinitySession{}
+	}
+	if lb.affinity.IPHash {
+		out.HashBackend = hashPick(client, lb.Servers())
+	}
+	s.mu.Lock()
+	_, out.Reset = s.reset[client]
+	s.mu.Unlock()
+	writeJSON(rw, out)
+}
+
+// serveResetAffinity handles DELETE /affinity?client=..., forgetting where the client is
+// pinned so its next request goes wherever the strategy picks and its cookie follows
+func (lb *LoadBalancer) serveResetAffinity(rw http.ResponseWriter, req *http.Request) {
+	if !lb.authorized(rw, req) {
+		return
+	}
+	client := affinityClient(req)
+	if client == "" {
+		http.Error(rw, "missing client", http.StatusBadRequest)
+		return
+	}
+	lb.sessions.release(client, time.Now())
+	lb.logger.Info("affinity reset", "client", client)
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,58 @@
+package loadbalancer
+
+import (
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// AutoCert obtains and renews certificates from Let's Encrypt, or another ACME CA, for the
+// listed hosts. Challenges are answered over TLS on the balancer's port, or over HTTP on the
+// WithHTTPRedirect port when there is one; either must be reachable from the internet on 443 or 80.
+type AutoCert struct {
+	// Hosts are the names certificates may be requested for; other names are refused, so
+	// clients can't make the balancer request certificates for arbitrary hosts
+	Hosts []string
+	// CacheDir keeps certificates and the account key across restarts; default "autocert"
+	CacheDir string
+	// Email is given to the CA for expiry and problem notices
+	Email string
+	// DirectoryURL is the CA's ACME directory; default Let's Encrypt production
+	DirectoryURL string
+	// DNS answers DNS-01 challenges by publishing TXT records through the zone's DNS API, so
+	// the balancer needn't be reachable from the CA and Hosts may include wildcards such as
+	// "*.example.com". The hosts then share one certificate, obtained in the background once
+	// the balancer starts and renewed 30 days before it expires.
+	DNS DNSProvider
+	// DNSPropagation bounds the wait for a challenge record to show up in DNS before the CA
+	// is asked to look for it; default 2m
+	DNSPropagation time.Duration
+}
+
+// WithAutoCert terminates TLS with certificates obtained automatically as configured.
+// Using it means accepting the CA's terms of service.
+func WithAutoCert(a AutoCert) Option {
+	return func(lb *LoadBalancer) {
+		if a.CacheDir == "" {
+			a.CacheDir = "autocert"
+		}
+		if a.DNS != nil {
+			if a.DNSPropagation <= 0 {
+				a.DNSPropagation = 2 * time.Minute
+			}
+			lb.dnsCert = &dnsCert{AutoCert: a}
+			return
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(a.Hosts...),
+			Cache:      autocert.DirCache(a.CacheDir),
+			Email:      a.Email,
+		}
+		if a.DirectoryURL != "" {
+			m.Client = &acme.Client{DirectoryURL: a.DirectoryURL}
+		}
+		lb.autocert = m
+	}
+}
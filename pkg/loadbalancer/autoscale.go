@@ -0,0 +1,190 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Autoscaling publishes the signals an autoscaler sizes the backend fleet by, at GET /autoscale
+// on the admin port and as lb_autoscale_* metrics: the request rate and mean latency over
+// Window, the requests in flight and those still waiting for a backend, the healthy backend
+// count and the fleet's utilization.
+//
+// Utilization is the mean concurrency over Window, the rate times the mean latency, divided by
+// what the healthy backends are meant to carry: their WithBackendConcurrency or
+// WithMaxConcurrency cap, or TargetInFlight for those without one. The recommended backend
+// count brings utilization to TargetUtilization.
+type Autoscaling struct {
+	// Window is the period the rate, latency and utilization are averaged over; default 1m
+	Window time.Duration
+	// TargetInFlight is how many requests in flight a backend without a concurrency cap is
+	// sized for; without it and without caps, utilization isn't reported
+	TargetInFlight int
+	// TargetUtilization is the utilization the recommended backend count aims at; default 0.7
+	TargetUtilization float64
+}
+
+// WithAutoscaling publishes autoscaling signals
+func WithAutoscaling(a Autoscaling) Option {
+	return func(lb *LoadBalancer) {
+		if a.Window <= 0 {
+			a.Window = time.Minute
+		}
+		if a.TargetUtilization <= 0 || a.TargetUtilization > 1 {
+			a.TargetUtilization = 0.7
+		}
+		lb.autoscale = newAutoscaler(a)
+	}
+}
+
+// autoscaleSlot counts the requests that finished within one second
+type autoscaleSlot struct {
+	second   int64
+	requests uint64
+	latency  time.Duration
+}
+
+type autoscaler struct {
+	cfg Autoscaling
+	// inFlight counts the requests in the balancer, waiting for a backend or on one
+	inFlight atomic.Int64
+
+	mu    sync.Mutex
+	slots []autoscaleSlot
+}
+
+func newAutoscaler(cfg Autoscaling) *autoscaler {
+	return &autoscaler{cfg: cfg, slots: make([]autoscaleSlot, int(math.Ceil(cfg.Window.Seconds())))}
+}
+
+// record counts a finished request
+func (a *autoscaler) record(elapsed time.Duration) {
+	sec := time.Now().Unix()
+	a.mu.Lock()
+	slot := &a.slots[sec%int64(len(a.slots))]
+	if slot.second != sec {
+		*slot = autoscaleSlot{second: sec}
+	}
+	slot.requests++
+	slot.latency += elapsed
+	a.mu.Unlock()
+}
+
+// window sums the requests finished and their latency over the window
+func (a *autoscaler) window(now time.Time) (uint64, time.Duration) {
+	oldest := now.Unix() - int64(len(a.slots))
+	var requests uint64
+	var latency time.Duration
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, slot := range a.slots {
+		if slot.second > oldest {
+			requests += slot.requests
+			latency += slot.latency
+		}
+	}
+	return requests, latency
+}
+
+// AutoscaleSignals are the balancer-side signals for scaling the backend fleet, see Autoscaling
+type AutoscaleSignals struct {
+	// Window is the period RPS, MeanLatency and Utilization are averaged over, in seconds
+	Window float64 `json:"window_seconds"`
+	RPS    float64 `json:"rps"`
+	// MeanLatency is the mean time requests spent in the balancer, in seconds
+	MeanLatency float64 `json:"mean_latency_seconds"`
+	// InFlight counts the requests in the balancer; Queued those of them not on a backend yet
+	InFlight int64 `json:"in_flight"`
+	Queued   int64 `json:"queued"`
+	Healthy  int   `json:"healthy_backends"`
+	Backends int   `json:"backends"`
+	// Capacity is the requests in flight the healthy backends are sized for, 0 when unknown
+	Capacity int `json:"capacity"`
+	// Utilization is the mean concurrency over Capacity; Recommended is the backend count that
+	// would bring it to the target. Both are absent without a Capacity.
+	Utilization *float64 `json:"utilization,omitempty"`
+	Recommended *int     `json:"recommended_backends,omitempty"`
+}
+
+// AutoscaleSignals returns the current autoscaling signals, or false without WithAutoscaling
+func (lb *LoadBalancer) AutoscaleSignals() (AutoscaleSignals, bool) {
+	a := lb.autoscale
+	if a == nil {
+		return AutoscaleSignals{}, false
+	}
+	requests, latency := a.window(time.Now())
+	out := AutoscaleSignals{
+		Window:   a.cfg.Window.Seconds(),
+		RPS:      float64(requests) / a.cfg.Window.Seconds(),
+		InFlight: a.inFlight.Load(),
+	}
+	if requests > 0 {
+		out.MeanLatency = (latency / time.Duration(requests)).Seconds()
+	}
+
+	servers := lb.readinessServers()
+	out.Backends = len(servers)
+	var onBackends int64
+	// a healthy backend of unknown size makes the fleet's capacity unknown
+	unsized := false
+	lb.stateMu.Lock()
+	for _, server := range servers {
+		onBackends += ActiveConnectionsOf(server)
+		if !lb.lastAlive[server.Address()] {
+			continue
+		}
+		out.Healthy++
+		limit := lb.concurrencyLimit(server)
+		if limit <= 0 {
+			limit = a.cfg.TargetInFlight
+		}
+		unsized = unsized || limit <= 0
+		out.Capacity += limit
+	}
+	lb.stateMu.Unlock()
+	out.Queued = max(out.InFlight-onBackends, 0)
+	if unsized {
+		out.Capacity = 0
+	}
+	if out.Capacity > 0 {
+		// Little's law: the mean number in flight is the rate times the mean time spent
+		utilization := out.RPS * out.MeanLatency / float64(out.Capacity)
+		recommended := int(math.Ceil(utilization * float64(out.Healthy) / a.cfg.TargetUtilization))
+		out.Utilization, out.Recommended = &utilization, &recommended
+	}
+	return out, true
+}
+
+// serveAutoscale answers GET /autoscale with the autoscaling signals
+func (lb *LoadBalancer) serveAutoscale(rw http.ResponseWriter, _ *http.Request) {
+	signals, _ := lb.AutoscaleSignals()
+	writeJSON(rw, signals)
+}
+
+// writeAutoscaleMetrics writes the autoscaling signals as gauges
+func (lb *LoadBalancer) writeAutoscaleMetrics(w *bufio.Writer) {
+	s, ok := lb.AutoscaleSignals()
+	if !ok {
+		return
+	}
+	gauge := func(name, help string, v float64) {
+		writeMetricHeader(w, name, "gauge", help)
+		fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	gauge("lb_autoscale_rps", "Requests per second over the autoscaling window.", s.RPS)
+	gauge("lb_autoscale_mean_latency_seconds", "Mean time requests spent in the balancer over the autoscaling window.", s.MeanLatency)
+	gauge("lb_autoscale_in_flight", "Requests in the balancer.", float64(s.InFlight))
+	gauge("lb_autoscale_queued", "Requests in the balancer not on a backend yet.", float64(s.Queued))
+	gauge("lb_autoscale_healthy_backends", "Healthy backends.", float64(s.Healthy))
+	gauge("lb_autoscale_capacity", "Requests in flight the healthy backends are sized for; 0 when unknown.", float64(s.Capacity))
+	if s.Utilization != nil {
+		gauge("lb_autoscale_utilization", "Mean concurrency over the autoscaling window divided by the capacity.", *s.Utilization)
+		gauge("lb_autoscale_recommended_backends", "Backends that would bring utilization to the target.", float64(*s.Recommended))
+	}
+}
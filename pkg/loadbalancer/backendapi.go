@@ -0,0 +1,294 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// BackendAPI configures the admin endpoints that change the pool at runtime: POST /backends
+// with a NewBackend body, PATCH /backends/{address} with a BackendUpdate body, and
+// DELETE /backends/{address}. DELETE with ?drain=30s first stops new requests to the backend and
+// waits up to that long for those in flight to finish.
+type BackendAPI struct {
+	// Token is a bearer token the endpoints accept besides the WithAdminToken one; without
+	// either, every call is refused
+	Token string
+	// MinHealthy, when set, is the percentage of the healthy capacity (the weight of the healthy
+	// backends taking traffic) a DELETE must leave; removing more answers 409 unless the request
+	// has ?force=true. Any value above 0 refuses to remove the last healthy backend.
+	MinHealthy float64
+}
+
+// NewBackend is the body of POST /backends on the admin port
+type NewBackend struct {
+	URL string `json:"url"`
+	// Weight is the backend's relative weight; default 1
+	Weight int `json:"weight,omitempty"`
+	// HealthPath is probed instead of the backend URL itself
+	HealthPath string            `json:"health_path,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Note       string            `json:"note,omitempty"`
+}
+
+// BackendUpdate is the body of PATCH /backends/{address}; fields left out keep their value
+type BackendUpdate struct {
+	// Labels replaces the backend's labels; an empty object clears them
+	Labels *map[string]string `json:"labels"`
+	// Note replaces the backend's note; "" clears it
+	Note *string `json:"note"`
+}
+
+// WithBackendAPI enables POST, PATCH and DELETE of /backends on the admin handler
+func WithBackendAPI(cfg BackendAPI) Option {
+	return func(lb *LoadBalancer) {
+		lb.backendAPI = &cfg
+	}
+}
+
+// AddBackend builds a SimpleServer for addr with the balancer's server options followed by opts
+// and adds it to the pool, warming it up first when warm-up is configured. It fails with
+// ErrDuplicateBackend when the address is already a pool member. Backends added at runtime
+// are kept by Refresh like static ones.
+func (lb *LoadBalancer) AddBackend(addr string, opts ...ServerOption) (Server, error) {
+	server, err := newSimpleServer(addr, lb.transport, append(lb.serverOptions(), opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	key := canonicalAddr(addr)
+	lb.mu.Lock()
+	for _, s := range lb.serverList {
+		if canonicalAddr(s.Address()) == key {
+			lb.mu.Unlock()
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateBackend, s.Address())
+		}
+	}
+	// a new slice, so snapshots taken by in-flight requests stay as they were
+	lb.serverList = append(slices.Clip(lb.serverList), server)
+	lb.mu.Unlock()
+	lb.logger.Info("backend added", "server", addr)
+	lb.warmUp(server)
+	lb.prewarmAdded(server)
+	return server, nil
+}
+
+// RemoveBackend takes the backend at addr out of the pool and forgets its health, pauses and
+// counters. Requests already being proxied to it finish normally. A backend that a discoverer
+// still reports comes back on the next Refresh. It fails with ErrUnknownBackend when no pool
+// member has the address.
+func (lb *LoadBalancer) RemoveBackend(addr string) error {
+	key := canonicalAddr(addr)
+	lb.mu.Lock()
+	i := slices.IndexFunc(lb.serverList, func(s Server) bool { return canonicalAddr(s.Address()) == key })
+	if i < 0 {
+		lb.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrUnknownBackend, addr)
+	}
+	removed := lb.serverList[i].Address()
+	lb.serverList = slices.Delete(slices.Clone(lb.serverList), i, i+1)
+	delete(lb.discovered, key)
+	lb.mu.Unlock()
+
+	lb.stateMu.Lock()
+	delete(lb.lastAlive, removed)
+	delete(lb.backoff, removed)
+	if c, ok := lb.capacity[removed]; ok {
+		c.timer.Stop()
+		delete(lb.capacity, removed)
+	}
+	delete(lb.warming, removed)
+	delete(lb.draining, removed)
+	lb.stateMu.Unlock()
+	lb.backendMu.Lock()
+	delete(lb.backendStats, removed)
+	lb.backendMu.Unlock()
+	lb.sessions.forget(removed)
+	lb.logger.Info("backend removed", "server", removed)
+	return nil
+}
+
+// serveAddBackend adds the backend described by the request body
+func (lb *LoadBalancer) serveAddBackend(rw http.ResponseWriter, req *http.Request) {
+	if !lb.authorized(rw, req, lb.backendAPI.Token) {
+		return
+	}
+	var b NewBackend
+	if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, 16<<10)).Decode(&b); err != nil {
+		http.Error(rw, "invalid backend: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var opts []ServerOption
+	if b.Weight != 0 {
+		opts = append(opts, WithWeight(b.Weight))
+	}
+	if b.HealthPath != "" {
+		opts = append(opts, WithHealthPath(b.HealthPath))
+	}
+	if b.Labels != nil {
+		opts = append(opts, WithLabels(b.Labels))
+	}
+	if b.Note != "" {
+		opts = append(opts, WithNote(b.Note))
+	}
+	server, err := lb.AddBackend(b.URL, opts...)
+	switch {
+	case errors.Is(err, ErrDuplicateBackend):
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rw.Header().Set("Location", "/backends/"+url.PathEscape(server.Address()))
+	rw.WriteHeader(http.StatusCreated)
+}
+
+// serveRemoveBackend removes the backend named by the path
+func (lb *LoadBalancer) serveRemoveBackend(rw http.ResponseWriter, req *http.Request) {
+	if !lb.authorized(rw, req, lb.backendAPI.Token) {
+		return
+	}
+	addr, ok := lb.memberAddress(rw, req.PathValue("addr"))
+	if !ok {
+		return
+	}
+	if force, _ := strconv.ParseBool(req.URL.Query().Get("force")); !force {
+		if err := lb.guardCapacity(addr); err != nil {
+			http.Error(rw, err.Error()+"; add ?force=true to remove it anyway", http.StatusConflict)
+			return
+		}
+	} else {
+		lb.logger.Warn("backend removal forced", "server", addr)
+	}
+	if v := req.URL.Query().Get("drain"); v != "" {
+		grace, err := time.ParseDuration(v)
+		if err != nil || grace < 0 {
+			http.Error(rw, "invalid drain duration "+strconv.Quote(v), http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), grace)
+		err = lb.DrainBackend(ctx, addr)
+		cancel()
+		if errors.Is(err, ErrUnknownBackend) {
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			// the grace period is over; what is still running finishes on its own
+			lb.logger.Warn("removing backend before it drained", "server", addr, "error", err)
+		}
+	}
+	if err := lb.RemoveBackend(addr); err != nil {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// serveUpdateBackend changes the labels or note of the backend named by the path
+func (lb *LoadBalancer) serveUpdateBackend(rw http.ResponseWriter, req *http.Request) {
+	if !lb.authorized(rw, req, lb.backendAPI.Token) {
+		return
+	}
+	addr, ok := lb.memberAddress(rw, req.PathValue("addr"))
+	if !ok {
+		return
+	}
+	var u BackendUpdate
+	if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, 16<<10)).Decode(&u); err != nil {
+		http.Error(rw, "invalid update: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := canonicalAddr(addr)
+	servers := lb.Servers()
+	i := slices.IndexFunc(servers, func(s Server) bool { return canonicalAddr(s.Address()) == key })
+	if i < 0 {
+		http.Error(rw, fmt.Sprintf("%v: %s", ErrUnknownBackend, addr), http.StatusNotFound)
+		return
+	}
+	server := servers[i]
+	labeled, canLabel := server.(LabelSetter)
+	annotated, canNote := server.(Annotated)
+	if u.Labels != nil && !canLabel || u.Note != nil && !canNote {
+		http.Error(rw, "backend "+server.Address()+" does not support this change", http.StatusConflict)
+		return
+	}
+	if u.Labels != nil {
+		labeled.SetLabels(*u.Labels)
+	}
+	if u.Note != nil {
+		annotated.SetNote(*u.Note)
+	}
+	lb.logger.Info("backend updated", "server", server.Address(), "labels", LabelsOf(server), "note", NoteOf(server))
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// guardCapacity refuses to take addr out of rotation when that would leave less than
+// MinHealthy percent of the healthy capacity
+func (lb *LoadBalancer) guardCapacity(addr string) error {
+	if lb.backendAPI.MinHealthy <= 0 {
+		return nil
+	}
+	key := canonicalAddr(addr)
+	var total, removed int
+	for _, server := range lb.Servers() {
+		if !lb.takingTraffic(server) {
+			continue
+		}
+		total += WeightOf(server)
+		if canonicalAddr(server.Address()) == key {
+			removed = WeightOf(server)
+		}
+	}
+	if removed == 0 {
+		return nil
+	}
+	left := float64(total-removed) / float64(total) * 100
+	if total == removed || left < lb.backendAPI.MinHealthy {
+		return fmt.Errorf("removing %s would leave %.0f%% of the healthy capacity, under the %.0f%% minimum", addr, left, lb.backendAPI.MinHealthy)
+	}
+	return nil
+}
+
+// takingTraffic reports whether server is healthy, as far as the balancer knows, and not paused
+func (lb *LoadBalancer) takingTraffic(server Server) bool {
+	lb.stateMu.Lock()
+	alive, seen := lb.lastAlive[server.Address()]
+	lb.stateMu.Unlock()
+	return (!seen || alive) && !lb.paused(server.Address())
+}
+
+// memberAddress resolves the path's backend, given as its URL-escaped address or, when that
+// is unambiguous, its host:port. It answers the request itself and returns false when the
+// host:port is ambiguous.
+func (lb *LoadBalancer) memberAddress(rw http.ResponseWriter, addr string) (string, bool) {
+	if hasScheme(addr) {
+		return addr, true
+	}
+	var matches []string
+	for _, s := range lb.Servers() {
+		if u, err := url.Parse(s.Address()); err == nil && u.Host == addr {
+			matches = append(matches, s.Address())
+		}
+	}
+	if len(matches) > 1 {
+		http.Error(rw, "several backends have host "+addr+"; give the full URL", http.StatusConflict)
+		return "", false
+	}
+	if len(matches) == 1 {
+		return matches[0], true
+	}
+	return addr, true
+}
+
+// hasScheme reports whether addr starts with a URL scheme
+func hasScheme(addr string) bool {
+	u, err := url.Parse(addr)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
@@ -0,0 +1,103 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// BackendAuth is a credential the balancer presents to a backend that only takes requests from
+// callers it knows. It goes with every proxied request, replacing whatever the client sent in
+// the same header, and with health checks, warm-up requests and idle probes. Set one of Bearer,
+// Username or Header. A SigV4 request signature replaces an Authorization credential.
+//
+// The values are used as given; ResolveSecret reads them from the environment or a file. To
+// rotate a credential, build the server again with the new one, as a reload does.
+type BackendAuth struct {
+	// Bearer sends Authorization: Bearer <token>
+	Bearer string
+	// Username and Password send HTTP basic authentication
+	Username string
+	Password string
+	// Header and Value send a header of their own, such as X-Api-Key
+	Header string
+	Value  string
+}
+
+// WithBackendAuth presents auth to the backend with every request
+func WithBackendAuth(auth BackendAuth) ServerOption {
+	return func(s *SimpleServer) {
+		s.auth = &auth
+	}
+}
+
+func (a *BackendAuth) validate() error {
+	set := 0
+	for _, v := range []string{a.Bearer, a.Username, a.Header} {
+		if v != "" {
+			set++
+		}
+	}
+	switch {
+	case set != 1:
+		return errors.New("backend auth: set one of a bearer token, a username or a header")
+	case a.Header != "" && a.Value == "":
+		return fmt.Errorf("backend auth: header %s has no value", a.Header)
+	}
+	return nil
+}
+
+// apply sets the credential on req
+func (a *BackendAuth) apply(req *http.Request) {
+	switch {
+	case a.Bearer != "":
+		req.Header.Set("Authorization", "Bearer "+a.Bearer)
+	case a.Username != "":
+		req.SetBasicAuth(a.Username, a.Password)
+	case a.Header != "":
+		req.Header.Set(a.Header, a.Value)
+	}
+}
+
+// useAuth sets the credential on every proxied request
+func (s *SimpleServer) useAuth(auth *BackendAuth) {
+	base := s.proxy.Director
+	s.proxy.Director = func(req *http.Request) {
+		base(req)
+		auth.apply(req)
+	}
+}
+
+// authorize sets the server's credential, if it has one, on a request of the balancer's own
+func (s *SimpleServer) authorize(req *http.Request) {
+	if s.auth != nil {
+		s.auth.apply(req)
+	}
+}
+
+// ResolveSecret returns the secret ref refers to: the variable NAME for env:NAME, the contents
+// of the file for file:/path, without a trailing newline, and ref itself otherwise. Secrets
+// mounted as files, as Kubernetes and Docker do, are read again on every call.
+func ResolveSecret(ref string) (string, error) {
+	if name, ok := strings.CutPrefix(ref, "env:"); ok {
+		v, ok := os.LookupEnv(name)
+		if !ok || v == "" {
+			return "", fmt.Errorf("secret %s: $%s is not set", ref, name)
+		}
+		return v, nil
+	}
+	if path, ok := strings.CutPrefix(ref, "file:"); ok {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %w", ref, err)
+		}
+		v := strings.TrimRight(string(b), "\r\n")
+		if v == "" {
+			return "", fmt.Errorf("secret %s: file is empty", ref)
+		}
+		return v, nil
+	}
+	return ref, nil
+}
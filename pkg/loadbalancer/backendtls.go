@@ -0,0 +1,68 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// BackendTLS controls how the balancer verifies an https backend's certificate
+type BackendTLS struct {
+	// InsecureSkipVerify accepts any certificate, for backends with self-signed ones on a
+	// trusted network. Verification is on by default.
+	InsecureSkipVerify bool
+	// CAFile is a PEM bundle of the CAs trusted for the backend instead of the system roots
+	CAFile string
+	// ServerName is the name the certificate must carry, when it differs from the URL's host
+	ServerName string
+}
+
+// WithBackendTLS sets how the server's certificate is verified. It requires the server's
+// transport to be an *http.Transport.
+func WithBackendTLS(cfg BackendTLS) ServerOption {
+	return func(s *SimpleServer) {
+		s.verify = &cfg
+	}
+}
+
+// WithBackendTLSDefaults applies cfg to every server the balancer builds itself; a backend's
+// own WithBackendTLS replaces it
+func WithBackendTLSDefaults(cfg BackendTLS) Option {
+	return func(lb *LoadBalancer) {
+		lb.backendTLS = &cfg
+	}
+}
+
+// useBackendTLS gives the server's transport a TLS client configuration built from cfg
+func (s *SimpleServer) useBackendTLS(cfg BackendTLS) error {
+	base, ok := s.proxy.Transport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("loadbalancer: backend %s uses a %T, which has no TLS setting", s.addr, s.proxy.Transport)
+	}
+	tlsCfg := &tls.Config{}
+	if base.TLSClientConfig != nil {
+		tlsCfg = base.TLSClientConfig.Clone()
+	}
+	tlsCfg.InsecureSkipVerify = cfg.InsecureSkipVerify
+	if cfg.ServerName != "" {
+		tlsCfg.ServerName = cfg.ServerName
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return fmt.Errorf("loadbalancer: backend %s: %w", s.addr, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("loadbalancer: backend %s: no certificates in %s", s.addr, cfg.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	t := base.Clone()
+	t.TLSClientConfig = tlsCfg
+	s.proxy.Transport = t
+	s.client.Transport = t
+	return nil
+}
@@ -0,0 +1,135 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxBackoff caps the pause a backend can ask for, so a bad Retry-After can't remove it for long
+const maxBackoff = 5 * time.Minute
+
+// noteBackoff pauses traffic to server when it answered 503 with a Retry-After header
+func (lb *LoadBalancer) noteBackoff(server Server, status int, header http.Header) {
+	if server == nil || status != http.StatusServiceUnavailable {
+		return
+	}
+	delay, ok := parseRetryAfter(header.Get("Retry-After"), time.Now())
+	if !ok || delay <= 0 {
+		return
+	}
+	delay = min(delay, maxBackoff)
+	lb.stateMu.Lock()
+	lb.backoff[server.Address()] = time.Now().Add(delay)
+	lb.stateMu.Unlock()
+	lb.logger.Info("backend asked to back off", "server", server.Address(), "for", delay)
+}
+
+// backoffUntil returns when addr may receive traffic again, or the zero time if it may now
+func (lb *LoadBalancer) backoffUntil(addr string) time.Time {
+	lb.stateMu.Lock()
+	defer lb.stateMu.Unlock()
+	until, ok := lb.backoff[addr]
+	if !ok {
+		return time.Time{}
+	}
+	if !time.Now().Before(until) {
+		delete(lb.backoff, addr)
+		return time.Time{}
+	}
+	return until
+}
+
+// paused reports whether addr must not get new requests right now: it asked to back off,
+// reported no capacity, is in a maintenance window or is being drained
+func (lb *LoadBalancer) paused(addr string) bool {
+	return !lb.backoffUntil(addr).IsZero() || lb.noCapacity(addr) || lb.drained(addr) || lb.warmingUp(addr) ||
+		lb.isDraining(addr)
+}
+
+// parseRetryAfter accepts both forms of Retry-After: delay-seconds and an HTTP date
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		return at.Sub(now), true
+	}
+	return 0, false
+}
+
+// backendStatus is one row of GET /backends
+type backendStatus struct {
+	Address string `json:"address"`
+	// Alive is the last observed health; absent until the backend has been checked
+	Alive             *bool             `json:"alive,omitempty"`
+	Weight            int               `json:"weight"`
+	ActiveConnections int64             `json:"active_connections"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	Note              string            `json:"note,omitempty"`
+	BackoffUntil      *time.Time        `json:"backoff_until,omitempty"`
+	// Capacity is the agent-reported score currently standing in for the weight
+	Capacity    *int `json:"capacity,omitempty"`
+	Maintenance bool `json:"maintenance,omitempty"`
+	WarmingUp   bool `json:"warming_up,omitempty"`
+	Draining    bool `json:"draining,omitempty"`
+	// Degraded marks a backend deprioritized for its queue depth
+	Degraded bool `json:"degraded,omitempty"`
+	// Misconfigured explains why the backend fails for a protocol mismatch rather than being down
+	Misconfigured string `json:"misconfigured,omitempty"`
+	// Traffic is present with byte accounting
+	Traffic *ByteCount `json:"traffic,omitempty"`
+	// Requests counts calls to the backend by status class, Errors its failures by kind
+	Requests map[string]uint64            `json:"requests,omitempty"`
+	Errors   map[UpstreamErrorKind]uint64 `json:"errors,omitempty"`
+}
+
+// serveBackends lists the pool with each backend's observed state
+func (lb *LoadBalancer) serveBackends(rw http.ResponseWriter, _ *http.Request) {
+	servers := lb.Servers()
+	out := make([]backendStatus, 0, len(servers))
+	for _, server := range servers {
+		out = append(out, lb.backendStatusOf(server))
+	}
+	writeJSON(rw, out)
+}
+
+// backendStatusOf reports a backend's observed state
+func (lb *LoadBalancer) backendStatusOf(server Server) backendStatus {
+	st := backendStatus{
+		Address:           server.Address(),
+		Weight:            WeightOf(server),
+		ActiveConnections: ActiveConnectionsOf(server),
+		Labels:            LabelsOf(server),
+		Note:              NoteOf(server),
+		Maintenance:       lb.drained(server.Address()),
+		WarmingUp:         lb.warmingUp(server.Address()),
+		Draining:          lb.isDraining(server.Address()),
+		Degraded:          lb.degraded(server),
+		Misconfigured:     MisconfigurationOf(server),
+	}
+	lb.stateMu.Lock()
+	if alive, ok := lb.lastAlive[server.Address()]; ok {
+		st.Alive = &alive
+	}
+	if c, ok := lb.capacity[server.Address()]; ok {
+		capacity := c.capacity
+		st.Capacity = &capacity
+	}
+	lb.stateMu.Unlock()
+	if until := lb.backoffUntil(server.Address()); !until.IsZero() {
+		st.BackoffUntil = &until
+	}
+	if lb.usage != nil {
+		if c, ok := lb.usage.backends.get(server.Address()); ok {
+			st.Traffic = &c
+		}
+	}
+	st.Requests, st.Errors = lb.backendCounts(server.Address())
+	return st
+}
@@ -0,0 +1,115 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/metrics"
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/router"
+)
+
+// LatencyBudget is the response time a route is expected to stay within. Requests that take
+// longer are logged at warn level with a breakdown of where the time went, and counted in
+// lb_slow_requests_total. When several budgets match a request, the most specific one applies.
+type LatencyBudget struct {
+	// Host and PathPrefix select the requests; empty values match everything
+	Host       string
+	PathPrefix string
+	Budget     time.Duration
+	// Name names the route in logs and metrics; default Host+PathPrefix
+	Name string
+}
+
+// WithLatencyBudgets sets per-route latency budgets
+func WithLatencyBudgets(budgets ...LatencyBudget) Option {
+	return func(lb *LoadBalancer) {
+		lb.budgetDefs = append(lb.budgetDefs, budgets...)
+	}
+}
+
+type latencyBudget struct {
+	LatencyBudget
+	slow *metrics.Counter
+}
+
+// latencyBudgets is the compiled form of the budgets
+type latencyBudgets struct {
+	table *router.Table[*latencyBudget]
+	all   []*latencyBudget
+}
+
+func compileBudgets(defs []LatencyBudget) (*latencyBudgets, error) {
+	b := &latencyBudgets{}
+	rules := make([]router.Rule[*latencyBudget], len(defs))
+	for i, def := range defs {
+		if def.Budget <= 0 {
+			return nil, fmt.Errorf("latency budget %s%s: budget must be positive", def.Host, def.PathPrefix)
+		}
+		if def.Name == "" {
+			def.Name = def.Host + def.PathPrefix
+		}
+		lb := &latencyBudget{LatencyBudget: def, slow: metrics.NewCounter()}
+		b.all = append(b.all, lb)
+		rules[i] = router.Rule[*latencyBudget]{Host: def.Host, PathPrefix: def.PathPrefix, Target: lb}
+	}
+	table, err := router.Compile(rules)
+	if err != nil {
+		return nil, err
+	}
+	b.table = table
+	return b, nil
+}
+
+// middleware attaches the matching budget to the request and starts timing it
+func (b *latencyBudgets) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if budget, ok := b.table.Match(req.Host, req.URL.Path); ok {
+			st := stateFrom(req.Context())
+			st.budget = budget
+			req = traceTiming(req, st)
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// checkBudget logs and counts a finished request that overran its budget
+func (lb *LoadBalancer) checkBudget(req *http.Request, st *requestState, status int, elapsed time.Duration) {
+	budget := st.budget
+	if elapsed <= budget.Budget {
+		return
+	}
+	budget.slow.Inc()
+	backend := ""
+	if st.server != nil {
+		backend = st.server.Address()
+	}
+	t := st.timing.breakdown(st.start)
+	lb.logger.LogAttrs(context.Background(), slog.LevelWarn, "slow request",
+		slog.String("route", budget.Name),
+		slog.String("request_id", st.requestID),
+		slog.String("method", req.Method),
+		slog.String("path", req.URL.Path),
+		slog.String("backend", backend),
+		slog.Int("status", status),
+		slog.Duration("budget", budget.Budget),
+		slog.Duration("duration", elapsed),
+		slog.Duration("queue", t.Queue),
+		slog.Duration("dial", t.Dial),
+		slog.Duration("tls", t.TLS),
+		slog.Duration("ttfb", t.TTFB),
+		slog.Duration("transfer", t.Transfer),
+		slog.Int("attempts", len(st.failed)+1),
+	)
+}
+
+// writeMetrics writes lb_slow_requests_total for every budget
+func (b *latencyBudgets) writeMetrics(w *bufio.Writer) {
+	writeMetricHeader(w, "lb_slow_requests_total", "counter", "Requests that took longer than their route's latency budget.")
+	for _, budget := range b.all {
+		fmt.Fprintf(w, "lb_slow_requests_total{route=%s} %d\n", labelValue(budget.Name), budget.slow.Value())
+	}
+}
@@ -0,0 +1,52 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/router"
+)
+
+// AuthBypass exempts matching requests from the access list and from authentication
+// middleware that consults AuthBypassed, so health probes and ACME challenges get through
+// to the backends. Host may be an exact name, a "*.example.com" wildcard, or empty for any
+// host. A trailing "*" on PathPrefix is dropped, so "/.well-known/*" covers everything below.
+type AuthBypass struct {
+	Host       string
+	PathPrefix string
+}
+
+// WithAuthBypass lets requests matching any of the rules skip the access list. The paths are
+// matched after URL normalization, so "/x/../healthz" doesn't count as "/healthz" unless it is.
+func WithAuthBypass(rules ...AuthBypass) Option {
+	return func(lb *LoadBalancer) {
+		lb.authBypass = append(lb.authBypass, rules...)
+	}
+}
+
+// AuthBypassed reports whether req matched a WithAuthBypass rule. Custom authentication
+// middleware given to WithMiddleware should let such requests through unchecked.
+func AuthBypassed(req *http.Request) bool {
+	return stateFrom(req.Context()).authBypass
+}
+
+// bypassMiddleware compiles the rules into a route table and marks the matching requests
+func bypassMiddleware(rules []AuthBypass) (Middleware, error) {
+	routes := make([]router.Rule[struct{}], len(rules))
+	for i, r := range rules {
+		routes[i] = router.Rule[struct{}]{Host: r.Host, PathPrefix: strings.TrimSuffix(r.PathPrefix, "*")}
+	}
+	table, err := router.Compile(routes)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if _, ok := table.Match(req.Host, req.URL.Path); ok {
+				stateFrom(req.Context()).authBypass = true
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}, nil
+}
@@ -0,0 +1,405 @@
+package loadbalancer
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache configures the shared response cache. Only GET responses that declare their freshness
+// (Cache-Control max-age or s-maxage, or Expires) are stored, and requests carrying credentials
+// or cookies bypass the cache. The RFC 5861 extensions are honoured: within stale-while-revalidate
+// a stale entry is served while a background request refreshes it, and within stale-if-error a
+// stale entry stands in for a 5xx response.
+type Cache struct {
+	// MaxEntries is the number of responses kept; default 1000
+	MaxEntries int
+	// MaxBytes bounds the total size of the stored bodies; default 64 MiB
+	MaxBytes int64
+	// MaxObject is the largest body stored, and the most of a response held in memory; larger
+	// responses are streamed to the client uncached. Default 1 MiB.
+	MaxObject int64
+	// RevalidateTimeout bounds background refreshes; default 30s
+	RevalidateTimeout time.Duration
+}
+
+// WithCache enables the response cache
+func WithCache(c Cache) Option {
+	return func(lb *LoadBalancer) {
+		if c.MaxEntries <= 0 {
+			c.MaxEntries = 1000
+		}
+		if c.MaxBytes <= 0 {
+			c.MaxBytes = 64 << 20
+		}
+		if c.MaxObject <= 0 {
+			c.MaxObject = 1 << 20
+		}
+		if c.RevalidateTimeout <= 0 {
+			c.RevalidateTimeout = 30 * time.Second
+		}
+		lb.cacheCfg = &c
+	}
+}
+
+// cacheEntry is a stored response and the freshness it was served with
+type cacheEntry struct {
+	key    string
+	status int
+	header http.Header
+	body   []byte
+
+	stored               time.Time
+	freshFor             time.Duration
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+
+	generatedETag         bool
+	generatedLastModified bool
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return now.Sub(e.stored)
+}
+
+type responseCache struct {
+	cfg Cache
+	lb  *LoadBalancer
+
+	mu           sync.Mutex
+	entries      map[string]*list.Element
+	lru          *list.List
+	bytes        int64
+	revalidating map[string]bool
+}
+
+func newResponseCache(lb *LoadBalancer, cfg Cache) *responseCache {
+	return &responseCache{
+		cfg:          cfg,
+		lb:           lb,
+		entries:      make(map[string]*list.Element),
+		lru:          list.New(),
+		revalidating: make(map[string]bool),
+	}
+}
+
+func (c *responseCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+func (c *responseCache) put(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		c.removeLocked(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.bytes += int64(len(e.body))
+	for c.lru.Len() > c.cfg.MaxEntries || c.bytes > c.cfg.MaxBytes {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+func (c *responseCache) removeLocked(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, e.key)
+	c.bytes -= int64(len(e.body))
+}
+
+// cacheDirectives parses a Cache-Control header into lower-case names and their values
+func cacheDirectives(h http.Header) map[string]string {
+	out := make(map[string]string)
+	for _, v := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name != "" {
+				out[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return out
+}
+
+func directiveSeconds(d map[string]string, name string) (time.Duration, bool) {
+	v, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// cacheableStatus are the statuses a shared cache may store when freshness is explicit
+func cacheableStatus(status int) bool {
+	switch status {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent, http.StatusMovedPermanently,
+		http.StatusNotFound, http.StatusGone:
+		return true
+	}
+	return false
+}
+
+// newEntry builds a cache entry for a response, or returns nil when it must not be stored
+func (c *responseCache) newEntry(key string, status int, header http.Header, body []byte, now time.Time) *cacheEntry {
+	if !cacheableStatus(status) || header.Get("Set-Cookie") != "" || int64(len(body)) > c.cfg.MaxObject {
+		return nil
+	}
+	if vary := header.Get("Vary"); vary != "" {
+		// the key only covers the Accept family of headers
+		for _, name := range strings.Split(vary, ",") {
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "accept", "accept-encoding", "accept-language":
+			default:
+				return nil
+			}
+		}
+	}
+	d := cacheDirectives(header)
+	if _, ok := d["no-store"]; ok {
+		return nil
+	}
+	if _, ok := d["private"]; ok {
+		return nil
+	}
+	if _, ok := d["no-cache"]; ok {
+		return nil
+	}
+	fresh, ok := directiveSeconds(d, "s-maxage")
+	if !ok {
+		fresh, ok = directiveSeconds(d, "max-age")
+	}
+	if !ok {
+		expires, err := http.ParseTime(header.Get("Expires"))
+		if err != nil {
+			return nil
+		}
+		fresh = expires.Sub(now)
+	}
+	// the balancer's timings were true of the request that filled the entry, not of later hits
+	stripServerTiming(header)
+	e := &cacheEntry{key: key, status: status, header: header, body: body, stored: now, freshFor: fresh}
+	e.staleWhileRevalidate, _ = directiveSeconds(d, "stale-while-revalidate")
+	e.staleIfError, _ = directiveSeconds(d, "stale-if-error")
+	if fresh <= 0 && e.staleIfError <= 0 && e.staleWhileRevalidate <= 0 {
+		return nil
+	}
+	addValidators(e)
+	return e
+}
+
+func (c *responseCache) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		key, ok := coalesceKey(req)
+		if !ok || req.Method != http.MethodGet {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		now := time.Now()
+		e := c.get(key)
+		if e != nil {
+			age := e.age(now)
+			switch {
+			case age < e.freshFor:
+				c.serve(rw, req, e, now, "HIT")
+				return
+			case age < e.freshFor+e.staleWhileRevalidate:
+				c.revalidate(key, e, req, next)
+				c.serve(rw, req, e, now, "STALE")
+				return
+			case age < e.freshFor+e.staleIfError:
+				c.fetchOrStale(rw, req, next, key, e)
+				return
+			}
+		}
+
+		rw.Header().Set("X-Cache", "MISS")
+		tee := newTeeWriter(rw, c.cfg.MaxObject)
+		next.ServeHTTP(tee, req)
+		if tee.overflow || req.Context().Err() != nil {
+			return
+		}
+		if tee.status == 0 {
+			tee.status = http.StatusOK
+			tee.header = tee.shared()
+		}
+		tee.header.Del("X-Cache")
+		if entry := c.newEntry(key, tee.status, tee.header, tee.body, now); entry != nil {
+			c.put(entry)
+		}
+	})
+}
+
+// serve answers req from e, with a 304 when the client's validators still match
+func (c *responseCache) serve(rw http.ResponseWriter, req *http.Request, e *cacheEntry, now time.Time, state string) {
+	h := rw.Header()
+	h.Set("Age", strconv.Itoa(int(e.age(now).Seconds())))
+	h.Set("X-Cache", state)
+	if notModified(req, e) {
+		writeNotModified(rw, e)
+		return
+	}
+	for k, v := range e.header {
+		// headers the balancer already set for this request, such as its ID, stay its own;
+		// the values are copied so nothing done to this response's headers reaches the entry
+		if _, set := h[k]; !set {
+			h[k] = slices.Clone(v)
+		}
+	}
+	rw.WriteHeader(e.status)
+	if req.Method != http.MethodHead {
+		rw.Write(e.body)
+	}
+}
+
+// fetchOrStale goes upstream but falls back to the stale entry if the backends fail. A response
+// too large to cache is streamed to the client as it arrives.
+func (c *responseCache) fetchOrStale(rw http.ResponseWriter, req *http.Request, next http.Handler, key string, stale *cacheEntry) {
+	buf := newBufferWriter(c.cfg.MaxObject, rw)
+	next.ServeHTTP(buf, conditionalRequest(req, stale))
+	if buf.passing {
+		return
+	}
+	now := time.Now()
+	if buf.status >= 500 {
+		c.lb.logger.Debug("serving stale response after backend error", "key", c.lb.scrub.uri(req.URL), "status", buf.status)
+		c.serve(rw, req, stale, now, "STALE")
+		return
+	}
+	if entry := c.store(key, stale, buf, now); entry != nil {
+		c.serve(rw, req, entry, now, "REVALIDATED")
+		return
+	}
+	if buf.status == http.StatusNotModified {
+		// still valid, though the backend no longer lets it be cached
+		c.serve(rw, req, stale, now, "REVALIDATED")
+		return
+	}
+	buf.copyTo(rw)
+}
+
+// revalidate refreshes key in the background, once at a time
+func (c *responseCache) revalidate(key string, prev *cacheEntry, req *http.Request, next http.Handler) {
+	c.mu.Lock()
+	if c.revalidating[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[key] = true
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), c.cfg.RevalidateTimeout)
+	bg := conditionalRequest(req, prev)
+	// the refresh makes its own backend choice
+	bg = bg.WithContext(context.WithValue(ctx, requestStateKey{}, &requestState{start: time.Now()}))
+	go func() {
+		defer cancel()
+		defer func() {
+			c.mu.Lock()
+			delete(c.revalidating, key)
+			c.mu.Unlock()
+		}()
+		buf := newBufferWriter(c.cfg.MaxObject, nil)
+		next.ServeHTTP(buf, bg)
+		if buf.status < 500 && !buf.overflow {
+			c.store(key, prev, buf, time.Now())
+		}
+	}()
+}
+
+// store caches the upstream response in buf, renewing prev when the backend answered 304, and
+// returns the new entry if there is one
+func (c *responseCache) store(key string, prev *cacheEntry, buf *bufferWriter, now time.Time) *cacheEntry {
+	var entry *cacheEntry
+	if buf.status == http.StatusNotModified && prev != nil {
+		entry = c.refreshed(prev, buf.header, now)
+	} else {
+		entry = c.newEntry(key, buf.status, buf.header.Clone(), buf.body, now)
+	}
+	if entry != nil {
+		c.put(entry)
+	}
+	return entry
+}
+
+// bufferWriter holds a response in memory, up to limit bytes of body. Past that, a response
+// that isn't a 5xx is passed through to out, when there is one; otherwise the body is dropped
+// and overflow set.
+type bufferWriter struct {
+	header   http.Header
+	status   int
+	body     []byte
+	limit    int64
+	out      http.ResponseWriter
+	passing  bool
+	overflow bool
+}
+
+func newBufferWriter(limit int64, out http.ResponseWriter) *bufferWriter {
+	return &bufferWriter{header: make(http.Header), limit: limit, out: out}
+}
+
+func (w *bufferWriter) Header() http.Header { return w.header }
+
+func (w *bufferWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *bufferWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	switch {
+	case w.passing:
+		return w.out.Write(p)
+	case w.overflow:
+		return len(p), nil
+	case int64(len(w.body)+len(p)) <= w.limit:
+		w.body = append(w.body, p...)
+		return len(p), nil
+	case w.out != nil && w.status < 500:
+		// too large to cache: what was held goes out, and the rest follows as it arrives
+		w.copyTo(w.out)
+		w.passing, w.body = true, nil
+		return w.out.Write(p)
+	default:
+		w.overflow, w.body = true, nil
+		return len(p), nil
+	}
+}
+
+// Flush passes flushes on once the response is streamed
+func (w *bufferWriter) Flush() {
+	if w.passing {
+		http.NewResponseController(w.out).Flush()
+	}
+}
+
+// copyTo sends the buffered response to rw
+func (w *bufferWriter) copyTo(rw http.ResponseWriter) {
+	for k, v := range w.header {
+		rw.Header()[k] = v
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	rw.WriteHeader(w.status)
+	rw.Write(w.body)
+}
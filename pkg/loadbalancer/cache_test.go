@@ -0,0 +1,76 @@
+package loadbalancer_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/loadbalancer"
+)
+
+// cacheable starts a backend answering body with a response the cache may keep for a minute
+func cacheable(t *testing.T, body string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Cache-Control", "public, max-age=60")
+		rw.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestCacheKeepsPoolsApart(t *testing.T) {
+	public, dark := cacheable(t, "public"), cacheable(t, "SECRET-PRERELEASE")
+	lb, err := loadbalancer.New(
+		loadbalancer.WithBackends(public.URL),
+		loadbalancer.WithDarkLaunch(loadbalancer.DarkLaunch{Header: "X-Dark", Value: "open", Backends: []string{dark.URL}}),
+		loadbalancer.WithCache(loadbalancer.Cache{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(gate string) (string, string) {
+		req := httptest.NewRequest("GET", "/page", nil)
+		if gate != "" {
+			req.Header.Set("X-Dark", gate)
+		}
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		return rec.Body.String(), rec.Header().Get("X-Cache")
+	}
+
+	for _, step := range []struct {
+		gate, body, cache string
+	}{
+		{"open", "SECRET-PRERELEASE", "MISS"},
+		{"", "public", "MISS"},
+		{"", "public", "HIT"},
+		{"open", "SECRET-PRERELEASE", "HIT"},
+	} {
+		body, cache := get(step.gate)
+		if body != step.body || cache != step.cache {
+			t.Errorf("gate %q: got %q (%s), want %q (%s)", step.gate, body, cache, step.body, step.cache)
+		}
+	}
+}
+
+func TestCacheKeepsRequestHeaders(t *testing.T) {
+	lb, err := loadbalancer.New(
+		loadbalancer.WithBackends(cacheable(t, "ok").URL),
+		loadbalancer.WithCache(loadbalancer.Cache{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"first", "second"} {
+		rec := httptest.NewRecorder()
+		// as a stage ahead of the cache would tag the response
+		rec.Header().Set("X-Request-ID", id)
+		lb.ServeHTTP(rec, httptest.NewRequest("GET", "/page", nil))
+		if got := rec.Header().Values("X-Request-ID"); len(got) != 1 || got[0] != id {
+			t.Errorf("request %s (%s): X-Request-ID = %q", id, rec.Header().Get("X-Cache"), got)
+		}
+		if got := rec.Header().Get("Cache-Control"); got != "public, max-age=60" {
+			t.Errorf("request %s: Cache-Control = %q", id, got)
+		}
+	}
+}
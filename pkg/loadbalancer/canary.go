@@ -0,0 +1,364 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/metrics"
+)
+
+// Canary is a pool of new-version backends whose traffic share is ramped up in steps.
+// Each step runs for StepInterval while the canary's 5xx rate and latency are compared with the
+// regular pool's; when the canary does worse by more than Tolerance or LatencyTolerance, the ramp
+// is aborted and all traffic returns to the regular pool. Clients are assigned by address, so a
+// client that reached the canary at a small share keeps reaching it as the share grows.
+type Canary struct {
+	// Backends are the URLs of the canary pool
+	Backends []string
+	// Steps are the successive traffic shares in percent; default 1, 5, 25, 100
+	Steps []float64
+	// StepInterval is how long each step runs before the next; default 5m
+	StepInterval time.Duration
+	// Tolerance is how far the canary's error ratio may exceed the baseline's, e.g. 0.01
+	// for one percentage point; default 0.01
+	Tolerance float64
+	// LatencyTolerance is how far the canary's p95 latency may exceed the baseline's, e.g. 0.2
+	// for 20% slower; 0 leaves latency out of the decision
+	LatencyTolerance float64
+	// MinRequests is the canary traffic a step needs before it is judged; default 50
+	MinRequests int
+	// Token is the bearer token POST and DELETE /canary/ramp require, besides the
+	// WithAdminToken one; without either the ramp can only be driven through StartCanaryRamp
+	// and AbortCanaryRamp
+	Token string
+}
+
+// WithCanary configures a canary pool; it takes no traffic until a ramp is started
+func WithCanary(c Canary) Option {
+	return func(lb *LoadBalancer) {
+		if len(c.Steps) == 0 {
+			c.Steps = []float64{1, 5, 25, 100}
+		}
+		if c.StepInterval <= 0 {
+			c.StepInterval = 5 * time.Minute
+		}
+		if c.Tolerance <= 0 {
+			c.Tolerance = 0.01
+		}
+		if c.MinRequests <= 0 {
+			c.MinRequests = 50
+		}
+		lb.canary = &canary{Canary: c, state: CanaryIdle, canaryTotal: newABArm(), baselineTotal: newABArm()}
+		lb.canary.resetCounts()
+	}
+}
+
+// Canary ramp states
+const (
+	CanaryIdle       = "idle"
+	CanaryRamping    = "ramping"
+	CanaryComplete   = "complete"
+	CanaryRolledBack = "rolled back"
+)
+
+// errNoCanary is returned by the ramp controls without WithCanary
+var errNoCanary = errors.New("loadbalancer: no canary pool configured")
+
+// CanaryStatus describes the ramp
+type CanaryStatus struct {
+	State string `json:"state"`
+	// Share is the percentage of clients sent to the canary
+	Share float64 `json:"share"`
+	Step  int     `json:"step"`
+	// CanaryErrorRatio and BaselineErrorRatio are measured over the current step
+	CanaryRequests     uint64  `json:"canary_requests"`
+	CanaryErrorRatio   float64 `json:"canary_error_ratio"`
+	BaselineRequests   uint64  `json:"baseline_requests"`
+	BaselineErrorRatio float64 `json:"baseline_error_ratio"`
+	// CanaryLatency and BaselineLatency are estimated from the current step's responses
+	CanaryLatency   LatencySummary `json:"canary_latency"`
+	BaselineLatency LatencySummary `json:"baseline_latency"`
+	// LatencyRatio is the canary's p95 over the baseline's; 0 until both have traffic
+	LatencyRatio float64 `json:"latency_ratio"`
+	Reason       string  `json:"reason,omitempty"`
+}
+
+// LatencySummary gives response time percentiles in seconds
+type LatencySummary struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+func summarize(s metrics.HistogramSnapshot) LatencySummary {
+	return LatencySummary{P50: s.Quantile(0.5), P95: s.Quantile(0.95), P99: s.Quantile(0.99)}
+}
+
+// latencyRatio divides the canary's p95 by the baseline's
+func latencyRatio(canary, baseline metrics.HistogramSnapshot) float64 {
+	b := baseline.Quantile(0.95)
+	if canary.Count == 0 || b == 0 {
+		return 0
+	}
+	return canary.Quantile(0.95) / b
+}
+
+// abArm accumulates one side of the comparison over the whole life of the balancer, for /metrics
+type abArm struct {
+	requests, errors *metrics.Counter
+	latency          *metrics.Histogram
+}
+
+func newABArm() abArm {
+	return abArm{requests: metrics.NewCounter(), errors: metrics.NewCounter(), latency: metrics.NewHistogram(metrics.DefaultBuckets)}
+}
+
+func (a abArm) observe(failed bool, elapsed time.Duration) {
+	a.requests.Inc()
+	if failed {
+		a.errors.Inc()
+	}
+	a.latency.Observe(elapsed.Seconds())
+}
+
+type canary struct {
+	Canary
+	servers []Server
+	// share is the percentage in hundredths, read on every request
+	share atomic.Int64
+
+	canaryReqs, canaryErrs     atomic.Uint64
+	baselineReqs, baselineErrs atomic.Uint64
+	// the latencies of the current step, replaced when it changes
+	canaryLatency, baselineLatency atomic.Pointer[metrics.Histogram]
+	canaryTotal, baselineTotal     abArm
+
+	mu     sync.Mutex
+	state  string
+	step   int
+	reason string
+	cancel context.CancelFunc
+}
+
+func ratio(errs, reqs uint64) float64 {
+	if reqs == 0 {
+		return 0
+	}
+	return float64(errs) / float64(reqs)
+}
+
+func (c *canary) resetCounts() {
+	c.canaryReqs.Store(0)
+	c.canaryErrs.Store(0)
+	c.baselineReqs.Store(0)
+	c.baselineErrs.Store(0)
+	c.canaryLatency.Store(metrics.NewHistogram(metrics.DefaultBuckets))
+	c.baselineLatency.Store(metrics.NewHistogram(metrics.DefaultBuckets))
+}
+
+// picks reports whether client falls inside the current share
+func (c *canary) picks(client string) bool {
+	share := c.share.Load()
+	if share <= 0 {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(client))
+	return int64(h.Sum32()%10000) < share
+}
+
+func (lb *LoadBalancer) canaryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		st := stateFrom(req.Context())
+		// requests already bound to particular backends stay there
+		if st.allowed == nil && st.pool == nil && lb.canary.picks(lb.clientID(req)) {
+			st.pool, st.poolName = lb.canary.servers, PoolCanary
+			st.canary = true
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// observeCanary counts the outcome of a request for the arm it went to
+func (lb *LoadBalancer) observeCanary(req *http.Request, server Server, status int, elapsed time.Duration) {
+	c := lb.canary
+	if c.share.Load() <= 0 {
+		return
+	}
+	failed := status >= http.StatusInternalServerError
+	// a later stage (dark launch, backend override) may have sent the request elsewhere
+	if stateFrom(req.Context()).canary && (server == nil || slices.Contains(c.servers, server)) {
+		c.canaryReqs.Add(1)
+		if failed {
+			c.canaryErrs.Add(1)
+		}
+		c.canaryLatency.Load().Observe(elapsed.Seconds())
+		c.canaryTotal.observe(failed, elapsed)
+		return
+	}
+	c.baselineReqs.Add(1)
+	if failed {
+		c.baselineErrs.Add(1)
+	}
+	c.baselineLatency.Load().Observe(elapsed.Seconds())
+	c.baselineTotal.observe(failed, elapsed)
+}
+
+// StartCanaryRamp starts moving traffic to the canary pool step by step
+func (lb *LoadBalancer) StartCanaryRamp() error {
+	c := lb.canary
+	if c == nil {
+		return errNoCanary
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == CanaryRamping {
+		return errors.New("loadbalancer: canary ramp already running")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.state, c.step, c.reason, c.cancel = CanaryRamping, 0, "", cancel
+	c.setStep(0)
+	lb.logger.Info("canary ramp started", "share", c.Steps[0])
+	go lb.runCanaryRamp(ctx)
+	return nil
+}
+
+// AbortCanaryRamp stops the ramp and sends all traffic back to the regular pool
+func (lb *LoadBalancer) AbortCanaryRamp(reason string) error {
+	if lb.canary == nil {
+		return errNoCanary
+	}
+	lb.rollBackCanary(reason)
+	return nil
+}
+
+// CanaryStatus reports the ramp's progress
+func (lb *LoadBalancer) CanaryStatus() CanaryStatus {
+	c := lb.canary
+	if c == nil {
+		return CanaryStatus{State: CanaryIdle}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	canaryLatency, baselineLatency := c.canaryLatency.Load().Snapshot(), c.baselineLatency.Load().Snapshot()
+	return CanaryStatus{
+		State:              c.state,
+		Share:              float64(c.share.Load()) / 100,
+		Step:               c.step,
+		CanaryRequests:     c.canaryReqs.Load(),
+		CanaryErrorRatio:   ratio(c.canaryErrs.Load(), c.canaryReqs.Load()),
+		BaselineRequests:   c.baselineReqs.Load(),
+		BaselineErrorRatio: ratio(c.baselineErrs.Load(), c.baselineReqs.Load()),
+		CanaryLatency:      summarize(canaryLatency),
+		BaselineLatency:    summarize(baselineLatency),
+		LatencyRatio:       latencyRatio(canaryLatency, baselineLatency),
+		Reason:             c.reason,
+	}
+}
+
+// setStep moves to step i; c.mu must be held
+func (c *canary) setStep(i int) {
+	c.step = i
+	c.resetCounts()
+	c.share.Store(int64(c.Steps[i] * 100))
+}
+
+func (lb *LoadBalancer) rollBackCanary(reason string) {
+	c := lb.canary
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == CanaryIdle {
+		return
+	}
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.share.Store(0)
+	c.state, c.reason = CanaryRolledBack, reason
+	lb.logger.Warn("canary rolled back", "reason", reason)
+}
+
+// canaryCheckInterval is how often a running step is checked for a regression
+const canaryCheckInterval = 5 * time.Second
+
+func (lb *LoadBalancer) runCanaryRamp(ctx context.Context) {
+	c := lb.canary
+	ticker := time.NewTicker(canaryCheckInterval)
+	defer ticker.Stop()
+	stepStart := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		reqs, errs := c.canaryReqs.Load(), c.canaryErrs.Load()
+		canaryRatio := ratio(errs, reqs)
+		baseline := ratio(c.baselineErrs.Load(), c.baselineReqs.Load())
+		if reqs >= uint64(c.MinRequests) && canaryRatio > baseline+c.Tolerance {
+			lb.rollBackCanary("canary error ratio above baseline")
+			return
+		}
+		slower := latencyRatio(c.canaryLatency.Load().Snapshot(), c.baselineLatency.Load().Snapshot())
+		if c.LatencyTolerance > 0 && reqs >= uint64(c.MinRequests) && slower > 1+c.LatencyTolerance {
+			lb.rollBackCanary("canary p95 latency above baseline")
+			return
+		}
+		if time.Since(stepStart) < c.StepInterval {
+			continue
+		}
+		if reqs < uint64(c.MinRequests) {
+			lb.logger.Info("canary step extended: not enough traffic to judge", "requests", reqs)
+			stepStart = time.Now()
+			continue
+		}
+
+		c.mu.Lock()
+		if ctx.Err() != nil {
+			c.mu.Unlock()
+			return
+		}
+		if c.step == len(c.Steps)-1 {
+			c.state = CanaryComplete
+			c.mu.Unlock()
+			lb.logger.Info("canary ramp complete", "share", c.Steps[c.step])
+			return
+		}
+		c.setStep(c.step + 1)
+		lb.logger.Info("canary ramp advanced", "share", c.Steps[c.step], "error_ratio", canaryRatio, "baseline", baseline)
+		c.mu.Unlock()
+		stepStart = time.Now()
+	}
+}
+
+// serveCanary handles GET /canary
+func (lb *LoadBalancer) serveCanary(rw http.ResponseWriter, _ *http.Request) {
+	writeJSON(rw, lb.CanaryStatus())
+}
+
+// serveCanaryRamp handles POST /canary/ramp
+func (lb *LoadBalancer) serveCanaryRamp(rw http.ResponseWriter, req *http.Request) {
+	if !lb.authorized(rw, req, lb.canary.Token) {
+		return
+	}
+	if err := lb.StartCanaryRamp(); err != nil {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(rw, lb.CanaryStatus())
+}
+
+// serveCanaryAbort handles DELETE /canary/ramp
+func (lb *LoadBalancer) serveCanaryAbort(rw http.ResponseWriter, req *http.Request) {
+	if !lb.authorized(rw, req, lb.canary.Token) {
+		return
+	}
+	lb.AbortCanaryRamp("aborted by operator")
+	writeJSON(rw, lb.CanaryStatus())
+}
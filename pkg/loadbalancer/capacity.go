@@ -0,0 +1,121 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// CapacityReports configures the endpoint through which backends, or agents running beside
+// them, push their current capacity. A report replaces the backend's weight until it expires,
+// so weighted strategies follow load in near-real-time; a capacity of 0 stops new traffic.
+type CapacityReports struct {
+	// Token is a bearer token reporters may present instead of the WithAdminToken one; without
+	// either, every report is refused
+	Token string
+	// TTL is how long a report holds before the backend returns to its configured weight; default 30s
+	TTL time.Duration
+}
+
+// CapacityReport is the body of POST /capacity on the admin port
+type CapacityReport struct {
+	// Backend is the backend's address as configured in the pool
+	Backend string `json:"backend"`
+	// Capacity is a score derived by the agent from CPU, queue depth and the like. It is used
+	// as a relative weight, so every agent in a pool should report on the same scale.
+	Capacity int `json:"capacity"`
+}
+
+// maxCapacity bounds reported scores so a faulty agent can't take all the traffic
+const maxCapacity = 10000
+
+// capacityState remembers a backend's configured weight while a report overrides it
+type capacityState struct {
+	base     int
+	capacity int
+	expires  time.Time
+	timer    *time.Timer
+}
+
+// WithCapacityReports enables POST /capacity on the admin handler
+func WithCapacityReports(cfg CapacityReports) Option {
+	return func(lb *LoadBalancer) {
+		if cfg.TTL <= 0 {
+			cfg.TTL = 30 * time.Second
+		}
+		lb.capacityCfg = &cfg
+	}
+}
+
+// serveCapacity applies a capacity report
+func (lb *LoadBalancer) serveCapacity(rw http.ResponseWriter, req *http.Request) {
+	if !lb.authorized(rw, req, lb.capacityCfg.Token) {
+		return
+	}
+	var report CapacityReport
+	if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, 4096)).Decode(&report); err != nil {
+		http.Error(rw, "invalid report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if report.Capacity < 0 || report.Capacity > maxCapacity {
+		http.Error(rw, "capacity out of range", http.StatusBadRequest)
+		return
+	}
+	var target WeightSetter
+	for _, server := range lb.Servers() {
+		if server.Address() == report.Backend {
+			target, _ = server.(WeightSetter)
+			if target == nil {
+				http.Error(rw, "backend weight is not adjustable", http.StatusUnprocessableEntity)
+				return
+			}
+			break
+		}
+	}
+	if target == nil {
+		http.Error(rw, "unknown backend", http.StatusNotFound)
+		return
+	}
+	lb.applyCapacity(report.Backend, target, report.Capacity)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (lb *LoadBalancer) applyCapacity(addr string, server WeightSetter, capacity int) {
+	ttl := lb.capacityCfg.TTL
+	lb.stateMu.Lock()
+	defer lb.stateMu.Unlock()
+	st, ok := lb.capacity[addr]
+	if !ok {
+		st = &capacityState{base: server.Weight()}
+		lb.capacity[addr] = st
+	} else {
+		st.timer.Stop()
+	}
+	st.capacity = capacity
+	st.expires = time.Now().Add(ttl)
+	st.timer = time.AfterFunc(ttl, func() { lb.expireCapacity(addr, server, st) })
+	server.SetWeight(capacity)
+}
+
+// expireCapacity restores the configured weight once reports stop arriving
+func (lb *LoadBalancer) expireCapacity(addr string, server WeightSetter, st *capacityState) {
+	lb.stateMu.Lock()
+	defer lb.stateMu.Unlock()
+	if lb.capacity[addr] != st || time.Now().Before(st.expires) {
+		return
+	}
+	delete(lb.capacity, addr)
+	server.SetWeight(st.base)
+	lb.logger.Info("capacity report expired", "server", addr)
+}
+
+// noCapacity reports whether addr's agent has asked for no new traffic
+func (lb *LoadBalancer) noCapacity(addr string) bool {
+	if lb.capacityCfg == nil {
+		return false
+	}
+	lb.stateMu.Lock()
+	defer lb.stateMu.Unlock()
+	st, ok := lb.capacity[addr]
+	return ok && st.capacity == 0
+}
@@ -0,0 +1,30 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// StatusClientClosedRequest is reported to hooks and logs for requests the client abandoned
+// before the response was complete, following nginx's 499 convention. It is never sent:
+// by the time it applies there is nobody left to send it to.
+const StatusClientClosedRequest = 499
+
+// clientAborted reports whether the client went away before req was answered. The upstream call
+// shares req's context, so by then it has been cancelled and the backend's slot released. An
+// attempt cut off by the balancer has a cause of its own and doesn't count.
+func clientAborted(req *http.Request) bool {
+	return errors.Is(context.Cause(req.Context()), context.Canceled)
+}
+
+// noteClientAbort counts and logs an abandoned request so it isn't mistaken for a backend failure
+func (lb *LoadBalancer) noteClientAbort(req *http.Request, server Server, elapsed time.Duration) {
+	lb.clientAborts.Inc()
+	attrs := []any{"method", req.Method, "path", req.URL.Path, "elapsed", elapsed.Round(time.Millisecond)}
+	if server != nil {
+		attrs = append(attrs, "server", server.Address())
+	}
+	lb.logger.Info("client aborted request", attrs...)
+}
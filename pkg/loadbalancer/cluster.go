@@ -0,0 +1,76 @@
+package loadbalancer
+
+import (
+	"strings"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/gossip"
+)
+
+// peerReportTTL is how long a peer's "down" report is honoured without being refreshed.
+// The reporting instance republishes at half this interval while the backend stays down.
+const peerReportTTL = 10 * time.Second
+
+// healthKeyPrefix namespaces backend health in the gossip state
+const healthKeyPrefix = "health/"
+
+// WithGossip shares backend health with the other instances of a cluster: a backend this
+// instance sees fail is skipped by every peer within a few gossip rounds, and recoveries spread
+// the same way. The node starts and stops with the balancer.
+func WithGossip(node *gossip.Node) Option {
+	return func(lb *LoadBalancer) {
+		lb.gossip = node
+	}
+}
+
+// publishHealth announces a health observation to the cluster. Unchanged observations
+// are only re-sent often enough to keep peers' reports from expiring.
+func (lb *LoadBalancer) publishHealth(addr string, alive, changed bool) {
+	if lb.gossip == nil {
+		return
+	}
+	now := time.Now()
+	lb.stateMu.Lock()
+	if alive {
+		delete(lb.peerDown, addr)
+	}
+	if !changed && (alive || now.Sub(lb.published[addr]) < peerReportTTL/2) {
+		lb.stateMu.Unlock()
+		return
+	}
+	lb.published[addr] = now
+	lb.stateMu.Unlock()
+
+	value := "up"
+	if !alive {
+		value = "down"
+	}
+	lb.gossip.Set(healthKeyPrefix+addr, value)
+}
+
+// applyGossip records a health report learned from a peer
+func (lb *LoadBalancer) applyGossip(s gossip.State) {
+	addr, ok := strings.CutPrefix(s.Key, healthKeyPrefix)
+	if !ok {
+		return
+	}
+	lb.stateMu.Lock()
+	defer lb.stateMu.Unlock()
+	if s.Value == "down" {
+		lb.peerDown[addr] = s.Time()
+		lb.logger.Debug("peer reported backend down", "server", addr, "peer", s.Origin)
+		return
+	}
+	delete(lb.peerDown, addr)
+}
+
+// reportedDown reports whether a peer has recently seen addr fail
+func (lb *LoadBalancer) reportedDown(addr string) bool {
+	if lb.gossip == nil {
+		return false
+	}
+	lb.stateMu.Lock()
+	defer lb.stateMu.Unlock()
+	at, ok := lb.peerDown[addr]
+	return ok && time.Since(at) < peerReportTTL
+}
@@ -0,0 +1,211 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Coalescing collapses concurrent identical GET and HEAD requests into one upstream call.
+// The first request goes to a backend; the others wait for its response and receive a copy,
+// so a cache stampede costs the backends a single request. Requests carrying credentials or
+// cookies, or asking to bypass caches, are never coalesced.
+type Coalescing struct {
+	// Timeout is how long a waiting request holds out for the shared response before going
+	// upstream itself; default 5s
+	Timeout time.Duration
+	// MaxBody is the largest response that is shared; default 1 MiB
+	MaxBody int64
+}
+
+// WithCoalescing enables request coalescing
+func WithCoalescing(c Coalescing) Option {
+	return func(lb *LoadBalancer) {
+		if c.Timeout <= 0 {
+			c.Timeout = 5 * time.Second
+		}
+		if c.MaxBody <= 0 {
+			c.MaxBody = 1 << 20
+		}
+		lb.coalescing = &c
+	}
+}
+
+// coalescedCall is an upstream request that other requests are waiting on
+type coalescedCall struct {
+	done chan struct{}
+	// resp is nil when the response could not be shared
+	resp *sharedResponse
+}
+
+type sharedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+type coalescer struct {
+	cfg   Coalescing
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// coalesceKey identifies requests that would get the same response, or returns false
+// when req must not share one. Requests routed to different backends, such as a dark launch
+// or canary pool, get different keys.
+func coalesceKey(req *http.Request) (string, bool) {
+	st := stateFrom(req.Context())
+	if req.Method != http.MethodGet && req.Method != http.MethodHead || st.overridden {
+		return "", false
+	}
+	h := req.Header
+	if h.Get("Authorization") != "" || h.Get("Cookie") != "" ||
+		strings.Contains(h.Get("Cache-Control"), "no-cache") || h.Get("Pragma") == "no-cache" {
+		return "", false
+	}
+	return strings.Join([]string{req.Method, req.Host, req.URL.RequestURI(),
+		h.Get("Accept"), h.Get("Accept-Encoding"), h.Get("Accept-Language"), st.routing()}, "\x00"), true
+}
+
+// routing describes the backends the request was restricted to: its pool, label selector
+// and allowed backends
+func (st *requestState) routing() string {
+	var b strings.Builder
+	b.WriteString(st.poolName)
+	for _, k := range slices.Sorted(maps.Keys(st.selector)) {
+		fmt.Fprintf(&b, "\x01%s=%s", k, st.selector[k])
+	}
+	for _, addr := range st.allowed {
+		b.WriteString("\x01" + addr)
+	}
+	return b.String()
+}
+
+// shareable reports whether a response may be handed to other clients
+func shareable(h http.Header) bool {
+	cc := strings.ToLower(h.Get("Cache-Control"))
+	return h.Get("Set-Cookie") == "" && !strings.Contains(cc, "private") && !strings.Contains(cc, "no-store")
+}
+
+func (c *coalescer) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		key, ok := coalesceKey(req)
+		if !ok {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		c.mu.Lock()
+		if call, waiting := c.calls[key]; waiting {
+			c.mu.Unlock()
+			c.wait(call, rw, req, next)
+			return
+		}
+		call := &coalescedCall{done: make(chan struct{})}
+		c.calls[key] = call
+		c.mu.Unlock()
+
+		tee := newTeeWriter(rw, c.cfg.MaxBody)
+		defer func() {
+			c.mu.Lock()
+			delete(c.calls, key)
+			c.mu.Unlock()
+			if tee.status == 0 {
+				// the server sends the implicit 200 itself; writing it here would preempt the
+				// answer to a cancelled or abandoned request
+				tee.status, tee.header = http.StatusOK, tee.shared()
+			}
+			if !tee.overflow && shareable(tee.header) && req.Context().Err() == nil {
+				call.resp = &sharedResponse{status: tee.status, header: tee.header, body: tee.body}
+			}
+			close(call.done)
+		}()
+		next.ServeHTTP(tee, req)
+	})
+}
+
+// wait serves req from call's response, or upstream when that doesn't arrive in time
+func (c *coalescer) wait(call *coalescedCall, rw http.ResponseWriter, req *http.Request, next http.Handler) {
+	t := time.NewTimer(c.cfg.Timeout)
+	defer t.Stop()
+	select {
+	case <-call.done:
+	case <-t.C:
+		// the leader may still be setting resp, so it is only read once done is closed
+		next.ServeHTTP(rw, req)
+		return
+	case <-req.Context().Done():
+		return
+	}
+	resp := call.resp
+	if resp == nil {
+		next.ServeHTTP(rw, req)
+		return
+	}
+	for k, v := range resp.header {
+		// headers the balancer already set for this request, such as its ID, stay its own
+		if _, set := rw.Header()[k]; !set {
+			rw.Header()[k] = slices.Clone(v)
+		}
+	}
+	rw.Header().Set("X-LB-Coalesced", "1")
+	rw.WriteHeader(resp.status)
+	if req.Method != http.MethodHead {
+		rw.Write(resp.body)
+	}
+}
+
+// teeWriter passes the response through while keeping a copy for waiting requests
+type teeWriter struct {
+	http.ResponseWriter
+	limit    int64
+	status   int
+	header   http.Header
+	body     []byte
+	overflow bool
+	// own are the headers set for this request before it went upstream, left out of the copy
+	own []string
+}
+
+func newTeeWriter(rw http.ResponseWriter, limit int64) *teeWriter {
+	return &teeWriter{ResponseWriter: rw, limit: limit, own: slices.Collect(maps.Keys(rw.Header()))}
+}
+
+// shared copies the response headers, without the request's own
+func (w *teeWriter) shared() http.Header {
+	h := w.ResponseWriter.Header().Clone()
+	for _, k := range w.own {
+		delete(h, k)
+	}
+	return h
+}
+
+func (w *teeWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.header = w.shared()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *teeWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.overflow {
+		if int64(len(w.body)+len(p)) > w.limit {
+			w.overflow, w.body = true, nil
+		} else {
+			w.body = append(w.body, p...)
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *teeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
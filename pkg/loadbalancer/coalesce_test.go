@@ -0,0 +1,180 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// headerSpy records the WriteHeader calls that reach the client
+type headerSpy struct {
+	*httptest.ResponseRecorder
+	written []int
+}
+
+func (w *headerSpy) WriteHeader(status int) {
+	w.written = append(w.written, status)
+	w.ResponseRecorder.WriteHeader(status)
+}
+
+func (w *headerSpy) Write(p []byte) (int, error) {
+	if len(w.written) == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+// lead runs req through the coalescer as the leader, with upstream answering once released,
+// and returns the call waiting requests would share
+func lead(t *testing.T, c *coalescer, rw http.ResponseWriter, req *http.Request, upstream http.HandlerFunc) *coalescedCall {
+	t.Helper()
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.middleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			<-release
+			upstream(rw, req)
+		})).ServeHTTP(rw, req)
+	}()
+	key, _ := coalesceKey(req)
+	var call *coalescedCall
+	for deadline := time.Now().Add(time.Second); call == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("the leader never registered its call")
+		}
+		c.mu.Lock()
+		call = c.calls[key]
+		c.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	<-done
+	return call
+}
+
+func TestCoalesceStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		upstream   http.HandlerFunc
+		leaderSent []int
+		shared     int
+	}{
+		{
+			name:     "nothing written",
+			upstream: func(http.ResponseWriter, *http.Request) {},
+			// the server sends the implicit 200, not the coalescer
+			leaderSent: nil,
+			shared:     http.StatusOK,
+		},
+		{
+			name:       "header only",
+			upstream:   func(rw http.ResponseWriter, _ *http.Request) { rw.WriteHeader(http.StatusNoContent) },
+			leaderSent: []int{http.StatusNoContent},
+			shared:     http.StatusNoContent,
+		},
+		{
+			name:       "error status",
+			upstream:   func(rw http.ResponseWriter, _ *http.Request) { http.Error(rw, "gone", http.StatusNotFound) },
+			leaderSent: []int{http.StatusNotFound},
+			shared:     http.StatusNotFound,
+		},
+		{
+			name:       "implicit 200 with a body",
+			upstream:   func(rw http.ResponseWriter, _ *http.Request) { rw.Write([]byte("ok")) },
+			leaderSent: []int{http.StatusOK},
+			shared:     http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &coalescer{cfg: Coalescing{Timeout: time.Second, MaxBody: 1 << 10}, calls: make(map[string]*coalescedCall)}
+			leader := &headerSpy{ResponseRecorder: httptest.NewRecorder()}
+			call := lead(t, c, leader, httptest.NewRequest("GET", "/x", nil), tt.upstream)
+			if len(leader.written) != len(tt.leaderSent) || len(tt.leaderSent) > 0 && leader.written[0] != tt.leaderSent[0] {
+				t.Errorf("leader sent %v, want %v", leader.written, tt.leaderSent)
+			}
+			if call.resp == nil {
+				t.Fatal("the response was not shared")
+			}
+
+			follower := httptest.NewRecorder()
+			c.wait(call, follower, httptest.NewRequest("GET", "/x", nil), http.NotFoundHandler())
+			if follower.Code != tt.shared {
+				t.Errorf("follower got %d, want %d", follower.Code, tt.shared)
+			}
+			if follower.Header().Get("X-LB-Coalesced") != "1" {
+				t.Error("follower was not served the shared response")
+			}
+		})
+	}
+}
+
+func TestCoalesceCancelledLeader(t *testing.T) {
+	c := &coalescer{cfg: Coalescing{Timeout: time.Second, MaxBody: 1 << 10}, calls: make(map[string]*coalescedCall)}
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/x", nil).WithContext(ctx)
+	leader := &headerSpy{ResponseRecorder: httptest.NewRecorder()}
+	call := lead(t, c, leader, req, func(http.ResponseWriter, *http.Request) { cancel() })
+	if len(leader.written) != 0 {
+		t.Errorf("leader of a cancelled request sent %v", leader.written)
+	}
+	if call.resp != nil {
+		t.Fatal("the response of a cancelled request was shared")
+	}
+
+	// with nothing to share, the follower goes upstream itself
+	follower := httptest.NewRecorder()
+	c.wait(call, follower, httptest.NewRequest("GET", "/x", nil), http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusAccepted)
+	}))
+	if follower.Code != http.StatusAccepted {
+		t.Errorf("follower got %d, want its own upstream's %d", follower.Code, http.StatusAccepted)
+	}
+}
+
+func TestCoalesceWaitTimeout(t *testing.T) {
+	c := &coalescer{cfg: Coalescing{Timeout: time.Millisecond, MaxBody: 1 << 10}, calls: make(map[string]*coalescedCall)}
+	call := &coalescedCall{done: make(chan struct{})}
+	finished := make(chan struct{})
+	go func() {
+		// the leader finishing while the follower gives up on it
+		defer close(finished)
+		time.Sleep(time.Millisecond)
+		call.resp = &sharedResponse{status: http.StatusOK, header: make(http.Header)}
+		close(call.done)
+	}()
+	follower := httptest.NewRecorder()
+	c.wait(call, follower, httptest.NewRequest("GET", "/x", nil), http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusAccepted)
+	}))
+	<-finished
+	if follower.Code != http.StatusAccepted && follower.Header().Get("X-LB-Coalesced") == "" {
+		t.Errorf("follower got %d from neither upstream nor the leader", follower.Code)
+	}
+}
+
+func TestCoalesceKeepsRequestHeaders(t *testing.T) {
+	c := &coalescer{cfg: Coalescing{Timeout: time.Second, MaxBody: 1 << 10}, calls: make(map[string]*coalescedCall)}
+	leader := httptest.NewRecorder()
+	leader.Header().Set("X-Request-ID", "leader")
+	call := lead(t, c, leader, httptest.NewRequest("GET", "/x", nil), func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Write([]byte("ok"))
+	})
+	if _, ok := call.resp.header["X-Request-Id"]; ok {
+		t.Error("the leader's request ID was shared")
+	}
+
+	follower := httptest.NewRecorder()
+	follower.Header().Set("X-Request-ID", "follower")
+	c.wait(call, follower, httptest.NewRequest("GET", "/x", nil), http.NotFoundHandler())
+	if got := follower.Header().Get("X-Request-ID"); got != "follower" {
+		t.Errorf("follower's request ID = %q, want its own", got)
+	}
+	if got := follower.Header().Get("Content-Type"); got != "text/plain" {
+		t.Errorf("follower's Content-Type = %q, want the shared one", got)
+	}
+}
@@ -0,0 +1,73 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// WithBackendConcurrency caps the requests in flight to each backend at n, so a small backend
+// isn't buried under a burst. A full backend is passed over for the next one; when all are
+// full the request is answered with 503 and Retry-After. A server's own WithMaxConcurrency
+// takes precedence.
+func WithBackendConcurrency(n int) Option {
+	return func(lb *LoadBalancer) {
+		lb.maxPerBackend = n
+	}
+}
+
+// WithMaxConcurrency caps the requests in flight to this server; see WithBackendConcurrency
+func WithMaxConcurrency(n int) ServerOption {
+	return func(s *SimpleServer) {
+		s.maxActive = n
+	}
+}
+
+// concurrencyLimit returns the in-flight cap of server, 0 when it has none
+func (lb *LoadBalancer) concurrencyLimit(server Server) int {
+	if s, ok := server.(*SimpleServer); ok && s.maxActive > 0 {
+		return s.maxActive
+	}
+	return lb.maxPerBackend
+}
+
+// acquireSlot reserves one of server's in-flight slots for a request of class prio. It returns
+// the counter to release once the request is done, or false when the server is at its cap.
+func (lb *LoadBalancer) acquireSlot(server Server, prio Priority) (*atomic.Int64, bool) {
+	limit := lb.concurrencyLimit(server)
+	if limit <= 0 {
+		return nil, true
+	}
+	m := lb.backendMetricsFor(server.Address())
+	if m.slots.Add(1) > lb.priorities.limit(int64(limit), prio) {
+		m.slots.Add(-1)
+		m.saturated.Inc()
+		return nil, false
+	}
+	return &m.slots, true
+}
+
+// nextServerWithSlot is getNextAvailableServer for backends with a concurrency cap: full
+// backends are left out and the next one tried. The slot is recorded in st.slot.
+func (lb *LoadBalancer) nextServerWithSlot(req *http.Request) Server {
+	st := stateFrom(req.Context())
+	for {
+		server := lb.getNextAvailableServer(req)
+		if server == nil {
+			return nil
+		}
+		if slot, ok := lb.acquireSlot(server, st.priority); ok {
+			st.slot = slot
+			return server
+		}
+		TraceDecision(req, "passed over %s: at its concurrency cap", server.Address())
+		st.full = append(st.full, server.Address())
+	}
+}
+
+// releaseSlot gives back the slot taken for the request's current attempt
+func (st *requestState) releaseSlot() {
+	if st.slot != nil {
+		st.slot.Add(-1)
+		st.slot = nil
+	}
+}
@@ -0,0 +1,104 @@
+package loadbalancer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// addValidators gives a cached entry an ETag and Last-Modified when the backend sent none, so
+// clients can revalidate against the cache. Generated validators are never sent upstream.
+func addValidators(e *cacheEntry) {
+	if e.header.Get("ETag") == "" {
+		sum := sha256.Sum256(e.body)
+		e.header.Set("ETag", `"`+hex.EncodeToString(sum[:12])+`"`)
+		e.generatedETag = true
+	}
+	if e.header.Get("Last-Modified") == "" {
+		e.header.Set("Last-Modified", e.stored.UTC().Format(http.TimeFormat))
+		e.generatedLastModified = true
+	}
+}
+
+// notModified reports whether req's validators match e, following RFC 9110: If-None-Match
+// takes precedence and If-Modified-Since is only consulted without it
+func notModified(req *http.Request, e *cacheEntry) bool {
+	if e.status != http.StatusOK {
+		return false
+	}
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, e.header.Get("ETag"))
+	}
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(e.header.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// etagMatches is the weak comparison of an If-None-Match list against etag
+func etagMatches(list, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModifiedHeaders are the response headers a 304 repeats from the full response
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Last-Modified", "Vary"}
+
+func writeNotModified(rw http.ResponseWriter, e *cacheEntry) {
+	h := rw.Header()
+	for _, name := range notModifiedHeaders {
+		if v := e.header.Values(name); len(v) > 0 {
+			h[http.CanonicalHeaderKey(name)] = slices.Clone(v)
+		}
+	}
+	rw.WriteHeader(http.StatusNotModified)
+}
+
+// conditionalRequest prepares req for revalidating e upstream: the client's own validators are
+// replaced by the ones the backend issued for e
+func conditionalRequest(req *http.Request, e *cacheEntry) *http.Request {
+	out := req.Clone(req.Context())
+	out.Header.Del("If-None-Match")
+	out.Header.Del("If-Modified-Since")
+	if e == nil {
+		return out
+	}
+	if !e.generatedETag {
+		out.Header.Set("If-None-Match", e.header.Get("ETag"))
+	}
+	if !e.generatedLastModified {
+		out.Header.Set("If-Modified-Since", e.header.Get("Last-Modified"))
+	}
+	return out
+}
+
+// refreshed returns a copy of e renewed by a 304 from the backend carrying header
+func (c *responseCache) refreshed(e *cacheEntry, header http.Header, now time.Time) *cacheEntry {
+	merged := e.header.Clone()
+	for _, name := range notModifiedHeaders {
+		if v := header.Values(name); len(v) > 0 {
+			merged[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+	if e.generatedETag {
+		merged.Del("ETag")
+	}
+	if e.generatedLastModified {
+		merged.Del("Last-Modified")
+	}
+	return c.newEntry(e.key, e.status, merged, e.body, now)
+}
@@ -0,0 +1,76 @@
+package loadbalancer
+
+import (
+	"net"
+	"sync"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/metrics"
+)
+
+// WithMaxConnsPerClient caps the simultaneous frontend connections from one client IP
+// (for IPv6, one /64).
+// Connections over the limit are closed as soon as they are accepted and counted in
+// Stats().ConnectionsRejected, a first line of defence against connection floods.
+func WithMaxConnsPerClient(n int) Option {
+	return func(lb *LoadBalancer) {
+		lb.maxClientConns = n
+	}
+}
+
+// clientLimitListener enforces the per-client connection cap on accept
+type clientLimitListener struct {
+	net.Listener
+	limit    int
+	rejected *metrics.Counter
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (l *clientLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := remoteIP(conn)
+		l.mu.Lock()
+		if l.counts[ip] >= l.limit {
+			l.mu.Unlock()
+			l.rejected.Inc()
+			conn.Close()
+			continue
+		}
+		l.counts[ip]++
+		l.mu.Unlock()
+		return &limitedConn{Conn: conn, release: func() { l.release(ip) }}, nil
+	}
+}
+
+func (l *clientLimitListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts[ip]--; l.counts[ip] <= 0 {
+		delete(l.counts, ip)
+	}
+}
+
+// remoteIP returns the client key for conn's peer
+func remoteIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return clientKey(addr.AddrPort().Addr().Unmap().String())
+	}
+	return conn.RemoteAddr().String()
+}
+
+// limitedConn gives its slot back when closed
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
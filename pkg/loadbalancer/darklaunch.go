@@ -0,0 +1,93 @@
+package loadbalancer
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// DarkLaunch sends requests that carry a secret header or cookie to a hidden pre-release
+// pool, while everyone else stays on the regular backends. The hidden backends never take
+// regular traffic.
+type DarkLaunch struct {
+	// Header and Cookie name where the gate value is looked for; either may be empty
+	Header string
+	Cookie string
+	// Value is the initial gate value; it can be changed at runtime with SetDarkLaunchGate.
+	// An empty value closes the gate.
+	Value string
+	// Backends are the URLs of the pre-release pool
+	Backends []string
+	// Token is the bearer token PUT /dark-launch requires, besides the WithAdminToken one;
+	// without either the gate value can only be changed through SetDarkLaunchGate
+	Token string
+}
+
+// WithDarkLaunch enables header- or cookie-gated routing to a hidden pool
+func WithDarkLaunch(d DarkLaunch) Option {
+	return func(lb *LoadBalancer) {
+		lb.dark = &darkLaunch{DarkLaunch: d}
+		lb.dark.gate.Store(&d.Value)
+	}
+}
+
+type darkLaunch struct {
+	DarkLaunch
+	gate    atomic.Pointer[string]
+	servers []Server
+}
+
+// SetDarkLaunchGate changes the value that admits requests to the dark launch pool;
+// an empty value closes the gate. It does nothing without WithDarkLaunch.
+func (lb *LoadBalancer) SetDarkLaunchGate(value string) {
+	if lb.dark != nil {
+		lb.dark.gate.Store(&value)
+		lb.logger.Info("dark launch gate changed", "open", value != "")
+	}
+}
+
+// admits reports whether req presents the current gate value
+func (d *darkLaunch) admits(req *http.Request) bool {
+	gate := *d.gate.Load()
+	if gate == "" {
+		return false
+	}
+	var got string
+	if d.Header != "" {
+		got = req.Header.Get(d.Header)
+	}
+	if got == "" && d.Cookie != "" {
+		if c, err := req.Cookie(d.Cookie); err == nil {
+			got = c.Value
+		}
+	}
+	return got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(gate)) == 1
+}
+
+func (lb *LoadBalancer) darkLaunchMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if lb.dark.admits(req) {
+			st := stateFrom(req.Context())
+			st.pool, st.poolName = lb.dark.servers, PoolDark
+			st.allowed, st.strategy = nil, nil
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// serveDarkLaunchGate handles PUT /dark-launch with a body of {"value": "..."}
+func (lb *LoadBalancer) serveDarkLaunchGate(rw http.ResponseWriter, req *http.Request) {
+	if !lb.authorized(rw, req, lb.dark.Token) {
+		return
+	}
+	var body struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, 4096)).Decode(&body); err != nil {
+		http.Error(rw, "invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	lb.SetDarkLaunchGate(body.Value)
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,216 @@
+package loadbalancer
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// decisionTokenHeader carries DecisionTrace.Token
+const decisionTokenHeader = "X-LB-Trace-Token"
+
+// DecisionTrace explains why requests went to the backend they did: the candidates and their
+// load and weight, the strategy's reasoning, such as hash keys and scores, and why backends it
+// picked were passed over. A trusted caller asks for it by sending the Header, and gets the
+// trace back in an X-LB-Decision response header; SampleRate traces a share of all requests
+// into the log instead. Callers are trusted when they connect from one of the Trusted networks
+// or present Token in the X-LB-Trace-Token header.
+type DecisionTrace struct {
+	// Header asks for a trace of the request; default X-LB-Trace
+	Header string
+	// Token is the secret expected in X-LB-Trace-Token
+	Token string
+	// Trusted are client addresses or CIDRs allowed to ask for a trace without a token
+	Trusted []string
+	// SampleRate is the fraction of requests, between 0 and 1, traced into the log
+	SampleRate float64
+}
+
+// WithDecisionTrace traces the backend choice of the requests that ask for it, and of a sample
+func WithDecisionTrace(t DecisionTrace) Option {
+	return func(lb *LoadBalancer) {
+		if t.Header == "" {
+			t.Header = "X-LB-Trace"
+		}
+		lb.decisions = &t
+	}
+}
+
+type decisionTracer struct {
+	DecisionTrace
+	trusted []netip.Prefix
+}
+
+func compileDecisionTrace(t DecisionTrace) (*decisionTracer, error) {
+	if t.SampleRate < 0 || t.SampleRate > 1 {
+		return nil, errors.New("loadbalancer: decision trace sample rate must be between 0 and 1")
+	}
+	trusted, err := parsePrefixes(t.Trusted)
+	if err != nil {
+		return nil, err
+	}
+	return &decisionTracer{DecisionTrace: t, trusted: trusted}, nil
+}
+
+// authorized reports whether req may see its trace
+func (t *decisionTracer) authorized(req *http.Request) bool {
+	if t.Token != "" {
+		if got := req.Header.Get(decisionTokenHeader); got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(t.Token)) == 1 {
+			return true
+		}
+	}
+	addr, err := netip.ParseAddr(clientIP(req))
+	return err == nil && containsAddr(t.trusted, addr)
+}
+
+// decisionTrace collects the steps of one request's backend choice
+type decisionTrace struct {
+	mu    sync.Mutex
+	steps []string
+}
+
+func (d *decisionTrace) add(step string) {
+	d.mu.Lock()
+	d.steps = append(d.steps, step)
+	d.mu.Unlock()
+}
+
+func (d *decisionTrace) String() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return strings.Join(d.steps, "; ")
+}
+
+// decisionOf returns the trace of req, or nil when it isn't traced
+func decisionOf(req *http.Request) *decisionTrace {
+	if req == nil {
+		return nil
+	}
+	if st, ok := req.Context().Value(requestStateKey{}).(*requestState); ok {
+		return st.decision
+	}
+	return nil
+}
+
+// TraceDecision adds a step to the decision trace of req, when it is traced. Strategies call
+// it to explain their picks; it costs nothing for requests that aren't traced.
+func TraceDecision(req *http.Request, format string, args ...any) {
+	if d := decisionOf(req); d != nil {
+		d.add(fmt.Sprintf(format, args...))
+	}
+}
+
+// tracing reports whether req is traced, so callers can skip preparing a step nobody reads
+func tracing(req *http.Request) bool {
+	return decisionOf(req) != nil
+}
+
+// decisionMiddleware starts the trace of the requests that ask for one or are sampled, and reports it
+func (lb *LoadBalancer) decisionMiddleware(t *decisionTracer) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			asked := req.Header.Get(t.Header) != "" && t.authorized(req)
+			// neither header is for the backend's eyes
+			req.Header.Del(t.Header)
+			req.Header.Del(decisionTokenHeader)
+			if !asked && (t.SampleRate == 0 || rand.Float64() >= t.SampleRate) {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			st := stateFrom(req.Context())
+			d := &decisionTrace{}
+			st.decision = d
+			if asked {
+				rw = &decisionWriter{ResponseWriter: rw, trace: d}
+			}
+			next.ServeHTTP(rw, req)
+			if trace := d.String(); trace != "" {
+				server := ""
+				if st.server != nil {
+					server = st.server.Address()
+				}
+				lb.logger.Info("backend decision", "method", req.Method, "path", req.URL.Path, "server", server, "trace", trace)
+			}
+		})
+	}
+}
+
+// decisionWriter adds the trace to the response as it is sent
+type decisionWriter struct {
+	http.ResponseWriter
+	trace   *decisionTrace
+	written bool
+}
+
+func (w *decisionWriter) WriteHeader(code int) {
+	if !w.written && code >= 200 {
+		w.written = true
+		if s := w.trace.String(); s != "" {
+			w.Header().Set("X-LB-Decision", s)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *decisionWriter) Write(p []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *decisionWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// traceCandidates records the servers a request may go to, with their load and weight
+func traceCandidates(req *http.Request, strategy Strategy, servers []Server) {
+	st := stateFrom(req.Context())
+	parts := make([]string, len(servers))
+	for i, s := range servers {
+		parts[i] = fmt.Sprintf("%s (%d active, weight %d)", s.Address(), ActiveConnectionsOf(s), max(WeightOf(s), 1))
+	}
+	step := fmt.Sprintf("%s over %s", strategyName(strategy), strings.Join(parts, ", "))
+	if len(servers) == 0 {
+		step = "no candidates"
+	}
+	if len(st.failed) > 0 {
+		step += ", excluding failed " + strings.Join(st.failed, ", ")
+	}
+	if len(st.full) > 0 {
+		step += ", excluding full " + strings.Join(st.full, ", ")
+	}
+	if st.poolName != "" {
+		step = "pool " + st.poolName + ": " + step
+	}
+	TraceDecision(req, "%s", step)
+}
+
+// strategyName names a strategy in a trace
+func strategyName(s Strategy) string {
+	switch s := s.(type) {
+	case *RoundRobin:
+		return "round-robin"
+	case *LeastConnections:
+		return "least-connections"
+	case *WeightedRoundRobin:
+		return "weighted-round-robin"
+	case *WeightedRandom:
+		return "weighted-random"
+	case ConsistentHash:
+		return "consistent-hash"
+	case Chain:
+		names := make([]string, len(s))
+		for i, stage := range s {
+			names[i] = strategyName(stage)
+		}
+		return "chain " + strings.Join(names, ",")
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", s), "*")
+}
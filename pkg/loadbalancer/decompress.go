@@ -0,0 +1,85 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/router"
+)
+
+// RequestDecompression inflates gzip request bodies before they are proxied, for backends
+// that can't handle Content-Encoding on requests. The body is inflated in full before it is
+// sent, so the backend gets a plain body with an exact Content-Length; one that would inflate
+// past MaxBytes is refused with 413, which keeps a small zip bomb from turning into gigabytes,
+// and a corrupt one with 400. Bodies in other encodings pass unchanged. When several rules
+// match a request, the most specific one applies.
+type RequestDecompression struct {
+	// Host and PathPrefix select the requests the rule applies to; empty values match everything.
+	// Host may be a "*.example.com" wildcard.
+	Host       string
+	PathPrefix string
+	// MaxBytes is the largest inflated body; default 10 MiB
+	MaxBytes int64
+}
+
+// WithRequestDecompression adds rules inflating gzip request bodies
+func WithRequestDecompression(rules ...RequestDecompression) Option {
+	return func(lb *LoadBalancer) {
+		for _, r := range rules {
+			if r.MaxBytes <= 0 {
+				r.MaxBytes = 10 << 20
+			}
+			lb.decompress = append(lb.decompress, r)
+		}
+	}
+}
+
+// decompressMiddleware inflates the gzip bodies of requests matching one of rules
+func (lb *LoadBalancer) decompressMiddleware(rules []RequestDecompression) (Middleware, error) {
+	routes := make([]router.Rule[*RequestDecompression], len(rules))
+	for i := range rules {
+		r := &rules[i]
+		routes[i] = router.Rule[*RequestDecompression]{Host: r.Host, PathPrefix: r.PathPrefix, Target: r}
+	}
+	table, err := router.Compile(routes)
+	if err != nil {
+		return nil, err
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			enc := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+			if enc != "gzip" && enc != "x-gzip" || req.Body == nil || req.Body == http.NoBody {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			rule, ok := table.Match(req.Host, req.URL.Path)
+			if !ok {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			zr, err := gzip.NewReader(req.Body)
+			if err != nil {
+				http.Error(rw, "invalid gzip request body", http.StatusBadRequest)
+				return
+			}
+			body, err := io.ReadAll(io.LimitReader(zr, rule.MaxBytes+1))
+			if err != nil {
+				http.Error(rw, "invalid gzip request body", http.StatusBadRequest)
+				return
+			}
+			if int64(len(body)) > rule.MaxBytes {
+				lb.logger.Warn("refusing request body that inflates too far", "path", req.URL.Path, "client", clientIP(req), "max_bytes", rule.MaxBytes)
+				http.Error(rw, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			req.Body.Close()
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+			req.Header.Del("Content-Encoding")
+			next.ServeHTTP(rw, req)
+		})
+	}, nil
+}
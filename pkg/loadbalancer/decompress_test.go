@@ -0,0 +1,54 @@
+package loadbalancer_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/loadbalancer"
+)
+
+func TestRequestDecompressionMostSpecific(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.Copy(rw, req.Body)
+	}))
+	t.Cleanup(backend.Close)
+	lb, err := loadbalancer.New(
+		loadbalancer.WithBackends(backend.URL),
+		loadbalancer.WithRequestDecompression(
+			loadbalancer.RequestDecompression{PathPrefix: "/", MaxBytes: 4},
+			loadbalancer.RequestDecompression{Host: "*.example.com", PathPrefix: "/ingest"},
+		),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("0123456789"))
+	zw.Close()
+
+	for _, tt := range []struct {
+		host, path string
+		want       int
+	}{
+		{"other.org", "/ingest", http.StatusRequestEntityTooLarge},
+		{"api.example.com", "/", http.StatusRequestEntityTooLarge},
+		{"api.example.com:8080", "/ingest/events", http.StatusOK},
+	} {
+		req := httptest.NewRequest("POST", tt.path, bytes.NewReader(gz.Bytes()))
+		req.Host = tt.host
+		req.Header.Set("Content-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s%s: status %d, want %d", tt.host, tt.path, rec.Code, tt.want)
+		}
+		if tt.want == http.StatusOK && rec.Body.String() != "0123456789" {
+			t.Errorf("%s%s: backend got %q", tt.host, tt.path, rec.Body.String())
+		}
+	}
+}
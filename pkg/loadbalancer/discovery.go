@@ -0,0 +1,186 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// Backend is a backend reported by a discoverer together with what the source knows about it
+type Backend struct {
+	Address string
+	// Weight is the backend's relative weight; 0 leaves it to other sources or the default
+	Weight int
+	Labels map[string]string
+}
+
+// BackendDiscoverer is implemented by discoverers that report weights and labels along with
+// addresses. Refresh prefers it over Discover.
+type BackendDiscoverer interface {
+	DiscoverBackends(ctx context.Context) ([]Backend, error)
+}
+
+// WithDiscoverer adds a source of backends that is consulted by Refresh
+func WithDiscoverer(d Discoverer) Option {
+	return func(lb *LoadBalancer) {
+		lb.discoverers = append(lb.discoverers, d)
+	}
+}
+
+// canonicalAddr spells a backend URL one way, so "http://B:80/" and "http://b" are recognised
+// as the same backend
+func canonicalAddr(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" {
+		return addr
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	switch {
+	case u.Port() == "80" && (u.Scheme == "http" || u.Scheme == schemeH2C),
+		u.Port() == "443" && u.Scheme == "https":
+		u.Host = strings.TrimSuffix(u.Host, ":"+u.Port())
+	}
+	if u.Path == "/" {
+		u.Path = ""
+	}
+	return u.String()
+}
+
+// mergeBackend folds b into the entry for the same backend: the highest weight is kept and
+// labels are combined, the first source to set a label winning
+func mergeBackend(found map[string]Backend, b Backend) {
+	key := canonicalAddr(b.Address)
+	cur, ok := found[key]
+	if !ok {
+		found[key] = Backend{Address: b.Address, Weight: b.Weight, Labels: maps.Clone(b.Labels)}
+		return
+	}
+	cur.Weight = max(cur.Weight, b.Weight)
+	for k, v := range b.Labels {
+		if _, set := cur.Labels[k]; !set {
+			if cur.Labels == nil {
+				cur.Labels = make(map[string]string)
+			}
+			cur.Labels[k] = v
+		}
+	}
+	found[key] = cur
+}
+
+// mergeDuplicate folds the weight and labels of a repeated entry for a backend into the server
+// built for the first one, as mergeBackend does for discovered ones; the entry's other options
+// are dropped
+func mergeDuplicate(dup backendSpec) ServerOption {
+	return func(s *SimpleServer) {
+		// the entry's options are read off a stand-in, so no second proxy is built
+		probe := &SimpleServer{target: s.target, proxy: &httputil.ReverseProxy{}}
+		probe.weight.Store(1)
+		for _, opt := range dup.opts {
+			opt(probe)
+		}
+		key := canonicalAddr(s.addr)
+		found := map[string]Backend{key: {Address: s.addr, Weight: int(s.weight.Load()), Labels: maps.Clone(s.ownLabels)}}
+		mergeBackend(found, Backend{Address: dup.addr, Weight: int(probe.weight.Load()), Labels: probe.ownLabels})
+		s.weight.Store(int64(found[key].Weight))
+		s.labelMu.Lock()
+		s.ownLabels = found[key].Labels
+		s.mergeLabels()
+		s.labelMu.Unlock()
+	}
+}
+
+func discover(ctx context.Context, d Discoverer) ([]Backend, error) {
+	if bd, ok := d.(BackendDiscoverer); ok {
+		return bd.DiscoverBackends(ctx)
+	}
+	addrs, err := d.Discover(ctx)
+	backends := make([]Backend, len(addrs))
+	for i, addr := range addrs {
+		backends[i] = Backend{Address: addr}
+	}
+	return backends, err
+}
+
+// Refresh asks every discoverer for its backends and updates the pool.
+// New addresses become SimpleServers, and discovered servers that are no longer reported are removed;
+// servers added through WithServers or WithBackends are never removed.
+// An address reported by several sources, or also configured statically, is a single pool member:
+// it takes the highest reported weight and the union of the labels, and a static member keeps
+// its own weight and labels, gaining only labels it lacks.
+// When a discoverer fails, no discovered server is removed in that round.
+func (lb *LoadBalancer) Refresh(ctx context.Context) error {
+	var errs []error
+	found := make(map[string]Backend)
+	for _, d := range lb.discoverers {
+		backends, err := discover(ctx, d)
+		if err != nil {
+			errs = append(errs, err)
+			// without this source's answer, keep everything discovered so far
+			lb.mu.Lock()
+			for _, b := range lb.discovered {
+				mergeBackend(found, b)
+			}
+			lb.mu.Unlock()
+			continue
+		}
+		for _, b := range backends {
+			mergeBackend(found, b)
+		}
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	kept := lb.serverList[:0:0]
+	present := make(map[string]bool)
+	for _, s := range lb.serverList {
+		key := canonicalAddr(s.Address())
+		_, discovered := lb.discovered[key]
+		b, ok := found[key]
+		if discovered && !ok {
+			delete(lb.discovered, key)
+			continue
+		}
+		if ok {
+			applyMetadata(s, b, discovered)
+			if discovered {
+				lb.discovered[key] = b
+			}
+		}
+		kept = append(kept, s)
+		present[key] = true
+	}
+	for key, b := range found {
+		if present[key] {
+			continue
+		}
+		server, err := newSimpleServer(b.Address, lb.transport, lb.serverOptions()...)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		applyMetadata(server, b, true)
+		kept = append(kept, server)
+		lb.discovered[key] = b
+		lb.warmUp(server)
+		lb.prewarmAdded(server)
+	}
+	lb.serverList = kept
+	return errors.Join(errs...)
+}
+
+// applyMetadata updates a SimpleServer from discovered metadata. Discovered members take it
+// as reported; static members only gain labels they don't set themselves.
+func applyMetadata(s Server, b Backend, discovered bool) {
+	ss, ok := s.(*SimpleServer)
+	if !ok {
+		return
+	}
+	if discovered && b.Weight > 0 {
+		ss.SetWeight(b.Weight)
+	}
+	ss.setDiscoveredLabels(b.Labels)
+}
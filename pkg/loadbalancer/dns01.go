@@ -0,0 +1,284 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// DNSProvider publishes the TXT records that answer ACME DNS-01 challenges. Records for the
+// same name may be asked for one after another, each removed before the next is presented.
+type DNSProvider interface {
+	// Present creates a TXT record named fqdn, ending in a dot, holding value
+	Present(ctx context.Context, fqdn, value string) error
+	// CleanUp removes the record Present created
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+const (
+	// dnsCertRenewBefore is how long before expiry a certificate is renewed
+	dnsCertRenewBefore = 30 * 24 * time.Hour
+	// dnsCertRetry is how long a failed issuance waits before trying again
+	dnsCertRetry = 10 * time.Minute
+	// dnsCertCheck bounds the sleep between two looks at the certificate's expiry
+	dnsCertCheck = 12 * time.Hour
+)
+
+// dnsCert obtains one certificate for all hosts through DNS-01 and serves it
+type dnsCert struct {
+	AutoCert
+	cert atomic.Pointer[tls.Certificate]
+}
+
+func (d *dnsCert) validate() error {
+	if len(d.Hosts) == 0 {
+		return errors.New("DNS-01 certificate without hosts")
+	}
+	for _, host := range d.Hosts {
+		if strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+			return fmt.Errorf("DNS-01 certificate host %q: only a leading *. is allowed", host)
+		}
+	}
+	return nil
+}
+
+// getCertificate serves the certificate once it has been obtained
+func (d *dnsCert) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := d.cert.Load(); cert != nil {
+		return cert, nil
+	}
+	return nil, errors.New("loadbalancer: DNS-01 certificate not obtained yet")
+}
+
+// dnsCertLoop loads the cached certificate and keeps it renewed until ctx is done
+func (lb *LoadBalancer) dnsCertLoop(ctx context.Context) {
+	d := lb.dnsCert
+	if cert, err := d.load(); err == nil {
+		d.cert.Store(cert)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		lb.logger.Warn("cached DNS-01 certificate unusable", "error", err)
+	}
+	for {
+		wait := dnsCertCheck
+		if cert := d.cert.Load(); cert == nil || time.Until(cert.Leaf.NotAfter) < dnsCertRenewBefore {
+			cert, err := d.obtain(ctx)
+			switch {
+			case ctx.Err() != nil:
+				return
+			case err != nil:
+				lb.logger.Error("obtaining DNS-01 certificate failed", "hosts", d.Hosts, "error", err)
+				wait = dnsCertRetry
+			default:
+				d.cert.Store(cert)
+				lb.logger.Info("obtained DNS-01 certificate", "hosts", d.Hosts, "expires", cert.Leaf.NotAfter)
+			}
+		}
+		if cert := d.cert.Load(); cert != nil && wait == dnsCertCheck {
+			wait = min(wait, max(time.Until(cert.Leaf.NotAfter)-dnsCertRenewBefore, time.Minute))
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// certPath is where the certificate and its key are cached
+func (d *dnsCert) certPath() string {
+	return filepath.Join(d.CacheDir, strings.ReplaceAll(d.Hosts[0], "*", "_")+"+dns01")
+}
+
+// load reads the cached certificate, failing if it doesn't cover every host
+func (d *dnsCert) load() (*tls.Certificate, error) {
+	data, err := os.ReadFile(d.certPath())
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range d.Hosts {
+		if !slices.Contains(cert.Leaf.DNSNames, host) {
+			return nil, fmt.Errorf("cached certificate doesn't cover %s", host)
+		}
+	}
+	return &cert, nil
+}
+
+// client returns an ACME client with the cached account key, registering the account the
+// first time
+func (d *dnsCert) client(ctx context.Context) (*acme.Client, error) {
+	keyPath := filepath.Join(d.CacheDir, "acme_account+key")
+	var key *ecdsa.PrivateKey
+	if data, err := os.ReadFile(keyPath); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("ACME account key: no PEM data")
+		}
+		if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("ACME account key: %w", err)
+		}
+	} else if errors.Is(err, os.ErrNotExist) {
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(d.CacheDir, 0o700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+
+	client := &acme.Client{Key: key, DirectoryURL: d.DirectoryURL}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = acme.LetsEncryptURL
+	}
+	account := &acme.Account{}
+	if d.Email != "" {
+		account.Contact = []string{"mailto:" + d.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("ACME registration: %w", err)
+	}
+	return client, nil
+}
+
+// obtain orders a certificate for all hosts, answers its challenges through DNS and caches
+// the result
+func (d *dnsCert) obtain(ctx context.Context) (*tls.Certificate, error) {
+	client, err := d.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(d.Hosts...))
+	if err != nil {
+		return nil, err
+	}
+	// one at a time, since a host and its wildcard share a record name
+	for _, url := range order.AuthzURLs {
+		if err := d.authorize(ctx, client, url); err != nil {
+			return nil, err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: d.Hosts}, key)
+	if err != nil {
+		return nil, err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	for _, der := range chain {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	if err := os.WriteFile(d.certPath(), data, 0o600); err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: chain, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// authorize answers the DNS-01 challenge of one authorization, removing the record afterwards
+func (d *dnsCert) authorize(ctx context.Context, client *acme.Client, url string) error {
+	authz, err := client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("%s: the CA offers no dns-01 challenge", authz.Identifier.Value)
+	}
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	// a wildcard's identifier is the name without "*."
+	fqdn := "_acme-challenge." + authz.Identifier.Value + "."
+	if err := d.DNS.Present(ctx, fqdn, value); err != nil {
+		return fmt.Errorf("publishing %s: %w", fqdn, err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		d.DNS.CleanUp(ctx, fqdn, value)
+	}()
+
+	d.awaitRecord(ctx, fqdn, value)
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("%s: %w", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// awaitRecord polls DNS until fqdn holds value or DNSPropagation has passed. The CA asks the
+// zone's authoritative servers, so a record this resolver can't see yet may still do.
+func (d *dnsCert) awaitRecord(ctx context.Context, fqdn, value string) {
+	ctx, cancel := context.WithTimeout(ctx, d.DNSPropagation)
+	defer cancel()
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		if values, err := net.DefaultResolver.LookupTXT(ctx, fqdn); err == nil && slices.Contains(values, value) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CloudflareDNS publishes DNS-01 records through the Cloudflare API
+type CloudflareDNS struct {
+	// APIToken needs the Zone.DNS edit permission on the zone
+	APIToken string
+	// ZoneID is the zone holding the records; when empty it is looked up by name, which also
+	// needs the Zone.Zone read permission
+	ZoneID string
+	// Client defaults to a client with a 30s timeout
+	Client *http.Client
+}
+
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// cloudflareResponse is the envelope of every Cloudflare API response
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+// Present implements DNSProvider
+func (c *CloudflareDNS) Present(ctx context.Context, fqdn, value string) error {
+	zone, err := c.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	record := map[string]any{"type": "TXT", "name": strings.TrimSuffix(fqdn, "."), "content": value, "ttl": 120}
+	return c.call(ctx, http.MethodPost, "/zones/"+zone+"/dns_records", record, nil)
+}
+
+// CleanUp implements DNSProvider
+func (c *CloudflareDNS) CleanUp(ctx context.Context, fqdn, value string) error {
+	zone, err := c.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	query := url.Values{"type": {"TXT"}, "name": {strings.TrimSuffix(fqdn, ".")}, "content": {value}}
+	var records []struct {
+		ID string `json:"id"`
+	}
+	if err := c.call(ctx, http.MethodGet, "/zones/"+zone+"/dns_records?"+query.Encode(), nil, &records); err != nil {
+		return err
+	}
+	for _, r := range records {
+		if err := c.call(ctx, http.MethodDelete, "/zones/"+zone+"/dns_records/"+r.ID, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zone returns ZoneID, or the ID of the closest enclosing zone of fqdn in the account
+func (c *CloudflareDNS) zone(ctx context.Context, fqdn string) (string, error) {
+	if c.ZoneID != "" {
+		return c.ZoneID, nil
+	}
+	for name := range parentDomains(fqdn) {
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		if err := c.call(ctx, http.MethodGet, "/zones?name="+url.QueryEscape(name), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			return zones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("cloudflare: no zone holds %s", fqdn)
+}
+
+// call sends body as JSON and decodes the response's result into result
+func (c *CloudflareDNS) call(ctx context.Context, method, path string, body, result any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, cloudflareAPI+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.APIToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := dnsClient(c.Client).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var out cloudflareResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out); err != nil {
+		return fmt.Errorf("cloudflare: %s %s: %s", method, path, resp.Status)
+	}
+	if !out.Success {
+		msgs := make([]string, len(out.Errors))
+		for i, e := range out.Errors {
+			msgs[i] = fmt.Sprintf("%d %s", e.Code, e.Message)
+		}
+		return fmt.Errorf("cloudflare: %s %s: %s", method, path, strings.Join(msgs, "; "))
+	}
+	if result != nil {
+		return json.Unmarshal(out.Result, result)
+	}
+	return nil
+}
+
+// Route53DNS publishes DNS-01 records in an AWS Route 53 hosted zone
+type Route53DNS struct {
+	AccessKey string
+	SecretKey string
+	// SessionToken is sent with temporary credentials
+	SessionToken string
+	// HostedZoneID is the zone holding the records; when empty the public zone is looked up
+	// by name, which also needs route53:ListHostedZonesByName
+	HostedZoneID string
+	// Client defaults to a client with a 30s timeout
+	Client *http.Client
+}
+
+const route53API = "https://route53.amazonaws.com/2013-04-01"
+
+type route53Change struct {
+	XMLName     xml.Name `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+	Action      string   `xml:"ChangeBatch>Changes>Change>Action"`
+	Name        string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Name"`
+	Type        string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Type"`
+	TTL         int      `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>TTL"`
+	RecordValue string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>ResourceRecords>ResourceRecord>Value"`
+}
+
+type route53ChangeInfo struct {
+	ID     string `xml:"ChangeInfo>Id"`
+	Status string `xml:"ChangeInfo>Status"`
+}
+
+// Present implements DNSProvider. It returns once Route 53 reports the change in sync on all
+// of its name servers.
+func (r *Route53DNS) Present(ctx context.Context, fqdn, value string) error {
+	return r.change(ctx, "UPSERT", fqdn, value, true)
+}
+
+// CleanUp implements DNSProvider
+func (r *Route53DNS) CleanUp(ctx context.Context, fqdn, value string) error {
+	return r.change(ctx, "DELETE", fqdn, value, false)
+}
+
+// change applies one change to the TXT record set, waiting for it to be in sync if asked to
+func (r *Route53DNS) change(ctx context.Context, action, fqdn, value string, wait bool) error {
+	zone, err := r.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	body, err := xml.Marshal(route53Change{Action: action, Name: fqdn, Type: "TXT", TTL: 60, RecordValue: `"` + value + `"`})
+	if err != nil {
+		return err
+	}
+	var info route53ChangeInfo
+	if err := r.call(ctx, http.MethodPost, "/hostedzone/"+zone+"/rrset", append([]byte(xml.Header), body...), &info); err != nil {
+		return err
+	}
+	for wait && info.Status != "INSYNC" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+		if err := r.call(ctx, http.MethodGet, "/change/"+strings.TrimPrefix(info.ID, "/change/"), nil, &info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zone returns HostedZoneID, or the ID of the closest enclosing public zone of fqdn
+func (r *Route53DNS) zone(ctx context.Context, fqdn string) (string, error) {
+	if r.HostedZoneID != "" {
+		return strings.TrimPrefix(r.HostedZoneID, "/hostedzone/"), nil
+	}
+	for name := range parentDomains(fqdn) {
+		var out struct {
+			Zones []struct {
+				ID      string `xml:"Id"`
+				Name    string `xml:"Name"`
+				Private bool   `xml:"Config>PrivateZone"`
+			} `xml:"HostedZones>HostedZone"`
+		}
+		if err := r.call(ctx, http.MethodGet, "/hostedzonesbyname?dnsname="+url.QueryEscape(name), nil, &out); err != nil {
+			return "", err
+		}
+		for _, z := range out.Zones {
+			if z.Name == name+"." && !z.Private {
+				return strings.TrimPrefix(z.ID, "/hostedzone/"), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("route53: no public hosted zone holds %s", fqdn)
+}
+
+// call sends a signed request and decodes the XML response into result
+func (r *Route53DNS) call(ctx context.Context, method, path string, body []byte, result any) error {
+	req, err := http.NewRequestWithContext(ctx, method, route53API+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "text/xml")
+	}
+	sum := sha256.Sum256(body)
+	signer := &SigV4Signer{AccessKey: r.AccessKey, SecretKey: r.SecretKey, SessionToken: r.SessionToken, Region: "us-east-1", Service: "route53"}
+	signer.sign(req, time.Now(), hex.EncodeToString(sum[:]))
+	resp, err := dnsClient(r.Client).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var failure struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		if xml.Unmarshal(data, &failure) == nil && failure.Code != "" {
+			return fmt.Errorf("route53: %s %s: %s: %s", method, path, failure.Code, failure.Message)
+		}
+		return fmt.Errorf("route53: %s %s: %s", method, path, resp.Status)
+	}
+	return xml.Unmarshal(data, result)
+}
+
+// parentDomains yields fqdn without its trailing dot and then each enclosing domain down to
+// the last two labels
+func parentDomains(fqdn string) func(yield func(string) bool) {
+	return func(yield func(string) bool) {
+		name := strings.TrimSuffix(fqdn, ".")
+		for strings.Count(name, ".") >= 1 {
+			if !yield(name) {
+				return
+			}
+			_, name, _ = strings.Cut(name, ".")
+		}
+	}
+}
+
+func dnsClient(c *http.Client) *http.Client {
+	if c != nil {
+		return c
+	}
+	return &http.Client{Timeout: 30 * time.Second}
+}
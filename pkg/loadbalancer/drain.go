@@ -0,0 +1,212 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// drainPoll is how often DrainBackend looks at a draining backend's in-flight count
+const drainPoll = 100 * time.Millisecond
+
+// drainWatchPoll is how often a draining backend is checked for OnDrained
+const drainWatchPoll = time.Second
+
+// DrainBackend stops sending new requests to the backend at addr and waits until the requests
+// already in flight to it have finished. The backend stays in the pool, drained, until
+// RemoveBackend or ResumeBackend. It fails with ErrUnknownBackend when no pool member has the
+// address, and with ctx's error when requests are still running once ctx is done.
+func (lb *LoadBalancer) DrainBackend(ctx context.Context, addr string) error {
+	server, err := lb.startDrain(addr)
+	if err != nil {
+		return err
+	}
+	tick := time.NewTicker(drainPoll)
+	defer tick.Stop()
+	for ActiveConnectionsOf(server) > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("backend %s still has %d requests in flight: %w", server.Address(), ActiveConnectionsOf(server), ctx.Err())
+		case <-tick.C:
+		}
+	}
+	lb.logger.Info("backend drained", "server", server.Address())
+	return nil
+}
+
+// StartDrain stops sending new requests to the backend at addr without waiting for it; its
+// progress shows in DrainStatuses, and OnDrained hooks are called once it is done
+func (lb *LoadBalancer) StartDrain(addr string) error {
+	_, err := lb.startDrain(addr)
+	return err
+}
+
+// startDrain marks the backend draining, unless it already is, and watches it drain
+func (lb *LoadBalancer) startDrain(addr string) (Server, error) {
+	server := lb.member(addr)
+	if server == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownBackend, addr)
+	}
+	lb.stateMu.Lock()
+	since, already := lb.draining[server.Address()]
+	if !already {
+		since = time.Now()
+		lb.draining[server.Address()] = since
+	}
+	lb.stateMu.Unlock()
+	if !already {
+		lb.logger.Info("draining backend", "server", server.Address(), "in_flight", ActiveConnectionsOf(server))
+		go lb.watchDrain(server, since)
+	}
+	return server, nil
+}
+
+// DrainStatus is how far a draining backend has come
+type DrainStatus struct {
+	Backend string    `json:"backend"`
+	Since   time.Time `json:"since"`
+	// InFlight counts the requests still running on the backend
+	InFlight int64 `json:"in_flight"`
+	// Sessions counts the sticky clients still pinned to the backend that made a request within
+	// Affinity.SessionIdle; they move to another backend with their next request. It is always
+	// 0 without WithAffinity.
+	Sessions int `json:"sessions"`
+	// Drained is set once both are 0, when the backend can be shut down
+	Drained bool `json:"drained"`
+}
+
+// DrainStatuses reports on every backend being drained
+func (lb *LoadBalancer) DrainStatuses() []DrainStatus {
+	var statuses []DrainStatus
+	for _, server := range lb.Servers() {
+		if status, ok := lb.drainStatus(server); ok {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+// drainStatus reports on server, if it is draining
+func (lb *LoadBalancer) drainStatus(server Server) (DrainStatus, bool) {
+	lb.stateMu.Lock()
+	since, ok := lb.draining[server.Address()]
+	lb.stateMu.Unlock()
+	if !ok {
+		return DrainStatus{}, false
+	}
+	status := DrainStatus{
+		Backend:  server.Address(),
+		Since:    since,
+		InFlight: ActiveConnectionsOf(server),
+		Sessions: lb.sessions.count(server.Address(), time.Now()),
+	}
+	status.Drained = status.InFlight == 0 && status.Sessions == 0
+	return status, true
+}
+
+// watchDrain fires the OnDrained hooks once server has drained, and gives up when it is
+// resumed or removed first
+func (lb *LoadBalancer) watchDrain(server Server, since time.Time) {
+	tick := time.NewTicker(drainWatchPoll)
+	defer tick.Stop()
+	for range tick.C {
+		status, ok := lb.drainStatus(server)
+		if !ok || !status.Since.Equal(since) || lb.member(server.Address()) != server {
+			return
+		}
+		if status.Drained {
+			lb.logger.Info("backend drained of requests and sessions", "server", server.Address(), "took", time.Since(since))
+			lb.fireDrained(status)
+			return
+		}
+	}
+}
+
+// WithDrainWebhook POSTs a DrainStatus to w once each draining backend has no requests in
+// flight and no sticky sessions left, so deploy tooling knows the instance can be stopped
+func WithDrainWebhook(w *Webhook) Option {
+	return func(lb *LoadBalancer) {
+		lb.hooks = append(lb.hooks, Hooks{OnDrained: func(status DrainStatus) {
+			go func() {
+				if err := w.PublishDrained(context.Background(), status); err != nil {
+					lb.logger.Warn("drain webhook failed", "server", status.Backend, "error", err)
+				}
+			}()
+		}})
+	}
+}
+
+// serveDrains handles GET /drains
+func (lb *LoadBalancer) serveDrains(rw http.ResponseWriter, _ *http.Request) {
+	statuses := lb.DrainStatuses()
+	if statuses == nil {
+		statuses = []DrainStatus{}
+	}
+	writeJSON(rw, statuses)
+}
+
+// ResumeBackend lets a drained backend take new requests again
+func (lb *LoadBalancer) ResumeBackend(addr string) error {
+	server := lb.member(addr)
+	if server == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownBackend, addr)
+	}
+	lb.stateMu.Lock()
+	delete(lb.draining, server.Address())
+	lb.stateMu.Unlock()
+	lb.logger.Info("backend resumed", "server", server.Address())
+	return nil
+}
+
+// isDraining reports whether addr was drained with DrainBackend
+func (lb *LoadBalancer) isDraining(addr string) bool {
+	lb.stateMu.Lock()
+	defer lb.stateMu.Unlock()
+	_, ok := lb.draining[addr]
+	return ok
+}
+
+// member returns the pool member at addr, or nil
+func (lb *LoadBalancer) member(addr string) Server {
+	key := canonicalAddr(addr)
+	for _, s := range lb.Servers() {
+		if canonicalAddr(s.Address()) == key {
+			return s
+		}
+	}
+	return nil
+}
+
+// serveStartDrain handles POST /drains/{address}: the backend stops taking new requests, and
+// GET /drains shows when it is safe to stop
+func (lb *LoadBalancer) serveStartDrain(rw http.ResponseWriter, req *http.Request) {
+	if !lb.authorized(rw, req, lb.backendAPI.Token) {
+		return
+	}
+	addr, ok := lb.memberAddress(rw, req.PathValue("addr"))
+	if !ok {
+		return
+	}
+	if err := lb.StartDrain(addr); err != nil {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+// serveResume handles DELETE /drains/{address}, putting the backend back into rotation
+func (lb *LoadBalancer) serveResume(rw http.ResponseWriter, req *http.Request) {
+	if !lb.authorized(rw, req, lb.backendAPI.Token) {
+		return
+	}
+	addr, ok := lb.memberAddress(rw, req.PathValue("addr"))
+	if !ok {
+		return
+	}
+	if err := lb.ResumeBackend(addr); err != nil {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
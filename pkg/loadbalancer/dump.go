@@ -0,0 +1,122 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// StateDump is everything the balancer knows at one instant, for attaching to a support
+// request. Client addresses are replaced by a hash, and nothing secret is included.
+type StateDump struct {
+	Time     time.Time `json:"time"`
+	Balancer string    `json:"balancer"`
+	Leader   bool      `json:"leader"`
+	// Ready is the reason the balancer is not ready, or "ok"
+	Ready    string `json:"ready"`
+	Strategy string `json:"strategy"`
+	Stats    Stats  `json:"stats"`
+	// InFlight sums the requests in flight to the regular backends
+	InFlight int64           `json:"in_flight"`
+	Backends []backendStatus `json:"backends"`
+	Pools    []poolStatus    `json:"pools,omitempty"`
+	// PeerDown lists the backends that gossip peers currently report down
+	PeerDown []string      `json:"peer_down,omitempty"`
+	Affinity *affinityDump `json:"affinity,omitempty"`
+	Canary   *CanaryStatus `json:"canary,omitempty"`
+	// FailedOver is set while traffic goes to the remote region
+	FailedOver bool  `json:"failed_over,omitempty"`
+	Bans       []Ban `json:"bans,omitempty"`
+}
+
+// affinityDump is the sticky-session table: which cookie value leads to which backend
+type affinityDump struct {
+	Cookie string            `json:"cookie"`
+	IPHash bool              `json:"ip_hash"`
+	IDs    map[string]string `json:"ids"`
+}
+
+// DumpState captures the balancer's state. Pool membership is locked for the duration, so
+// no backend is added or removed halfway through; requests wait for it to finish. ctx bounds
+// the readiness probes, which run before the lock is taken.
+func (lb *LoadBalancer) DumpState(ctx context.Context) StateDump {
+	ready := "ok"
+	if err := lb.Ready(ctx); err != nil {
+		ready = err.Error()
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	d := StateDump{
+		Time:     time.Now().UTC(),
+		Balancer: lb.name,
+		Leader:   lb.IsLeader(),
+		Ready:    ready,
+		Strategy: fmt.Sprintf("%T", lb.strategy),
+		Stats:    lb.Stats(),
+		Backends: make([]backendStatus, 0, len(lb.serverList)),
+	}
+	for _, server := range lb.serverList {
+		d.InFlight += ActiveConnectionsOf(server)
+		d.Backends = append(d.Backends, lb.backendStatusOf(server))
+	}
+	for _, def := range lb.poolDefs {
+		p := lb.pools[def.Name]
+		status := poolStatus{Name: p.Name, Backends: make([]backendStatus, 0, len(p.servers))}
+		for _, server := range p.servers {
+			status.Backends = append(status.Backends, lb.backendStatusOf(server))
+		}
+		d.Pools = append(d.Pools, status)
+	}
+	if lb.gossip != nil {
+		for _, server := range lb.serverList {
+			if lb.reportedDown(server.Address()) {
+				d.PeerDown = append(d.PeerDown, server.Address())
+			}
+		}
+	}
+	if lb.affinity != nil {
+		a := &affinityDump{Cookie: lb.affinity.Cookie, IPHash: lb.affinity.IPHash, IDs: make(map[string]string)}
+		for _, server := range lb.serverList {
+			a.IDs[affinityID(server.Address())] = server.Address()
+		}
+		d.Affinity = a
+	}
+	if lb.canary != nil {
+		status := lb.CanaryStatus()
+		d.Canary = &status
+	}
+	d.FailedOver = lb.FailedOver()
+	if lb.abuse != nil {
+		lb.abuse.mu.Lock()
+		for _, ban := range lb.abuse.bans {
+			if d.Time.Before(ban.Until) {
+				ban.Client = redact(ban.Client)
+				d.Bans = append(d.Bans, ban)
+			}
+		}
+		lb.abuse.mu.Unlock()
+		sort.Slice(d.Bans, func(i, j int) bool { return d.Bans[i].Until.Before(d.Bans[j].Until) })
+	}
+	return d
+}
+
+// redact stands in for a client address with a short hash, so the same client can still be
+// followed through one dump
+func redact(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return "client-" + hex.EncodeToString(sum[:6])
+}
+
+// serveDump handles GET /debug/state, for callers presenting the admin token
+func (lb *LoadBalancer) serveDump(rw http.ResponseWriter, req *http.Request) {
+	if !lb.authorized(rw, req) {
+		return
+	}
+	rw.Header().Set("Content-Disposition", `attachment; filename="lb-state.json"`)
+	writeJSON(rw, lb.DumpState(req.Context()))
+}
@@ -0,0 +1,79 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// WithEgressProxy sends the traffic of servers created from WithBackends and discovery
+// through a forward proxy (http, https or socks5). Without it the HTTP_PROXY, HTTPS_PROXY
+// and NO_PROXY environment variables decide, as for any Go client.
+func WithEgressProxy(proxyURL *url.URL) Option {
+	return func(lb *LoadBalancer) {
+		lb.egressProxy = proxyURL
+	}
+}
+
+// WithProxy sends this server's traffic, health checks included, through a forward proxy
+// (http, https or socks5), overriding the environment. It requires the server's transport
+// to be an *http.Transport.
+func WithProxy(proxyURL *url.URL) ServerOption {
+	return func(s *SimpleServer) {
+		s.egress = proxyURL
+	}
+}
+
+// serverOptions returns the options applied to every server the balancer builds itself
+func (lb *LoadBalancer) serverOptions() []ServerOption {
+	opts := []ServerOption{WithServerLogger(lb.logger)}
+	if lb.timeouts != nil {
+		opts = append(opts, WithTimeouts(*lb.timeouts))
+	}
+	if lb.source != nil {
+		opts = append(opts, WithSource(*lb.source))
+	}
+	if lb.backendTLS != nil {
+		opts = append(opts, WithBackendTLS(*lb.backendTLS))
+	}
+	if lb.egressProxy != nil {
+		opts = append(opts, WithProxy(lb.egressProxy))
+	}
+	if lb.idleProbe != nil {
+		opts = append(opts, WithKeepAliveProbes(lb.idleProbe.keepAlive()))
+	}
+	if lb.recycle.enabled() {
+		opts = append(opts, WithRecycling(lb.recycle))
+	}
+	if lb.hostRewrite {
+		opts = append(opts, WithHostRewrite())
+	}
+	if lb.signer != nil {
+		opts = append(opts, WithRequestSigning(lb.signer))
+	}
+	if lb.healthChecks != nil && lb.healthChecks.Path != "" {
+		opts = append(opts, WithHealthPath(lb.healthChecks.Path))
+	}
+	return opts
+}
+
+// useProxy points the server's transport at the forward proxy
+func (s *SimpleServer) useProxy(proxyURL *url.URL) error {
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("%w %q: unsupported scheme %q", ErrInvalidProxyURL, proxyURL.Redacted(), proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return fmt.Errorf("%w %q: missing host", ErrInvalidProxyURL, proxyURL.Redacted())
+	}
+	base, ok := s.proxy.Transport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("%w: backend %s uses a %T, which has no proxy setting", ErrInvalidProxyURL, s.addr, s.proxy.Transport)
+	}
+	t := base.Clone()
+	t.Proxy = http.ProxyURL(proxyURL)
+	s.proxy.Transport = t
+	s.client.Transport = t
+	return nil
+}
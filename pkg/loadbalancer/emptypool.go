@@ -0,0 +1,202 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/metrics"
+)
+
+// What the balancer does with requests before any backend has been healthy, see EmptyPool
+const (
+	// EmptyPoolProxy proxies requests as usual, so they fail with 503 until a backend is up
+	EmptyPoolProxy = "proxy"
+	// EmptyPoolBlock holds requests until a backend is healthy, answering 503 to those that
+	// waited longer than EmptyPool.Wait; Ready fails meanwhile, as it does without one
+	EmptyPoolBlock = "block"
+	// EmptyPoolSplash answers requests with EmptyPool.Page and 503
+	EmptyPoolSplash = "splash"
+	// EmptyPoolRetry retries discovery with backoff, from EmptyPool.MinBackoff up to
+	// EmptyPool.MaxBackoff, until it finds backends, answering 503 meanwhile
+	EmptyPoolRetry = "retry"
+)
+
+// defaultSplash is the page EmptyPoolSplash serves without EmptyPool.Page
+const defaultSplash = `<!doctype html>
+<html><head><meta charset="utf-8"><title>Starting up</title></head>
+<body><h1>Starting up</h1><p>The service is starting. Please try again in a moment.</p></body></html>
+`
+
+// EmptyPool says what happens while the balancer starts up without a healthy backend: its
+// pool may be empty until discovery answers, or its backends may still be booting. The
+// policy applies until the first backend is seen healthy, and never again afterwards; a pool
+// that empties later is handled as usual.
+type EmptyPool struct {
+	// Mode is EmptyPoolProxy, EmptyPoolBlock, EmptyPoolSplash or EmptyPoolRetry
+	Mode string
+	// Wait is how long EmptyPoolBlock holds a request; default 10s
+	Wait time.Duration
+	// Page is the HTML EmptyPoolSplash serves; default a short notice
+	Page []byte
+	// RetryAfter is sent with the answers given while waiting; default 5s
+	RetryAfter time.Duration
+	// MinBackoff and MaxBackoff bound the delay between EmptyPoolRetry's discovery attempts;
+	// default 1s and 30s
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// WithEmptyPool sets the startup policy for a balancer without a healthy backend
+func WithEmptyPool(p EmptyPool) Option {
+	return func(lb *LoadBalancer) {
+		if p.Wait <= 0 {
+			p.Wait = 10 * time.Second
+		}
+		if len(p.Page) == 0 {
+			p.Page = []byte(defaultSplash)
+		}
+		if p.RetryAfter <= 0 {
+			p.RetryAfter = 5 * time.Second
+		}
+		if p.MinBackoff <= 0 {
+			p.MinBackoff = time.Second
+		}
+		if p.MaxBackoff <= 0 {
+			p.MaxBackoff = 30 * time.Second
+		}
+		lb.emptyPool = &emptyPool{cfg: p, answered: metrics.NewCounter()}
+	}
+}
+
+// emptyPoolCheckInterval is how often a waiting balancer looks for a healthy backend
+const emptyPoolCheckInterval = time.Second
+
+// emptyPool tracks whether the balancer is still waiting for its first healthy backend
+type emptyPool struct {
+	cfg EmptyPool
+	// settled is set once a backend has been healthy
+	settled atomic.Bool
+	// mu is held by the one request checking, so the others don't pile probes on the backends
+	mu        sync.Mutex
+	checkedAt time.Time
+	// answered counts the requests the policy answered itself
+	answered *metrics.Counter
+}
+
+func (e *emptyPool) validate() error {
+	switch e.cfg.Mode {
+	case EmptyPoolProxy, EmptyPoolBlock, EmptyPoolSplash, EmptyPoolRetry:
+	default:
+		return fmt.Errorf("empty pool: unknown mode %q, want proxy, block, splash or retry", e.cfg.Mode)
+	}
+	if e.cfg.MaxBackoff < e.cfg.MinBackoff {
+		return errors.New("empty pool: maximum backoff is below the minimum")
+	}
+	return nil
+}
+
+// waitingForBackends reports whether the balancer hasn't seen a healthy backend yet, checking
+// again at most once every emptyPoolCheckInterval
+func (lb *LoadBalancer) waitingForBackends(ctx context.Context) bool {
+	e := lb.emptyPool
+	if e == nil || e.settled.Load() {
+		return false
+	}
+	if !e.mu.TryLock() {
+		return true
+	}
+	defer e.mu.Unlock()
+	if time.Since(e.checkedAt) < emptyPoolCheckInterval {
+		return true
+	}
+	e.checkedAt = time.Now()
+	if lb.healthyCount(ctx) == 0 {
+		return true
+	}
+	e.settled.Store(true)
+	lb.logger.Info("first healthy backend seen; serving traffic")
+	return false
+}
+
+// emptyPoolMiddleware applies the startup policy to requests arriving before any backend has
+// been healthy
+func (lb *LoadBalancer) emptyPoolMiddleware(next http.Handler) http.Handler {
+	e := lb.emptyPool
+	retryAfter := strconv.Itoa(max(int(e.cfg.RetryAfter.Round(time.Second).Seconds()), 1))
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !lb.waitingForBackends(req.Context()) || e.cfg.Mode == EmptyPoolProxy {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		if e.cfg.Mode == EmptyPoolBlock && lb.awaitBackends(req.Context(), e.cfg.Wait) {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		e.answered.Inc()
+		rw.Header().Set("Retry-After", retryAfter)
+		if e.cfg.Mode == EmptyPoolSplash {
+			rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+			rw.Header().Set("Cache-Control", "no-store")
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			rw.Write(e.cfg.Page)
+			return
+		}
+		http.Error(rw, "no backend available yet", http.StatusServiceUnavailable)
+	})
+}
+
+// awaitBackends holds a request for up to wait until a backend is healthy, reporting whether
+// one is
+func (lb *LoadBalancer) awaitBackends(ctx context.Context, wait time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	tick := time.NewTicker(emptyPoolCheckInterval / 4)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-tick.C:
+			if !lb.waitingForBackends(ctx) {
+				return true
+			}
+		}
+	}
+}
+
+// emptyPoolRetryLoop retries discovery with growing delays until it finds backends, leaving
+// the rest to the regular discovery loop
+func (lb *LoadBalancer) emptyPoolRetryLoop(ctx context.Context) {
+	delay := lb.emptyPool.cfg.MinBackoff
+	for len(lb.readinessServers()) == 0 {
+		lb.logger.Info("no backends discovered yet; retrying", "in", delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if err := lb.Refresh(ctx); err != nil && ctx.Err() == nil {
+			lb.logger.Warn("discovery failed", "error", err)
+		}
+		delay = min(2*delay, lb.emptyPool.cfg.MaxBackoff)
+	}
+}
+
+// writeMetrics writes whether the balancer is still waiting and the requests answered meanwhile
+func (e *emptyPool) writeMetrics(w *bufio.Writer) {
+	waiting := 1
+	if e.settled.Load() {
+		waiting = 0
+	}
+	writeMetricHeader(w, "lb_waiting_for_backends", "gauge", "Whether the balancer has yet to see a healthy backend since it started.")
+	fmt.Fprintf(w, "lb_waiting_for_backends %d\n", waiting)
+	writeMetricHeader(w, "lb_empty_pool_requests_total", "counter", "Requests answered by the empty pool policy before any backend was healthy.")
+	fmt.Fprintf(w, "lb_empty_pool_requests_total %d\n", e.answered.Value())
+}
@@ -0,0 +1,29 @@
+package loadbalancer
+
+import "errors"
+
+var (
+	// ErrInvalidBackendURL is returned when a backend address cannot be used as a proxy target
+	ErrInvalidBackendURL = errors.New("loadbalancer: invalid backend URL")
+	// ErrInvalidProxyURL is returned when an egress proxy address is not an http, https or socks5 URL
+	ErrInvalidProxyURL = errors.New("loadbalancer: invalid proxy URL")
+	// ErrBackendDown is reported when a backend fails its health check
+	ErrBackendDown = errors.New("loadbalancer: backend is down")
+	// ErrDuplicateBackend is returned by AddBackend when the address is already in the pool
+	ErrDuplicateBackend = errors.New("loadbalancer: backend already in the pool")
+	// ErrUnknownBackend is returned by RemoveBackend when no pool member has the address
+	ErrUnknownBackend = errors.New("loadbalancer: no such backend")
+	// ErrUnknownRequest is returned by CancelRequest when no request in flight has the ID
+	ErrUnknownRequest = errors.New("loadbalancer: no such request in flight")
+)
+
+var (
+	// ErrAlreadyStarted is returned by Start when the balancer is already running
+	ErrAlreadyStarted = errors.New("loadbalancer: already started")
+	// ErrNotStarted is returned by Stop when the balancer is not running
+	ErrNotStarted = errors.New("loadbalancer: not started")
+	// ErrListenerChanged is returned by Handoff when the new balancer adds or removes the admin
+	// or redirect listener, turns protocol sniffing on or off, or adds, removes or changes the
+	// transparent proxy listener
+	ErrListenerChanged = errors.New("loadbalancer: listener added or removed; restart to apply")
+)
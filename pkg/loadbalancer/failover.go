@@ -0,0 +1,149 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/metrics"
+)
+
+// RegionFailover sends traffic to another region when too little of the local pool is healthy.
+// The remote backends are usually the other region's balancers, addressed by DNS name, so
+// their addresses follow DNS. They are health checked with the local ones and take no traffic
+// while the local pool is healthy enough.
+type RegionFailover struct {
+	// Backends are the URLs of the remote region
+	Backends []string
+	// FailBelow is the healthy share of the local pool, from 0 to 1, under which traffic fails
+	// over; default 0.5
+	FailBelow float64
+	// RecoverAt is the healthy share at which traffic comes back; default 0.8. The gap between
+	// the two keeps a pool that hovers around one threshold from flapping between regions.
+	RecoverAt float64
+	// Hold is the least time between two switches; default 1m
+	Hold time.Duration
+}
+
+// WithRegionFailover enables failover to a remote region
+func WithRegionFailover(f RegionFailover) Option {
+	return func(lb *LoadBalancer) {
+		if f.FailBelow <= 0 {
+			f.FailBelow = 0.5
+		}
+		if f.RecoverAt <= 0 {
+			f.RecoverAt = max(0.8, f.FailBelow)
+		}
+		if f.Hold <= 0 {
+			f.Hold = time.Minute
+		}
+		lb.failover = &failover{RegionFailover: f, switches: metrics.NewCounter()}
+	}
+}
+
+// failoverCheckInterval is how often requests re-evaluate the local pool's health
+const failoverCheckInterval = time.Second
+
+type failover struct {
+	RegionFailover
+	servers []Server
+	active  atomic.Bool
+
+	mu       sync.Mutex
+	checked  time.Time
+	switched time.Time
+	switches *metrics.Counter
+}
+
+func (f RegionFailover) validate() error {
+	if len(f.Backends) == 0 {
+		return errors.New("region failover without backends")
+	}
+	if f.FailBelow > 1 || f.RecoverAt > 1 || f.RecoverAt < f.FailBelow {
+		return errors.New("region failover: want 0 < FailBelow <= RecoverAt <= 1")
+	}
+	return nil
+}
+
+// FailedOver reports whether traffic is going to the remote region
+func (lb *LoadBalancer) FailedOver() bool {
+	return lb.failover != nil && lb.failover.active.Load()
+}
+
+// healthyShare is the fraction of the regular backends that are up; backends not checked yet
+// count as up, so a balancer that has just started doesn't fail over
+func (lb *LoadBalancer) healthyShare() float64 {
+	servers := lb.Servers()
+	if len(servers) == 0 {
+		return 0
+	}
+	lb.stateMu.Lock()
+	defer lb.stateMu.Unlock()
+	healthy := 0
+	for _, server := range servers {
+		if alive, ok := lb.lastAlive[server.Address()]; !ok || alive {
+			healthy++
+		}
+	}
+	return float64(healthy) / float64(len(servers))
+}
+
+// evaluateFailover switches regions when the local pool's health has crossed a threshold and the last
+// switch is at least Hold ago. Concurrent callers leave it to the one already evaluating.
+func (lb *LoadBalancer) evaluateFailover(now time.Time) {
+	f := lb.failover
+	if !f.mu.TryLock() {
+		return
+	}
+	defer f.mu.Unlock()
+	if now.Sub(f.checked) < failoverCheckInterval {
+		return
+	}
+	f.checked = now
+	if now.Sub(f.switched) < f.Hold {
+		return
+	}
+	share := lb.healthyShare()
+	active := f.active.Load()
+	switch {
+	case !active && share < f.FailBelow:
+		lb.logger.Warn("local pool unhealthy; failing over to the remote region", "healthy_share", share, "threshold", f.FailBelow)
+	case active && share >= f.RecoverAt:
+		lb.logger.Info("local pool recovered; leaving the remote region", "healthy_share", share, "threshold", f.RecoverAt)
+	default:
+		return
+	}
+	f.active.Store(!active)
+	f.switched = now
+	f.switches.Inc()
+}
+
+// failoverMiddleware sends requests bound for the regular backends to the remote region while
+// failed over; requests a route or the canary already sent elsewhere keep their pool
+func (lb *LoadBalancer) failoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lb.evaluateFailover(time.Now())
+		st := stateFrom(req.Context())
+		if lb.failover.active.Load() && st.pool == nil {
+			st.pool, st.poolName = lb.failover.servers, PoolFailover
+			st.allowed, st.strategy = nil, nil
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// writeMetrics writes whether traffic is failed over and how often it has switched
+func (f *failover) writeMetrics(w *bufio.Writer) {
+	active := 0
+	if f.active.Load() {
+		active = 1
+	}
+	writeMetricHeader(w, "lb_failover_active", "gauge", "Whether traffic is going to the remote region.")
+	fmt.Fprintf(w, "lb_failover_active %d\n", active)
+	writeMetricHeader(w, "lb_failover_switches_total", "counter", "Switches between the local and the remote region.")
+	fmt.Fprintf(w, "lb_failover_switches_total %d\n", f.switches.Value())
+}
@@ -0,0 +1,83 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/router"
+)
+
+// FaultRule injects latency or errors into a share of the requests it matches,
+// so clients can exercise their resilience against the real edge.
+// When several rules match a request, the most specific one (as resolved by pkg/router) applies.
+type FaultRule struct {
+	// Host and PathPrefix select the requests; empty values match everything
+	Host       string
+	PathPrefix string
+	// DelayPercent of matching requests are held for Delay before being proxied
+	DelayPercent float64
+	Delay        time.Duration
+	// AbortPercent of matching requests are answered with AbortStatus without reaching a backend
+	AbortPercent float64
+	AbortStatus  int
+}
+
+// WithFaults enables fault injection with the given rules
+func WithFaults(rules ...FaultRule) Option {
+	return func(lb *LoadBalancer) {
+		lb.faultRules = append(lb.faultRules, rules...)
+	}
+}
+
+func (r FaultRule) validate() error {
+	if r.DelayPercent < 0 || r.DelayPercent > 100 || r.AbortPercent < 0 || r.AbortPercent > 100 {
+		return fmt.Errorf("fault rule %s%s: percentages must be between 0 and 100", r.Host, r.PathPrefix)
+	}
+	if r.AbortPercent > 0 && (r.AbortStatus < 100 || r.AbortStatus > 599) {
+		return fmt.Errorf("fault rule %s%s: invalid abort status %d", r.Host, r.PathPrefix, r.AbortStatus)
+	}
+	return nil
+}
+
+// faultMiddleware compiles the rules into a route table and applies the matching one
+func (lb *LoadBalancer) faultMiddleware(rules []FaultRule) (Middleware, error) {
+	routes := make([]router.Rule[*FaultRule], len(rules))
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return nil, err
+		}
+		routes[i] = router.Rule[*FaultRule]{Host: rules[i].Host, PathPrefix: rules[i].PathPrefix, Target: &rules[i]}
+	}
+	table, err := router.Compile(routes)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rule, ok := table.Match(req.Host, req.URL.Path)
+			if !ok {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			if rule.Delay > 0 && rand.Float64()*100 < rule.DelayPercent {
+				rw.Header().Add("X-LB-Fault", "delay")
+				t := time.NewTimer(rule.Delay)
+				select {
+				case <-t.C:
+				case <-req.Context().Done():
+					t.Stop()
+					return
+				}
+			}
+			if rand.Float64()*100 < rule.AbortPercent {
+				rw.Header().Add("X-LB-Fault", "abort")
+				http.Error(rw, "fault injected", rule.AbortStatus)
+				return
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}, nil
+}
@@ -0,0 +1,91 @@
+package loadbalancer
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// TLSFingerprint returns the JA3 fingerprint of the TLS client hello req arrived with: the MD5
+// hash, in hex, of its version, cipher suites, extensions, curves and point formats. It is ""
+// for plain HTTP and for TLS terminated outside the balancer. Clients built on the same TLS
+// stack share a fingerprint whatever address they come from, so it tells automated clients
+// apart from browsers. Browsers that shuffle their extensions get a different one per
+// connection.
+func TLSFingerprint(req *http.Request) string {
+	if c, ok := req.Context().Value(switchConnKey{}).(*switchConn); ok {
+		if fp := c.fingerprint.Load(); fp != nil {
+			return *fp
+		}
+	}
+	return ""
+}
+
+// fingerprintHellos has cfg record the JA3 fingerprint of every client hello on its connection
+func fingerprintHellos(cfg *tls.Config) {
+	next := cfg.GetConfigForClient
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if c := switchConnOf(hello.Conn); c != nil {
+			fp := ja3(hello)
+			c.fingerprint.Store(&fp)
+		}
+		if next != nil {
+			return next(hello)
+		}
+		return nil, nil
+	}
+}
+
+// ja3 hashes the JA3 string of hello, leaving out GREASE values
+func ja3(hello *tls.ClientHelloInfo) string {
+	// the version is the legacy one, which is TLS 1.2 whenever supported_versions is sent
+	version := uint16(tls.VersionTLS12)
+	if !slices.Contains(hello.Extensions, 43) && len(hello.SupportedVersions) > 0 {
+		version = hello.SupportedVersions[0]
+	}
+	curves := make([]uint16, len(hello.SupportedCurves))
+	for i, c := range hello.SupportedCurves {
+		curves[i] = uint16(c)
+	}
+	points := make([]uint16, len(hello.SupportedPoints))
+	for i, p := range hello.SupportedPoints {
+		points[i] = uint16(p)
+	}
+	s := strconv.Itoa(int(version)) + "," + ja3List(hello.CipherSuites) + "," + ja3List(hello.Extensions) + "," +
+		ja3List(curves) + "," + ja3List(points)
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func ja3List(values []uint16) string {
+	var b strings.Builder
+	for _, v := range values {
+		if v&0x0f0f == 0x0a0a && v>>8 == v&0xff {
+			continue // GREASE
+		}
+		if b.Len() > 0 {
+			b.WriteByte('-')
+		}
+		b.WriteString(strconv.Itoa(int(v)))
+	}
+	return b.String()
+}
+
+// TLSFingerprintIdentity identifies clients by the JA3 fingerprint of their TLS client hello,
+// as "ja3:" and the hash. Every client of one TLS stack shares it, so limits keyed on it are
+// shared by, say, all the instances of a scraper however many addresses it rotates through;
+// put it after a more specific stage, such as an API key, when legitimate clients share a
+// stack too.
+type TLSFingerprintIdentity struct{}
+
+// ClientID returns the request's TLS fingerprint
+func (TLSFingerprintIdentity) ClientID(req *http.Request) string {
+	if fp := TLSFingerprint(req); fp != "" {
+		return "ja3:" + fp
+	}
+	return ""
+}
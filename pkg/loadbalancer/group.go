@@ -0,0 +1,108 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Group runs several independent LoadBalancers, each on its own port, inside one process.
+// Instances share nothing but the process: pools, strategies, counters and hooks stay separate.
+type Group struct {
+	mu        sync.Mutex
+	balancers []*LoadBalancer
+}
+
+// NewGroup creates a Group. Names and ports must be unique across the balancers.
+func NewGroup(balancers ...*LoadBalancer) (*Group, error) {
+	names := make(map[string]bool)
+	ports := make(map[string]bool)
+	for _, lb := range balancers {
+		if names[lb.name] {
+			return nil, fmt.Errorf("loadbalancer: duplicate balancer name %q", lb.name)
+		}
+		if ports[lb.port] {
+			return nil, fmt.Errorf("loadbalancer: balancers %q share port %s", lb.name, lb.port)
+		}
+		names[lb.name], ports[lb.port] = true, true
+	}
+	return &Group{balancers: balancers}, nil
+}
+
+// Balancers returns the members of the group
+func (g *Group) Balancers() []*LoadBalancer {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]*LoadBalancer(nil), g.balancers...)
+}
+
+// Replace hands the running member named like next over to next, see LoadBalancer.Handoff.
+// The group then starts and stops next in the old member's place.
+func (g *Group) Replace(ctx context.Context, next *LoadBalancer) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i, lb := range g.balancers {
+		if lb.name != next.name {
+			continue
+		}
+		if err := lb.Handoff(ctx, next); err != nil {
+			return fmt.Errorf("balancer %q: %w", lb.name, err)
+		}
+		g.balancers[i] = next
+		return nil
+	}
+	return fmt.Errorf("loadbalancer: no balancer named %q in the group", next.name)
+}
+
+// Start starts every balancer. If one fails, those already started are stopped again.
+func (g *Group) Start(ctx context.Context) error {
+	balancers := g.Balancers()
+	for i, lb := range balancers {
+		if err := lb.Start(ctx); err != nil {
+			for _, started := range balancers[:i] {
+				started.Stop(ctx)
+			}
+			return fmt.Errorf("balancer %q: %w", lb.name, err)
+		}
+	}
+	return nil
+}
+
+// Stop stops every balancer, sharing the ctx deadline between them
+func (g *Group) Stop(ctx context.Context) error {
+	var errs []error
+	for _, lb := range g.Balancers() {
+		if err := lb.Stop(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("balancer %q: %w", lb.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Run starts the group and blocks until ctx is done or one of the balancers stops serving
+// on its own, then stops every balancer, allowing grace for in-flight requests to finish
+func (g *Group) Run(ctx context.Context, grace time.Duration) error {
+	if err := g.Start(ctx); err != nil {
+		return err
+	}
+
+	balancers := g.Balancers()
+	stopped := make(chan struct{}, len(balancers))
+	for _, lb := range balancers {
+		done := lb.Done()
+		go func() {
+			<-done
+			stopped <- struct{}{}
+		}()
+	}
+	select {
+	case <-ctx.Done():
+	case <-stopped:
+	}
+
+	stopCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	return g.Stop(stopCtx)
+}
@@ -0,0 +1,133 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// HeaderHygiene cleans request headers before any stage sees them and refuses requests whose
+// headers are oversized or try to confuse the proxies between client and backend.
+//
+// Hop-by-hop headers are removed: those listed in Connection, Keep-Alive, Proxy-Connection,
+// TE other than "trailers", and Upgrade unless Connection asks for it. Upgrades to h2c are
+// removed too, since a backend accepting one would carry on past every rule of the balancer.
+// A request whose Connection header lists Content-Length, Transfer-Encoding or Host, which would
+// have a proxy drop the header that frames or routes it, is refused with 400.
+//
+// Conflicting Content-Length values and unknown transfer codings are refused by the HTTP
+// server itself. A request carrying both Content-Length and chunked Transfer-Encoding has its
+// Content-Length dropped, and its body goes to the backend re-framed, so the two never
+// disagree downstream.
+type HeaderHygiene struct {
+	// MaxHeaders bounds the number of header fields; default 100
+	MaxHeaders int
+	// MaxHeaderBytes bounds the size of all header names and values together; default 64KiB.
+	// The server also stops reading a request head at this size.
+	MaxHeaderBytes int
+	// MaxValueBytes bounds the size of one header value; default 8KiB
+	MaxValueBytes int
+}
+
+// WithHeaderHygiene strips hop-by-hop headers, enforces header limits with 431 Request Header
+// Fields Too Large and refuses requests that abuse Connection
+func WithHeaderHygiene(h HeaderHygiene) Option {
+	return func(lb *LoadBalancer) {
+		if h.MaxHeaders <= 0 {
+			h.MaxHeaders = 100
+		}
+		if h.MaxHeaderBytes <= 0 {
+			h.MaxHeaderBytes = 64 << 10
+		}
+		if h.MaxValueBytes <= 0 {
+			h.MaxValueBytes = 8 << 10
+		}
+		lb.headerHygiene = &h
+	}
+}
+
+func (h *HeaderHygiene) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !h.withinLimits(req.Header) {
+			http.Error(rw, "Request header fields too large", http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
+		if !stripHopByHop(req.Header) {
+			http.Error(rw, "Bad request: Connection lists a framing header", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// withinLimits reports whether header respects the count and size limits
+func (h *HeaderHygiene) withinLimits(header http.Header) bool {
+	count, size := 0, 0
+	for name, values := range header {
+		for _, v := range values {
+			if len(v) > h.MaxValueBytes {
+				return false
+			}
+			count++
+			size += len(name) + len(v)
+		}
+	}
+	return count <= h.MaxHeaders && size <= h.MaxHeaderBytes
+}
+
+// upgradeProtocols lists the protocols Upgrade offers, apart from h2c: a backend switching to
+// it would carry on past every rule of the balancer
+func upgradeProtocols(header http.Header) []string {
+	var protocols []string
+	for _, v := range header["Upgrade"] {
+		for protocol := range strings.SplitSeq(v, ",") {
+			protocol = strings.TrimSpace(protocol)
+			name, _, _ := strings.Cut(protocol, "/")
+			if protocol != "" && !strings.EqualFold(name, "h2c") {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	return protocols
+}
+
+// stripHopByHop removes the hop-by-hop headers, keeping Connection and Upgrade for a negotiated
+// upgrade. It returns false when Connection lists a header that frames or routes the request.
+func stripHopByHop(header http.Header) bool {
+	upgrade := false
+	var listed []string
+	for _, v := range header["Connection"] {
+		for token := range strings.SplitSeq(v, ",") {
+			token = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(token))
+			switch token {
+			case "":
+			case "Content-Length", "Transfer-Encoding", "Host":
+				return false
+			case "Upgrade":
+				upgrade = true
+			default:
+				listed = append(listed, token)
+			}
+		}
+	}
+	for _, name := range listed {
+		header.Del(name)
+	}
+	header.Del("Keep-Alive")
+	header.Del("Proxy-Connection")
+	if te := header.Get("Te"); te != "" {
+		header.Del("Te")
+		if strings.Contains(strings.ToLower(te), "trailers") {
+			header.Set("Te", "trailers")
+		}
+	}
+	if protocols := upgradeProtocols(header); upgrade && len(protocols) > 0 {
+		header.Set("Upgrade", strings.Join(protocols, ", "))
+		header.Set("Connection", "Upgrade")
+		return true
+	}
+	header.Del("Upgrade")
+	header.Del("Http2-Settings")
+	header.Del("Connection")
+	return true
+}
@@ -0,0 +1,41 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestStripHopByHopUpgrade(t *testing.T) {
+	tests := []struct {
+		upgrade []string
+		want    string
+	}{
+		{[]string{"websocket"}, "websocket"},
+		{[]string{"h2c"}, ""},
+		{[]string{" H2C "}, ""},
+		{[]string{"websocket, h2c"}, "websocket"},
+		{[]string{"h2c/1.0,websocket"}, "websocket"},
+		{[]string{"websocket", "h2c"}, "websocket"},
+		{[]string{"h2c", "h2c"}, ""},
+	}
+	for _, tt := range tests {
+		header := http.Header{"Connection": {"Upgrade, HTTP2-Settings"}, "Upgrade": tt.upgrade, "Http2-Settings": {"AAMAAABkAAQCAAAAAAIAAAAA"}}
+		if !stripHopByHop(header) {
+			t.Fatalf("Upgrade %q: refused", tt.upgrade)
+		}
+		if got := strings.Join(header.Values("Upgrade"), ", "); got != tt.want {
+			t.Errorf("Upgrade %q: forwarded %q, want %q", tt.upgrade, got, tt.want)
+		}
+		wantConnection := ""
+		if tt.want != "" {
+			wantConnection = "Upgrade"
+		}
+		if got := header.Get("Connection"); got != wantConnection {
+			t.Errorf("Upgrade %q: Connection %q, want %q", tt.upgrade, got, wantConnection)
+		}
+		if header.Get("Http2-Settings") != "" {
+			t.Errorf("Upgrade %q: HTTP2-Settings forwarded", tt.upgrade)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// HealthChecks moves health checking off the request path: every backend is probed on a
+// fixed interval in the background, and request routing only reads the cached result.
+// A backend is marked down after Unhealthy consecutive failed probes and up again after
+// Healthy consecutive good ones; its first probe decides its initial state directly.
+type HealthChecks struct {
+	// Interval between probes of each backend; default 10s
+	Interval time.Duration
+	// Timeout bounds a single probe; default 2s
+	Timeout time.Duration
+	// Path is probed instead of the backend URL itself, e.g. "/healthz", on the servers the
+	// balancer builds from URLs; servers passed to WithServers use their own WithHealthPath
+	Path string
+	// Healthy and Unhealthy are the consecutive results that flip a backend's state; default 2 and 3
+	Healthy   int
+	Unhealthy int
+	// Passive also marks a backend down the moment a request can't reach it: the connection is
+	// refused, reset or times out, or the name doesn't resolve. Probes bring it back as usual,
+	// after Healthy good ones in a row.
+	Passive bool
+}
+
+// WithHealthChecks enables background health checking while the balancer is started.
+// Without it every request probes the backend it is about to use.
+func WithHealthChecks(h HealthChecks) Option {
+	return func(lb *LoadBalancer) {
+		if h.Interval <= 0 {
+			h.Interval = 10 * time.Second
+		}
+		if h.Timeout <= 0 {
+			h.Timeout = 2 * time.Second
+		}
+		if h.Healthy <= 0 {
+			h.Healthy = 2
+		}
+		if h.Unhealthy <= 0 {
+			h.Unhealthy = 3
+		}
+		lb.healthChecks = &h
+	}
+}
+
+// WithHealthPath makes IsAlive probe path on the backend instead of the backend URL itself.
+// A relative path is resolved against the backend URL.
+func WithHealthPath(path string) ServerOption {
+	return func(s *SimpleServer) {
+		if ref, err := url.Parse(path); err == nil {
+			s.healthURL = s.target.ResolveReference(ref)
+		}
+	}
+}
+
+// isAlive reports whether server may take a request: from the background checker's cache when
+// it runs, and otherwise by probing it now
+func (lb *LoadBalancer) isAlive(ctx context.Context, server Server) bool {
+	if lb.healthChecks != nil {
+		lb.stateMu.Lock()
+		alive, seen := lb.lastAlive[server.Address()]
+		lb.stateMu.Unlock()
+		// not probed yet: give it the benefit of the doubt
+		return !seen || alive
+	}
+	alive := lb.healthCheck(ctx, server)
+	if ctx.Err() == nil {
+		lb.observeHealth(server, alive)
+	}
+	return alive
+}
+
+// notePassiveFailure marks server down after a connection-level failure when passive checks are on
+func (lb *LoadBalancer) notePassiveFailure(server Server, err *UpstreamError) {
+	if lb.healthChecks == nil || !lb.healthChecks.Passive || !err.Kind.connectionFailure() {
+		return
+	}
+	lb.stateMu.Lock()
+	alive, seen := lb.lastAlive[server.Address()]
+	lb.stateMu.Unlock()
+	if seen && !alive {
+		return
+	}
+	lb.logger.Warn("marking backend down after connection failure", "server", server.Address(), "kind", err.Kind)
+	lb.observeHealth(server, false)
+}
+
+// probeRun counts a backend's consecutive probe results
+type probeRun struct {
+	successes, failures int
+	// alive is the state the last round left the backend in
+	alive bool
+}
+
+// healthLoop probes every backend each interval until ctx is done
+func (lb *LoadBalancer) healthLoop(ctx context.Context) {
+	runs := make(map[string]*probeRun)
+	ticker := time.NewTicker(lb.healthChecks.Interval)
+	defer ticker.Stop()
+	for {
+		if lb.IsLeader() {
+			lb.probeAll(ctx, runs)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkedServers are all the servers the balancer may route to, hidden pools included
+func (lb *LoadBalancer) checkedServers() []Server {
+	servers := lb.Servers()
+	if lb.dark != nil {
+		servers = append(servers, lb.dark.servers...)
+	}
+	if lb.canary != nil {
+		servers = append(servers, lb.canary.servers...)
+	}
+	if lb.failover != nil {
+		servers = append(servers, lb.failover.servers...)
+	}
+	return append(servers, lb.poolServers()...)
+}
+
+// probeAll runs one round of probes concurrently and applies the thresholds
+func (lb *LoadBalancer) probeAll(ctx context.Context, runs map[string]*probeRun) {
+	cfg := lb.healthChecks
+	servers := lb.checkedServers()
+	results := make([]bool, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Go(func() {
+			probeCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+			defer cancel()
+			results[i] = lb.healthCheck(probeCtx, server)
+		})
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	present := make(map[string]bool, len(servers))
+	for i, server := range servers {
+		addr := server.Address()
+		present[addr] = true
+		run, ok := runs[addr]
+		if !ok {
+			run = &probeRun{}
+			runs[addr] = run
+		}
+
+		lb.stateMu.Lock()
+		alive, seen := lb.lastAlive[addr]
+		lb.stateMu.Unlock()
+		if seen && !alive && run.alive {
+			// a passive failure marked it down since the last round, so it has to earn its way back
+			run.successes = 0
+		}
+		if results[i] {
+			run.successes, run.failures = run.successes+1, 0
+		} else {
+			run.successes, run.failures = 0, run.failures+1
+		}
+		switch {
+		case !seen:
+			alive = results[i]
+		case alive && run.failures >= cfg.Unhealthy:
+			alive = false
+		case !alive && run.successes >= cfg.Healthy:
+			alive = true
+		}
+		run.alive = alive
+		lb.observeHealth(server, alive)
+	}
+	for addr := range runs {
+		if !present[addr] {
+			delete(runs, addr)
+		}
+	}
+}
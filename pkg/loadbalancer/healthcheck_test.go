@@ -0,0 +1,43 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPassiveFailureRestartsRecovery(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	t.Cleanup(backend.Close)
+	lb, err := New(WithBackends(backend.URL), WithHealthChecks(HealthChecks{Healthy: 2, Passive: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := lb.Servers()[0]
+	alive := func() bool {
+		lb.stateMu.Lock()
+		defer lb.stateMu.Unlock()
+		return lb.lastAlive[server.Address()]
+	}
+	runs := make(map[string]*probeRun)
+	for range 3 {
+		lb.probeAll(context.Background(), runs)
+	}
+	if !alive() {
+		t.Fatal("a healthy backend was not marked up")
+	}
+
+	lb.notePassiveFailure(server, &UpstreamError{Kind: UpstreamRefused, Server: server.Address()})
+	if alive() {
+		t.Fatal("a refused connection did not mark the backend down")
+	}
+	lb.probeAll(context.Background(), runs)
+	if alive() {
+		t.Error("one good probe brought the backend back, want 2")
+	}
+	lb.probeAll(context.Background(), runs)
+	if !alive() {
+		t.Error("2 good probes did not bring the backend back")
+	}
+}
@@ -0,0 +1,189 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// HealthEventSchema identifies the layout of HealthEvent; it changes only when a field is
+// removed or changes meaning
+const HealthEventSchema = "loadbalancer.health/v1"
+
+// healthExportQueue bounds the transitions waiting to be published
+const healthExportQueue = 256
+
+// HealthEvent is published for every backend health transition, encoded as JSON
+type HealthEvent struct {
+	// Schema is HealthEventSchema
+	Schema   string `json:"schema"`
+	Balancer string `json:"balancer"`
+	Backend  string `json:"backend"`
+	// Pool is the pool the backend serves in: "default", "canary", "dark" or a WithPools name
+	Pool string `json:"pool"`
+	// State is "up" or "down"; Previous is the state before, empty on a backend's first check
+	State    string            `json:"state"`
+	Previous string            `json:"previous,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Time     time.Time         `json:"time"`
+	// Healthy and Total count the members of the backend's pool after the transition
+	Healthy int `json:"healthy"`
+	Total   int `json:"total"`
+}
+
+// HealthPublisher sends health transitions to an external system, such as a message bus topic
+// that autoscalers and deploy pipelines subscribe to
+type HealthPublisher interface {
+	PublishHealth(ctx context.Context, event HealthEvent) error
+}
+
+// WithHealthExport publishes every backend health transition with p. Events are sent in order
+// from a background goroutine, so a slow publisher never holds up health checks; when more
+// than 256 are waiting, new ones are dropped and logged.
+func WithHealthExport(p HealthPublisher) Option {
+	return func(lb *LoadBalancer) {
+		lb.healthExport = p
+		lb.healthEvents = make(chan HealthEvent, healthExportQueue)
+	}
+}
+
+// Webhook is a HealthPublisher that POSTs each event to URL, retrying a failed delivery twice
+type Webhook struct {
+	URL string
+	// Token, when set, is sent as a bearer token
+	Token string
+	// Timeout bounds one delivery attempt; default 5s
+	Timeout time.Duration
+}
+
+// PublishHealth delivers event to the webhook; any 2xx status counts as delivered
+func (w *Webhook) PublishHealth(ctx context.Context, event HealthEvent) error {
+	return w.deliver(ctx, event)
+}
+
+// PublishDrained delivers the status of a backend that finished draining
+func (w *Webhook) PublishDrained(ctx context.Context, status DrainStatus) error {
+	return w.deliver(ctx, status)
+}
+
+// deliver POSTs v as JSON, retrying a failed delivery twice
+func (w *Webhook) deliver(ctx context.Context, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	timeout := w.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	for attempt := 0; ; attempt++ {
+		err = w.post(ctx, body, timeout)
+		if err == nil || attempt == 2 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt+1) * time.Second):
+		}
+	}
+}
+
+func (w *Webhook) post(ctx context.Context, body []byte, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.Token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// exportHealth queues the event for a health transition of server
+func (lb *LoadBalancer) exportHealth(server Server, alive, seen, prev bool) {
+	if lb.healthExport == nil {
+		return
+	}
+	name, members := lb.poolOf(server)
+	event := HealthEvent{
+		Schema:   HealthEventSchema,
+		Balancer: lb.name,
+		Backend:  server.Address(),
+		Pool:     name,
+		State:    healthState(alive),
+		Labels:   LabelsOf(server),
+		Time:     time.Now().UTC(),
+		Total:    len(members),
+	}
+	if seen {
+		event.Previous = healthState(prev)
+	}
+	lb.stateMu.Lock()
+	for _, s := range members {
+		if alive, ok := lb.lastAlive[s.Address()]; !ok || alive {
+			event.Healthy++
+		}
+	}
+	lb.stateMu.Unlock()
+	select {
+	case lb.healthEvents <- event:
+	default:
+		lb.logger.Warn("health export queue full, dropping event", "server", server.Address(), "state", event.State)
+	}
+}
+
+// healthExportLoop publishes queued events until ctx is done
+func (lb *LoadBalancer) healthExportLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-lb.healthEvents:
+			if err := lb.healthExport.PublishHealth(ctx, event); err != nil && ctx.Err() == nil {
+				lb.logger.Warn("health export failed", "server", event.Backend, "state", event.State, "error", err)
+			}
+		}
+	}
+}
+
+// poolOf names the pool server belongs to and returns its members
+func (lb *LoadBalancer) poolOf(server Server) (string, []Server) {
+	if lb.canary != nil && slices.Contains(lb.canary.servers, server) {
+		return PoolCanary, lb.canary.servers
+	}
+	if lb.dark != nil && slices.Contains(lb.dark.servers, server) {
+		return PoolDark, lb.dark.servers
+	}
+	if lb.failover != nil && slices.Contains(lb.failover.servers, server) {
+		return PoolFailover, lb.failover.servers
+	}
+	for _, def := range lb.poolDefs {
+		if p := lb.pools[def.Name]; slices.Contains(p.servers, server) {
+			return p.Name, p.servers
+		}
+	}
+	return PoolDefault, lb.Servers()
+}
+
+func healthState(alive bool) string {
+	if alive {
+		return "up"
+	}
+	return "down"
+}
@@ -0,0 +1,98 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"time"
+)
+
+// Hooks are callbacks invoked at points in a request's lifecycle.
+// Any field may be nil. Hooks run synchronously on the request path, so they should be quick.
+type Hooks struct {
+	// OnRequest is called when a request arrives, before a backend is chosen
+	OnRequest func(req *http.Request)
+	// OnBackendSelected is called once a backend has been chosen for the request
+	OnBackendSelected func(req *http.Request, server Server)
+	// OnResponse is called after the request has been served; server is nil when no backend was available
+	OnResponse func(req *http.Request, server Server, status int, elapsed time.Duration)
+	// OnBackendStateChange is called when a backend's observed health flips
+	OnBackendStateChange func(server Server, alive bool)
+	// OnRetry is called before a request is dispatched to another backend after attempt failed
+	OnRetry func(req *http.Request, failed Server, attempt int, err error)
+	// OnDrained is called once a draining backend has no requests in flight and no sticky
+	// sessions left
+	OnDrained func(status DrainStatus)
+}
+
+// WithHooks registers a set of hooks. It may be passed several times; every set is called in registration order.
+func WithHooks(h Hooks) Option {
+	return func(lb *LoadBalancer) {
+		lb.hooks = append(lb.hooks, h)
+	}
+}
+
+func (lb *LoadBalancer) fireRequest(req *http.Request) {
+	for _, h := range lb.hooks {
+		if h.OnRequest != nil {
+			h.OnRequest(req)
+		}
+	}
+}
+
+func (lb *LoadBalancer) fireBackendSelected(req *http.Request, server Server) {
+	for _, h := range lb.hooks {
+		if h.OnBackendSelected != nil {
+			h.OnBackendSelected(req, server)
+		}
+	}
+}
+
+func (lb *LoadBalancer) fireResponse(req *http.Request, server Server, status int, elapsed time.Duration) {
+	for _, h := range lb.hooks {
+		if h.OnResponse != nil {
+			h.OnResponse(req, server, status, elapsed)
+		}
+	}
+}
+
+func (lb *LoadBalancer) fireBackendStateChange(server Server, alive bool) {
+	for _, h := range lb.hooks {
+		if h.OnBackendStateChange != nil {
+			h.OnBackendStateChange(server, alive)
+		}
+	}
+}
+
+func (lb *LoadBalancer) fireRetry(req *http.Request, failed Server, attempt int, err error) {
+	for _, h := range lb.hooks {
+		if h.OnRetry != nil {
+			h.OnRetry(req, failed, attempt, err)
+		}
+	}
+}
+
+func (lb *LoadBalancer) fireDrained(status DrainStatus) {
+	for _, h := range lb.hooks {
+		if h.OnDrained != nil {
+			h.OnDrained(status)
+		}
+	}
+}
+
+// observeHealth records the latest health result for server and reports transitions.
+// A server's first observation only counts as a change when it is down.
+func (lb *LoadBalancer) observeHealth(server Server, alive bool) {
+	lb.stateMu.Lock()
+	prev, seen := lb.lastAlive[server.Address()]
+	lb.lastAlive[server.Address()] = alive
+	lb.stateMu.Unlock()
+	lb.publishHealth(server.Address(), alive, !seen || prev != alive)
+
+	if (seen && prev != alive) || (!seen && !alive) {
+		lb.logger.Info("backend state changed", "server", server.Address(), "alive", alive)
+		lb.fireBackendStateChange(server, alive)
+		lb.exportHealth(server, alive, seen, prev)
+	}
+	if seen && !prev && alive {
+		lb.warmUp(server)
+	}
+}
@@ -0,0 +1,43 @@
+package loadbalancer
+
+import "net/http"
+
+// By default a SimpleServer forwards the client's Host header unchanged, which suits backends
+// serving the public hostname. The options below change that for upstreams that route on Host.
+
+// WithHostRewrite sends the backend's own host, as written in its URL, as the Host header.
+// The client's Host is passed on in X-Forwarded-Host.
+func WithHostRewrite() ServerOption {
+	return func(s *SimpleServer) {
+		s.setHost(s.target.Host)
+	}
+}
+
+// WithHost sends host as the Host header of every proxied request and health check, e.g. a virtual host name
+// that differs from both the client's and the backend's address.
+// The client's Host is passed on in X-Forwarded-Host.
+func WithHost(host string) ServerOption {
+	return func(s *SimpleServer) {
+		s.setHost(host)
+	}
+}
+
+// WithBackendHostRewrite applies WithHostRewrite to every backend the balancer builds
+func WithBackendHostRewrite() Option {
+	return func(lb *LoadBalancer) {
+		lb.hostRewrite = true
+	}
+}
+
+// setHost fixes the Host header of proxied requests and health checks
+func (s *SimpleServer) setHost(host string) {
+	s.host = host
+	base := s.proxy.Director
+	s.proxy.Director = func(req *http.Request) {
+		base(req)
+		if req.Host != "" && req.Header.Get("X-Forwarded-Host") == "" {
+			req.Header.Set("X-Forwarded-Host", req.Host)
+		}
+		req.Host = host
+	}
+}
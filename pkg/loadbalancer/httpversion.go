@@ -0,0 +1,77 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// HTTPVersion is the HTTP version a backend is spoken to in
+type HTTPVersion string
+
+const (
+	// HTTPAuto uses HTTP/2 when an https backend offers it through ALPN and HTTP/1.1 otherwise
+	HTTPAuto HTTPVersion = ""
+	// HTTP1Only never uses HTTP/2, for backends that mishandle it
+	HTTP1Only HTTPVersion = "http1"
+	// HTTP2Only requires HTTP/2: https backends must negotiate it and http backends are
+	// spoken to with prior knowledge, like h2c:// ones. Calls to a backend that can't fail.
+	HTTP2Only HTTPVersion = "h2"
+)
+
+// ParseHTTPVersion accepts "auto", "http1" (or "http/1.1") and "h2" (or "http2")
+func ParseHTTPVersion(s string) (HTTPVersion, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "auto":
+		return HTTPAuto, nil
+	case "http1", "http/1.1":
+		return HTTP1Only, nil
+	case "h2", "http2":
+		return HTTP2Only, nil
+	}
+	return HTTPAuto, fmt.Errorf("loadbalancer: unknown HTTP version %q; want auto, http1 or h2", s)
+}
+
+// WithHTTPVersion fixes the HTTP version used to reach the server instead of negotiating it. It
+// requires the server's transport to be an *http.Transport.
+func WithHTTPVersion(v HTTPVersion) ServerOption {
+	return func(s *SimpleServer) {
+		s.protocol = v
+	}
+}
+
+// useHTTPVersion limits the server's transport to HTTP version v
+func (s *SimpleServer) useHTTPVersion(v HTTPVersion) error {
+	base, ok := s.proxy.Transport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("loadbalancer: backend %s uses a %T, which has no HTTP version setting", s.addr, s.proxy.Transport)
+	}
+	tr := base.Clone()
+	protocols := new(http.Protocols)
+	switch v {
+	case HTTP1Only:
+		if strings.HasPrefix(s.addr, schemeH2C+":") {
+			return fmt.Errorf("loadbalancer: backend %s is h2c and can't be limited to HTTP/1.1", s.addr)
+		}
+		protocols.SetHTTP1(true)
+		tr.ForceAttemptHTTP2 = false
+		if tr.TLSClientConfig != nil {
+			// cloning the transport set it up for HTTP/2, leaving h2 among the ALPN offers
+			tr.TLSClientConfig = tr.TLSClientConfig.Clone()
+			tr.TLSClientConfig.NextProtos = slices.DeleteFunc(tr.TLSClientConfig.NextProtos, func(p string) bool { return p == "h2" })
+		}
+	case HTTP2Only:
+		if s.target.Scheme == "https" {
+			protocols.SetHTTP2(true)
+		} else {
+			protocols.SetUnencryptedHTTP2(true)
+		}
+	default:
+		return fmt.Errorf("loadbalancer: backend %s: unknown HTTP version %q", s.addr, v)
+	}
+	tr.Protocols = protocols
+	s.proxy.Transport = tr
+	s.client.Transport = tr
+	return nil
+}
@@ -0,0 +1,260 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/metrics"
+)
+
+// Idempotency answers a client's retry of a request carrying an idempotency key with the
+// response to the first attempt, so a POST retried after a lost response doesn't run twice on
+// the backends. A retry arriving while the first attempt is still in flight waits for its
+// response. Keys are scoped to the client and the request's method, host and path, and a key
+// reused for a different request body is refused with 422. Responses are kept in memory, by
+// each balancer instance on its own.
+//
+// Responses that invite a retry are not kept, so the retry runs: 408, 429, 5xx, and responses
+// cut off because the client went away. Neither are responses over MaxBody.
+type Idempotency struct {
+	// Header carries the key; default Idempotency-Key. Keys are at most 255 printable ASCII
+	// characters.
+	Header string
+	// Methods are the methods keys apply to; default POST and PATCH
+	Methods []string
+	// TTL is how long a response is replayed; default 24h
+	TTL time.Duration
+	// Wait is how long a retry waits for the first attempt to finish before it is answered
+	// 409; default 30s
+	Wait time.Duration
+	// MaxEntries is the number of responses kept; default 10000
+	MaxEntries int
+	// MaxBody is the largest request or response body handled; default 1 MiB. Larger requests
+	// pass through without a key.
+	MaxBody int64
+}
+
+// WithIdempotency replays the responses of requests carrying an idempotency key to the retries
+// of those requests
+func WithIdempotency(cfg Idempotency) Option {
+	return func(lb *LoadBalancer) {
+		if cfg.Header == "" {
+			cfg.Header = "Idempotency-Key"
+		}
+		if cfg.Methods == nil {
+			cfg.Methods = []string{http.MethodPost, http.MethodPatch}
+		}
+		if cfg.TTL <= 0 {
+			cfg.TTL = 24 * time.Hour
+		}
+		if cfg.Wait <= 0 {
+			cfg.Wait = 30 * time.Second
+		}
+		if cfg.MaxEntries <= 0 {
+			cfg.MaxEntries = 10000
+		}
+		if cfg.MaxBody <= 0 {
+			cfg.MaxBody = 1 << 20
+		}
+		lb.idempotency = newIdempotencyCache(lb, cfg)
+	}
+}
+
+// maxIdempotencyKeyLen bounds the keys accepted from clients
+const maxIdempotencyKeyLen = 255
+
+// idempotentCall is the first attempt of a keyed request and, once done, its response
+type idempotentCall struct {
+	key         string
+	fingerprint [sha256.Size]byte
+	done        chan struct{}
+	// resp is nil until done, and stays nil when the response isn't kept
+	resp    *sharedResponse
+	expires time.Time
+}
+
+type idempotencyCache struct {
+	cfg Idempotency
+	lb  *LoadBalancer
+
+	mu    sync.Mutex
+	calls map[string]*list.Element
+	lru   *list.List
+
+	stored   *metrics.Counter
+	replayed *metrics.Counter
+	conflict *metrics.Counter
+	mismatch *metrics.Counter
+}
+
+func newIdempotencyCache(lb *LoadBalancer, cfg Idempotency) *idempotencyCache {
+	return &idempotencyCache{
+		cfg:      cfg,
+		lb:       lb,
+		calls:    make(map[string]*list.Element),
+		lru:      list.New(),
+		stored:   metrics.NewCounter(),
+		replayed: metrics.NewCounter(),
+		conflict: metrics.NewCounter(),
+		mismatch: metrics.NewCounter(),
+	}
+}
+
+// begin returns the call already made under key, or registers call as the first attempt and
+// returns nil
+func (c *idempotencyCache) begin(call *idempotentCall) *idempotentCall {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.calls[call.key]; ok {
+		prev := el.Value.(*idempotentCall)
+		if prev.expires.IsZero() || now.Before(prev.expires) {
+			c.lru.MoveToFront(el)
+			return prev
+		}
+		c.lru.Remove(el)
+	}
+	c.calls[call.key] = c.lru.PushFront(call)
+	for c.lru.Len() > c.cfg.MaxEntries {
+		back := c.lru.Back()
+		if back.Value.(*idempotentCall).expires.IsZero() {
+			// attempts still in flight are never evicted; they leave on their own
+			break
+		}
+		c.lru.Remove(back)
+		delete(c.calls, back.Value.(*idempotentCall).key)
+	}
+	return nil
+}
+
+// finish records the response of call, or forgets call when resp is nil so a retry runs
+func (c *idempotencyCache) finish(call *idempotentCall, resp *sharedResponse) {
+	c.mu.Lock()
+	if resp == nil {
+		if el, ok := c.calls[call.key]; ok && el.Value == call {
+			c.lru.Remove(el)
+			delete(c.calls, call.key)
+		}
+	} else {
+		call.resp, call.expires = resp, time.Now().Add(c.cfg.TTL)
+	}
+	c.mu.Unlock()
+	close(call.done)
+}
+
+// keyOf scopes the client's key to the client and the request, returning false when req
+// carries no usable key
+func (c *idempotencyCache) keyOf(req *http.Request) (string, bool) {
+	key := req.Header.Get(c.cfg.Header)
+	if !slices.Contains(c.cfg.Methods, req.Method) || !printableToken(key, maxIdempotencyKeyLen) {
+		return "", false
+	}
+	return c.lb.clientID(req) + "\x00" + req.Method + "\x00" + req.Host + "\x00" + req.URL.Path + "\x00" + key, true
+}
+
+// keepable reports whether a response is replayed to retries
+func keepable(status int) bool {
+	return status != http.StatusRequestTimeout && status != http.StatusTooManyRequests && status < 500
+}
+
+func (c *idempotencyCache) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		key, ok := c.keyOf(req)
+		if !ok {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		var body []byte
+		if req.Body != nil && req.Body != http.NoBody {
+			var err error
+			body, err = io.ReadAll(io.LimitReader(req.Body, c.cfg.MaxBody+1))
+			if err != nil || int64(len(body)) > c.cfg.MaxBody {
+				req.Body = readCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+				next.ServeHTTP(rw, req)
+				return
+			}
+			req.Body = readCloser{bytes.NewReader(body), req.Body}
+		}
+		call := &idempotentCall{key: key, fingerprint: sha256.Sum256(body), done: make(chan struct{})}
+		if prev := c.begin(call); prev != nil {
+			c.replay(rw, req, prev, call.fingerprint)
+			return
+		}
+
+		tee := newTeeWriter(rw, c.cfg.MaxBody)
+		var resp *sharedResponse
+		// deferred so a panicking proxy doesn't leave retries waiting on the call
+		defer func() { c.finish(call, resp) }()
+		next.ServeHTTP(tee, req)
+		if tee.status == 0 {
+			tee.status, tee.header = http.StatusOK, tee.shared()
+		}
+		if tee.overflow || !keepable(tee.status) || req.Context().Err() != nil {
+			return
+		}
+		// the balancer's timings were true of the first attempt, not of the replays
+		stripServerTiming(tee.header)
+		resp = &sharedResponse{status: tee.status, header: tee.header, body: tee.body}
+		c.stored.Inc()
+	})
+}
+
+// replay answers a retry with the response to the first attempt, waiting for it when it is
+// still in flight
+func (c *idempotencyCache) replay(rw http.ResponseWriter, req *http.Request, call *idempotentCall, fingerprint [sha256.Size]byte) {
+	if call.fingerprint != fingerprint {
+		c.mismatch.Inc()
+		http.Error(rw, "idempotency key reused for a different request", http.StatusUnprocessableEntity)
+		return
+	}
+	t := time.NewTimer(c.cfg.Wait)
+	defer t.Stop()
+	select {
+	case <-call.done:
+	case <-t.C:
+	case <-req.Context().Done():
+		return
+	}
+	c.mu.Lock()
+	resp := call.resp
+	c.mu.Unlock()
+	if resp == nil {
+		// still running, or it failed in a way that lets the client try again
+		c.conflict.Inc()
+		rw.Header().Set("Retry-After", "1")
+		http.Error(rw, "a request with this idempotency key is in progress", http.StatusConflict)
+		return
+	}
+	c.replayed.Inc()
+	for k, v := range resp.header {
+		// headers the balancer already set for this request, such as its ID, stay its own
+		if _, set := rw.Header()[k]; !set {
+			rw.Header()[k] = slices.Clone(v)
+		}
+	}
+	rw.Header().Set("Idempotent-Replayed", "true")
+	rw.WriteHeader(resp.status)
+	rw.Write(resp.body)
+}
+
+// writeMetrics writes how keyed requests were answered and how many responses are kept
+func (c *idempotencyCache) writeMetrics(w *bufio.Writer) {
+	writeMetricHeader(w, "lb_idempotency_requests_total", "counter", "Requests carrying an idempotency key, by how they were answered.")
+	fmt.Fprintf(w, "lb_idempotency_requests_total{result=\"stored\"} %d\n", c.stored.Value())
+	fmt.Fprintf(w, "lb_idempotency_requests_total{result=\"replayed\"} %d\n", c.replayed.Value())
+	fmt.Fprintf(w, "lb_idempotency_requests_total{result=\"conflict\"} %d\n", c.conflict.Value())
+	fmt.Fprintf(w, "lb_idempotency_requests_total{result=\"mismatch\"} %d\n", c.mismatch.Value())
+	c.mu.Lock()
+	n := c.lru.Len()
+	c.mu.Unlock()
+	writeMetricHeader(w, "lb_idempotency_entries", "gauge", "Idempotency keys remembered, including those of requests in flight.")
+	fmt.Fprintf(w, "lb_idempotency_entries %d\n", n)
+}
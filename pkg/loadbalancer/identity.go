@@ -0,0 +1,202 @@
+package loadbalancer
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// ClientIdentity tells who a request comes from. The balancer uses it wherever it keeps state
+// or counts per client: rate limits, bandwidth limits, admission fairness, abuse bans, byte
+// accounting, affinity by hash, the canary's client split and the access log. Without one,
+// or when it returns "", the client is its address (its /64 for IPv6).
+type ClientIdentity interface {
+	// ClientID returns the client's identity, or "" when the request doesn't carry one
+	ClientID(req *http.Request) string
+}
+
+// ClientIdentityFunc adapts a function to ClientIdentity
+type ClientIdentityFunc func(req *http.Request) string
+
+// ClientID calls f
+func (f ClientIdentityFunc) ClientID(req *http.Request) string {
+	return f(req)
+}
+
+// IdentityChain asks each identity in turn and returns the first answer
+type IdentityChain []ClientIdentity
+
+// ClientID returns the first identity found
+func (c IdentityChain) ClientID(req *http.Request) string {
+	for _, id := range c {
+		if v := id.ClientID(req); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// WithClientIdentity sets how clients are identified
+func WithClientIdentity(id ClientIdentity) Option {
+	return func(lb *LoadBalancer) {
+		lb.identity = id
+	}
+}
+
+// clientID identifies the client of req, once per request
+func (lb *LoadBalancer) clientID(req *http.Request) string {
+	st := stateFrom(req.Context())
+	if st.clientID == "" {
+		if lb.identity != nil {
+			st.clientID = lb.identity.ClientID(req)
+		}
+		if st.clientID == "" {
+			st.clientID = clientKey(clientIP(req))
+		}
+	}
+	return st.clientID
+}
+
+// HeaderIdentity identifies clients by a header such as an API key. Since the value is often a
+// secret, the identity is a hash of it: "key:" and 12 hex digits.
+type HeaderIdentity struct {
+	Header string
+}
+
+// ClientID hashes the header's value
+func (h HeaderIdentity) ClientID(req *http.Request) string {
+	v := req.Header.Get(h.Header)
+	if v == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(v))
+	return "key:" + hex.EncodeToString(sum[:6])
+}
+
+// JWTSubjectIdentity identifies clients by the sub claim of a bearer JWT, as "sub:" and the
+// subject. The token's signature is not checked, so a client can claim any subject; use it
+// behind something that verifies tokens, or where a forged identity only costs its forger.
+type JWTSubjectIdentity struct {
+	// Header carries the token; default Authorization, where it follows "Bearer "
+	Header string
+}
+
+// ClientID returns the token's subject
+func (j JWTSubjectIdentity) ClientID(req *http.Request) string {
+	header := j.Header
+	if header == "" {
+		header = "Authorization"
+	}
+	token := req.Header.Get(header)
+	if t, ok := strings.CutPrefix(token, "Bearer "); ok {
+		token = t
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Sub string `json:"sub"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Sub == "" {
+		return ""
+	}
+	return "sub:" + claims.Sub
+}
+
+// MTLSIdentity identifies clients by the common name of their TLS client certificate, as "cn:"
+// and the name. It needs TLS termination that asks for client certificates.
+type MTLSIdentity struct{}
+
+// ClientID returns the certificate's common name
+func (MTLSIdentity) ClientID(req *http.Request) string {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	if cn := req.TLS.PeerCertificates[0].Subject.CommonName; cn != "" {
+		return "cn:" + cn
+	}
+	return ""
+}
+
+// ParseClientIdentity builds an identity from a spec such as "header;name=X-Api-Key,ip": each
+// comma-separated stage is a registered name followed by ;key=value params, tried in order
+func ParseClientIdentity(spec string) (ClientIdentity, error) {
+	var chain IdentityChain
+	for _, stage := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(stage), ";")
+		params := make(Params)
+		for _, p := range parts[1:] {
+			key, value, ok := strings.Cut(strings.TrimSpace(p), "=")
+			if !ok {
+				return nil, fmt.Errorf("loadbalancer: client identity %s: parameter %q is not key=value", parts[0], p)
+			}
+			params[key] = value
+		}
+		id, err := NewClientIdentity(parts[0], params)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, id)
+	}
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+	return chain, nil
+}
+
+// onlyParams fails when p has a parameter not in allowed
+func onlyParams(kind string, p Params, allowed ...string) error {
+	for key := range p {
+		if !slices.Contains(allowed, key) {
+			return fmt.Errorf("loadbalancer: %s: unknown parameter %q", kind, key)
+		}
+	}
+	return nil
+}
+
+func init() {
+	RegisterClientIdentity("ip", func(p Params) (ClientIdentity, error) {
+		if err := onlyParams("ip", p); err != nil {
+			return nil, err
+		}
+		return ClientIdentityFunc(func(req *http.Request) string { return clientKey(clientIP(req)) }), nil
+	})
+	RegisterClientIdentity("header", func(p Params) (ClientIdentity, error) {
+		if err := onlyParams("header", p, "name"); err != nil {
+			return nil, err
+		}
+		if p["name"] == "" {
+			return nil, errors.New("loadbalancer: header: missing parameter name")
+		}
+		return HeaderIdentity{Header: p["name"]}, nil
+	})
+	RegisterClientIdentity("jwt-sub", func(p Params) (ClientIdentity, error) {
+		if err := onlyParams("jwt-sub", p, "header"); err != nil {
+			return nil, err
+		}
+		return JWTSubjectIdentity{Header: p["header"]}, nil
+	})
+	RegisterClientIdentity("ja3", func(p Params) (ClientIdentity, error) {
+		if err := onlyParams("ja3", p); err != nil {
+			return nil, err
+		}
+		return TLSFingerprintIdentity{}, nil
+	})
+	RegisterClientIdentity("mtls-cn", func(p Params) (ClientIdentity, error) {
+		if err := onlyParams("mtls-cn", p); err != nil {
+			return nil, err
+		}
+		return MTLSIdentity{}, nil
+	})
+}
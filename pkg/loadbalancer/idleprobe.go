@@ -0,0 +1,206 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/metrics"
+)
+
+// IdleProbing keeps the pooled keep-alive connections to backends honest, so requests don't
+// fail on connections a backend dropped without a word, as happens when it restarts behind a
+// NAT or firewall that forgets the flow. Every connection gets TCP keep-alive probes, and
+// every Interval each backend with open connections is sent a cheap request over one of them.
+// When that request finds its connection dead, all of the backend's idle connections are
+// closed, since whatever killed one has almost always killed the rest.
+//
+// Connections the backend closes properly are dropped from the pool as soon as it does;
+// HTTP/2 connections are checked with pings regardless.
+type IdleProbing struct {
+	// Interval between probes of a backend's pooled connections; default 30s
+	Interval time.Duration
+	// Method of the probe, sent to the backend's health path; default OPTIONS
+	Method string
+	// KeepAliveIdle, KeepAliveInterval and KeepAliveCount tune the TCP keep-alive probes: the
+	// first after a connection has been quiet for KeepAliveIdle, then every KeepAliveInterval
+	// until KeepAliveCount go unanswered; default 15s, 5s and 3
+	KeepAliveIdle     time.Duration
+	KeepAliveInterval time.Duration
+	KeepAliveCount    int
+}
+
+// WithIdleProbing probes the idle upstream connections of every server the balancer builds
+// and evicts them once they turn out to be stale
+func WithIdleProbing(p IdleProbing) Option {
+	return func(lb *LoadBalancer) {
+		if p.Interval <= 0 {
+			p.Interval = 30 * time.Second
+		}
+		if p.Method == "" {
+			p.Method = http.MethodOptions
+		}
+		if p.KeepAliveIdle <= 0 {
+			p.KeepAliveIdle = 15 * time.Second
+		}
+		if p.KeepAliveInterval <= 0 {
+			p.KeepAliveInterval = 5 * time.Second
+		}
+		if p.KeepAliveCount <= 0 {
+			p.KeepAliveCount = 3
+		}
+		lb.idleProbe = &idleProbe{IdleProbing: p, evicted: make(map[string]*metrics.Counter)}
+	}
+}
+
+// WithKeepAliveProbes tunes the TCP keep-alive of this server's upstream connections and
+// counts them, so idle probing can pass over a server with none open. It requires the
+// server's transport to be an *http.Transport.
+func WithKeepAliveProbes(cfg net.KeepAliveConfig) ServerOption {
+	return func(s *SimpleServer) {
+		cfg.Enable = true
+		s.keepAlive = &cfg
+	}
+}
+
+// useKeepAlive wraps the server's dialer so every connection gets the keep-alive settings
+func (s *SimpleServer) useKeepAlive(cfg net.KeepAliveConfig) error {
+	base, ok := s.proxy.Transport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("loadbalancer: backend %s uses a %T, which has no dialer settings", s.addr, s.proxy.Transport)
+	}
+	t := base.Clone()
+	dial := t.DialContext
+	if dial == nil {
+		dial = new(net.Dialer).DialContext
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetKeepAliveConfig(cfg)
+		}
+		s.conns.Add(1)
+		return &countedConn{Conn: conn, open: &s.conns}, nil
+	}
+	s.proxy.Transport = t
+	s.client.Transport = t
+	return nil
+}
+
+// countedConn takes itself off its server's count of open connections when closed
+type countedConn struct {
+	net.Conn
+	open   *atomic.Int64
+	closed sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.closed.Do(func() { c.open.Add(-1) })
+	return c.Conn.Close()
+}
+
+// idleProbe counts the stale connection pools it found, by backend
+type idleProbe struct {
+	IdleProbing
+
+	mu      sync.Mutex
+	evicted map[string]*metrics.Counter
+}
+
+func (p *idleProbe) keepAlive() net.KeepAliveConfig {
+	return net.KeepAliveConfig{Enable: true, Idle: p.KeepAliveIdle, Interval: p.KeepAliveInterval, Count: p.KeepAliveCount}
+}
+
+// idleProbeLoop probes every backend's connections each Interval until ctx is done
+func (lb *LoadBalancer) idleProbeLoop(ctx context.Context) {
+	ticker := time.NewTicker(lb.idleProbe.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var wg sync.WaitGroup
+		for _, server := range lb.checkedServers() {
+			s, ok := server.(*SimpleServer)
+			if !ok || (s.keepAlive != nil && s.conns.Load() == 0) {
+				continue
+			}
+			wg.Go(func() { lb.probeIdle(ctx, s) })
+		}
+		wg.Wait()
+	}
+}
+
+// probeIdle sends one probe to s and closes its idle connections if the probe went out on a
+// dead one. The transport silently retries a probe whose reused connection turns out to be
+// closed, so a second connection being taken gives that away too.
+func (lb *LoadBalancer) probeIdle(ctx context.Context, s *SimpleServer) {
+	p := lb.idleProbe
+	probeCtx, cancel := context.WithTimeout(ctx, min(p.Interval, 5*time.Second))
+	defer cancel()
+	target := s.target
+	if s.healthURL != nil {
+		target = s.healthURL
+	}
+	var conns, reused atomic.Int32
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if conns.Add(1) == 1 && info.Reused {
+				reused.Store(1)
+			}
+		},
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(probeCtx, trace), p.Method, target.String(), nil)
+	if err != nil {
+		return
+	}
+	s.authorize(req)
+	resp, err := s.client.Do(req)
+	if err == nil {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+	}
+	// a probe on a fresh connection says nothing about the pool, and a failed one is the
+	// health check's business
+	if ctx.Err() != nil || reused.Load() == 0 || (err == nil && conns.Load() == 1) {
+		return
+	}
+	s.client.CloseIdleConnections()
+	p.evictedFor(s.addr).Inc()
+	lb.logger.Info("stale upstream connections closed", "server", s.addr, "error", err)
+}
+
+func (p *idleProbe) evictedFor(addr string) *metrics.Counter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c := p.evicted[addr]
+	if c == nil {
+		c = metrics.NewCounter()
+		p.evicted[addr] = c
+	}
+	return c
+}
+
+// writeMetrics writes the stale connection pools found by backend
+func (p *idleProbe) writeMetrics(w *bufio.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	writeMetricHeader(w, "lb_stale_upstream_pools_total", "counter", "Times a backend's idle connections were closed after a probe found one dead.")
+	for _, addr := range slices.Sorted(maps.Keys(p.evicted)) {
+		fmt.Fprintf(w, "lb_stale_upstream_pools_total{backend=%s} %d\n", labelValue(addr), p.evicted[addr].Value())
+	}
+}
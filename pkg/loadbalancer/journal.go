@@ -0,0 +1,196 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RequestJournal keeps a summary of every request in flight, so that when the balancer
+// panics, is sent a fatal signal or cuts requests off at shutdown, a post-mortem can see
+// exactly what it was doing. Summaries live in a fixed ring of slots; past Size requests in
+// flight the oldest are overwritten. Client addresses are replaced by a hash, as in
+// DumpState, and query strings are left out.
+//
+// The balancer dumps the journal itself on a panic in a request handler and when Stop gives up
+// on the requests still running; fatal signals are the program's to catch, with DumpJournal.
+// Fatal runtime errors end the process without running any more Go code and can't be caught.
+type RequestJournal struct {
+	// Size is the number of slots; default 256
+	Size int
+	// Output receives the dumps; default os.Stderr
+	Output io.Writer
+}
+
+// WithRequestJournal keeps a journal of the requests in flight
+func WithRequestJournal(j RequestJournal) Option {
+	return func(lb *LoadBalancer) {
+		if j.Size <= 0 {
+			j.Size = 256
+		}
+		if j.Output == nil {
+			j.Output = os.Stderr
+		}
+		lb.journal = &journal{RequestJournal: j, slots: make([]atomic.Pointer[journalEntry], j.Size)}
+	}
+}
+
+// JournalEntry summarizes one request in flight
+type JournalEntry struct {
+	Start     time.Time `json:"start"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	Path      string    `json:"path"`
+	Client    string    `json:"client"`
+	RequestID string    `json:"request_id,omitempty"`
+	Route     string    `json:"route,omitempty"`
+	// Backend is the backend of the latest attempt, and Attempts the number made so far
+	Backend  string `json:"backend,omitempty"`
+	Attempts int    `json:"attempts"`
+}
+
+// journalEntry is a slot's request; route and backend change as it goes
+type journalEntry struct {
+	JournalEntry
+	mu sync.Mutex
+}
+
+// journal is the ring of in-flight requests
+type journal struct {
+	RequestJournal
+
+	next  atomic.Uint64
+	slots []atomic.Pointer[journalEntry]
+	// dumpMu keeps concurrent dumps from interleaving their lines
+	dumpMu sync.Mutex
+}
+
+// requestEntry returns the entry summarizing req, creating it on first use
+func requestEntry(req *http.Request, st *requestState) *journalEntry {
+	if st.journal == nil {
+		st.journal = &journalEntry{JournalEntry: JournalEntry{
+			Start:     st.start,
+			Method:    req.Method,
+			Host:      req.Host,
+			Path:      req.URL.Path,
+			Client:    redact(clientIP(req)),
+			RequestID: st.requestID,
+		}}
+	}
+	return st.journal
+}
+
+// begin records e in the next slot and returns the slot's index
+func (j *journal) begin(e *journalEntry) int {
+	i := int(j.next.Add(1)-1) % len(j.slots)
+	j.slots[i].Store(e)
+	return i
+}
+
+// end frees the slot of e unless a newer request has taken it over
+func (j *journal) end(e *journalEntry, i int) {
+	j.slots[i].CompareAndSwap(e, nil)
+}
+
+// snapshot returns a copy of e as it stands
+func (e *journalEntry) snapshot() JournalEntry {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.JournalEntry
+}
+
+// attempt notes that e is being sent to backend
+func (e *journalEntry) attempt(route, backend string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Route = route
+	e.Backend = backend
+	e.Attempts++
+}
+
+// entries returns the requests in flight, oldest first
+func (j *journal) entries() []JournalEntry {
+	out := make([]JournalEntry, 0)
+	for i := range j.slots {
+		if e := j.slots[i].Load(); e != nil {
+			out = append(out, e.snapshot())
+		}
+	}
+	slices.SortFunc(out, func(a, b JournalEntry) int { return a.Start.Compare(b.Start) })
+	return out
+}
+
+// journalDump heads a dump of the journal
+type journalDump struct {
+	Time     time.Time `json:"time"`
+	Balancer string    `json:"balancer"`
+	Reason   string    `json:"reason"`
+	InFlight int       `json:"in_flight"`
+}
+
+// dump writes a header line naming reason, then one JSON line per request in flight
+func (j *journal) dump(w io.Writer, balancer, reason string) error {
+	entries := j.entries()
+	j.dumpMu.Lock()
+	defer j.dumpMu.Unlock()
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(journalDump{Time: time.Now().UTC(), Balancer: balancer, Reason: reason, InFlight: len(entries)}); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InFlightRequests returns the journal's requests in flight, oldest first; nil without a
+// request journal
+func (lb *LoadBalancer) InFlightRequests() []JournalEntry {
+	if lb.journal == nil {
+		return nil
+	}
+	return lb.journal.entries()
+}
+
+// DumpJournal writes the requests in flight to the journal's Output, headed by a line giving
+// reason, such as the signal received. It does nothing without a request journal.
+func (lb *LoadBalancer) DumpJournal(reason string) error {
+	if lb.journal == nil {
+		return nil
+	}
+	return lb.journal.dump(lb.journal.Output, lb.name, reason)
+}
+
+// journalRequest records req in the journal for as long as it runs, dumping the journal if
+// the handler panics. The panic carries on afterwards, so the server handles it as before.
+func (lb *LoadBalancer) journalRequest(rw http.ResponseWriter, req *http.Request, st *requestState, next http.Handler) {
+	e := requestEntry(req, st)
+	i := lb.journal.begin(e)
+	defer func() {
+		if v := recover(); v != nil {
+			// ErrAbortHandler is how the proxy cuts off a half-sent response, not a crash
+			if v != http.ErrAbortHandler {
+				if err := lb.DumpJournal(fmt.Sprintf("panic: %v", v)); err != nil {
+					lb.logger.Error("dumping the request journal failed", "error", err)
+				}
+			}
+			lb.journal.end(e, i)
+			panic(v)
+		}
+		lb.journal.end(e, i)
+	}()
+	next.ServeHTTP(rw, req)
+}
+
+// serveInFlight handles GET /debug/inflight
+func (lb *LoadBalancer) serveInFlight(rw http.ResponseWriter, _ *http.Request) {
+	writeJSON(rw, lb.journal.entries())
+}
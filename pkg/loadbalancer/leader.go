@@ -0,0 +1,35 @@
+package loadbalancer
+
+import (
+	"net/http"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/election"
+)
+
+// WithElector runs the balancer in active-passive mode: the elector campaigns while the
+// balancer is started, and background work that probes backends or changes shared state
+// only runs while this instance is the leader. Every instance keeps serving traffic.
+func WithElector(e *election.Elector) Option {
+	return func(lb *LoadBalancer) {
+		lb.elector = e
+	}
+}
+
+// IsLeader reports whether this instance should perform leader-only work.
+// Without an elector every instance is its own leader.
+func (lb *LoadBalancer) IsLeader() bool {
+	return lb.elector == nil || lb.elector.IsLeader()
+}
+
+// serveLeader reports this instance's role for operators and peers
+func (lb *LoadBalancer) serveLeader(rw http.ResponseWriter, _ *http.Request) {
+	status := struct {
+		Elected bool   `json:"elected"`
+		Leader  bool   `json:"leader"`
+		ID      string `json:"id,omitempty"`
+	}{Elected: lb.elector != nil, Leader: lb.IsLeader()}
+	if lb.elector != nil {
+		status.ID = lb.elector.ID()
+	}
+	writeJSON(rw, status)
+}
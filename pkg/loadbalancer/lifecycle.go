@@ -0,0 +1,445 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lifecycle holds the state owned by Start and Stop
+type lifecycle struct {
+	mu       sync.Mutex
+	started  bool
+	stopping bool
+	srv      *http.Server
+	adminSrv *http.Server
+	// redirectSrv answers plain HTTP on the WithHTTPRedirect port
+	redirectSrv *http.Server
+	// front, admin and redirect sit behind the servers so a Handoff can swap balancers under them
+	front    *switchHandler
+	admin    *switchHandler
+	redirect *switchHandler
+	// listener, adminListener and redirectListener let a Handoff move the servers to new ports
+	listener         *switchListener
+	adminListener    *switchListener
+	redirectListener *switchListener
+	// sniff tells the protocols apart on the listening port under WithProtocolSniffing
+	sniff *sniffListener
+	// l4 is the WithTransparentProxy listener
+	l4 *l4Frontend
+	// ctx is the request context, ended by cancel; bgCancel ends only the background work
+	ctx      context.Context
+	cancel   context.CancelFunc
+	bgCancel context.CancelFunc
+	bg       sync.WaitGroup
+	result   *serveResult
+}
+
+// serveResult is how serving the listener ended; err is set before done is closed
+type serveResult struct {
+	done chan struct{}
+	err  error
+}
+
+// switchHandler passes requests to whichever handler was stored last
+type switchHandler struct {
+	h atomic.Pointer[http.Handler]
+}
+
+func newSwitchHandler(h http.Handler) *switchHandler {
+	s := new(switchHandler)
+	s.h.Store(&h)
+	return s
+}
+
+func (s *switchHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	(*s.h.Load()).ServeHTTP(rw, req)
+}
+
+func (s *switchHandler) swap(h http.Handler) {
+	s.h.Store(&h)
+}
+
+// WithDiscoveryInterval sets how often Start's background loop calls Refresh; the default is 30s
+func WithDiscoveryInterval(d time.Duration) Option {
+	return func(lb *LoadBalancer) {
+		lb.discoveryInterval = d
+	}
+}
+
+// WithListener makes Start serve on ln instead of opening the port itself, for sockets
+// inherited from systemd or a supervisor. Stop closes ln, so it can only be served once.
+func WithListener(ln net.Listener) Option {
+	return func(lb *LoadBalancer) {
+		lb.listener = ln
+	}
+}
+
+// Start opens the listener and launches the background work (discovery refresh) without blocking.
+// ctx bounds startup only; once Start returns, the balancer runs until Stop is called.
+func (lb *LoadBalancer) Start(ctx context.Context) error {
+	lb.life.mu.Lock()
+	defer lb.life.mu.Unlock()
+	if lb.life.started {
+		return ErrAlreadyStarted
+	}
+
+	if len(lb.discoverers) > 0 {
+		if err := lb.Refresh(ctx); err != nil {
+			lb.logger.Warn("initial discovery failed", "error", err)
+		}
+	}
+	if lb.prewarm != nil {
+		lb.prewarmAll(ctx)
+	}
+	var ln net.Listener = lb.listener
+	if ln == nil {
+		var err error
+		ln, err = new(net.ListenConfig).Listen(ctx, "tcp", listenAddr(lb.port))
+		if err != nil {
+			return err
+		}
+	}
+	lb.life.listener = newSwitchListener(ln)
+	ln = lb.life.listener
+	if lb.maxClientConns > 0 {
+		ln = &clientLimitListener{Listener: ln, limit: lb.maxClientConns, counts: make(map[string]int), rejected: lb.connsRejected}
+	}
+	tlsConfig := lb.serverTLSConfig()
+
+	var adminLn, redirectLn, l4Ln net.Listener
+	closeAll := func() {
+		for _, l := range []net.Listener{ln, adminLn, redirectLn, l4Ln} {
+			if l != nil {
+				l.Close()
+			}
+		}
+	}
+	lb.life.adminListener, lb.life.redirectListener = nil, nil
+	if lb.adminPort != "" {
+		l, err := new(net.ListenConfig).Listen(ctx, "tcp", listenAddr(lb.adminPort))
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("admin listener: %w", err)
+		}
+		lb.life.adminListener = newSwitchListener(l)
+		adminLn = lb.life.adminListener
+	}
+	if lb.redirectPort != "" {
+		l, err := new(net.ListenConfig).Listen(ctx, "tcp", listenAddr(lb.redirectPort))
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("redirect listener: %w", err)
+		}
+		lb.life.redirectListener = newSwitchListener(l)
+		redirectLn = lb.life.redirectListener
+	}
+	lb.life.l4 = nil
+	if lb.transparent != nil {
+		l4, err := lb.listenTransparent(ctx)
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("transparent proxy listener: %w", err)
+		}
+		lb.life.l4 = l4
+		l4Ln = l4.ln
+	}
+
+	if lb.gossip != nil {
+		if err := lb.gossip.Listen(); err != nil {
+			closeAll()
+			return fmt.Errorf("gossip listener: %w", err)
+		}
+	}
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	if lb.life.l4 != nil {
+		lb.life.l4.ctx = runCtx
+	}
+	lb.life.sniff = nil
+	if lb.sniffing != nil {
+		lb.life.sniff = lb.sniffListener(runCtx, ln, tlsConfig)
+		ln = lb.life.sniff
+	} else if tlsConfig != nil {
+		ln = lb.listenTLS(runCtx, ln, tlsConfig)
+	}
+	lb.life.front = newSwitchHandler(lb)
+	lb.life.srv = &http.Server{
+		Handler:     lb.life.front,
+		BaseContext: func(net.Listener) context.Context { return runCtx },
+	}
+	if lb.headerHygiene != nil {
+		lb.life.srv.MaxHeaderBytes = lb.headerHygiene.MaxHeaderBytes
+	}
+	trackConns(lb.life.srv)
+	lb.life.ctx, lb.life.cancel = runCtx, cancel
+	lb.life.result = &serveResult{done: make(chan struct{})}
+	lb.life.started = true
+	lb.life.stopping = false
+
+	go serve(lb.life.srv, ln, lb.life.result)
+	lb.life.adminSrv, lb.life.admin = nil, nil
+	if adminLn != nil {
+		lb.life.admin = newSwitchHandler(lb.AdminHandler())
+		lb.life.adminSrv = &http.Server{
+			Handler:     lb.life.admin,
+			BaseContext: func(net.Listener) context.Context { return runCtx },
+		}
+		trackConns(lb.life.adminSrv)
+		go lb.life.adminSrv.Serve(adminLn)
+		lb.logger.Info("admin endpoints started", "addr", adminLn.Addr().String())
+	}
+	lb.life.redirectSrv, lb.life.redirect = nil, nil
+	if redirectLn != nil {
+		lb.life.redirect = newSwitchHandler(lb.redirectHandler())
+		lb.life.redirectSrv = &http.Server{
+			Handler:           lb.life.redirect,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		trackConns(lb.life.redirectSrv)
+		go lb.life.redirectSrv.Serve(redirectLn)
+		lb.logger.Info("HTTPS redirect started", "addr", redirectLn.Addr().String())
+	}
+	if lb.life.l4 != nil {
+		go lb.life.l4.serve()
+		lb.logger.Info("transparent proxy started", "addr", lb.life.l4.ln.Addr().String(), "mode", lb.transparent.Mode)
+	}
+	lb.startBackground()
+	lb.logger.Info("load balancer started", "addr", ln.Addr().String())
+	return nil
+}
+
+// startBackground launches the work that runs beside serving, under a context of its own
+// so a Handoff can end it while requests carry on
+func (lb *LoadBalancer) startBackground() {
+	bgCtx, cancel := context.WithCancel(lb.life.ctx)
+	lb.life.bgCancel = cancel
+	if lb.elector != nil {
+		lb.goBackground(bgCtx, lb.elector.Run)
+	}
+	if lb.gossip != nil {
+		lb.goBackground(bgCtx, lb.gossip.Run)
+	}
+	if lb.healthChecks != nil {
+		lb.goBackground(bgCtx, lb.healthLoop)
+	}
+	if lb.healthExport != nil {
+		lb.goBackground(bgCtx, lb.healthExportLoop)
+	}
+	if len(lb.discoverers) > 0 && lb.discoveryInterval > 0 {
+		lb.goBackground(bgCtx, lb.discoveryLoop)
+	}
+	if lb.emptyPool != nil && lb.emptyPool.cfg.Mode == EmptyPoolRetry && len(lb.discoverers) > 0 && !lb.emptyPool.settled.Load() {
+		lb.goBackground(bgCtx, lb.emptyPoolRetryLoop)
+	}
+	if lb.dnsCert != nil {
+		lb.goBackground(bgCtx, lb.dnsCertLoop)
+	}
+	if lb.promWeights != nil {
+		lb.goBackground(bgCtx, lb.promWeightsLoop)
+	}
+	if lb.adaptiveTimeouts != nil {
+		lb.goBackground(bgCtx, lb.adaptiveTimeoutsLoop)
+	}
+	if lb.idleProbe != nil {
+		lb.goBackground(bgCtx, lb.idleProbeLoop)
+	}
+	if lb.snapshots != nil {
+		lb.goBackground(bgCtx, lb.snapshotLoop)
+	}
+	if lb.tenants != nil {
+		for _, name := range lb.tenants.order {
+			lb.goBackground(bgCtx, lb.tenants.tenants[name].Balancer.runAsTenant)
+		}
+	}
+}
+
+func serve(srv *http.Server, ln net.Listener, result *serveResult) {
+	err := srv.Serve(ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	result.err = err
+	close(result.done)
+}
+
+// goBackground runs fn in a goroutine that Stop waits for
+func (lb *LoadBalancer) goBackground(ctx context.Context, fn func(context.Context)) {
+	lb.life.bg.Add(1)
+	go func() {
+		defer lb.life.bg.Done()
+		fn(ctx)
+	}()
+}
+
+func (lb *LoadBalancer) discoveryLoop(ctx context.Context) {
+	ticker := time.NewTicker(lb.discoveryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := lb.Refresh(ctx); err != nil && ctx.Err() == nil {
+				lb.logger.Warn("discovery failed", "error", err)
+			}
+		}
+	}
+}
+
+// Stop stops accepting connections, waits for in-flight requests until ctx is done, then
+// cancels whatever is left along with the background goroutines
+func (lb *LoadBalancer) Stop(ctx context.Context) error {
+	lb.life.mu.Lock()
+	if !lb.life.started {
+		lb.life.mu.Unlock()
+		return ErrNotStarted
+	}
+	lb.life.started = false
+	lb.life.stopping = true
+	srv, adminSrv, redirectSrv, cancel, result := lb.life.srv, lb.life.adminSrv, lb.life.redirectSrv, lb.life.cancel, lb.life.result
+	l4 := lb.life.l4
+	lb.life.mu.Unlock()
+
+	if redirectSrv != nil {
+		redirectSrv.Close()
+	}
+	if l4 != nil {
+		// its connections carry on until cancel below cuts them off
+		l4.close()
+	}
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		// the deadline passed with requests still running; cut them off
+		if dumpErr := lb.DumpJournal("shutdown grace expired"); dumpErr != nil {
+			lb.logger.Error("dumping the request journal failed", "error", dumpErr)
+		}
+		srv.Close()
+	}
+	if adminSrv != nil {
+		// the admin port stays up while traffic drains so probes see the shutdown
+		adminSrv.Close()
+	}
+	cancel()
+	lb.life.bg.Wait()
+	<-result.done
+	lb.logger.Info("load balancer stopped")
+	return errors.Join(err, result.err)
+}
+
+// Handoff moves the listeners of the running balancer to next, which must not have been started,
+// so a new configuration takes effect without dropping a connection. New requests go to next at
+// once and those in flight finish on lb. lb's background work stops before next's starts, so
+// leases and gossip sockets change hands cleanly; afterwards lb counts as stopped and next is the
+// one to Stop. When next wants other ports, the listeners move there: the new addresses are bound
+// before anything is handed over, the old ones are closed once next has taken over, and the
+// connections still open on them are closed as they go idle. The admin, redirect and transparent
+// proxy listeners can't be added or removed this way, nor the transparent proxy's port or mode
+// changed, and the listeners keep the TLS and per-client connection settings they were started
+// with.
+func (lb *LoadBalancer) Handoff(ctx context.Context, next *LoadBalancer) error {
+	lb.life.mu.Lock()
+	defer lb.life.mu.Unlock()
+	if !lb.life.started {
+		return ErrNotStarted
+	}
+	next.life.mu.Lock()
+	defer next.life.mu.Unlock()
+	if next.life.started {
+		return ErrAlreadyStarted
+	}
+	moves, err := lb.openRebinds(ctx, next)
+	if err != nil {
+		return err
+	}
+
+	if len(next.discoverers) > 0 {
+		if err := next.Refresh(ctx); err != nil {
+			next.logger.Warn("initial discovery failed", "error", err)
+		}
+	}
+	if next.prewarm != nil {
+		// next has transports of its own, warm them while lb still serves
+		next.prewarmAll(ctx)
+	}
+	if next.emptyPool != nil && (lb.emptyPool == nil || lb.emptyPool.settled.Load()) {
+		// startup is over; a reload doesn't start it again
+		next.emptyPool.settled.Store(true)
+	}
+	lb.life.bgCancel()
+	lb.life.bg.Wait()
+	if next.gossip != nil {
+		if err := next.gossip.Listen(); err != nil {
+			// carry on as before rather than serve without the cluster
+			if lb.gossip != nil {
+				if err := lb.gossip.Listen(); err != nil {
+					lb.logger.Warn("gossip stopped", "error", err)
+					lb.gossip = nil
+				}
+			}
+			lb.startBackground()
+			closeRebinds(moves)
+			return fmt.Errorf("gossip listener: %w", err)
+		}
+	}
+
+	next.life.srv, next.life.adminSrv, next.life.redirectSrv = lb.life.srv, lb.life.adminSrv, lb.life.redirectSrv
+	next.life.front, next.life.admin, next.life.redirect = lb.life.front, lb.life.admin, lb.life.redirect
+	next.life.listener, next.life.adminListener, next.life.redirectListener = lb.life.listener, lb.life.adminListener, lb.life.redirectListener
+	next.life.sniff = lb.life.sniff
+	if next.life.sniff != nil {
+		next.life.sniff.swap(next.sniffing)
+	}
+	next.life.l4 = lb.life.l4
+	if next.life.l4 != nil {
+		next.life.l4.swap(next.transparent)
+	}
+	next.life.ctx, next.life.cancel, next.life.result = lb.life.ctx, lb.life.cancel, lb.life.result
+	next.life.started, next.life.stopping = true, false
+	next.life.front.swap(next)
+	if next.life.admin != nil {
+		next.life.admin.swap(next.AdminHandler())
+	}
+	if next.life.redirect != nil {
+		next.life.redirect.swap(next.redirectHandler())
+	}
+	for _, m := range moves {
+		m.ln.rebind(m.next)
+		next.logger.Info("listener moved", "from", listenAddr(m.from), "to", m.next.Addr().String())
+	}
+	next.startBackground()
+	lb.life.started, lb.life.stopping = false, true
+	next.logger.Info("load balancer took over the listeners")
+	return nil
+}
+
+// Done is closed when the listener stops serving, either through Stop or because it failed.
+// It returns nil before Start.
+func (lb *LoadBalancer) Done() <-chan struct{} {
+	lb.life.mu.Lock()
+	defer lb.life.mu.Unlock()
+	if lb.life.result == nil {
+		return nil
+	}
+	return lb.life.result.done
+}
+
+// Err returns the error that ended serving, if any
+func (lb *LoadBalancer) Err() error {
+	lb.life.mu.Lock()
+	defer lb.life.mu.Unlock()
+	if lb.life.result == nil {
+		return nil
+	}
+	select {
+	case <-lb.life.result.done:
+		return lb.life.result.err
+	default:
+		return nil
+	}
+}
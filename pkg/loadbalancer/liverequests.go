@@ -0,0 +1,162 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/metrics"
+)
+
+// errRequestCancelled is the cause of a request cut off through DELETE /requests/{id}
+var errRequestCancelled = errors.New("request cancelled by an operator")
+
+// WithRequestCancellation keeps track of every request in flight, so operators can list them
+// with GET /requests on the admin handler and cut a stuck one off with DELETE /requests/{id},
+// which requires the WithAdminToken token.
+// Cancelling a request abandons its upstream call, closing the backend connection, and answers
+// the client with 503 and a closed connection, or just closes the connection when the response
+// is already under way. The backend isn't blamed for it and the request isn't retried.
+func WithRequestCancellation() Option {
+	return func(lb *LoadBalancer) {
+		lb.live = &liveRequests{cancelled: metrics.NewCounter()}
+	}
+}
+
+// LiveRequest is a request in flight, as GET /requests lists it
+type LiveRequest struct {
+	ID uint64 `json:"id"`
+	JournalEntry
+	Elapsed float64 `json:"elapsed_seconds"`
+}
+
+type liveRequest struct {
+	entry  *journalEntry
+	cancel context.CancelCauseFunc
+}
+
+// liveRequests holds the requests in flight by ID
+type liveRequests struct {
+	next      atomic.Uint64
+	reqs      sync.Map
+	cancelled *metrics.Counter
+}
+
+// track records req until the returned func is called, returning it with a context the
+// request can be cancelled through
+func (l *liveRequests) track(req *http.Request, st *requestState) (*http.Request, func()) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	id := l.next.Add(1)
+	l.reqs.Store(id, &liveRequest{entry: requestEntry(req, st), cancel: cancel})
+	return req.WithContext(ctx), func() {
+		l.reqs.Delete(id)
+		cancel(nil)
+	}
+}
+
+// list returns the requests in flight for at least minAge, oldest first
+func (l *liveRequests) list(minAge time.Duration) []LiveRequest {
+	now := time.Now()
+	out := make([]LiveRequest, 0)
+	l.reqs.Range(func(k, v any) bool {
+		e := v.(*liveRequest).entry.snapshot()
+		if age := now.Sub(e.Start); age >= minAge {
+			out = append(out, LiveRequest{ID: k.(uint64), JournalEntry: e, Elapsed: age.Seconds()})
+		}
+		return true
+	})
+	slices.SortFunc(out, func(a, b LiveRequest) int { return cmp.Compare(a.ID, b.ID) })
+	return out
+}
+
+// LiveRequests returns the requests in flight, oldest first; nil without WithRequestCancellation
+func (lb *LoadBalancer) LiveRequests() []LiveRequest {
+	if lb.live == nil {
+		return nil
+	}
+	return lb.live.list(0)
+}
+
+// CancelRequest cuts off the request in flight with the given ID. It returns
+// ErrUnknownRequest when there is no such request, or it has just finished.
+func (lb *LoadBalancer) CancelRequest(id uint64) error {
+	if lb.live == nil {
+		return ErrUnknownRequest
+	}
+	v, ok := lb.live.reqs.Load(id)
+	if !ok {
+		return ErrUnknownRequest
+	}
+	r := v.(*liveRequest)
+	r.cancel(errRequestCancelled)
+	lb.live.cancelled.Inc()
+	e := r.entry.snapshot()
+	lb.logger.Warn("request cancelled", "id", id, "method", e.Method, "path", e.Path, "server", e.Backend, "elapsed", time.Since(e.Start).Round(time.Millisecond))
+	return nil
+}
+
+// requestCancelled reports whether req was cut off through CancelRequest
+func requestCancelled(req *http.Request) bool {
+	return errors.Is(context.Cause(req.Context()), errRequestCancelled)
+}
+
+// answerCancelled answers a cancelled request that nothing was written for yet
+func answerCancelled(w *responseWriter, req *http.Request) {
+	if w.status == 0 && requestCancelled(req) {
+		w.Header().Set("Connection", "close")
+		http.Error(w, "request cancelled", http.StatusServiceUnavailable)
+	}
+}
+
+// serveLiveRequests handles GET /requests; ?min_age=30s lists only requests running at least
+// that long
+func (lb *LoadBalancer) serveLiveRequests(rw http.ResponseWriter, req *http.Request) {
+	var minAge time.Duration
+	if v := req.URL.Query().Get("min_age"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(rw, "min_age must be a duration such as 30s", http.StatusBadRequest)
+			return
+		}
+		minAge = d
+	}
+	writeJSON(rw, lb.live.list(minAge))
+}
+
+// serveCancelRequest handles DELETE /requests/{id}
+func (lb *LoadBalancer) serveCancelRequest(rw http.ResponseWriter, req *http.Request) {
+	if !lb.authorized(rw, req) {
+		return
+	}
+	id, err := strconv.ParseUint(req.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(rw, "invalid request ID", http.StatusBadRequest)
+		return
+	}
+	if err := lb.CancelRequest(id); err != nil {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// writeMetrics writes the requests in flight and those cancelled
+func (l *liveRequests) writeMetrics(w *bufio.Writer) {
+	n := 0
+	l.reqs.Range(func(_, _ any) bool {
+		n++
+		return true
+	})
+	writeMetricHeader(w, "lb_requests_in_flight", "gauge", "Requests being served.")
+	fmt.Fprintf(w, "lb_requests_in_flight %d\n", n)
+	writeMetricHeader(w, "lb_requests_cancelled_total", "counter", "Requests cut off by an operator through the admin API.")
+	fmt.Fprintf(w, "lb_requests_cancelled_total %d\n", l.cancelled.Value())
+}
@@ -0,0 +1,978 @@
+// Package loadbalancer implements an HTTP load balancer that distributes requests
+// across a set of backend servers.
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/election"
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/gossip"
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/metrics"
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/traffic"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// LoadBalancer distributes requests across its servers using a pluggable Strategy
+type LoadBalancer struct {
+	name         string
+	port         string
+	serverList   []Server
+	backendSpecs []backendSpec
+	mu           sync.Mutex
+
+	strategy      Strategy
+	healthCheck   HealthCheckFunc
+	logger        *slog.Logger
+	transport     http.RoundTripper
+	egressProxy   *url.URL
+	recycle       Recycling
+	idleProbe     *idleProbe
+	journal       *journal
+	live          *liveRequests
+	emptyPool     *emptyPool
+	hostRewrite   bool
+	retry         RetryPolicy
+	hooks         []Hooks
+	middleware    []Middleware
+	discoverers   []Discoverer
+	discovered    map[string]Backend
+	scriptRules   []ScriptRule
+	faultRules    []FaultRule
+	stubs         []Stub
+	localMethods  []LocalMethods
+	local         *localMethods
+	respRules     []ResponseRule
+	respChecks    []ResponseRule
+	redirects     *upstreamRedirects
+	bodyRewrites  []BodyRewrite
+	decompress    []RequestDecompression
+	recorder      *traffic.Recorder
+	recordOpts    RecordOptions
+	scrub         *Scrub
+	bandwidth     BandwidthLimit
+	routeRates    []RouteBandwidthLimit
+	accessList    *AccessList
+	authBypass    []AuthBypass
+	budgetDefs    []LatencyBudget
+	budgets       *latencyBudgets
+	serverTiming  bool
+	abuse         *abuseTracker
+	admission     *Admission
+	rateLimit     *RateLimit
+	queueDepth    *QueueDepth
+	autoscale     *autoscaler
+	accessLog     *AccessLog
+	priorities    *Priorities
+	coalescing    *Coalescing
+	idempotency   *idempotencyCache
+	cacheCfg      *Cache
+	override      *BackendOverride
+	decisions     *DecisionTrace
+	usage         *usageTracker
+	reports       *trafficReports
+	normalize     *URLNormalization
+	headerHygiene *HeaderHygiene
+	sniffing      *ProtocolSniffing
+	transparent   *transparentProxy
+	healthChecks  *HealthChecks
+	healthExport  HealthPublisher
+	healthEvents  chan HealthEvent
+	tags          *RequestTags
+	affinity      *Affinity
+	identity      ClientIdentity
+	sessions      *stickySessions
+	statusPage    *statusPage
+	backendAPI    *BackendAPI
+	reload        func(context.Context) error
+	handler       http.Handler
+
+	discoveryInterval time.Duration
+	listener          net.Listener
+	tlsConfig         *tls.Config
+	certFiles         *certFiles
+	autocert          *autocert.Manager
+	dnsCert           *dnsCert
+	redirectPort      string
+	backendTLS        *BackendTLS
+	signer            RequestSigner
+	timeouts          *UpstreamTimeouts
+	source            *Source
+	maxPerBackend     int
+	tickets           *SessionTickets
+	adminPort         string
+	adminToken        string
+	operatorToken     string
+	startupGate       int
+	gateOpen          atomic.Bool
+	elector           *election.Elector
+	gossip            *gossip.Node
+	life              lifecycle
+	tenantDefs        []Tenant
+	tenants           *TenantRouter
+
+	stateMu   sync.Mutex
+	lastAlive map[string]bool
+	// peerDown holds the time a peer last reported each backend down; published tracks our own reports
+	peerDown  map[string]time.Time
+	published map[string]time.Time
+	// backoff holds backends paused by a 503 Retry-After until the given time
+	backoff map[string]time.Time
+	// capacity holds the agent reports currently overriding backend weights
+	capacity         map[string]*capacityState
+	capacityCfg      *CapacityReports
+	promWeights      *promWeights
+	adaptiveTimeouts *adaptiveTimeouts
+	snapshots        *ConfigSnapshots
+	// lastSnapshot is the time of the newest snapshot taken, so that no two share an ID
+	lastSnapshot time.Time
+	// warming holds backends that have not passed their warm-up yet
+	warming map[string]*warmState
+	warmCfg *WarmUp
+	prewarm *Prewarm
+	// draining holds the backends taken out of rotation by DrainBackend
+	draining map[string]time.Time
+
+	maintenanceWindows []MaintenanceWindow
+	timeRules          []TimeRule
+	dark               *darkLaunch
+	failover           *failover
+	rollout            *rollout
+	poolDefs           []Pool
+	pools              map[string]*pool
+	routes             []Route
+	spillovers         []*spillover
+	canary             *canary
+	maintenance        *maintenance
+
+	maxClientConns int
+
+	requests      *metrics.Counter
+	bytesRead     *metrics.Counter
+	bytesWritten  *metrics.Counter
+	connsRejected *metrics.Counter
+	clientAborts  *metrics.Counter
+	shed          *metrics.Counter
+	rateLimited   *metrics.Counter
+	// upstreamErrors counts failed backend calls; it holds every UpstreamErrorKind
+	upstreamErrors map[UpstreamErrorKind]*metrics.Counter
+	// backendStats holds per-backend counters for /metrics, keyed by address
+	backendMu    sync.RWMutex
+	backendStats map[string]*backendMetrics
+}
+
+var _ http.Handler = (*LoadBalancer)(nil)
+
+// backendSpec is a backend from WithBackends or WithBackend, built into a SimpleServer by New
+type backendSpec struct {
+	addr string
+	opts []ServerOption
+}
+
+// Stats is a point-in-time view of the load balancer's traffic counters
+type Stats struct {
+	Requests uint64
+	// BytesRead and BytesWritten count request and response body bytes
+	BytesRead    uint64
+	BytesWritten uint64
+	// ConnectionsRejected counts connections closed by the per-client limit
+	ConnectionsRejected uint64
+	// ClientAborts counts requests abandoned by the client before the response was complete
+	ClientAborts uint64
+	// Shed counts requests refused by admission control
+	Shed uint64
+	// RateLimited counts requests refused with 429 by the per-client rate limit
+	RateLimited uint64
+	// UpstreamErrors counts failed backend calls by kind; kinds that never happened are absent
+	UpstreamErrors map[UpstreamErrorKind]uint64
+}
+
+// New creates a LoadBalancer configured by opts.
+// Without options it listens on port 8080 with an empty round-robin pool.
+// It fails if any backend given through WithBackends is invalid.
+func New(opts ...Option) (*LoadBalancer, error) {
+	lb := &LoadBalancer{
+		name:              "default",
+		port:              "8080",
+		strategy:          NewRoundRobin(),
+		healthCheck:       checkIsAlive,
+		logger:            slog.Default(),
+		discoveryInterval: 30 * time.Second,
+		lastAlive:         make(map[string]bool),
+		peerDown:          make(map[string]time.Time),
+		published:         make(map[string]time.Time),
+		backoff:           make(map[string]time.Time),
+		capacity:          make(map[string]*capacityState),
+		warming:           make(map[string]*warmState),
+		draining:          make(map[string]time.Time),
+		discovered:        make(map[string]Backend),
+		requests:          metrics.NewCounter(),
+		bytesRead:         metrics.NewCounter(),
+		bytesWritten:      metrics.NewCounter(),
+		connsRejected:     metrics.NewCounter(),
+		clientAborts:      metrics.NewCounter(),
+		shed:              metrics.NewCounter(),
+		rateLimited:       metrics.NewCounter(),
+		upstreamErrors:    make(map[UpstreamErrorKind]*metrics.Counter),
+		backendStats:      make(map[string]*backendMetrics),
+	}
+	for _, kind := range upstreamErrorKinds {
+		lb.upstreamErrors[kind] = metrics.NewCounter()
+	}
+	for _, opt := range opts {
+		opt(lb)
+	}
+	lb.logger = lb.logger.With("balancer", lb.name)
+	if lb.abuse != nil {
+		lb.hooks = append(lb.hooks, Hooks{OnResponse: lb.observeAbuse})
+	}
+	if lb.canary != nil {
+		lb.hooks = append(lb.hooks, Hooks{OnResponse: lb.observeCanary})
+	}
+	if lb.gossip != nil {
+		lb.gossip.OnUpdate(lb.applyGossip)
+	}
+	if lb.certFiles != nil {
+		if err := lb.certFiles.load(); err != nil {
+			return nil, err
+		}
+	}
+	// a backend listed twice is one member with the metadata of both, as a second one would
+	// double its share of traffic
+	given := make(map[string]Server)
+	for _, server := range lb.serverList {
+		given[canonicalAddr(server.Address())] = server
+	}
+	first := make(map[string]int)
+	var specs []backendSpec
+	for _, b := range lb.backendSpecs {
+		key := canonicalAddr(b.addr)
+		if i, ok := first[key]; ok {
+			specs[i].opts = append(slices.Clip(specs[i].opts), mergeDuplicate(b))
+			continue
+		}
+		if server, ok := given[key]; ok {
+			if ss, ok := server.(*SimpleServer); ok {
+				mergeDuplicate(b)(ss)
+			} else {
+				lb.logger.Warn("ignoring duplicate backend", "server", b.addr)
+			}
+			continue
+		}
+		first[key] = len(specs)
+		specs = append(specs, b)
+	}
+	for _, b := range specs {
+		server, err := newSimpleServer(b.addr, lb.transport, append(lb.serverOptions(), b.opts...)...)
+		if err != nil {
+			return nil, err
+		}
+		lb.serverList = append(lb.serverList, server)
+	}
+
+	if lb.dark != nil {
+		for _, addr := range lb.dark.Backends {
+			server, err := newSimpleServer(addr, lb.transport, lb.serverOptions()...)
+			if err != nil {
+				return nil, err
+			}
+			lb.dark.servers = append(lb.dark.servers, server)
+		}
+	}
+	if lb.canary != nil {
+		for _, addr := range lb.canary.Backends {
+			server, err := newSimpleServer(addr, lb.transport, lb.serverOptions()...)
+			if err != nil {
+				return nil, err
+			}
+			lb.canary.servers = append(lb.canary.servers, server)
+		}
+	}
+	if lb.affinity != nil {
+		lb.sessions = newStickySessions(lb.affinity.SessionIdle)
+	}
+	if lb.scrub != nil {
+		if err := lb.scrub.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if lb.dnsCert != nil {
+		if err := lb.dnsCert.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if lb.adaptiveTimeouts != nil {
+		if err := lb.adaptiveTimeouts.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if lb.promWeights != nil {
+		if err := lb.promWeights.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if lb.snapshots != nil {
+		if err := lb.snapshots.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if lb.redirects != nil {
+		if err := lb.redirects.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if lb.emptyPool != nil {
+		if err := lb.emptyPool.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if lb.transparent != nil {
+		if err := lb.transparent.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if lb.failover != nil {
+		if err := lb.failover.validate(); err != nil {
+			return nil, err
+		}
+		for _, addr := range lb.failover.Backends {
+			server, err := newSimpleServer(addr, lb.transport, lb.serverOptions()...)
+			if err != nil {
+				return nil, err
+			}
+			lb.failover.servers = append(lb.failover.servers, server)
+		}
+	}
+	if err := lb.buildPools(); err != nil {
+		return nil, err
+	}
+	if len(lb.tenantDefs) > 0 {
+		tenants, err := NewTenantRouter(lb.tenantDefs...)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range lb.tenantDefs {
+			// the tenant's own admin API answers to its token and to ours
+			if t.Balancer.adminToken == "" {
+				t.Balancer.adminToken = t.AdminToken
+			}
+			t.Balancer.operatorToken = lb.adminToken
+		}
+		lb.tenants = tenants
+	}
+	if len(lb.maintenanceWindows) > 0 {
+		m, err := newMaintenance(lb.maintenanceWindows)
+		if err != nil {
+			return nil, err
+		}
+		lb.maintenance = m
+	}
+
+	if err := lb.buildHandler(); err != nil {
+		return nil, err
+	}
+	return lb, nil
+}
+
+// buildHandler assembles the request pipeline: user middleware first, then the
+// built-in stages enabled by options, then the proxy itself
+func (lb *LoadBalancer) buildHandler() error {
+	var chain []Middleware
+	if lb.headerHygiene != nil {
+		// first, so no stage ever sees a hop-by-hop header
+		chain = append(chain, lb.headerHygiene.middleware)
+	}
+	if lb.normalize != nil {
+		// ahead of everything that matches on the path, custom middleware included
+		chain = append(chain, lb.normalize.middleware)
+	}
+	if lb.statusPage != nil {
+		// public and unauthenticated, so ahead of anything that may refuse the client
+		chain = append(chain, lb.statusPage.middleware)
+	}
+	if lb.decisions != nil {
+		// ahead of custom middleware, so it never sees the trace headers
+		t, err := compileDecisionTrace(*lb.decisions)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, lb.decisionMiddleware(t))
+	}
+	if len(lb.budgetDefs) > 0 {
+		// early, so the queue time covers the balancer's own stages
+		budgets, err := compileBudgets(lb.budgetDefs)
+		if err != nil {
+			return err
+		}
+		lb.budgets = budgets
+		chain = append(chain, budgets.middleware)
+	}
+	if len(lb.authBypass) > 0 {
+		// ahead of custom middleware, which may authenticate with AuthBypassed in mind
+		bypass, err := bypassMiddleware(lb.authBypass)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, bypass)
+	}
+	chain = append(chain, lb.middleware...)
+	if lb.accessList != nil {
+		acl, err := compileACL(*lb.accessList)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, acl.middleware)
+	}
+	if lb.abuse != nil {
+		chain = append(chain, lb.abuseMiddleware)
+	}
+	if lb.rateLimit != nil {
+		r, err := newRateLimiter(lb, *lb.rateLimit)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, r.middleware)
+	}
+	if lb.priorities != nil {
+		chain = append(chain, lb.priorities.middleware)
+	}
+	if lb.admission != nil {
+		a := &admission{cfg: *lb.admission, prio: lb.priorities, refused: lb.shed, lb: lb}
+		chain = append(chain, a.middleware)
+	}
+	if lb.tenants != nil {
+		// past the shared limits; what is left of the chain is the front's own traffic
+		chain = append(chain, lb.tenants.middleware)
+	}
+	if lb.bandwidth.BytesPerSecond > 0 {
+		chain = append(chain, newThrottle(lb, lb.bandwidth).middleware)
+	}
+	if len(lb.routeRates) > 0 {
+		m, err := lb.routeThrottleMiddleware(lb.routeRates)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, m)
+	}
+	if len(lb.decompress) > 0 {
+		decompress, err := lb.decompressMiddleware(lb.decompress)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, decompress)
+	}
+	if lb.recorder != nil && lb.recordOpts.SampleRate > 0 {
+		chain = append(chain, lb.recordMiddleware)
+	}
+	if len(lb.faultRules) > 0 {
+		faults, err := lb.faultMiddleware(lb.faultRules)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, faults)
+	}
+	if len(lb.stubs) > 0 {
+		stubs, err := lb.stubMiddleware(lb.stubs)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, stubs)
+	}
+	if len(lb.localMethods) > 0 {
+		local, err := lb.localMethodsMiddleware(lb.localMethods)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, local)
+	}
+	if len(lb.timeRules) > 0 {
+		rules, err := compileTimeRules(lb.timeRules)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, timeMiddleware(rules))
+	}
+	if lb.emptyPool != nil {
+		// after the stages that answer without a backend
+		chain = append(chain, lb.emptyPoolMiddleware)
+	}
+	if len(lb.routes) > 0 {
+		routes, err := lb.routeMiddleware(lb.routes)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, routes)
+	}
+	if lb.canary != nil {
+		chain = append(chain, lb.canaryMiddleware)
+	}
+	if lb.dark != nil {
+		chain = append(chain, lb.darkLaunchMiddleware)
+	}
+	if lb.failover != nil {
+		chain = append(chain, lb.failoverMiddleware)
+	}
+	if lb.rollout != nil {
+		chain = append(chain, lb.rolloutMiddleware)
+	}
+	if len(lb.scriptRules) > 0 {
+		rules, err := compileScriptRules(lb.scriptRules)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, lb.scriptMiddleware(rules))
+	}
+	if lb.override != nil {
+		o, err := compileOverride(*lb.override)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, lb.overrideMiddleware(o))
+	}
+
+	checks, err := compileResponseRules(lb.respRules)
+	if err != nil {
+		return err
+	}
+	lb.respChecks = checks
+	if len(lb.bodyRewrites) > 0 {
+		rules, err := compileBodyRewrites(lb.bodyRewrites)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, rewriteMiddleware(rules))
+	}
+
+	if lb.idempotency != nil {
+		chain = append(chain, lb.idempotency.middleware)
+	}
+	if lb.cacheCfg != nil {
+		chain = append(chain, newResponseCache(lb, *lb.cacheCfg).middleware)
+	}
+	if lb.coalescing != nil {
+		c := &coalescer{cfg: *lb.coalescing, calls: make(map[string]*coalescedCall)}
+		chain = append(chain, c.middleware)
+	}
+
+	lb.handler = http.HandlerFunc(lb.serveProxy)
+	for i := len(chain) - 1; i >= 0; i-- {
+		lb.handler = chain[i](lb.handler)
+	}
+	return nil
+}
+
+// checkIsAlive is the default HealthCheckFunc that defers to the server itself
+func checkIsAlive(ctx context.Context, server Server) bool {
+	return server.IsAlive(ctx)
+}
+
+// Name returns the name that identifies the balancer in logs and groups
+func (lb *LoadBalancer) Name() string {
+	return lb.name
+}
+
+// Port returns the port the load balancer was configured with
+func (lb *LoadBalancer) Port() string {
+	return lb.port
+}
+
+// Stats aggregates the traffic counters
+func (lb *LoadBalancer) Stats() Stats {
+	upstreamErrors := make(map[UpstreamErrorKind]uint64)
+	for kind, c := range lb.upstreamErrors {
+		if n := c.Value(); n > 0 {
+			upstreamErrors[kind] = n
+		}
+	}
+	return Stats{
+		Requests:            lb.requests.Value(),
+		BytesRead:           lb.bytesRead.Value(),
+		BytesWritten:        lb.bytesWritten.Value(),
+		ConnectionsRejected: lb.connsRejected.Value(),
+		ClientAborts:        lb.clientAborts.Value(),
+		Shed:                lb.shed.Value(),
+		RateLimited:         lb.rateLimited.Value(),
+		UpstreamErrors:      upstreamErrors,
+	}
+}
+
+// responseWriter records the status code and the number of body bytes written to the client
+type responseWriter struct {
+	http.ResponseWriter
+	counter *metrics.Counter
+	status  int
+	written uint64
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.counter.Add(uint64(n))
+	w.written += uint64(n)
+	return n, err
+}
+
+// Status returns the status code sent to the client, defaulting to 200 like net/http does
+func (w *responseWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Servers returns a snapshot of the current pool
+func (lb *LoadBalancer) Servers() []Server {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return append([]Server(nil), lb.serverList...)
+}
+
+// candidates returns the servers the request may go to: its pool, narrowed to the allowed
+// addresses and selected labels, without those that already failed it or are full
+func (lb *LoadBalancer) candidates(st *requestState) []Server {
+	servers := lb.Servers()
+	if st.pool != nil {
+		servers = slices.Clone(st.pool)
+	}
+	if st.allowed != nil || st.selector != nil || len(st.failed) > 0 || len(st.full) > 0 {
+		servers = slices.DeleteFunc(servers, func(s Server) bool {
+			return (st.allowed != nil && !slices.Contains(st.allowed, s.Address())) ||
+				!hasLabels(s, st.selector) || slices.Contains(st.failed, s.Address()) ||
+				slices.Contains(st.full, s.Address())
+		})
+	}
+	return servers
+}
+
+// hasLabels reports whether the server carries every label of selector with the same value
+func hasLabels(s Server, selector map[string]string) bool {
+	if len(selector) == 0 {
+		return true
+	}
+	labels := LabelsOf(s)
+	for k, v := range selector {
+		if got, ok := labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// getNextAvailableServer asks the strategy for servers until one passes the health check,
+// or with background health checks until one was last seen healthy.
+// It stops early once the request context is cancelled.
+func (lb *LoadBalancer) getNextAvailableServer(req *http.Request) Server {
+	ctx := req.Context()
+	st := stateFrom(ctx)
+	servers := lb.candidates(st)
+	if pinned := st.pinned; pinned != "" {
+		if server := lb.pinnedServer(ctx, servers, pinned); server != nil {
+			TraceDecision(req, "chose %s: pinned", server.Address())
+			return server
+		}
+		TraceDecision(req, "pinned %s unavailable", pinned)
+	}
+	strategy := lb.strategy
+	if st.strategy != nil {
+		strategy = st.strategy
+	}
+	if tracing(req) {
+		traceCandidates(req, strategy, servers)
+	}
+	var peerDown, busy []Server
+	// a server turned down is left out of the next pick, so strategies that would choose it
+	// again, like least-connections, move on to another
+	for attempt := 1; len(servers) > 0 && ctx.Err() == nil; attempt++ {
+		server := strategy.Next(servers, req)
+		if server == nil {
+			TraceDecision(req, "strategy declined")
+			return nil
+		}
+		servers = slices.DeleteFunc(servers, func(s Server) bool { return s.Address() == server.Address() })
+		if lb.paused(server.Address()) {
+			TraceDecision(req, "passed over %s: paused", server.Address())
+			continue
+		}
+		if lb.reportedDown(server.Address()) {
+			TraceDecision(req, "set aside %s: reported down by a peer", server.Address())
+			peerDown = append(peerDown, server)
+			continue
+		}
+		if lb.degraded(server) {
+			TraceDecision(req, "set aside %s: queue too deep", server.Address())
+			busy = append(busy, server)
+			continue
+		}
+		alive := lb.isAlive(ctx, server)
+		if ctx.Err() != nil {
+			// a cancelled probe says nothing about the backend
+			return nil
+		}
+		if alive && !lb.warmingUp(server.Address()) {
+			lb.logger.Debug("selected server", "server", server.Address())
+			if tracing(req) {
+				TraceDecision(req, "chose %s", server.Address())
+			}
+			return server
+		}
+		TraceDecision(req, "passed over %s: unhealthy", server.Address())
+		lb.fireRetry(req, server, attempt, ErrBackendDown)
+	}
+	// a saturated server beats none, and peers can be wrong (partitions, stale reports);
+	// rather than fail, check for ourselves
+	for _, server := range append(busy, peerDown...) {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if lb.isAlive(ctx, server) && !lb.warmingUp(server.Address()) {
+			TraceDecision(req, "chose %s: nothing better was left", server.Address())
+			return server
+		}
+	}
+	TraceDecision(req, "no backend available")
+	return nil
+}
+
+// pinnedServer returns the server with address addr when it is in the pool and alive
+func (lb *LoadBalancer) pinnedServer(ctx context.Context, servers []Server, addr string) Server {
+	for _, server := range servers {
+		if server.Address() != addr {
+			continue
+		}
+		// a drained backend must lose its pinned clients too
+		if !lb.isDraining(addr) && lb.isAlive(ctx, server) && !lb.warmingUp(addr) {
+			return server
+		}
+		break
+	}
+	lb.logger.Debug("pinned backend unavailable, falling back to strategy", "server", addr)
+	return nil
+}
+
+// requestState carries per-request bookkeeping from ServeHTTP down through the middleware chain
+type requestState struct {
+	start  time.Time
+	server Server
+	// pinned is the address of a backend the request must go to, if it is alive
+	pinned string
+	// affinity is the backend ID the client's affinity cookie carried
+	affinity string
+	// clientID identifies the client, see clientID
+	clientID string
+	// retryable tells the server to only report a transport failure in upstreamErr, not answer 502
+	retryable   bool
+	upstreamErr *UpstreamError
+	// bodyErr is the error that cut off the backend's response body
+	bodyErr error
+	// failed lists the backends already tried for this request
+	failed []string
+	// full lists the backends passed over for being at their concurrency cap; slot is the
+	// in-flight slot held on the current one
+	full []string
+	slot *atomic.Int64
+	// allowed, when non-nil, restricts the request to these backend addresses
+	allowed []string
+	// selector, when non-nil, restricts the request to backends carrying these labels
+	selector map[string]string
+	// pool, when non-nil, replaces the balancer's servers for this request
+	pool []Server
+	// poolName names the backends the request was restricted to, for X-LB-Pool
+	poolName string
+	// strategy, when non-nil, picks from pool instead of the balancer's strategy
+	strategy Strategy
+	// route names the route that sent the request to its pool
+	route string
+	// overridden marks a request pinned by the backend override header; it must not be
+	// answered from another request's response
+	overridden bool
+	// canary marks a request sent to the canary pool
+	canary bool
+	// requestID is the ID the access log tagged the request with
+	requestID string
+	// journal is the request's entry in the request journal
+	journal *journalEntry
+	// upstream is the time spent waiting on backends, over every attempt
+	upstream time.Duration
+	// priority is the request's class under load
+	priority Priority
+	// rewrite, when non-nil, edits the body of the response
+	rewrite *compiledRewrite
+	// authBypass marks a request exempt from the access list, see WithAuthBypass
+	authBypass bool
+	// budget is the latency budget of the request's route
+	budget *latencyBudget
+	// timing, when non-nil, breaks the request's time down by stage
+	timing *requestTiming
+	// serverTiming asks for the timing to be reported in a Server-Timing header
+	serverTiming bool
+	// decision, when non-nil, records how the request's backend was chosen
+	decision *decisionTrace
+}
+
+type requestStateKey struct{}
+
+// stateFrom returns the requestState attached by ServeHTTP, or a throwaway one
+func stateFrom(ctx context.Context) *requestState {
+	if st, ok := ctx.Value(requestStateKey{}).(*requestState); ok {
+		return st
+	}
+	return &requestState{start: time.Now()}
+}
+
+// ServeHTTP runs the request through the middleware chain and on to a backend.
+// LoadBalancer is an http.Handler, so it can be mounted on any mux or server.
+func (lb *LoadBalancer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	lb.logger.Debug("received request", "path", req.URL.Path)
+	lb.requests.Inc()
+	st := &requestState{start: time.Now()}
+	req = req.WithContext(context.WithValue(req.Context(), requestStateKey{}, st))
+	if lb.serverTiming {
+		st.serverTiming = true
+		req = traceTiming(req, st)
+	}
+	body := &countingBody{ReadCloser: req.Body, counter: lb.bytesRead}
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = body
+	}
+	if lb.accessLog != nil {
+		lb.accessLog.tagRequest(rw, req, st)
+	}
+	lb.fireRequest(req)
+
+	if lb.autoscale != nil {
+		lb.autoscale.inFlight.Add(1)
+	}
+
+	w := &responseWriter{ResponseWriter: rw, counter: lb.bytesWritten}
+	// deferred so the books are kept when the proxy aborts a half-sent response by panicking
+	defer func() {
+		status, elapsed := w.Status(), time.Since(st.start)
+		if lb.autoscale != nil {
+			lb.autoscale.inFlight.Add(-1)
+			lb.autoscale.record(elapsed)
+		}
+		if clientAborted(req) {
+			status = StatusClientClosedRequest
+			lb.noteClientAbort(req, st.server, elapsed)
+		} else if st.bodyErr != nil {
+			lb.noteUpstreamError(&UpstreamError{Kind: UpstreamBodyCopy, Server: st.server.Address(), Err: st.bodyErr})
+			lb.logger.Warn("response body cut off", "server", st.server.Address(), "kind", UpstreamBodyCopy, "error", st.bodyErr)
+		}
+		lb.noteBackoff(st.server, status, w.Header())
+		if lb.usage != nil {
+			lb.usage.record(req, lb.clientID(req), st.server, body.n.Load(), w.written)
+		}
+		if lb.reports != nil {
+			lb.reports.record(req, st.server, status, elapsed, body.n.Load(), w.written)
+		}
+		lb.fireResponse(req, st.server, status, elapsed)
+		if st.budget != nil {
+			lb.checkBudget(req, st, status, elapsed)
+		}
+		if lb.accessLog != nil {
+			client := ""
+			if lb.identity != nil {
+				client = lb.clientID(req)
+			}
+			lb.accessLog.log(lb.logger, lb.scrub, client, req, st, status, w.written, elapsed)
+		}
+	}()
+	if lb.live != nil {
+		var done func()
+		req, done = lb.live.track(req, st)
+		defer done()
+		defer answerCancelled(w, req)
+	}
+	if lb.journal != nil {
+		lb.journalRequest(w, req, st, lb.handler)
+		return
+	}
+	lb.handler.ServeHTTP(w, req)
+}
+
+// serveProxy forwards the request to the selected backend server, moving on to another
+// one after a transport failure when the retry policy allows it
+func (lb *LoadBalancer) serveProxy(rw http.ResponseWriter, req *http.Request) {
+	st := stateFrom(req.Context())
+	attempts, body := lb.retry.prepare(req)
+	if st.timing != nil {
+		st.timing.reachedProxy(time.Now())
+	}
+	if lb.affinity != nil && st.pinned == "" {
+		client := lb.clientID(req)
+		st.pinned = lb.affinity.pin(req, st, client, lb.candidates(st))
+		if lb.sessions.released(client) {
+			st.pinned = ""
+		}
+		lb.sessions.pinned(st.pinned != "")
+	}
+	for attempt := 1; ; attempt++ {
+		targetServer := lb.nextServerWithSlot(req)
+		if req.Context().Err() != nil {
+			// the client went away while we were choosing a backend
+			st.releaseSlot()
+			return
+		}
+		if targetServer == nil {
+			if len(st.full) > 0 {
+				rw.Header().Set("Retry-After", "1")
+			}
+			http.Error(rw, "Service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if st.timing != nil {
+			st.timing.chose(time.Now())
+		}
+		st.server = targetServer
+		st.retryable = attempt < attempts
+		st.upstreamErr = nil
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		lb.fireBackendSelected(req, targetServer)
+		if lb.affinity != nil {
+			lb.affinity.stick(rw, req, st, targetServer)
+			lb.sessions.note(lb.clientID(req), targetServer.Address(), st.affinity, time.Now())
+		}
+		if lb.tags != nil {
+			lb.tags.apply(req, st)
+		}
+		lb.serveAttempt(rw, req, st, targetServer)
+		st.releaseSlot()
+		if st.upstreamErr != nil {
+			lb.noteUpstreamError(st.upstreamErr)
+			lb.notePassiveFailure(targetServer, st.upstreamErr)
+		}
+		if !st.retryable || st.upstreamErr == nil || req.Context().Err() != nil {
+			return
+		}
+		lb.logger.Debug("retrying on another backend", "server", targetServer.Address(), "attempt", attempt, "error", st.upstreamErr)
+		TraceDecision(req, "retrying after %s failed: %s", targetServer.Address(), st.upstreamErr.Kind)
+		st.failed = append(st.failed, targetServer.Address())
+		lb.fireRetry(req, targetServer, attempt, st.upstreamErr)
+	}
+}
@@ -0,0 +1,254 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/metrics"
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/router"
+)
+
+// LocalMethods answers OPTIONS and HEAD requests at the balancer for the routes it matches, so
+// preflights and probes don't take backend capacity. When several match a request, the most
+// specific one applies.
+type LocalMethods struct {
+	// Host and PathPrefix select the requests; empty values match everything
+	Host       string
+	PathPrefix string
+	// Allow lists the methods an OPTIONS request is told about in the Allow header; empty
+	// leaves OPTIONS to the backends
+	Allow []string
+	// CORSOrigins are the origins whose CORS preflights are answered too, allowing the Allow
+	// methods and whatever headers were asked for; "*" stands for any origin. Preflights from
+	// other origins go to the backends.
+	CORSOrigins []string
+	// CORSMaxAge is how long a browser may reuse a preflight answer; zero leaves it to the browser
+	CORSMaxAge time.Duration
+	// HeadTTL is how long the status and headers of a GET response answer HEAD requests for the
+	// same URL; zero leaves HEAD to the backends. Responses that are private, set cookies or
+	// answer requests with credentials are not used.
+	HeadTTL time.Duration
+}
+
+// WithLocalMethods answers OPTIONS and HEAD requests of matching routes at the balancer
+func WithLocalMethods(rules ...LocalMethods) Option {
+	return func(lb *LoadBalancer) {
+		lb.localMethods = append(lb.localMethods, rules...)
+	}
+}
+
+// maxHeadEntries bounds the GET responses remembered for HEAD requests
+const maxHeadEntries = 10000
+
+// headEntry is what a GET response left for HEAD requests to the same URL
+type headEntry struct {
+	status  int
+	header  http.Header
+	expires time.Time
+}
+
+// localMethods holds the remembered GET responses and counts the requests answered locally
+type localMethods struct {
+	mu      sync.Mutex
+	entries map[string]headEntry
+
+	options, preflights, heads *metrics.Counter
+}
+
+// localMethodsMiddleware compiles the rules into a route table and answers what it can
+func (lb *LoadBalancer) localMethodsMiddleware(rules []LocalMethods) (Middleware, error) {
+	table := make([]router.Rule[*LocalMethods], len(rules))
+	for i := range rules {
+		r := &rules[i]
+		allow := make([]string, len(r.Allow))
+		for j, m := range r.Allow {
+			allow[j] = strings.ToUpper(strings.TrimSpace(m))
+		}
+		r.Allow = allow
+		if r.HeadTTL < 0 || r.CORSMaxAge < 0 {
+			return nil, fmt.Errorf("local methods %s%s: negative duration", r.Host, r.PathPrefix)
+		}
+		table[i] = router.Rule[*LocalMethods]{Host: r.Host, PathPrefix: r.PathPrefix, Target: r}
+	}
+	routes, err := router.Compile(table)
+	if err != nil {
+		return nil, err
+	}
+	l := &localMethods{
+		entries:    make(map[string]headEntry),
+		options:    metrics.NewCounter(),
+		preflights: metrics.NewCounter(),
+		heads:      metrics.NewCounter(),
+	}
+	lb.local = l
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rule, ok := routes.Match(req.Host, req.URL.Path)
+			if !ok {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			switch req.Method {
+			case http.MethodOptions:
+				if l.answerOptions(rw, req, rule) {
+					return
+				}
+			case http.MethodHead:
+				if l.answerHead(rw, req, rule) {
+					return
+				}
+			case http.MethodGet:
+				if rule.HeadTTL > 0 {
+					l.recordGet(rw, req, next, rule)
+					return
+				}
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}, nil
+}
+
+// answerOptions answers a plain OPTIONS request with the allowed methods, and a CORS preflight
+// from an allowed origin with the CORS headers
+func (l *localMethods) answerOptions(rw http.ResponseWriter, req *http.Request, rule *LocalMethods) bool {
+	if len(rule.Allow) == 0 {
+		return false
+	}
+	allow := strings.Join(rule.Allow, ", ")
+	h := rw.Header()
+	origin := req.Header.Get("Origin")
+	if origin != "" && req.Header.Get("Access-Control-Request-Method") != "" {
+		wildcard := slices.Contains(rule.CORSOrigins, "*")
+		if !wildcard && !slices.Contains(rule.CORSOrigins, origin) {
+			return false
+		}
+		if wildcard {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Add("Vary", "Origin")
+		}
+		h.Set("Access-Control-Allow-Methods", allow)
+		if asked := req.Header.Get("Access-Control-Request-Headers"); asked != "" {
+			h.Set("Access-Control-Allow-Headers", asked)
+		}
+		if rule.CORSMaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(rule.CORSMaxAge.Seconds())))
+		}
+		l.preflights.Inc()
+	} else {
+		l.options.Inc()
+	}
+	h.Set("Allow", allow)
+	h.Set("Content-Length", "0")
+	rw.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// headKey is the key of the GET response a HEAD request may be answered from
+func headKey(req *http.Request) (string, bool) {
+	key, ok := coalesceKey(req)
+	if !ok {
+		return "", false
+	}
+	_, key, _ = strings.Cut(key, "\x00")
+	return key, true
+}
+
+// answerHead answers a HEAD request from a remembered GET response
+func (l *localMethods) answerHead(rw http.ResponseWriter, req *http.Request, rule *LocalMethods) bool {
+	if rule.HeadTTL <= 0 {
+		return false
+	}
+	key, ok := headKey(req)
+	if !ok {
+		return false
+	}
+	l.mu.Lock()
+	e, ok := l.entries[key]
+	l.mu.Unlock()
+	if !ok || time.Now().After(e.expires) {
+		return false
+	}
+	h := rw.Header()
+	for k, v := range e.header {
+		h[k] = slices.Clone(v)
+	}
+	l.heads.Inc()
+	rw.WriteHeader(e.status)
+	return true
+}
+
+// recordGet passes a GET request on and remembers its response's status and headers
+func (l *localMethods) recordGet(rw http.ResponseWriter, req *http.Request, next http.Handler, rule *LocalMethods) {
+	key, ok := headKey(req)
+	if !ok {
+		next.ServeHTTP(rw, req)
+		return
+	}
+	w := &headRecorder{ResponseWriter: rw}
+	next.ServeHTTP(w, req)
+	if w.header == nil || req.Context().Err() != nil || !cacheableStatus(w.status) || !shareable(w.header) {
+		return
+	}
+	if w.header.Get("Content-Length") == "" && w.header.Get("Content-Encoding") == "" {
+		w.header.Set("Content-Length", strconv.FormatInt(w.written, 10))
+	}
+	// the balancer's timings and the date were true of the GET, not of the HEAD answered from it
+	stripServerTiming(w.header)
+	w.header.Del("Date")
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) >= maxHeadEntries {
+		maps.DeleteFunc(l.entries, func(_ string, e headEntry) bool { return now.After(e.expires) })
+		if len(l.entries) >= maxHeadEntries {
+			return
+		}
+	}
+	l.entries[key] = headEntry{status: w.status, header: w.header, expires: now.Add(rule.HeadTTL)}
+}
+
+// headRecorder keeps a copy of the response headers and counts the body
+type headRecorder struct {
+	http.ResponseWriter
+	status  int
+	header  http.Header
+	written int64
+}
+
+func (w *headRecorder) WriteHeader(status int) {
+	if w.header == nil && status >= 200 {
+		w.status, w.header = status, w.ResponseWriter.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headRecorder) Write(p []byte) (int, error) {
+	if w.header == nil {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *headRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// writeMetrics writes how many requests were answered without a backend
+func (l *localMethods) writeMetrics(w *bufio.Writer) {
+	writeMetricHeader(w, "lb_local_answers_total", "counter", "OPTIONS and HEAD requests answered by the balancer instead of a backend.")
+	fmt.Fprintf(w, "lb_local_answers_total{kind=\"options\"} %d\n", l.options.Value())
+	fmt.Fprintf(w, "lb_local_answers_total{kind=\"preflight\"} %d\n", l.preflights.Value())
+	fmt.Fprintf(w, "lb_local_answers_total{kind=\"head\"} %d\n", l.heads.Value())
+}
@@ -0,0 +1,411 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/metrics"
+)
+
+// LogEntry is one access log line, encoded as JSON by the sinks that ship it elsewhere.
+// Upstream and Duration are in nanoseconds.
+type LogEntry struct {
+	Time           time.Time     `json:"time"`
+	RequestID      string        `json:"request_id"`
+	Method         string        `json:"method"`
+	Path           string        `json:"path"`
+	Query          string        `json:"query,omitempty"`
+	Client         string        `json:"client"`
+	ClientID       string        `json:"client_id,omitempty"`
+	TLSFingerprint string        `json:"tls_fingerprint,omitempty"`
+	Backend        string        `json:"backend"`
+	Status         int           `json:"status"`
+	Bytes          uint64        `json:"bytes"`
+	Upstream       time.Duration `json:"upstream"`
+	Duration       time.Duration `json:"duration"`
+}
+
+// attrs lists the fields of e in the order they are logged
+func (e *LogEntry) attrs() []slog.Attr {
+	attrs := []slog.Attr{
+		slog.String("request_id", e.RequestID),
+		slog.String("method", e.Method),
+		slog.String("path", e.Path),
+	}
+	if e.Query != "" {
+		attrs = append(attrs, slog.String("query", e.Query))
+	}
+	attrs = append(attrs, slog.String("client", e.Client))
+	if e.ClientID != "" {
+		attrs = append(attrs, slog.String("client_id", e.ClientID))
+	}
+	if e.TLSFingerprint != "" {
+		attrs = append(attrs, slog.String("tls_fingerprint", e.TLSFingerprint))
+	}
+	return append(attrs,
+		slog.String("backend", e.Backend),
+		slog.Int("status", e.Status),
+		slog.Uint64("bytes", e.Bytes),
+		slog.Duration("upstream", e.Upstream),
+		slog.Duration("duration", e.Duration),
+	)
+}
+
+// LogSink receives the access log, see AccessLog.Sink. Write is called on the request's
+// goroutine, so a sink that can be slow belongs behind an AsyncSink.
+type LogSink interface {
+	Write(entry LogEntry) error
+}
+
+// BatchLogSink is a LogSink that ships several entries at once more cheaply than one by one;
+// AsyncSink hands it whatever has queued up
+type BatchLogSink interface {
+	LogSink
+	WriteBatch(entries []LogEntry) error
+}
+
+// WriterSink writes entries as JSON lines to a writer, in the same form as a JSON slog handler
+// would log them
+type WriterSink struct {
+	logger *slog.Logger
+	closer io.Closer
+}
+
+// NewWriterSink writes entries to w, such as os.Stdout
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{logger: slog.New(slog.NewJSONHandler(w, nil))}
+}
+
+// OpenFileSink appends entries to the file at path, creating it when missing
+func OpenFileSink(path string) (*WriterSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	s := NewWriterSink(f)
+	s.closer = f
+	return s, nil
+}
+
+func (s *WriterSink) Write(e LogEntry) error {
+	s.logger.LogAttrs(context.Background(), slog.LevelInfo, "request", e.attrs()...)
+	return nil
+}
+
+// Close closes the file of a sink opened with OpenFileSink
+func (s *WriterSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// syslogFacilityLocal0 is the facility SyslogSink uses by default
+const syslogFacilityLocal0 = 16
+
+// syslogSockets are where the local syslog daemon listens
+var syslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// SyslogSink sends each entry as a JSON message to a syslog daemon, reconnecting after a
+// failed write. Messages are framed as the standard library's log/syslog frames them.
+type SyslogSink struct {
+	// Network is "udp" or "tcp"; with neither Network nor Address, the local daemon's socket
+	// is used
+	Network string
+	Address string
+	// Tag names the program in every message; default "lb"
+	Tag string
+	// Facility is the syslog facility number; default 16, local0
+	Facility int
+
+	mu       sync.Mutex
+	conn     net.Conn
+	local    bool
+	hostname string
+}
+
+func (s *SyslogSink) Write(e LogEntry) error {
+	msg, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if err := s.dial(); err != nil {
+			return err
+		}
+	}
+	if _, err = s.conn.Write(s.frame(e, msg)); err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *SyslogSink) dial() error {
+	if s.Tag == "" {
+		s.Tag = "lb"
+	}
+	if s.Facility == 0 {
+		s.Facility = syslogFacilityLocal0
+	}
+	if s.Network == "" && s.Address == "" {
+		for _, path := range syslogSockets {
+			for _, network := range []string{"unixgram", "unix"} {
+				if conn, err := net.Dial(network, path); err == nil {
+					s.conn, s.local = conn, true
+					return nil
+				}
+			}
+		}
+		return errors.New("syslog: no local syslog daemon found")
+	}
+	conn, err := net.DialTimeout(s.Network, s.Address, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("syslog: %w", err)
+	}
+	s.conn = conn
+	s.hostname, _ = os.Hostname()
+	return nil
+}
+
+// frame formats one message; entries for server errors are sent as warnings, the rest as
+// informational
+func (s *SyslogSink) frame(e LogEntry, msg []byte) []byte {
+	severity := 6
+	if e.Status >= 500 {
+		severity = 4
+	}
+	pri := s.Facility*8 + severity
+	if s.local {
+		return fmt.Appendf(nil, "<%d>%s %s[%d]: %s\n", pri, e.Time.Format(time.Stamp), s.Tag, os.Getpid(), msg)
+	}
+	return fmt.Appendf(nil, "<%d>%s %s %s[%d]: %s\n", pri, e.Time.Format(time.RFC3339), s.hostname, s.Tag, os.Getpid(), msg)
+}
+
+// Close closes the connection to the daemon
+func (s *SyslogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// HTTPSink POSTs entries to a collector: as newline-delimited JSON, or, with KafkaREST, as the
+// records of a Kafka REST Proxy produce request, so they land on a Kafka topic without a
+// native Kafka client. Any 2xx status counts as delivered.
+type HTTPSink struct {
+	// URL receives the POSTs; for KafkaREST, the topic's URL, such as
+	// http://kafka-rest:8082/topics/access-log
+	URL string
+	// Token, when set, is sent as a bearer token
+	Token string
+	// KafkaREST switches to the Kafka REST Proxy's JSON embedded format
+	KafkaREST bool
+	// Timeout bounds one POST; default 5s
+	Timeout time.Duration
+	// Client sends the POSTs; default http.DefaultClient
+	Client *http.Client
+}
+
+func (s *HTTPSink) Write(e LogEntry) error {
+	return s.WriteBatch([]LogEntry{e})
+}
+
+// WriteBatch POSTs entries in one request
+func (s *HTTPSink) WriteBatch(entries []LogEntry) error {
+	var body bytes.Buffer
+	contentType := "application/x-ndjson"
+	if s.KafkaREST {
+		contentType = "application/vnd.kafka.json.v2+json"
+		records := make([]struct {
+			Value LogEntry `json:"value"`
+		}, len(entries))
+		for i, e := range entries {
+			records[i].Value = e
+		}
+		if err := json.NewEncoder(&body).Encode(map[string]any{"records": records}); err != nil {
+			return err
+		}
+	} else {
+		enc := json.NewEncoder(&body)
+		for _, e := range entries {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+	}
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("log collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// asyncBatch bounds the entries AsyncSink hands a BatchLogSink at once
+const asyncBatch = 500
+
+// AsyncSink queues entries for another sink and writes them from a background goroutine, so
+// requests never wait on the log. When the queue is full, entries are dropped and counted.
+// It is meant to outlive balancer reloads; Close writes what is queued and stops it.
+type AsyncSink struct {
+	sink  LogSink
+	queue chan LogEntry
+	done  chan struct{}
+	// mu guards closed, so entries of requests outliving the balancer are dropped, not sent on
+	// the closed queue
+	mu     sync.RWMutex
+	closed bool
+	// failing is set while writes fail, so a collector that is down is logged once
+	failing bool
+
+	written *metrics.Counter
+	dropped *metrics.Counter
+	failed  *metrics.Counter
+}
+
+// NewAsyncSink starts writing to sink from a queue of buffer entries
+func NewAsyncSink(sink LogSink, buffer int) *AsyncSink {
+	s := &AsyncSink{
+		sink:    sink,
+		queue:   make(chan LogEntry, max(buffer, 1)),
+		done:    make(chan struct{}),
+		written: metrics.NewCounter(),
+		dropped: metrics.NewCounter(),
+		failed:  metrics.NewCounter(),
+	}
+	go s.run()
+	return s
+}
+
+// Write queues e, dropping it when the queue is full or the sink is closed
+func (s *AsyncSink) Write(e LogEntry) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		s.dropped.Inc()
+		return nil
+	}
+	select {
+	case s.queue <- e:
+	default:
+		s.dropped.Inc()
+	}
+	return nil
+}
+
+// run writes queued entries until Close, batching those that piled up during the last write
+func (s *AsyncSink) run() {
+	defer close(s.done)
+	batch := make([]LogEntry, 0, asyncBatch)
+	for e := range s.queue {
+		batch = append(batch[:0], e)
+	collect:
+		for len(batch) < asyncBatch {
+			select {
+			case e, ok := <-s.queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, e)
+			default:
+				break collect
+			}
+		}
+		s.flush(batch)
+	}
+}
+
+func (s *AsyncSink) flush(batch []LogEntry) {
+	var err error
+	if b, ok := s.sink.(BatchLogSink); ok {
+		err = b.WriteBatch(batch)
+	} else {
+		for _, e := range batch {
+			if err = s.sink.Write(e); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		s.failed.Add(uint64(len(batch)))
+		if !s.failing {
+			slog.Warn("access log sink failing; entries are being lost", "error", err)
+		}
+		s.failing = true
+		return
+	}
+	s.written.Add(uint64(len(batch)))
+	if s.failing {
+		slog.Info("access log sink recovered")
+	}
+	s.failing = false
+}
+
+// Close writes the queued entries, then closes the sink when it has a Close method
+func (s *AsyncSink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.queue)
+	s.mu.Unlock()
+	<-s.done
+	if c, ok := s.sink.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// writeMetrics writes the sink's counters and the depth of its queue
+func (s *AsyncSink) writeMetrics(w *bufio.Writer) {
+	writeMetricHeader(w, "lb_access_log_entries_total", "counter", "Access log entries written by the sink.")
+	fmt.Fprintf(w, "lb_access_log_entries_total %d\n", s.written.Value())
+	writeMetricHeader(w, "lb_access_log_dropped_total", "counter", "Access log entries dropped because the sink's queue was full or closed.")
+	fmt.Fprintf(w, "lb_access_log_dropped_total %d\n", s.dropped.Value())
+	writeMetricHeader(w, "lb_access_log_failed_total", "counter", "Access log entries lost to failed writes.")
+	fmt.Fprintf(w, "lb_access_log_failed_total %d\n", s.failed.Value())
+	writeMetricHeader(w, "lb_access_log_queue", "gauge", "Access log entries waiting to be written.")
+	fmt.Fprintf(w, "lb_access_log_queue %d\n", len(s.queue))
+}
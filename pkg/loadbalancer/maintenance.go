@@ -0,0 +1,82 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/schedule"
+)
+
+// MaintenanceWindow drains backends on a recurring schedule: while a window is open they get
+// no new requests, and afterwards they return to the pool without anyone calling the admin API.
+type MaintenanceWindow struct {
+	// Backends are the addresses drained during the window
+	Backends []string
+	// Schedule is a cron specification of when the window opens, e.g. "0 2 * * *"
+	Schedule string
+	// Duration is how long the window stays open
+	Duration time.Duration
+	// Location is the time zone the schedule is read in; default UTC
+	Location *time.Location
+}
+
+// WithMaintenance adds maintenance windows
+func WithMaintenance(windows ...MaintenanceWindow) Option {
+	return func(lb *LoadBalancer) {
+		lb.maintenanceWindows = append(lb.maintenanceWindows, windows...)
+	}
+}
+
+type compiledWindow struct {
+	backends []string
+	window   *schedule.Window
+}
+
+// maintenance remembers which backends were drained at the last check, to log transitions
+type maintenance struct {
+	windows []compiledWindow
+
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+func newMaintenance(windows []MaintenanceWindow) (*maintenance, error) {
+	m := &maintenance{active: make(map[string]bool)}
+	for _, w := range windows {
+		win, err := schedule.NewWindow(w.Schedule, w.Duration, w.Location)
+		if err != nil {
+			return nil, fmt.Errorf("maintenance window %q: %w", w.Schedule, err)
+		}
+		m.windows = append(m.windows, compiledWindow{backends: w.Backends, window: win})
+	}
+	return m, nil
+}
+
+// drained reports whether addr is inside one of its windows now
+func (lb *LoadBalancer) drained(addr string) bool {
+	m := lb.maintenance
+	if m == nil {
+		return false
+	}
+	now := time.Now()
+	in := false
+	for _, w := range m.windows {
+		if slices.Contains(w.backends, addr) && w.window.Open(now) {
+			in = true
+			break
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if in != m.active[addr] {
+		m.active[addr] = in
+		if in {
+			lb.logger.Info("backend entering maintenance", "server", addr)
+		} else {
+			lb.logger.Info("backend leaving maintenance", "server", addr)
+		}
+	}
+	return in
+}
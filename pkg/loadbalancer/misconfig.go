@@ -0,0 +1,94 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Misconfigured is implemented by servers that can tell a backend speaking another protocol
+// than the one configured, such as HTTPS behind an http:// address, from a backend that is
+// simply down
+type Misconfigured interface {
+	// Misconfiguration explains the mismatch last seen, or is "" when there is none
+	Misconfiguration() string
+}
+
+// MisconfigurationOf returns why the server's backend is misconfigured, or "" when it is not
+// or the server does not implement Misconfigured
+func MisconfigurationOf(s Server) string {
+	if m, ok := s.(Misconfigured); ok {
+		return m.Misconfiguration()
+	}
+	return ""
+}
+
+// plainAnswerToTLS is http.Transport's unexported error for an HTTP answer to a TLS handshake
+const plainAnswerToTLS = "server gave HTTP response to HTTPS client"
+
+// plainToTLSAnswers are what HTTPS servers answer a plain HTTP request with
+var plainToTLSAnswers = []string{
+	"Client sent an HTTP request to an HTTPS server",
+	"The plain HTTP request was sent to HTTPS port",
+}
+
+// protocolMismatch explains a failed call to a backend, or a response from it, when they show
+// that the backend speaks another protocol than scheme says; it is "" otherwise
+func protocolMismatch(scheme string, err error, resp *http.Response) string {
+	if err != nil {
+		msg := err.Error()
+		if strings.Contains(msg, plainAnswerToTLS) {
+			return "backend speaks plain HTTP but is configured as https://"
+		}
+		var recordErr tls.RecordHeaderError
+		if errors.As(err, &recordErr) {
+			return "backend doesn't speak TLS but is configured as https://"
+		}
+		if !strings.Contains(msg, "malformed HTTP") {
+			return ""
+		}
+		// a TLS alert or handshake record where an HTTP status line was expected
+		if scheme == "http" && (strings.Contains(msg, `"\x15\x03`) || strings.Contains(msg, `"\x16\x03`)) {
+			return "backend speaks HTTPS but is configured as http://"
+		}
+		return "backend answers with bytes that aren't HTTP"
+	}
+	if scheme == "http" && resp.StatusCode == http.StatusBadRequest {
+		// the body is small; what isn't read here is discarded with it
+		head, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		for _, answer := range plainToTLSAnswers {
+			if bytes.Contains(head, []byte(answer)) {
+				return "backend speaks HTTPS but is configured as http://"
+			}
+		}
+	}
+	return ""
+}
+
+// noteMisconfig records the protocol mismatch seen on a call to the backend, "" for none,
+// logging when one starts or stops
+func (s *SimpleServer) noteMisconfig(reason string) {
+	var prev string
+	if p := s.misconfig.Swap(&reason); p != nil {
+		prev = *p
+	}
+	switch {
+	case reason == prev:
+	case reason != "":
+		s.logger.Warn("backend misconfigured", "server", s.addr, "problem", reason)
+	default:
+		s.logger.Info("backend protocol mismatch resolved", "server", s.addr)
+	}
+}
+
+// Misconfiguration explains the protocol mismatch seen on the last health check or failed
+// request, or is "" when there was none
+func (s *SimpleServer) Misconfiguration() string {
+	if p := s.misconfig.Load(); p != nil {
+		return *p
+	}
+	return ""
+}
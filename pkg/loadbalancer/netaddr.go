@@ -0,0 +1,142 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// listenAddr turns a configured port into a listen address. A bare port ("8080") listens on
+// every interface, IPv4 and IPv6 alike; a full address ("[::1]:8080", "10.0.0.1:8080") binds
+// just that one.
+func listenAddr(port string) string {
+	if strings.Contains(port, ":") {
+		return port
+	}
+	return ":" + port
+}
+
+// clientIP returns the address of the peer that sent req, without the port or brackets.
+// IPv4 clients reaching a dual-stack socket are reported in dotted form.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = strings.Trim(req.RemoteAddr, "[]")
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.Unmap().String()
+	}
+	return host
+}
+
+// requestHost returns the host req was addressed to, without the port or IPv6 brackets
+func requestHost(req *http.Request) string {
+	if h, _, err := net.SplitHostPort(req.Host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(req.Host, "["), "]")
+}
+
+// clientKey groups client addresses for per-client limits. IPv4 addresses stand alone, while
+// IPv6 addresses are grouped by /64, since a single host usually controls a whole /64 and
+// could otherwise dodge a limit by rotating addresses.
+func clientKey(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Is6() {
+		return ip
+	}
+	prefix, _ := addr.WithZone("").Prefix(64)
+	return prefix.String()
+}
+
+// AccessList admits or refuses clients by address. Entries are CIDR prefixes or single
+// addresses, IPv4 or IPv6. Deny wins over Allow; a non-empty Allow refuses everyone else.
+type AccessList struct {
+	Allow []string
+	Deny  []string
+	// DenyFingerprints refuses clients whose TLS client hello has one of these JA3
+	// fingerprints, whatever their address; see TLSFingerprint
+	DenyFingerprints []string
+}
+
+// WithAccessList answers 403 to clients the list refuses
+func WithAccessList(acl AccessList) Option {
+	return func(lb *LoadBalancer) {
+		lb.accessList = &acl
+	}
+}
+
+type compiledACL struct {
+	allow, deny  []netip.Prefix
+	fingerprints map[string]bool
+}
+
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	out := make([]netip.Prefix, 0, len(entries))
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if p, err := netip.ParsePrefix(e); err == nil {
+			out = append(out, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(strings.Trim(e, "[]"))
+		if err != nil {
+			return nil, fmt.Errorf("access list: invalid address or prefix %q", e)
+		}
+		addr = addr.Unmap()
+		out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return out, nil
+}
+
+func compileACL(acl AccessList) (*compiledACL, error) {
+	allow, err := parsePrefixes(acl.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parsePrefixes(acl.Deny)
+	if err != nil {
+		return nil, err
+	}
+	fingerprints := make(map[string]bool, len(acl.DenyFingerprints))
+	for _, fp := range acl.DenyFingerprints {
+		if fp = strings.ToLower(strings.TrimSpace(fp)); fp != "" {
+			fingerprints[fp] = true
+		}
+	}
+	return &compiledACL{allow: allow, deny: deny, fingerprints: fingerprints}, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// admits reports whether the client at ip may be served
+func (a *compiledACL) admits(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+	if containsAddr(a.deny, addr) {
+		return false
+	}
+	return len(a.allow) == 0 || containsAddr(a.allow, addr)
+}
+
+func (a *compiledACL) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !stateFrom(req.Context()).authBypass && (!a.admits(clientIP(req)) || a.fingerprints[TLSFingerprint(req)]) {
+			http.Error(rw, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
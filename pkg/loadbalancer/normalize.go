@@ -0,0 +1,159 @@
+package loadbalancer
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// URLNormalization rewrites request paths into one canonical spelling before any stage
+// looks at them, so "/admin", "//admin", "/x/../admin" and "/%61dmin" can't be told apart
+// by route rules, access rules or backends. Malformed percent-encoding is refused with 400.
+type URLNormalization struct {
+	// KeepSlashes leaves runs of slashes alone instead of collapsing them into one
+	KeepSlashes bool
+	// KeepDotSegments leaves "." and ".." segments alone instead of resolving them
+	KeepDotSegments bool
+	// Lowercase folds the path to lower case, for backends with case-insensitive routing
+	Lowercase bool
+	// Skip lists route prefixes whose requests keep the path exactly as sent, for backends
+	// that give doubled slashes or case a meaning. They are matched against the normalized
+	// path, so "/raw/../admin" is not let through as "/raw".
+	Skip []string
+}
+
+// WithURLNormalization normalizes request paths ahead of the middleware chain
+func WithURLNormalization(n URLNormalization) Option {
+	return func(lb *LoadBalancer) {
+		lb.normalize = &n
+	}
+}
+
+var errBadEscape = errors.New("malformed percent-encoding")
+
+func (n URLNormalization) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, "/") {
+			// "*" and other non-path targets pass through untouched
+			next.ServeHTTP(rw, req)
+			return
+		}
+		escaped, err := n.normalize(req.URL.EscapedPath())
+		if err != nil {
+			http.Error(rw, "Bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		path, err := url.PathUnescape(escaped)
+		if err != nil {
+			http.Error(rw, "Bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !n.skips(path) {
+			req.URL.Path, req.URL.RawPath = path, escaped
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+func (n URLNormalization) skips(path string) bool {
+	for _, prefix := range n.Skip {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize returns the canonical form of an escaped path
+func (n URLNormalization) normalize(p string) (string, error) {
+	p, err := normalizeEscapes(p, n.Lowercase)
+	if err != nil {
+		return "", err
+	}
+	if !n.KeepSlashes {
+		for strings.Contains(p, "//") {
+			p = strings.ReplaceAll(p, "//", "/")
+		}
+	}
+	if !n.KeepDotSegments {
+		p = removeDotSegments(p)
+	}
+	return p, nil
+}
+
+// normalizeEscapes decodes percent-encoded unreserved characters, which have only one meaning,
+// and upper-cases the hex digits of the escapes that remain (RFC 3986 section 6.2.2)
+func normalizeEscapes(p string, lower bool) (string, error) {
+	var sb strings.Builder
+	sb.Grow(len(p))
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c != '%' {
+			if lower && 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			sb.WriteByte(c)
+			continue
+		}
+		if i+2 >= len(p) || !isHex(p[i+1]) || !isHex(p[i+2]) {
+			return "", errBadEscape
+		}
+		b := unhex(p[i+1])<<4 | unhex(p[i+2])
+		if isUnreserved(b) {
+			if lower && 'A' <= b && b <= 'Z' {
+				b += 'a' - 'A'
+			}
+			sb.WriteByte(b)
+		} else {
+			sb.WriteByte('%')
+			sb.WriteString(strings.ToUpper(p[i+1 : i+3]))
+		}
+		i += 2
+	}
+	return sb.String(), nil
+}
+
+// removeDotSegments resolves "." and ".." segments, keeping a trailing slash (RFC 3986 section 5.2.4)
+func removeDotSegments(p string) string {
+	segments := strings.Split(p[1:], "/")
+	out := make([]string, 0, len(segments))
+	for i, seg := range segments {
+		last := i == len(segments)-1
+		switch seg {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, seg)
+		}
+	}
+	return "/" + strings.Join(out, "/")
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
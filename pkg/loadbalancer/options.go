@@ -0,0 +1,90 @@
+package loadbalancer
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+)
+
+// Option configures a LoadBalancer
+type Option func(*LoadBalancer)
+
+// HealthCheckFunc reports whether a server may receive traffic.
+// It should give up once ctx is done.
+type HealthCheckFunc func(ctx context.Context, server Server) bool
+
+// WithName names the balancer; it is attached to every log line so instances sharing
+// a process can be told apart. The default is "default".
+func WithName(name string) Option {
+	return func(lb *LoadBalancer) {
+		lb.name = name
+	}
+}
+
+// WithPort sets the port the load balancer listens on
+func WithPort(port string) Option {
+	return func(lb *LoadBalancer) {
+		lb.port = port
+	}
+}
+
+// WithServers adds already constructed servers to the pool
+func WithServers(servers ...Server) Option {
+	return func(lb *LoadBalancer) {
+		lb.serverList = append(lb.serverList, servers...)
+	}
+}
+
+// WithBackends adds a SimpleServer for each backend URL.
+// The servers are built after all options are applied, so they pick up WithTransport.
+func WithBackends(addrs ...string) Option {
+	return func(lb *LoadBalancer) {
+		for _, addr := range addrs {
+			lb.backendSpecs = append(lb.backendSpecs, backendSpec{addr: addr})
+		}
+	}
+}
+
+// WithBackend adds a SimpleServer for one backend URL, built like those of WithBackends.
+// opts apply after the balancer-wide server settings, so a WithHealthPath here wins over WithHealthChecks.
+func WithBackend(addr string, opts ...ServerOption) Option {
+	return func(lb *LoadBalancer) {
+		lb.backendSpecs = append(lb.backendSpecs, backendSpec{addr: addr, opts: opts})
+	}
+}
+
+// WithStrategy sets the balancing strategy; the default is round-robin
+func WithStrategy(strategy Strategy) Option {
+	return func(lb *LoadBalancer) {
+		lb.strategy = strategy
+	}
+}
+
+// WithHealthCheck replaces the liveness check applied to a server before it is used.
+// By default the server's own IsAlive method is called.
+func WithHealthCheck(check HealthCheckFunc) Option {
+	return func(lb *LoadBalancer) {
+		lb.healthCheck = check
+	}
+}
+
+// WithLogger sets the logger for balancer events; the default is slog.Default()
+func WithLogger(logger *slog.Logger) Option {
+	return func(lb *LoadBalancer) {
+		lb.logger = logger
+	}
+}
+
+// WithTransport sets the RoundTripper used by servers created from WithBackends
+func WithTransport(transport http.RoundTripper) Option {
+	return func(lb *LoadBalancer) {
+		lb.transport = transport
+	}
+}
+
+// WithMiddleware wraps the proxy handler. Middleware given first runs first.
+func WithMiddleware(mw ...Middleware) Option {
+	return func(lb *LoadBalancer) {
+		lb.middleware = append(lb.middleware, mw...)
+	}
+}
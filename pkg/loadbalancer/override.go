@@ -0,0 +1,111 @@
+package loadbalancer
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/netip"
+	"net/url"
+)
+
+// overrideTokenHeader carries BackendOverride.Token
+const overrideTokenHeader = "X-LB-Backend-Token"
+
+// BackendOverride lets trusted callers send a request to a backend of their choosing by
+// naming it in a header, for reproducing backend-specific bugs through the balancer. The
+// request goes to that backend or fails; it is never cached, coalesced or sent elsewhere.
+// Callers are trusted when they connect from one of the Trusted networks or present Token
+// in the X-LB-Backend-Token header; at least one of the two must be configured.
+type BackendOverride struct {
+	// Header names the backend, as its URL or host:port; default X-LB-Backend
+	Header string
+	// Token is the secret expected in X-LB-Backend-Token
+	Token string
+	// Trusted are client addresses or CIDRs allowed to override without a token
+	Trusted []string
+}
+
+// WithBackendOverride enables the debugging header that pins a request to one backend
+func WithBackendOverride(o BackendOverride) Option {
+	return func(lb *LoadBalancer) {
+		if o.Header == "" {
+			o.Header = "X-LB-Backend"
+		}
+		lb.override = &o
+	}
+}
+
+type backendOverride struct {
+	BackendOverride
+	trusted []netip.Prefix
+}
+
+func compileOverride(o BackendOverride) (*backendOverride, error) {
+	if o.Token == "" && len(o.Trusted) == 0 {
+		return nil, errors.New("loadbalancer: backend override needs a token or trusted networks")
+	}
+	trusted, err := parsePrefixes(o.Trusted)
+	if err != nil {
+		return nil, err
+	}
+	return &backendOverride{BackendOverride: o, trusted: trusted}, nil
+}
+
+// authorized reports whether req may choose its backend
+func (o *backendOverride) authorized(req *http.Request) bool {
+	if o.Token != "" {
+		if got := req.Header.Get(overrideTokenHeader); got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(o.Token)) == 1 {
+			return true
+		}
+	}
+	addr, err := netip.ParseAddr(clientIP(req))
+	return err == nil && containsAddr(o.trusted, addr)
+}
+
+// findBackend returns the regular or dark launch backend named by target
+func (lb *LoadBalancer) findBackend(target string) Server {
+	servers := lb.Servers()
+	if lb.dark != nil {
+		servers = append(servers, lb.dark.servers...)
+	}
+	for _, s := range servers {
+		if s.Address() == target {
+			return s
+		}
+		if u, err := url.Parse(s.Address()); err == nil && u.Host == target {
+			return s
+		}
+	}
+	return nil
+}
+
+func (lb *LoadBalancer) overrideMiddleware(o *backendOverride) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			target := req.Header.Get(o.Header)
+			authorized := target != "" && o.authorized(req)
+			// neither header is for the backend's eyes
+			req.Header.Del(o.Header)
+			req.Header.Del(overrideTokenHeader)
+			if !authorized {
+				if target != "" {
+					lb.logger.Debug("ignoring backend override from untrusted client", "client", clientIP(req))
+				}
+				next.ServeHTTP(rw, req)
+				return
+			}
+			server := lb.findBackend(target)
+			if server == nil {
+				http.Error(rw, "unknown backend "+target, http.StatusBadRequest)
+				return
+			}
+			st := stateFrom(req.Context())
+			st.pool, st.poolName = []Server{server}, PoolOverride
+			st.allowed = nil
+			st.overridden = true
+			rw.Header().Set(o.Header, server.Address())
+			lb.logger.Info("backend override", "server", server.Address(), "client", clientIP(req), "path", req.URL.Path)
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
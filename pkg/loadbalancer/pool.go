@@ -0,0 +1,199 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/router"
+)
+
+// Pool is a named set of backends that routes can send requests to instead of the balancer's
+// own. Pool members are health checked along with the regular backends, at the same interval
+// and thresholds.
+type Pool struct {
+	Name string
+	// Backends are the URLs of the pool's members
+	Backends []string
+	// Strategy picks among the members; default the balancer's strategy
+	Strategy Strategy
+	// HealthPath, when set, is probed on the members instead of the balancer-wide path
+	HealthPath string
+	// HTTPVersion fixes the HTTP version spoken to the members, see WithHTTPVersion
+	HTTPVersion HTTPVersion
+}
+
+// Route sends the requests matching Host and PathPrefix to the pool named Pool. Host may be
+// an exact name, a "*.example.com" wildcard, or empty for any host. The most specific host
+// wins, then the longest path prefix; requests matching no route go to the regular backends.
+type Route struct {
+	Host       string
+	PathPrefix string
+	Pool       string
+	// Name names the route in X-LB-Route and byte accounting; default Host+PathPrefix
+	Name string
+	// Spillover, when set, sends the requests beyond a threshold to another pool
+	Spillover *Spillover
+}
+
+// WithPools defines backend pools for WithRoutes to send requests to
+func WithPools(pools ...Pool) Option {
+	return func(lb *LoadBalancer) {
+		lb.poolDefs = append(lb.poolDefs, pools...)
+	}
+}
+
+// WithRoutes sends requests to backend pools by host and path
+func WithRoutes(routes ...Route) Option {
+	return func(lb *LoadBalancer) {
+		lb.routes = append(lb.routes, routes...)
+	}
+}
+
+type pool struct {
+	Pool
+	servers []Server
+}
+
+// buildPools creates the servers of every pool defined with WithPools
+func (lb *LoadBalancer) buildPools() error {
+	lb.pools = make(map[string]*pool, len(lb.poolDefs))
+	for _, def := range lb.poolDefs {
+		if def.Name == "" {
+			return errors.New("pool without a name")
+		}
+		if _, ok := lb.pools[def.Name]; ok {
+			return fmt.Errorf("pool %q defined twice", def.Name)
+		}
+		opts := lb.serverOptions()
+		if def.HealthPath != "" {
+			opts = append(opts, WithHealthPath(def.HealthPath))
+		}
+		if def.HTTPVersion != HTTPAuto {
+			opts = append(opts, WithHTTPVersion(def.HTTPVersion))
+		}
+		// never nil, so a route to a pool without members isn't sent to the regular backends
+		p := &pool{Pool: def, servers: []Server{}}
+		for _, addr := range def.Backends {
+			server, err := newSimpleServer(addr, lb.transport, opts...)
+			if err != nil {
+				return fmt.Errorf("pool %q: %w", def.Name, err)
+			}
+			p.servers = append(p.servers, server)
+		}
+		lb.pools[def.Name] = p
+	}
+	return nil
+}
+
+// poolServers are the members of every pool, in the order the pools were defined
+func (lb *LoadBalancer) poolServers() []Server {
+	var servers []Server
+	for _, def := range lb.poolDefs {
+		servers = append(servers, lb.pools[def.Name].servers...)
+	}
+	return servers
+}
+
+// RouteInfo describes one entry of the route table
+type RouteInfo struct {
+	Name       string
+	Host       string
+	PathPrefix string
+	Pool       string
+	// Backends counts the pool's members
+	Backends int
+}
+
+// Routes lists the route table in the order the routes were configured
+func (lb *LoadBalancer) Routes() []RouteInfo {
+	out := make([]RouteInfo, 0, len(lb.routes))
+	for _, r := range lb.routes {
+		info := RouteInfo{Name: r.Name, Host: r.Host, PathPrefix: r.PathPrefix, Pool: r.Pool}
+		if info.Name == "" {
+			info.Name = r.Host + r.PathPrefix
+		}
+		if p, ok := lb.pools[r.Pool]; ok {
+			info.Backends = len(p.servers)
+		}
+		out = append(out, info)
+	}
+	return out
+}
+
+type compiledRoute struct {
+	name  string
+	pool  *pool
+	spill *spillover
+}
+
+// routeMiddleware compiles the routes into a route table and restricts matching requests to
+// their pool
+func (lb *LoadBalancer) routeMiddleware(routes []Route) (Middleware, error) {
+	rules := make([]router.Rule[*compiledRoute], len(routes))
+	for i, r := range routes {
+		p, ok := lb.pools[r.Pool]
+		if !ok {
+			return nil, fmt.Errorf("route %s%s: unknown pool %q", r.Host, r.PathPrefix, r.Pool)
+		}
+		name := r.Name
+		if name == "" {
+			name = r.Host + r.PathPrefix
+		}
+		target := &compiledRoute{name: name, pool: p}
+		if r.Spillover != nil {
+			overflow, ok := lb.pools[r.Spillover.Pool]
+			if !ok || overflow == p {
+				return nil, fmt.Errorf("route %s: spillover to unknown pool %q", name, r.Spillover.Pool)
+			}
+			spill, err := newSpillover(name, p, overflow, *r.Spillover)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %w", name, err)
+			}
+			target.spill = spill
+			lb.spillovers = append(lb.spillovers, spill)
+		}
+		rules[i] = router.Rule[*compiledRoute]{Host: r.Host, PathPrefix: r.PathPrefix, Target: target}
+	}
+	table, err := router.Compile(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if r, ok := table.Match(req.Host, req.URL.Path); ok {
+				st := stateFrom(req.Context())
+				st.pool, st.poolName = r.pool.servers, r.pool.Name
+				st.strategy, st.route = r.pool.Strategy, r.name
+				// restrictions meant for the regular backends don't apply to the pool
+				st.allowed = nil
+				if r.spill != nil {
+					r.spill.serve(next, rw, req, st)
+					return
+				}
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}, nil
+}
+
+// poolStatus is one entry of GET /pools
+type poolStatus struct {
+	Name     string          `json:"name"`
+	Backends []backendStatus `json:"backends"`
+}
+
+// servePools lists the pools with each member's observed state
+func (lb *LoadBalancer) servePools(rw http.ResponseWriter, _ *http.Request) {
+	out := make([]poolStatus, 0, len(lb.poolDefs))
+	for _, def := range lb.poolDefs {
+		p := lb.pools[def.Name]
+		status := poolStatus{Name: p.Name, Backends: make([]backendStatus, 0, len(p.servers))}
+		for _, server := range p.servers {
+			status.Backends = append(status.Backends, lb.backendStatusOf(server))
+		}
+		out = append(out, status)
+	}
+	writeJSON(rw, out)
+}
@@ -0,0 +1,136 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Prewarm opens idle connections to every backend before traffic needs them, so the first wave
+// of requests after a start, a reload or a pool change doesn't pay for dialing and TLS. Each
+// connection is opened by a request to the backend's health path; the requests are held until
+// all of them have a connection, so the transport keeps that many apart. HTTP/2 backends
+// multiplex over one connection and are warmed with a single one.
+type Prewarm struct {
+	// Conns is the number of idle connections kept ready per backend, at most 64
+	Conns int
+	// Timeout bounds pre-warming a backend; default 5s
+	Timeout time.Duration
+}
+
+// WithPrewarm pre-establishes upstream connections on start and for backends added later
+func WithPrewarm(p Prewarm) Option {
+	return func(lb *LoadBalancer) {
+		p.Conns = min(max(p.Conns, 1), 64)
+		if p.Timeout <= 0 {
+			p.Timeout = 5 * time.Second
+		}
+		lb.prewarm = &p
+	}
+}
+
+// prewarmAll warms every backend the balancer knows of, at once
+func (lb *LoadBalancer) prewarmAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, server := range lb.checkedServers() {
+		wg.Go(func() { lb.prewarmServer(ctx, server) })
+	}
+	wg.Wait()
+}
+
+// prewarmAdded warms a backend that joined the pool at runtime in the background
+func (lb *LoadBalancer) prewarmAdded(server Server) {
+	if lb.prewarm != nil {
+		go lb.prewarmServer(context.Background(), server)
+	}
+}
+
+// prewarmServer opens the configured connections to server; servers that aren't a
+// SimpleServer have no transport to warm
+func (lb *LoadBalancer) prewarmServer(ctx context.Context, server Server) {
+	s, ok := server.(*SimpleServer)
+	if lb.prewarm == nil || !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, lb.prewarm.Timeout)
+	defer cancel()
+	opened, err := s.openConns(ctx, lb.prewarm.Conns)
+	if err != nil {
+		lb.logger.Warn("pre-warming backend failed", "server", s.Address(), "conns", opened, "error", err)
+		return
+	}
+	lb.logger.Debug("backend pre-warmed", "server", s.Address(), "conns", opened)
+}
+
+// openConns sends n concurrent requests to the health target, each waiting on the others
+// before it goes out, and returns how many connections were newly dialed
+func (s *SimpleServer) openConns(ctx context.Context, n int) (int, error) {
+	target := s.target
+	if s.healthURL != nil {
+		target = s.healthURL
+	}
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		opened int
+		errs   []error
+	)
+	connected := make(chan struct{})
+	var pending sync.WaitGroup
+	pending.Add(n)
+	go func() {
+		pending.Wait()
+		close(connected)
+	}()
+	for range n {
+		wg.Go(func() {
+			once := sync.OnceFunc(pending.Done)
+			defer once()
+			trace := &httptrace.ClientTrace{
+				GotConn: func(info httptrace.GotConnInfo) {
+					if !info.Reused {
+						mu.Lock()
+						opened++
+						mu.Unlock()
+					}
+					once()
+					select {
+					case <-connected:
+					case <-ctx.Done():
+					}
+				},
+			}
+			req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, target.String(), nil)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				return
+			}
+			if s.host != "" {
+				req.Host = s.host
+			}
+			req.Header.Set("User-Agent", "loadbalancer-prewarm")
+			s.authorize(req)
+			resp, err := s.client.Do(req)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				return
+			}
+			// read the body to the end so the connection goes back to the idle pool
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+			resp.Body.Close()
+		})
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return opened, fmt.Errorf("%d of %d requests failed: %w", len(errs), n, errs[0])
+	}
+	return opened, nil
+}
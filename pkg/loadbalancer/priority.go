@@ -0,0 +1,107 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// Priority is a request's class when the balancer has to shed load
+type Priority int
+
+// The priority classes; the zero value is PriorityNormal
+const (
+	PriorityLow Priority = iota - 1
+	PriorityNormal
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	}
+	return "normal"
+}
+
+// ParsePriority accepts "high", "normal" and "low"
+func ParsePriority(s string) (Priority, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "high":
+		return PriorityHigh, nil
+	case "normal", "":
+		return PriorityNormal, nil
+	case "low":
+		return PriorityLow, nil
+	}
+	return PriorityNormal, fmt.Errorf("loadbalancer: unknown priority %q; want high, normal or low", s)
+}
+
+// PriorityRule gives the requests it matches a priority class. Empty fields match everything.
+type PriorityRule struct {
+	Host       string
+	PathPrefix string
+	// Header, when set, must be present on the request, with Value if that is set too
+	Header   string
+	Value    string
+	Priority Priority
+}
+
+// Priorities sort requests into classes so that overload hurts the least important traffic
+// first. Low-priority requests may only use LowShare of the WithAdmission in-flight limit and
+// of each backend's concurrency cap, high-priority ones also get the admission Reserve, so
+// routes like checkout keep working while batch jobs are turned away.
+type Priorities struct {
+	// Rules are checked in order and the first match sets the class; unmatched requests are normal
+	Rules []PriorityRule
+	// LowShare is the part of a limit low-priority requests may fill; default 0.8
+	LowShare float64
+}
+
+// WithPriorities assigns requests priority classes
+func WithPriorities(p Priorities) Option {
+	return func(lb *LoadBalancer) {
+		if p.LowShare <= 0 || p.LowShare > 1 {
+			p.LowShare = 0.8
+		}
+		lb.priorities = &p
+	}
+}
+
+// classify returns the class of the first rule matching req
+func (p *Priorities) classify(req *http.Request) Priority {
+	for _, r := range p.Rules {
+		if r.Host != "" && !strings.EqualFold(r.Host, requestHost(req)) {
+			continue
+		}
+		if !strings.HasPrefix(req.URL.Path, r.PathPrefix) {
+			continue
+		}
+		if r.Header != "" {
+			v, ok := req.Header[http.CanonicalHeaderKey(r.Header)]
+			if !ok || (r.Value != "" && !strings.EqualFold(strings.Join(v, ","), r.Value)) {
+				continue
+			}
+		}
+		return r.Priority
+	}
+	return PriorityNormal
+}
+
+func (p *Priorities) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		stateFrom(req.Context()).priority = p.classify(req)
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// limit scales a limit down to what a request of class prio may use; p may be nil
+func (p *Priorities) limit(limit int64, prio Priority) int64 {
+	if p == nil || prio != PriorityLow {
+		return limit
+	}
+	return max(int64(math.Floor(float64(limit)*p.LowShare)), 1)
+}
@@ -0,0 +1,421 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/metrics"
+)
+
+// statusClasses are the code label values of lb_backend_requests_total
+var statusClasses = [...]string{"1xx", "2xx", "3xx", "4xx", "5xx"}
+
+// backendMetrics holds the traffic counters of one backend
+type backendMetrics struct {
+	// requests is indexed by status class, 1xx first
+	requests [len(statusClasses)]*metrics.Counter
+	latency  *metrics.Histogram
+	errors   map[UpstreamErrorKind]*metrics.Counter
+	// slots are the requests in flight under a concurrency cap, saturated the times it was hit
+	slots     atomic.Int64
+	saturated *metrics.Counter
+}
+
+func newBackendMetrics() *backendMetrics {
+	m := &backendMetrics{
+		latency:   metrics.NewHistogram(metrics.DefaultBuckets),
+		errors:    make(map[UpstreamErrorKind]*metrics.Counter),
+		saturated: metrics.NewCounter(),
+	}
+	for i := range m.requests {
+		m.requests[i] = metrics.NewCounter()
+	}
+	for _, kind := range upstreamErrorKinds {
+		m.errors[kind] = metrics.NewCounter()
+	}
+	return m
+}
+
+// backendMetricsFor returns the counters of the backend at addr, creating them on first use
+func (lb *LoadBalancer) backendMetricsFor(addr string) *backendMetrics {
+	lb.backendMu.RLock()
+	m := lb.backendStats[addr]
+	lb.backendMu.RUnlock()
+	if m != nil {
+		return m
+	}
+	lb.backendMu.Lock()
+	defer lb.backendMu.Unlock()
+	if m = lb.backendStats[addr]; m == nil {
+		m = newBackendMetrics()
+		lb.backendStats[addr] = m
+	}
+	return m
+}
+
+// backendCounts returns the non-zero request and error counts of the backend at addr
+func (lb *LoadBalancer) backendCounts(addr string) (map[string]uint64, map[UpstreamErrorKind]uint64) {
+	lb.backendMu.RLock()
+	m := lb.backendStats[addr]
+	lb.backendMu.RUnlock()
+	if m == nil {
+		return nil, nil
+	}
+	requests := make(map[string]uint64)
+	for class, c := range m.requests {
+		if n := c.Value(); n > 0 {
+			requests[statusClasses[class]] = n
+		}
+	}
+	errs := make(map[UpstreamErrorKind]uint64)
+	for kind, c := range m.errors {
+		if n := c.Value(); n > 0 {
+			errs[kind] = n
+		}
+	}
+	return requests, errs
+}
+
+// attemptWriter records the status a backend answered one attempt with
+type attemptWriter struct {
+	http.ResponseWriter
+	status int
+	// headers, when set, is called as the response headers arrive
+	headers func()
+}
+
+func (w *attemptWriter) WriteHeader(code int) {
+	// informational responses precede the real one, except for a protocol switch
+	if w.status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		w.status = code
+		if w.headers != nil {
+			w.headers()
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *attemptWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+		if w.headers != nil {
+			w.headers()
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *attemptWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// serveAttempt sends the request to server and records the outcome against it.
+// A failure handed back for a retry counts with the status its kind would have been answered with.
+func (lb *LoadBalancer) serveAttempt(rw http.ResponseWriter, req *http.Request, st *requestState, server Server) {
+	w := &attemptWriter{ResponseWriter: rw}
+	var out http.ResponseWriter = w
+	if rule := lb.responseRule(req); rule != nil {
+		out = &validatingWriter{ResponseWriter: w, lb: lb, rule: rule, req: req, server: server, before: rw.Header().Clone()}
+	}
+	sent := req
+	if lb.adaptiveTimeouts != nil && lb.adaptiveTimeouts.bounds(req) {
+		var done func()
+		sent, w.headers, done = lb.adaptiveTimeouts.timedAttempt(req, server)
+		defer done()
+	}
+	if st.journal != nil {
+		st.journal.attempt(st.route, server.Address())
+	}
+	start := time.Now()
+	if st.timing != nil {
+		st.timing.begin(start)
+	}
+	if p := lb.redirectPolicy(req); p != nil {
+		lb.serveRedirects(out, sent, server, p)
+	} else {
+		server.Serve(out, sent)
+	}
+	elapsed := time.Since(start)
+	if st.timing != nil {
+		st.timing.end(start.Add(elapsed))
+	}
+	st.upstream += elapsed
+
+	status := w.status
+	switch {
+	case status == 0 && st.upstreamErr != nil:
+		status = st.upstreamErr.Kind.Status()
+	case status == 0:
+		status = http.StatusOK
+	}
+	m := lb.backendMetricsFor(server.Address())
+	if class := status/100 - 1; class >= 0 && class < len(m.requests) {
+		m.requests[class].Inc()
+	}
+	m.latency.Observe(elapsed.Seconds())
+}
+
+// serveMetrics writes the balancer's counters and per-backend state in the Prometheus text format
+func (lb *LoadBalancer) serveMetrics(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w := bufio.NewWriter(rw)
+	defer w.Flush()
+	lb.writeMetrics(w)
+}
+
+// writeMetrics writes everything serveMetrics serves
+func (lb *LoadBalancer) writeMetrics(w *bufio.Writer) {
+	stats := lb.Stats()
+	for _, c := range []struct {
+		name, help string
+		value      uint64
+	}{
+		{"lb_requests_total", "Requests received.", stats.Requests},
+		{"lb_request_bytes_total", "Request body bytes read from clients.", stats.BytesRead},
+		{"lb_response_bytes_total", "Response body bytes written to clients.", stats.BytesWritten},
+		{"lb_connections_rejected_total", "Connections closed by the per-client limit.", stats.ConnectionsRejected},
+		{"lb_client_aborts_total", "Requests abandoned by the client.", stats.ClientAborts},
+		{"lb_shed_total", "Requests refused by admission control.", stats.Shed},
+		{"lb_rate_limited_total", "Requests refused by the per-client rate limit.", stats.RateLimited},
+	} {
+		writeMetricHeader(w, c.name, "counter", c.help)
+		fmt.Fprintf(w, "%s %d\n", c.name, c.value)
+	}
+
+	// pool members are reported, and keep their counters, like the regular backends
+	servers := append(lb.Servers(), lb.poolServers()...)
+	addrs := make([]string, len(servers))
+	for i, s := range servers {
+		addrs[i] = s.Address()
+	}
+	lb.stateMu.Lock()
+	alive := make([]bool, len(servers))
+	seen := make([]bool, len(servers))
+	for i, addr := range addrs {
+		alive[i], seen[i] = lb.lastAlive[addr]
+	}
+	lb.stateMu.Unlock()
+
+	writeMetricHeader(w, "lb_backend_up", "gauge", "Whether the backend passed its last health check; absent until it is checked.")
+	for i, addr := range addrs {
+		if seen[i] {
+			fmt.Fprintf(w, "lb_backend_up{backend=%s} %d\n", labelValue(addr), boolMetric(alive[i]))
+		}
+	}
+	writeMetricHeader(w, "lb_backend_in_flight", "gauge", "Requests currently being proxied to the backend.")
+	for i, s := range servers {
+		fmt.Fprintf(w, "lb_backend_in_flight{backend=%s} %d\n", labelValue(addrs[i]), ActiveConnectionsOf(s))
+	}
+	if lb.queueDepth != nil {
+		writeMetricHeader(w, "lb_backend_degraded", "gauge", "Whether the backend is deprioritized for its queue depth.")
+		for i, s := range servers {
+			fmt.Fprintf(w, "lb_backend_degraded{backend=%s} %d\n", labelValue(addrs[i]), boolMetric(lb.degraded(s)))
+		}
+	}
+	writeMetricHeader(w, "lb_backend_misconfigured", "gauge", "Whether the backend was last seen speaking another protocol than configured.")
+	for i, s := range servers {
+		fmt.Fprintf(w, "lb_backend_misconfigured{backend=%s} %d\n", labelValue(addrs[i]), boolMetric(MisconfigurationOf(s) != ""))
+	}
+	writeMetricHeader(w, "lb_backend_weight", "gauge", "The backend's relative weight.")
+	for i, s := range servers {
+		fmt.Fprintf(w, "lb_backend_weight{backend=%s} %d\n", labelValue(addrs[i]), WeightOf(s))
+	}
+	writeMetricHeader(w, "lb_backend_info", "gauge", "Always 1; carries the backend's labels as label_<name>, to join onto the other backend series.")
+	for i, s := range servers {
+		fmt.Fprintf(w, "lb_backend_info{backend=%s%s} 1\n", labelValue(addrs[i]), backendLabelPairs(LabelsOf(s)))
+	}
+
+	lb.pruneBackendMetrics(addrs)
+	lb.backendMu.RLock()
+	tracked := maps.Clone(lb.backendStats)
+	lb.backendMu.RUnlock()
+	sorted := slices.Sorted(maps.Keys(tracked))
+
+	writeMetricHeader(w, "lb_backend_requests_total", "counter", "Backend calls by status class; failed calls count as the 502 or 504 they are answered with.")
+	for _, addr := range sorted {
+		m := tracked[addr]
+		for class, c := range m.requests {
+			if n := c.Value(); n > 0 {
+				fmt.Fprintf(w, "lb_backend_requests_total{backend=%s,code=%q} %d\n", labelValue(addr), statusClasses[class], n)
+			}
+		}
+	}
+	writeMetricHeader(w, "lb_backend_errors_total", "counter", "Failed backend calls by kind.")
+	for _, addr := range sorted {
+		m := tracked[addr]
+		for _, kind := range upstreamErrorKinds {
+			if n := m.errors[kind].Value(); n > 0 {
+				fmt.Fprintf(w, "lb_backend_errors_total{backend=%s,kind=%q} %d\n", labelValue(addr), kind, n)
+			}
+		}
+	}
+	writeMetricHeader(w, "lb_backend_saturated_total", "counter", "Times the backend was passed over for being at its concurrency cap.")
+	for _, addr := range sorted {
+		if n := tracked[addr].saturated.Value(); n > 0 {
+			fmt.Fprintf(w, "lb_backend_saturated_total{backend=%s} %d\n", labelValue(addr), n)
+		}
+	}
+	writeMetricHeader(w, "lb_backend_response_seconds", "histogram", "Time from sending a request to the backend until its response was fully relayed.")
+	for _, addr := range sorted {
+		writeHistogram(w, "lb_backend_response_seconds", "backend="+labelValue(addr), tracked[addr].latency.Snapshot())
+	}
+	if lb.canary != nil {
+		lb.writeCanaryMetrics(w)
+	}
+	if lb.sessions != nil {
+		lb.sessions.writeMetrics(w)
+	}
+	if lb.local != nil {
+		lb.local.writeMetrics(w)
+	}
+	if lb.promWeights != nil {
+		lb.promWeights.writeMetrics(w)
+	}
+	if lb.adaptiveTimeouts != nil {
+		lb.adaptiveTimeouts.writeMetrics(w)
+	}
+	if lb.idleProbe != nil {
+		lb.idleProbe.writeMetrics(w)
+	}
+	if lb.life.sniff != nil {
+		lb.life.sniff.writeMetrics(w)
+	}
+	if lb.life.l4 != nil {
+		lb.life.l4.writeMetrics(w)
+	}
+	if lb.redirects != nil {
+		lb.redirects.writeMetrics(w)
+	}
+	if lb.live != nil {
+		lb.live.writeMetrics(w)
+	}
+	if lb.emptyPool != nil {
+		lb.emptyPool.writeMetrics(w)
+	}
+	if lb.accessLog != nil {
+		lb.accessLog.writeMetrics(w)
+	}
+	if lb.idempotency != nil {
+		lb.idempotency.writeMetrics(w)
+	}
+	if lb.autoscale != nil {
+		lb.writeAutoscaleMetrics(w)
+	}
+	if len(lb.spillovers) > 0 {
+		lb.writeSpilloverMetrics(w)
+	}
+	if lb.failover != nil {
+		lb.failover.writeMetrics(w)
+	}
+	if lb.rollout != nil {
+		lb.rollout.writeMetrics(w)
+	}
+	if lb.budgets != nil {
+		lb.budgets.writeMetrics(w)
+	}
+	if lb.tenants != nil {
+		lb.tenants.writeMetrics(w)
+	}
+}
+
+// writeCanaryMetrics sets the canary pool beside the regular one
+func (lb *LoadBalancer) writeCanaryMetrics(w *bufio.Writer) {
+	c := lb.canary
+	arms := []struct {
+		pool  string
+		total abArm
+		step  *metrics.Histogram
+	}{
+		{"baseline", c.baselineTotal, c.baselineLatency.Load()},
+		{"canary", c.canaryTotal, c.canaryLatency.Load()},
+	}
+	writeMetricHeader(w, "lb_canary_share", "gauge", "Percentage of clients sent to the canary pool.")
+	fmt.Fprintf(w, "lb_canary_share %s\n", strconv.FormatFloat(float64(c.share.Load())/100, 'g', -1, 64))
+	writeMetricHeader(w, "lb_canary_requests_total", "counter", "Requests measured during canary ramps, by arm.")
+	for _, a := range arms {
+		fmt.Fprintf(w, "lb_canary_requests_total{pool=%q} %d\n", a.pool, a.total.requests.Value())
+	}
+	writeMetricHeader(w, "lb_canary_errors_total", "counter", "5xx responses during canary ramps, by arm.")
+	for _, a := range arms {
+		fmt.Fprintf(w, "lb_canary_errors_total{pool=%q} %d\n", a.pool, a.total.errors.Value())
+	}
+	writeMetricHeader(w, "lb_canary_response_seconds", "histogram", "Response times during canary ramps, by arm.")
+	for _, a := range arms {
+		writeHistogram(w, "lb_canary_response_seconds", "pool="+strconv.Quote(a.pool), a.total.latency.Snapshot())
+	}
+	writeMetricHeader(w, "lb_canary_step_latency_seconds", "gauge", "Response time percentiles over the current ramp step, by arm.")
+	for _, a := range arms {
+		s := a.step.Snapshot()
+		for _, q := range []float64{0.5, 0.95, 0.99} {
+			fmt.Fprintf(w, "lb_canary_step_latency_seconds{pool=%q,quantile=%q} %s\n", a.pool, strconv.FormatFloat(q, 'g', -1, 64), strconv.FormatFloat(s.Quantile(q), 'g', -1, 64))
+		}
+	}
+}
+
+// writeHistogram writes the series of one histogram; labels go before le
+func writeHistogram(w *bufio.Writer, name, labels string, s metrics.HistogramSnapshot) {
+	for i, bound := range s.Bounds {
+		fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", name, labels, strconv.FormatFloat(bound, 'g', -1, 64), s.Cumulative[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, s.Count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(s.Sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, s.Count)
+}
+
+// pruneBackendMetrics forgets the counters of backends that have left the pool, so discovery
+// churn doesn't grow the scrape without bound
+func (lb *LoadBalancer) pruneBackendMetrics(pool []string) {
+	lb.backendMu.Lock()
+	defer lb.backendMu.Unlock()
+	maps.DeleteFunc(lb.backendStats, func(addr string, _ *backendMetrics) bool {
+		return !slices.Contains(pool, addr)
+	})
+}
+
+func writeMetricHeader(w *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labelValue quotes v as a Prometheus label value
+func labelValue(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+// backendLabelPairs renders a backend's labels as ,label_<name>="value" pairs, with characters
+// Prometheus doesn't allow in label names replaced by underscores. Of labels that end up with
+// the same name, the first in sorted order is kept.
+func backendLabelPairs(labels map[string]string) string {
+	var b strings.Builder
+	seen := make(map[string]bool, len(labels))
+	for _, k := range slices.Sorted(maps.Keys(labels)) {
+		name := strings.Map(func(r rune) rune {
+			if r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+				return r
+			}
+			return '_'
+		}, k)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		fmt.Fprintf(&b, ",label_%s=%s", name, labelValue(labels[k]))
+	}
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
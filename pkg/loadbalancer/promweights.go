@@ -0,0 +1,310 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/metrics"
+)
+
+// PrometheusWeights sets backend weights from a Prometheus query run on an interval, so
+// weighted strategies follow whatever the backends' dashboards already measure: idle CPU, a
+// queue depth, a custom load score
+type PrometheusWeights struct {
+	// URL is the Prometheus server, such as http://prometheus:9090
+	URL string
+	// Query is an instant PromQL query returning one sample per backend, such as
+	// avg by (instance) (rate(node_cpu_seconds_total{mode="idle"}[1m]))
+	Query string
+	// Label names the sample label that identifies the backend; default "instance". Its value
+	// is matched against the backend's address, its host:port or its host name.
+	Label string
+	// Interval is how often the query runs; default 15s
+	Interval time.Duration
+	// Scale multiplies the value into a weight; default 1. With Inverse, the weight is Scale
+	// divided by the value instead, for metrics where more means busier, such as latency.
+	Scale   float64
+	Inverse bool
+	// MinWeight and MaxWeight bound the weights set; default 1 and 10000
+	MinWeight int
+	MaxWeight int
+	// Stale is how long the weights last without a successful query before backends return
+	// to their configured weights; default three intervals
+	Stale time.Duration
+	// Token, when set, is sent as a bearer token
+	Token string
+	// Client defaults to a client with a 10s timeout
+	Client *http.Client
+}
+
+// WithPrometheusWeights adjusts backend weights from a Prometheus query. A backend the query
+// has no sample for keeps its configured weight; capacity reports win over the query.
+func WithPrometheusWeights(cfg PrometheusWeights) Option {
+	return func(lb *LoadBalancer) {
+		if cfg.Label == "" {
+			cfg.Label = "instance"
+		}
+		if cfg.Interval <= 0 {
+			cfg.Interval = 15 * time.Second
+		}
+		if cfg.Scale == 0 {
+			cfg.Scale = 1
+		}
+		if cfg.MinWeight <= 0 {
+			cfg.MinWeight = 1
+		}
+		if cfg.MaxWeight == 0 {
+			cfg.MaxWeight = maxCapacity
+		}
+		if cfg.Stale <= 0 {
+			cfg.Stale = 3 * cfg.Interval
+		}
+		lb.promWeights = &promWeights{
+			PrometheusWeights: cfg,
+			base:              make(map[string]int),
+			failures:          metrics.NewCounter(),
+		}
+	}
+}
+
+// promWeights remembers the configured weights of the backends it overrides
+type promWeights struct {
+	PrometheusWeights
+
+	mu   sync.Mutex
+	base map[string]int
+	// weights holds the weights last set, for the metrics
+	weights   map[string]int
+	succeeded time.Time
+	failures  *metrics.Counter
+}
+
+func (p *promWeights) validate() error {
+	switch {
+	case p.URL == "":
+		return errors.New("prometheus weights without a URL")
+	case p.Query == "":
+		return errors.New("prometheus weights without a query")
+	case p.Scale < 0:
+		return errors.New("prometheus weights: negative scale")
+	case p.MaxWeight < p.MinWeight || p.MaxWeight > maxCapacity:
+		return fmt.Errorf("prometheus weights: want min weight <= max weight <= %d", maxCapacity)
+	}
+	return nil
+}
+
+// promWeightsLoop runs the query every Interval until ctx is done
+func (lb *LoadBalancer) promWeightsLoop(ctx context.Context) {
+	p := lb.promWeights
+	p.mu.Lock()
+	p.succeeded = time.Now()
+	p.mu.Unlock()
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		samples, err := p.query(ctx)
+		switch {
+		case ctx.Err() != nil:
+			lb.restorePromWeights()
+			return
+		case err != nil:
+			p.failures.Inc()
+			lb.logger.Warn("prometheus weight query failed", "error", err)
+			p.mu.Lock()
+			stale := time.Since(p.succeeded) > p.Stale
+			p.mu.Unlock()
+			if stale {
+				lb.restorePromWeights()
+			}
+		default:
+			lb.applyPromWeights(samples)
+		}
+		select {
+		case <-ctx.Done():
+			lb.restorePromWeights()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// query runs the query and returns each sample's value by the value of its Label
+func (p *promWeights) query(ctx context.Context) (map[string]float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.Interval)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL+"/api/v1/query?"+url.Values{"query": {p.Query}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.Token)
+	}
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Status    string `json:"status"`
+		Error     string `json:"error"`
+		ErrorType string `json:"errorType"`
+		Data      struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Metric map[string]string `json:"metric"`
+				Value  [2]any            `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&out); err != nil {
+		return nil, fmt.Errorf("prometheus answered %s", resp.Status)
+	}
+	if out.Status != "success" {
+		return nil, fmt.Errorf("prometheus: %s: %s", out.ErrorType, out.Error)
+	}
+	if out.Data.ResultType != "vector" {
+		return nil, fmt.Errorf("prometheus: query returned a %s, want a vector", out.Data.ResultType)
+	}
+	samples := make(map[string]float64, len(out.Data.Result))
+	for _, r := range out.Data.Result {
+		s, _ := r.Value[1].(string)
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(v) {
+			continue
+		}
+		if id, ok := r.Metric[p.Label]; ok {
+			samples[id] = v
+		}
+	}
+	return samples, nil
+}
+
+// weight turns a sample into a weight within the bounds
+func (p *promWeights) weight(v float64) int {
+	w := v * p.Scale
+	if p.Inverse {
+		w = math.Inf(1)
+		if v > 0 {
+			w = p.Scale / v
+		}
+	}
+	return int(math.Round(math.Max(float64(p.MinWeight), math.Min(w, float64(p.MaxWeight)))))
+}
+
+// promSample finds the sample of the backend at addr
+func promSample(samples map[string]float64, addr string) (float64, bool) {
+	if v, ok := samples[addr]; ok {
+		return v, true
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return 0, false
+	}
+	if v, ok := samples[u.Host]; ok {
+		return v, true
+	}
+	v, ok := samples[u.Hostname()]
+	return v, ok
+}
+
+// applyPromWeights sets the weight of every backend with a sample and restores the others
+func (lb *LoadBalancer) applyPromWeights(samples map[string]float64) {
+	p := lb.promWeights
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.succeeded = time.Now()
+	weights := make(map[string]int)
+	for _, server := range lb.Servers() {
+		ws, ok := server.(WeightSetter)
+		if !ok {
+			continue
+		}
+		addr := server.Address()
+		v, found := promSample(samples, addr)
+		if !found {
+			if base, ok := p.base[addr]; ok {
+				lb.restoreWeight(addr, ws, base)
+				delete(p.base, addr)
+			}
+			continue
+		}
+		if lb.reportsCapacity(addr) {
+			continue
+		}
+		if _, ok := p.base[addr]; !ok {
+			p.base[addr] = ws.Weight()
+		}
+		w := p.weight(v)
+		weights[addr] = w
+		ws.SetWeight(w)
+	}
+	p.weights = weights
+}
+
+// reportsCapacity reports whether a capacity report currently sets addr's weight
+func (lb *LoadBalancer) reportsCapacity(addr string) bool {
+	lb.stateMu.Lock()
+	defer lb.stateMu.Unlock()
+	_, ok := lb.capacity[addr]
+	return ok
+}
+
+// restoreWeight gives the backend at addr its configured weight back, or hands it to the
+// capacity report overriding it to restore when the report expires
+func (lb *LoadBalancer) restoreWeight(addr string, ws WeightSetter, base int) {
+	lb.stateMu.Lock()
+	defer lb.stateMu.Unlock()
+	if st, ok := lb.capacity[addr]; ok {
+		st.base = base
+		return
+	}
+	ws.SetWeight(base)
+}
+
+// restorePromWeights returns every overridden backend to its configured weight
+func (lb *LoadBalancer) restorePromWeights() {
+	p := lb.promWeights
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.base) == 0 {
+		return
+	}
+	for _, server := range lb.Servers() {
+		if base, ok := p.base[server.Address()]; ok {
+			if ws, ok := server.(WeightSetter); ok {
+				lb.restoreWeight(server.Address(), ws, base)
+			}
+		}
+	}
+	clear(p.base)
+	p.weights = nil
+	lb.logger.Info("prometheus weights restored to the configured weights")
+}
+
+// writeMetrics writes the weights set from the query and the failed queries
+func (p *promWeights) writeMetrics(w *bufio.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	writeMetricHeader(w, "lb_prometheus_weight", "gauge", "Backend weights currently set from the Prometheus query.")
+	for _, addr := range slices.Sorted(maps.Keys(p.weights)) {
+		fmt.Fprintf(w, "lb_prometheus_weight{backend=%s} %d\n", labelValue(addr), p.weights[addr])
+	}
+	writeMetricHeader(w, "lb_prometheus_weight_query_failures_total", "counter", "Prometheus weight queries that failed.")
+	fmt.Fprintf(w, "lb_prometheus_weight_query_failures_total %d\n", p.failures.Value())
+}
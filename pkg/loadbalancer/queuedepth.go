@@ -0,0 +1,28 @@
+package loadbalancer
+
+// QueueDepth deprioritizes backends whose in-flight requests pile up. A backend that is up but
+// saturated is passed over for any candidate that isn't, before its queue turns into timeouts,
+// and only picked when every other candidate is saturated too or down.
+type QueueDepth struct {
+	// Degraded is the number of requests in flight, per unit of weight, at which a backend
+	// counts as saturated
+	Degraded int
+}
+
+// WithQueueDepth enables queue-depth aware backend selection
+func WithQueueDepth(q QueueDepth) Option {
+	return func(lb *LoadBalancer) {
+		if q.Degraded > 0 {
+			lb.queueDepth = &q
+		}
+	}
+}
+
+// degraded reports whether server has as many requests in flight as QueueDepth tolerates
+func (lb *LoadBalancer) degraded(server Server) bool {
+	if lb.queueDepth == nil {
+		return false
+	}
+	limit := int64(lb.queueDepth.Degraded) * int64(max(WeightOf(server), 1))
+	return ActiveConnectionsOf(server) >= limit
+}
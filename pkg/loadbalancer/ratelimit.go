@@ -0,0 +1,136 @@
+package loadbalancer
+
+import (
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit caps how fast each client may send requests with a token bucket: a client gets
+// Burst requests at once and then Rate per second. Requests over the limit are answered with
+// 429 and a Retry-After header saying when the next one would be let through.
+type RateLimit struct {
+	// Rate is the sustained requests per second allowed per client
+	Rate float64
+	// Burst is how many requests an idle client may send at once; default Rate rounded up, at least 1
+	Burst int
+	// Header, when set, names a request header (e.g. an API key) identifying the client;
+	// requests without it are keyed by client IP (IPv6 clients by their /64)
+	Header string
+	// TrustedProxies are addresses or CIDRs of proxies in front of the balancer. For requests
+	// arriving from one, the client is the last address in X-Forwarded-For not in this list.
+	TrustedProxies []string
+}
+
+// WithRateLimit limits the request rate of every client
+func WithRateLimit(limit RateLimit) Option {
+	return func(lb *LoadBalancer) {
+		if limit.Burst <= 0 {
+			limit.Burst = max(int(math.Ceil(limit.Rate)), 1)
+		}
+		lb.rateLimit = &limit
+	}
+}
+
+type rateLimiter struct {
+	limit   RateLimit
+	trusted []netip.Prefix
+	lb      *LoadBalancer
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(lb *LoadBalancer, limit RateLimit) (*rateLimiter, error) {
+	trusted, err := parsePrefixes(limit.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return &rateLimiter{limit: limit, trusted: trusted, lb: lb, buckets: make(map[string]*bucket), lastSweep: time.Now()}, nil
+}
+
+func (r *rateLimiter) key(req *http.Request) string {
+	if r.limit.Header != "" {
+		if v := req.Header.Get(r.limit.Header); v != "" {
+			return "h:" + v
+		}
+	}
+	if r.lb.identity != nil {
+		if id := r.lb.identity.ClientID(req); id != "" {
+			return "id:" + id
+		}
+	}
+	return "ip:" + clientKey(forwardedClientIP(req, r.trusted))
+}
+
+// take spends one request from key's bucket, or returns how long until one is available
+func (r *rateLimiter) take(key string) (time.Duration, bool) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(r.limit.Burst), last: now}
+		r.buckets[key] = b
+	}
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*r.limit.Rate, float64(r.limit.Burst))
+	b.last = now
+
+	if now.Sub(r.lastSweep) > bucketIdle {
+		r.lastSweep = now
+		for k, other := range r.buckets {
+			if now.Sub(other.last) > bucketIdle {
+				delete(r.buckets, k)
+			}
+		}
+	}
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / r.limit.Rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+func (r *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		wait, ok := r.take(r.key(req))
+		if !ok {
+			r.lb.rateLimited.Inc()
+			rw.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(wait.Seconds())), 1)))
+			http.Error(rw, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// forwardedClientIP is clientIP, except that requests from a trusted proxy are attributed to
+// the nearest untrusted address in X-Forwarded-For
+func forwardedClientIP(req *http.Request, trusted []netip.Prefix) string {
+	ip := clientIP(req)
+	if len(trusted) == 0 {
+		return ip
+	}
+	if addr, err := netip.ParseAddr(ip); err != nil || !containsAddr(trusted, addr) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// an unparseable hop can't be trusted to name anyone further back
+			break
+		}
+		addr = addr.Unmap()
+		ip = addr.String()
+		if !containsAddr(trusted, addr) {
+			break
+		}
+	}
+	return ip
+}
@@ -0,0 +1,201 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// switchListener lets a running server move to another address. Accept takes connections from
+// the current listener, and each connection remembers the listener it came through, so the
+// ones left on a replaced listener can be wound down while the server carries on.
+type switchListener struct {
+	mu     sync.Mutex
+	ln     net.Listener
+	gen    uint64
+	closed bool
+	conns  map[*switchConn]struct{}
+}
+
+func newSwitchListener(ln net.Listener) *switchListener {
+	return &switchListener{ln: ln, conns: make(map[*switchConn]struct{})}
+}
+
+func (l *switchListener) Accept() (net.Conn, error) {
+	for {
+		l.mu.Lock()
+		ln, gen := l.ln, l.gen
+		l.mu.Unlock()
+		conn, err := ln.Accept()
+		if err != nil {
+			l.mu.Lock()
+			moved := l.gen != gen && !l.closed
+			l.mu.Unlock()
+			if moved {
+				continue
+			}
+			return nil, err
+		}
+		c := &switchConn{Conn: conn, l: l, gen: gen}
+		l.mu.Lock()
+		l.conns[c] = struct{}{}
+		l.mu.Unlock()
+		return c, nil
+	}
+}
+
+func (l *switchListener) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	ln := l.ln
+	l.mu.Unlock()
+	return ln.Close()
+}
+
+func (l *switchListener) Addr() net.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ln.Addr()
+}
+
+// rebind makes ln the listener and closes the previous one. Connections that came through it
+// and sit idle are closed; busy ones are closed after their current response.
+func (l *switchListener) rebind(ln net.Listener) {
+	l.mu.Lock()
+	old := l.ln
+	l.ln = ln
+	l.gen++
+	var idle []*switchConn
+	for c := range l.conns {
+		if c.idle.Load() {
+			idle = append(idle, c)
+		}
+	}
+	l.mu.Unlock()
+	old.Close()
+	for _, c := range idle {
+		c.Close()
+	}
+}
+
+// switchConn is a connection accepted by a switchListener
+type switchConn struct {
+	net.Conn
+	l    *switchListener
+	gen  uint64
+	idle atomic.Bool
+	// fingerprint is the JA3 fingerprint of the TLS client hello, once one was received
+	fingerprint atomic.Pointer[string]
+}
+
+// retired reports whether the connection came through a listener that has since been replaced
+func (c *switchConn) retired() bool {
+	c.l.mu.Lock()
+	defer c.l.mu.Unlock()
+	return c.gen != c.l.gen
+}
+
+func (c *switchConn) Close() error {
+	c.l.mu.Lock()
+	delete(c.l.conns, c)
+	c.l.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// switchConnOf finds the switchConn under the TLS, per-client limit and sniffing wrappers of conn
+func switchConnOf(conn net.Conn) *switchConn {
+	for {
+		switch c := conn.(type) {
+		case *switchConn:
+			return c
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *limitedConn:
+			conn = c.Conn
+		case *peekedConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+type switchConnKey struct{}
+
+// trackConns has srv close the connections left on a replaced listener: idle ones at once, and
+// busy ones after their response, which tells the client to close through Connection: close
+// or, over HTTP/2, a GOAWAY
+func trackConns(srv *http.Server) {
+	srv.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+		if c := switchConnOf(conn); c != nil {
+			ctx = context.WithValue(ctx, switchConnKey{}, c)
+		}
+		return ctx
+	}
+	srv.ConnState = func(conn net.Conn, state http.ConnState) {
+		c := switchConnOf(conn)
+		if c == nil {
+			return
+		}
+		c.idle.Store(state == http.StateIdle)
+		if state == http.StateIdle && c.retired() {
+			conn.Close()
+		}
+	}
+	next := srv.Handler
+	srv.Handler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if c, ok := req.Context().Value(switchConnKey{}).(*switchConn); ok && c.retired() {
+			rw.Header().Set("Connection", "close")
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// rebinding is a listener to move to a new address once a Handoff has gone through
+type rebinding struct {
+	ln   *switchListener
+	next net.Listener
+	from string
+}
+
+// openRebinds listens on the addresses next wants that differ from lb's, before anything is
+// handed over, so a port that can't be bound leaves lb running as it was
+func (lb *LoadBalancer) openRebinds(ctx context.Context, next *LoadBalancer) ([]rebinding, error) {
+	if (lb.adminPort == "") != (next.adminPort == "") || (lb.redirectPort == "") != (next.redirectPort == "") ||
+		(lb.life.sniff == nil) != (next.sniffing == nil) ||
+		(lb.life.l4 == nil) != (next.transparent == nil) || (lb.life.l4 != nil && lb.life.l4.changed(next.transparent)) {
+		return nil, ErrListenerChanged
+	}
+	pairs := []struct {
+		ln       *switchListener
+		from, to string
+	}{
+		{lb.life.listener, lb.port, next.port},
+		{lb.life.adminListener, lb.adminPort, next.adminPort},
+		{lb.life.redirectListener, lb.redirectPort, next.redirectPort},
+	}
+	var moves []rebinding
+	for _, p := range pairs {
+		if p.ln == nil || listenAddr(p.from) == listenAddr(p.to) {
+			continue
+		}
+		ln, err := new(net.ListenConfig).Listen(ctx, "tcp", listenAddr(p.to))
+		if err != nil {
+			closeRebinds(moves)
+			return nil, fmt.Errorf("listener %s: %w", p.to, err)
+		}
+		moves = append(moves, rebinding{ln: p.ln, next: ln, from: p.from})
+	}
+	return moves, nil
+}
+
+// closeRebinds gives up moves that won't happen
+func closeRebinds(moves []rebinding) {
+	for _, m := range moves {
+		m.next.Close()
+	}
+}
@@ -0,0 +1,112 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/traffic"
+)
+
+// RecordOptions controls which requests are recorded and how much of them is kept
+type RecordOptions struct {
+	// SampleRate is the fraction of requests recorded, between 0 and 1
+	SampleRate float64
+	// MaxBody caps the request and response body bytes stored per record
+	MaxBody int
+}
+
+// WithRecorder records sampled requests, their chosen backend and their responses to rec
+func WithRecorder(rec *traffic.Recorder, opts RecordOptions) Option {
+	return func(lb *LoadBalancer) {
+		lb.recorder = rec
+		lb.recordOpts = opts
+	}
+}
+
+// recordMiddleware captures sampled requests for offline debugging and replay
+func (lb *LoadBalancer) recordMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if rand.Float64() >= lb.recordOpts.SampleRate {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		rec := &traffic.Record{
+			Time:   time.Now(),
+			Method: req.Method,
+			Host:   req.Host,
+			URI:    lb.scrub.uri(req.URL),
+			Header: req.Header.Clone(),
+		}
+		lb.scrub.header(rec.Header)
+		if req.Body != nil && req.Body != http.NoBody {
+			body, err := io.ReadAll(io.LimitReader(req.Body, int64(lb.recordOpts.MaxBody)+1))
+			if err == nil {
+				rec.BodyTruncated = len(body) > lb.recordOpts.MaxBody
+				rec.Body = body[:min(len(body), lb.recordOpts.MaxBody)]
+			}
+			// hand the backend the bytes we consumed followed by the rest of the stream
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		}
+
+		w := &captureWriter{ResponseWriter: rw, max: lb.recordOpts.MaxBody}
+		next.ServeHTTP(w, req)
+
+		rec.Status = w.statusCode()
+		rec.ResponseSize = w.size
+		rec.ResponseBody = w.body.Bytes()
+		rec.Duration = time.Since(rec.Time)
+		if server := stateFrom(req.Context()).server; server != nil {
+			rec.Backend = server.Address()
+		}
+		if err := lb.recorder.Record(rec); err != nil {
+			lb.logger.Debug("traffic record dropped", "error", err)
+		}
+	})
+}
+
+// captureWriter keeps the status and the first max bytes of a response
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+	max    int
+	body   bytes.Buffer
+}
+
+func (w *captureWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if room := w.max - w.body.Len(); room > 0 {
+		w.body.Write(b[:min(len(b), room)])
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *captureWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *captureWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
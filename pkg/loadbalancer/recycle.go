@@ -0,0 +1,109 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// Recycling bounds how long an upstream connection is reused. Once a limit is reached the
+// connection serves its current request with "Connection: close" and a fresh one is dialled,
+// so backends behind DNS failover or rolling restarts rebalance without waiting for idle timeouts.
+// HTTP/2 connections stop taking new streams and close once their in-flight streams finish.
+type Recycling struct {
+	// MaxRequests per connection; unlimited when 0
+	MaxRequests int
+	// MaxAge of a connection since it was dialled; unlimited when 0
+	MaxAge time.Duration
+}
+
+func (r Recycling) enabled() bool {
+	return r.MaxRequests > 0 || r.MaxAge > 0
+}
+
+// WithUpstreamRecycling applies connection recycling to every server the balancer builds
+func WithUpstreamRecycling(r Recycling) Option {
+	return func(lb *LoadBalancer) {
+		lb.recycle = r
+	}
+}
+
+// WithRecycling recycles this server's upstream connections. It requires the server's
+// transport to be an *http.Transport.
+func WithRecycling(r Recycling) ServerOption {
+	return func(s *SimpleServer) {
+		s.recycle = r
+	}
+}
+
+// useRecycling wraps the server's transport so connections are tracked from dial onwards
+func (s *SimpleServer) useRecycling(r Recycling) error {
+	base, ok := s.proxy.Transport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("loadbalancer: backend %s uses a %T, which cannot recycle connections", s.addr, s.proxy.Transport)
+	}
+	t := base.Clone()
+	dial := t.DialContext
+	if dial == nil {
+		dial = new(net.Dialer).DialContext
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &recyclingConn{Conn: conn, born: time.Now()}, nil
+	}
+	rt := &recyclingTransport{Transport: t, limits: r}
+	s.proxy.Transport = rt
+	s.client.Transport = rt
+	return nil
+}
+
+// recyclingConn remembers when it was dialled and how many requests it has carried
+type recyclingConn struct {
+	net.Conn
+	born     time.Time
+	requests atomic.Int64
+}
+
+// recyclingTransport marks the request that exhausts its connection as the last one on it
+type recyclingTransport struct {
+	*http.Transport
+	limits Recycling
+}
+
+func (t *recyclingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var out *http.Request
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn := info.Conn
+			if tc, ok := conn.(*tls.Conn); ok {
+				conn = tc.NetConn()
+			}
+			c, ok := conn.(*recyclingConn)
+			if !ok {
+				return
+			}
+			n := c.requests.Add(1)
+			if (t.limits.MaxRequests > 0 && n >= int64(t.limits.MaxRequests)) ||
+				(t.limits.MaxAge > 0 && time.Since(c.born) >= t.limits.MaxAge) {
+				// HTTP/1 reads Close after the connection is chosen; HTTP/2 has already copied
+				// it by then but still consults the (shared) header map
+				out.Close = true
+				out.Header.Set("Connection", "close")
+			}
+		},
+	}
+	out = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	out.Header = req.Header.Clone()
+	if out.Header == nil {
+		out.Header = make(http.Header)
+	}
+	return t.Transport.RoundTrip(out)
+}
@@ -0,0 +1,233 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Params are the name/value settings passed to a plugin factory, typically taken from config
+type Params map[string]string
+
+// Middleware wraps the handler that proxies requests to backends
+type Middleware func(http.Handler) http.Handler
+
+// Discoverer reports the backend URLs that should currently be in the pool
+type Discoverer interface {
+	Discover(ctx context.Context) ([]string, error)
+}
+
+// StrategyFactory builds a Strategy from its settings
+type StrategyFactory func(params Params) (Strategy, error)
+
+// MiddlewareFactory builds a Middleware from its settings
+type MiddlewareFactory func(params Params) (Middleware, error)
+
+// DiscovererFactory builds a Discoverer from its settings
+type DiscovererFactory func(params Params) (Discoverer, error)
+
+// ClientIdentityFactory builds a ClientIdentity from its settings
+type ClientIdentityFactory func(params Params) (ClientIdentity, error)
+
+// registry holds named plugin factories of one kind
+type registry[F any] struct {
+	kind      string
+	mu        sync.RWMutex
+	factories map[string]F
+}
+
+func newRegistry[F any](kind string) *registry[F] {
+	return &registry[F]{kind: kind, factories: make(map[string]F)}
+}
+
+func (r *registry[F]) register(name string, factory F) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, dup := r.factories[name]; dup {
+		panic(fmt.Sprintf("loadbalancer: %s %q registered twice", r.kind, name))
+	}
+	r.factories[name] = factory
+}
+
+func (r *registry[F]) lookup(name string) (F, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	factory, ok := r.factories[name]
+	if !ok {
+		return factory, fmt.Errorf("loadbalancer: unknown %s %q", r.kind, name)
+	}
+	return factory, nil
+}
+
+func (r *registry[F]) names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]string, 0, len(r.factories))
+	for name := range r.factories {
+		out = append(out, name)
+	}
+	slices.Sort(out)
+	return out
+}
+
+var (
+	strategies  = newRegistry[StrategyFactory]("strategy")
+	middlewares = newRegistry[MiddlewareFactory]("middleware")
+	discoverers = newRegistry[DiscovererFactory]("discoverer")
+	identities  = newRegistry[ClientIdentityFactory]("client identity")
+)
+
+// RegisterStrategy makes a strategy available by name. It is meant to be called from init
+// and panics if the name is already taken.
+func RegisterStrategy(name string, factory StrategyFactory) { strategies.register(name, factory) }
+
+// RegisterMiddleware makes a middleware available by name. It panics if the name is already taken.
+func RegisterMiddleware(name string, factory MiddlewareFactory) { middlewares.register(name, factory) }
+
+// RegisterDiscoverer makes a discoverer available by name. It panics if the name is already taken.
+func RegisterDiscoverer(name string, factory DiscovererFactory) { discoverers.register(name, factory) }
+
+// RegisterClientIdentity makes a client identity available by name. It panics if the name is
+// already taken.
+func RegisterClientIdentity(name string, factory ClientIdentityFactory) {
+	identities.register(name, factory)
+}
+
+// NewStrategy builds the strategy registered under name
+func NewStrategy(name string, params Params) (Strategy, error) {
+	factory, err := strategies.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return factory(params)
+}
+
+// ParseStrategy builds a strategy from a spec such as "least-connections" or
+// "consistent-hash;cookie=session,least-connections": each comma-separated stage is a
+// registered name followed by ;key=value params, and a spec of several stages is a Chain
+func ParseStrategy(spec string) (Strategy, error) {
+	var chain Chain
+	for _, stage := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(stage), ";")
+		params := make(Params)
+		for _, p := range parts[1:] {
+			key, value, ok := strings.Cut(strings.TrimSpace(p), "=")
+			if !ok {
+				return nil, fmt.Errorf("loadbalancer: strategy %s: parameter %q is not key=value", parts[0], p)
+			}
+			params[key] = value
+		}
+		s, err := NewStrategy(parts[0], params)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, s)
+	}
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+	return chain, nil
+}
+
+// NewMiddleware builds the middleware registered under name
+func NewMiddleware(name string, params Params) (Middleware, error) {
+	factory, err := middlewares.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return factory(params)
+}
+
+// NewDiscoverer builds the discoverer registered under name
+func NewDiscoverer(name string, params Params) (Discoverer, error) {
+	factory, err := discoverers.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return factory(params)
+}
+
+// NewClientIdentity builds the client identity registered under name
+func NewClientIdentity(name string, params Params) (ClientIdentity, error) {
+	factory, err := identities.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return factory(params)
+}
+
+// Strategies lists the registered strategy names
+func Strategies() []string { return strategies.names() }
+
+// Middlewares lists the registered middleware names
+func Middlewares() []string { return middlewares.names() }
+
+// Discoverers lists the registered discoverer names
+func Discoverers() []string { return discoverers.names() }
+
+// ClientIdentities lists the registered client identity names
+func ClientIdentities() []string { return identities.names() }
+
+// StaticDiscoverer always reports the same backends
+type StaticDiscoverer []string
+
+// Discover returns the fixed list
+func (d StaticDiscoverer) Discover(context.Context) ([]string, error) {
+	return d, nil
+}
+
+func init() {
+	RegisterStrategy("round-robin", func(Params) (Strategy, error) {
+		return NewRoundRobin(), nil
+	})
+	RegisterStrategy("least-connections", func(Params) (Strategy, error) {
+		return NewLeastConnections(), nil
+	})
+	RegisterStrategy("weighted-round-robin", func(Params) (Strategy, error) {
+		return NewWeightedRoundRobin(), nil
+	})
+	RegisterStrategy("weighted-random", func(p Params) (Strategy, error) {
+		smoothing, jitter := 10*time.Second, 0.2
+		for key, value := range p {
+			var err error
+			switch key {
+			case "smoothing":
+				smoothing, err = time.ParseDuration(value)
+			case "jitter":
+				jitter, err = strconv.ParseFloat(value, 64)
+				if err == nil && (jitter < 0 || jitter > 1) {
+					err = errors.New("want a fraction from 0 to 1")
+				}
+			default:
+				return nil, fmt.Errorf("loadbalancer: weighted-random: unknown parameter %q", key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("loadbalancer: weighted-random: %s %q: %w", key, value, err)
+			}
+		}
+		return NewWeightedRandom(smoothing, jitter), nil
+	})
+	RegisterStrategy("consistent-hash", func(p Params) (Strategy, error) {
+		for key := range p {
+			if key != "header" && key != "cookie" {
+				return nil, fmt.Errorf("loadbalancer: consistent-hash: unknown parameter %q", key)
+			}
+		}
+		return ConsistentHash{Header: p["header"], Cookie: p["cookie"]}, nil
+	})
+	RegisterDiscoverer("static", func(p Params) (Discoverer, error) {
+		var addrs StaticDiscoverer
+		for _, addr := range strings.Split(p["addrs"], ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+		return addrs, nil
+	})
+}
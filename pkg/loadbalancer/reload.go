@@ -0,0 +1,28 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+)
+
+// WithReload serves POST /reload on the admin port, for callers presenting the WithAdminToken
+// token. reload should rebuild the balancer from
+// its configuration and hand over to it, typically through Group.Replace; when it fails the
+// running configuration stays in place and the error is returned to the caller.
+func WithReload(reload func(ctx context.Context) error) Option {
+	return func(lb *LoadBalancer) {
+		lb.reload = reload
+	}
+}
+
+func (lb *LoadBalancer) serveReload(rw http.ResponseWriter, req *http.Request) {
+	if !lb.authorized(rw, req) {
+		return
+	}
+	if err := lb.reload(req.Context()); err != nil {
+		lb.logger.Warn("reload failed", "error", err)
+		http.Error(rw, "reload failed: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
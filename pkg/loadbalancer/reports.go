@@ -0,0 +1,256 @@
+package loadbalancer
+
+import (
+	"cmp"
+	"encoding/csv"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/metrics"
+)
+
+// allBackends is the backend of the rows that total a route over its backends
+const allBackends = "*"
+
+// TrafficReports sums up the traffic of every route and backend over fixed periods, for
+// teams without a metrics stack: request counts, error rates, p95 latency and body bytes,
+// served as JSON or CSV by GET /reports.
+type TrafficReports struct {
+	// Period is the span of one report, aligned to the clock; default 1h
+	Period time.Duration
+	// Keep is how many finished reports are kept; default 24
+	Keep int
+	// Route names the route a request belongs to when it matched no configured route; by
+	// default its first path segment, as for ByteAccounting
+	Route func(*http.Request) string
+}
+
+// WithTrafficReports aggregates traffic into periodic reports and enables GET /reports on the
+// admin handler
+func WithTrafficReports(r TrafficReports) Option {
+	return func(lb *LoadBalancer) {
+		if r.Period <= 0 {
+			r.Period = time.Hour
+		}
+		if r.Keep <= 0 {
+			r.Keep = 24
+		}
+		if r.Route == nil {
+			r.Route = firstPathSegment
+		}
+		lb.reports = &trafficReports{cfg: r}
+	}
+}
+
+// TrafficReport is the traffic of one period
+type TrafficReport struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Partial marks the period still running
+	Partial bool         `json:"partial,omitempty"`
+	Rows    []TrafficRow `json:"rows"`
+}
+
+// TrafficRow is the traffic of one route on one backend, or on all of them when Backend is "*".
+// Requests answered by the balancer itself have no backend.
+type TrafficRow struct {
+	Route    string `json:"route"`
+	Backend  string `json:"backend"`
+	Requests uint64 `json:"requests"`
+	// Errors counts the 5xx responses, whether from the backend or the balancer
+	Errors    uint64  `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	// P95 is the 95th percentile response time in seconds
+	P95      float64 `json:"p95_seconds"`
+	BytesIn  uint64  `json:"bytes_in"`
+	BytesOut uint64  `json:"bytes_out"`
+}
+
+// trafficCell accumulates one row
+type trafficCell struct {
+	requests, errors, in, out atomic.Uint64
+	latency                   *metrics.Histogram
+}
+
+type trafficKey struct{ route, backend string }
+
+// trafficPeriod accumulates the rows of one period
+type trafficPeriod struct {
+	start, end time.Time
+	mu         sync.RWMutex
+	cells      map[trafficKey]*trafficCell
+}
+
+func (p *trafficPeriod) cell(key trafficKey) *trafficCell {
+	p.mu.RLock()
+	c, ok := p.cells[key]
+	p.mu.RUnlock()
+	if ok {
+		return c
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c, ok = p.cells[key]; !ok {
+		c = &trafficCell{latency: metrics.NewHistogram(metrics.DefaultBuckets)}
+		p.cells[key] = c
+	}
+	return c
+}
+
+// report reads the period's rows, sorted by route with each route's total first
+func (p *trafficPeriod) report() TrafficReport {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	r := TrafficReport{Start: p.start, End: p.end, Rows: make([]TrafficRow, 0, len(p.cells))}
+	for key, c := range p.cells {
+		row := TrafficRow{
+			Route:    key.route,
+			Backend:  key.backend,
+			Requests: c.requests.Load(),
+			Errors:   c.errors.Load(),
+			P95:      c.latency.Snapshot().Quantile(0.95),
+			BytesIn:  c.in.Load(),
+			BytesOut: c.out.Load(),
+		}
+		if row.Requests > 0 {
+			row.ErrorRate = float64(row.Errors) / float64(row.Requests)
+		}
+		r.Rows = append(r.Rows, row)
+	}
+	slices.SortFunc(r.Rows, func(a, b TrafficRow) int {
+		if c := cmp.Compare(a.Route, b.Route); c != 0 {
+			return c
+		}
+		if (a.Backend == allBackends) != (b.Backend == allBackends) {
+			if a.Backend == allBackends {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(a.Backend, b.Backend)
+	})
+	return r
+}
+
+type trafficReports struct {
+	cfg TrafficReports
+
+	current atomic.Pointer[trafficPeriod]
+	// mu guards rotating current into done
+	mu   sync.Mutex
+	done []TrafficReport
+}
+
+// period returns the period now falls in, closing the current one if it is over. Periods
+// without traffic are skipped rather than reported empty.
+func (t *trafficReports) period(now time.Time) *trafficPeriod {
+	if p := t.current.Load(); p != nil && now.Before(p.end) {
+		return p
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.current.Load()
+	if p != nil && now.Before(p.end) {
+		return p
+	}
+	if p != nil && len(p.cells) > 0 {
+		t.done = append(t.done, p.report())
+		if len(t.done) > t.cfg.Keep {
+			t.done = slices.Delete(t.done, 0, len(t.done)-t.cfg.Keep)
+		}
+	}
+	start := now.Truncate(t.cfg.Period)
+	p = &trafficPeriod{start: start, end: start.Add(t.cfg.Period), cells: make(map[trafficKey]*trafficCell)}
+	t.current.Store(p)
+	return p
+}
+
+// record adds one finished request to the current period
+func (t *trafficReports) record(req *http.Request, server Server, status int, elapsed time.Duration, in, out uint64) {
+	route := stateFrom(req.Context()).route
+	if route == "" {
+		route = t.cfg.Route(req)
+	}
+	backend := ""
+	if server != nil {
+		backend = server.Address()
+	}
+	p := t.period(time.Now())
+	for _, key := range []trafficKey{{route, backend}, {route, allBackends}} {
+		c := p.cell(key)
+		c.requests.Add(1)
+		if status >= 500 {
+			c.errors.Add(1)
+		}
+		c.in.Add(in)
+		c.out.Add(out)
+		c.latency.Observe(elapsed.Seconds())
+	}
+}
+
+// reports returns the finished reports, oldest first, followed by the running one
+func (t *trafficReports) reports() []TrafficReport {
+	p := t.period(time.Now())
+	t.mu.Lock()
+	out := slices.Clone(t.done)
+	t.mu.Unlock()
+	current := p.report()
+	current.Partial = true
+	return append(out, current)
+}
+
+// TrafficReports returns the finished traffic reports, oldest first, followed by the one for
+// the period still running; nil without WithTrafficReports
+func (lb *LoadBalancer) TrafficReports() []TrafficReport {
+	if lb.reports == nil {
+		return nil
+	}
+	return lb.reports.reports()
+}
+
+// serveReports handles GET /reports. ?format=csv returns one CSV row per report row instead
+// of JSON, and ?last=n only the last n reports, the running one included.
+func (lb *LoadBalancer) serveReports(rw http.ResponseWriter, req *http.Request) {
+	reports := lb.reports.reports()
+	if v := req.URL.Query().Get("last"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(rw, "last must be a positive number", http.StatusBadRequest)
+			return
+		}
+		reports = reports[max(len(reports)-n, 0):]
+	}
+	switch req.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(rw, reports)
+	case "csv":
+		rw.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		rw.Header().Set("Content-Disposition", `attachment; filename="lb-traffic.csv"`)
+		writeReportsCSV(csv.NewWriter(rw), reports)
+	default:
+		http.Error(rw, "format must be json or csv", http.StatusBadRequest)
+	}
+}
+
+func writeReportsCSV(w *csv.Writer, reports []TrafficReport) {
+	w.Write([]string{"start", "end", "partial", "route", "backend", "requests", "errors", "error_rate", "p95_seconds", "bytes_in", "bytes_out"})
+	for _, r := range reports {
+		start, end, partial := r.Start.UTC().Format(time.RFC3339), r.End.UTC().Format(time.RFC3339), strconv.FormatBool(r.Partial)
+		for _, row := range r.Rows {
+			w.Write([]string{
+				start, end, partial, row.Route, row.Backend,
+				strconv.FormatUint(row.Requests, 10),
+				strconv.FormatUint(row.Errors, 10),
+				strconv.FormatFloat(row.ErrorRate, 'f', 4, 64),
+				strconv.FormatFloat(row.P95, 'f', 4, 64),
+				strconv.FormatUint(row.BytesIn, 10),
+				strconv.FormatUint(row.BytesOut, 10),
+			})
+		}
+	}
+	w.Flush()
+}
@@ -0,0 +1,75 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"slices"
+)
+
+// RetryPolicy decides when a request whose upstream call failed at the transport level
+// (refused, reset, timed out before a response) is sent to another backend. Only requests
+// that are safe to repeat are retried, so a retry never duplicates non-idempotent work.
+type RetryPolicy struct {
+	// Attempts is the number of backends tried per request, the first included; default 2
+	Attempts int
+	// Methods that may be retried; default GET, HEAD, PUT and DELETE
+	Methods []string
+	// IdempotencyHeader lets clients opt any other request in by sending it; default "Idempotency-Key"
+	IdempotencyHeader string
+	// MaxBody is the largest request body buffered so it can be resent; larger requests are not retried.
+	// Default 1 MiB.
+	MaxBody int64
+}
+
+// defaultRetryMethods are idempotent under RFC 9110
+var defaultRetryMethods = []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete}
+
+// WithRetry enables retrying failed upstream calls on another backend
+func WithRetry(policy RetryPolicy) Option {
+	return func(lb *LoadBalancer) {
+		if policy.Attempts == 0 {
+			policy.Attempts = 2
+		}
+		if policy.Methods == nil {
+			policy.Methods = defaultRetryMethods
+		}
+		if policy.IdempotencyHeader == "" {
+			policy.IdempotencyHeader = "Idempotency-Key"
+		}
+		if policy.MaxBody == 0 {
+			policy.MaxBody = 1 << 20
+		}
+		lb.retry = policy
+	}
+}
+
+// allows reports whether req may be sent more than once
+func (p RetryPolicy) allows(req *http.Request) bool {
+	return slices.Contains(p.Methods, req.Method) || req.Header.Get(p.IdempotencyHeader) != ""
+}
+
+// prepare returns how many attempts req may take and, when it has a body, a buffered copy
+// to resend on each attempt. Requests that can't be retried get a single attempt and their
+// body is left untouched.
+func (p RetryPolicy) prepare(req *http.Request) (int, []byte) {
+	if p.Attempts <= 1 || !p.allows(req) {
+		return 1, nil
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return p.Attempts, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, p.MaxBody+1))
+	if err != nil || int64(len(body)) > p.MaxBody {
+		// hand the backend what was read followed by the rest of the stream
+		req.Body = readCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return 1, nil
+	}
+	return p.Attempts, body
+}
+
+// readCloser reads from one source and closes another
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,206 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/router"
+)
+
+// defaultRewriteTypes are the media types a BodyRewrite edits when it names none
+var defaultRewriteTypes = []string{"text/html", "text/plain", "text/css", "text/xml", "application/json", "application/javascript", "application/xml"}
+
+// htmlBodyTag finds the opening body tag a banner goes after
+var htmlBodyTag = regexp.MustCompile(`(?i)<body[^>]*>`)
+
+// BodyRewrite edits the bodies of backend responses on matching routes, for example to replace
+// internal hostnames with public ones or to put a banner on every HTML page. A body is read
+// whole before it is edited, so only bodies up to MaxBytes are rewritten; larger ones pass
+// unchanged, as do compressed, partial and event-stream responses. Requests on these routes
+// are sent without Accept-Encoding so backends answer in plain text. When several rules match
+// a request, the most specific one applies.
+type BodyRewrite struct {
+	// Host and PathPrefix select the requests the rule applies to; empty values match everything.
+	// Host may be a "*.example.com" wildcard.
+	Host       string
+	PathPrefix string
+	// ContentTypes are the media types edited, e.g. "text/*"; default HTML, plain text, CSS,
+	// XML, JSON and JavaScript
+	ContentTypes []string
+	// Replace are applied to the body in order
+	Replace []Replacement
+	// Banner is inserted after the opening <body> tag of HTML responses
+	Banner string
+	// MaxBytes is the largest body that is rewritten; default 1 MiB
+	MaxBytes int64
+}
+
+// Replacement substitutes New for every occurrence of Old. With Regexp, Old is a regular
+// expression and New may refer to its groups as $1 or ${name}.
+type Replacement struct {
+	Old    string
+	New    string
+	Regexp bool
+}
+
+// WithBodyRewrites adds rules rewriting response bodies
+func WithBodyRewrites(rules ...BodyRewrite) Option {
+	return func(lb *LoadBalancer) {
+		lb.bodyRewrites = append(lb.bodyRewrites, rules...)
+	}
+}
+
+type compiledRewrite struct {
+	BodyRewrite
+	patterns []*regexp.Regexp
+}
+
+func compileBodyRewrites(rules []BodyRewrite) (*router.Table[*compiledRewrite], error) {
+	out := make([]router.Rule[*compiledRewrite], len(rules))
+	for i, r := range rules {
+		if r.MaxBytes <= 0 {
+			r.MaxBytes = 1 << 20
+		}
+		if len(r.ContentTypes) == 0 {
+			r.ContentTypes = defaultRewriteTypes
+		}
+		r.ContentTypes = slices.Clone(r.ContentTypes)
+		for j, ct := range r.ContentTypes {
+			r.ContentTypes[j] = strings.ToLower(strings.TrimSpace(ct))
+		}
+		c := &compiledRewrite{BodyRewrite: r, patterns: make([]*regexp.Regexp, len(r.Replace))}
+		for j, rep := range r.Replace {
+			if rep.Old == "" {
+				return nil, fmt.Errorf("body rewrite %d: replacement %d has nothing to replace", i, j)
+			}
+			if !rep.Regexp {
+				continue
+			}
+			re, err := regexp.Compile(rep.Old)
+			if err != nil {
+				return nil, fmt.Errorf("body rewrite %d: %w", i, err)
+			}
+			c.patterns[j] = re
+		}
+		out[i] = router.Rule[*compiledRewrite]{Host: r.Host, PathPrefix: r.PathPrefix, Target: c}
+	}
+	return router.Compile(out)
+}
+
+// rewriteMiddleware marks requests matching a rule so their response body is rewritten
+func rewriteMiddleware(rules *router.Table[*compiledRewrite]) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if r, ok := rules.Match(req.Host, req.URL.Path); ok {
+				stateFrom(req.Context()).rewrite = r
+				req.Header.Del("Accept-Encoding")
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// prepareResponse is the first ModifyResponse hook of every SimpleServer
+func prepareResponse(resp *http.Response) error {
+	if err := noteBodyError(resp); err != nil {
+		return err
+	}
+	st := stateFrom(resp.Request.Context())
+	if st.serverTiming {
+		// added to any the backend sent, which describe its own phases
+		resp.Header.Add("Server-Timing", st.timing.serverTiming(st.start))
+	}
+	r := st.rewrite
+	if r == nil {
+		return nil
+	}
+	if mediaType, ok := r.applies(resp); ok {
+		resp.Body = &rewrittenBody{src: resp.Body, rule: r, html: mediaType == "text/html"}
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			// the bytes differ from the backend's, so the tag can only be weak
+			resp.Header.Set("ETag", "W/"+etag)
+		}
+	}
+	return nil
+}
+
+// applies reports whether resp has a body the rule can edit, and its media type
+func (r *compiledRewrite) applies(resp *http.Response) (string, bool) {
+	switch resp.StatusCode {
+	case http.StatusSwitchingProtocols, http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return "", false
+	}
+	if resp.Request.Method == http.MethodHead || resp.ContentLength > r.MaxBytes {
+		return "", false
+	}
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" && !strings.EqualFold(enc, "identity") {
+		return "", false
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType == "text/event-stream" {
+		return "", false
+	}
+	return mediaType, slices.ContainsFunc(r.ContentTypes, func(want string) bool { return mediaTypeMatches(want, mediaType) })
+}
+
+// apply returns body with the rule's edits made
+func (r *compiledRewrite) apply(body []byte, html bool) []byte {
+	for i, rep := range r.Replace {
+		if re := r.patterns[i]; re != nil {
+			body = re.ReplaceAll(body, []byte(rep.New))
+		} else {
+			body = bytes.ReplaceAll(body, []byte(rep.Old), []byte(rep.New))
+		}
+	}
+	if r.Banner != "" && html {
+		if loc := htmlBodyTag.FindIndex(body); loc != nil {
+			body = slices.Insert(body, loc[1], []byte(r.Banner)...)
+		}
+	}
+	return body
+}
+
+// rewrittenBody reads the backend's body on the first Read and serves the edited copy, or the
+// original bytes when the body turns out to be over the size cap
+type rewrittenBody struct {
+	src  io.ReadCloser
+	rule *compiledRewrite
+	html bool
+	out  io.Reader
+}
+
+func (b *rewrittenBody) Read(p []byte) (int, error) {
+	if b.out == nil {
+		buf, err := io.ReadAll(io.LimitReader(b.src, b.rule.MaxBytes+1))
+		switch {
+		case err != nil:
+			b.out = io.MultiReader(bytes.NewReader(buf), failingReader{err})
+		case int64(len(buf)) > b.rule.MaxBytes:
+			b.out = io.MultiReader(bytes.NewReader(buf), b.src)
+		default:
+			b.out = bytes.NewReader(b.rule.apply(buf, b.html))
+		}
+	}
+	return b.out.Read(p)
+}
+
+func (b *rewrittenBody) Close() error {
+	return b.src.Close()
+}
+
+// failingReader returns err once what was read before it is used up
+type failingReader struct {
+	err error
+}
+
+func (r failingReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
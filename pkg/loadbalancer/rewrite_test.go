@@ -0,0 +1,41 @@
+package loadbalancer_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/loadbalancer"
+)
+
+func TestBodyRewriteMostSpecific(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Write([]byte("app.internal"))
+	}))
+	t.Cleanup(backend.Close)
+	lb, err := loadbalancer.New(
+		loadbalancer.WithBackends(backend.URL),
+		loadbalancer.WithBodyRewrites(
+			loadbalancer.BodyRewrite{PathPrefix: "/", Replace: []loadbalancer.Replacement{{Old: "app.internal", New: "any"}}},
+			loadbalancer.BodyRewrite{PathPrefix: "/docs", Replace: []loadbalancer.Replacement{{Old: "app.internal", New: "docs"}}},
+			loadbalancer.BodyRewrite{Host: "*.example.com", Replace: []loadbalancer.Replacement{{Old: "app.internal", New: "sub"}}},
+		),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct{ host, path, want string }{
+		{"other.org", "/", "any"},
+		{"other.org", "/docs/intro", "docs"},
+		{"www.example.com:8080", "/docs/intro", "sub"},
+	} {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Host = tt.host
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		if got := rec.Body.String(); got != tt.want {
+			t.Errorf("%s%s: body %q, want %q", tt.host, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// VersionRollout moves traffic to a new backend version by itself. Backends carry their
+// version in a label, from -backend ;label.version=, discovery or the backend API. Once at
+// least MinHealthy backends of the newest version are healthy, every request goes to that
+// version; until then it goes to the newest version that has enough, and to the regular pool
+// as a whole while none has. Traffic falls back the same way when a version loses backends.
+type VersionRollout struct {
+	// Label names the label holding the version; default "version"
+	Label string
+	// MinHealthy is the number of healthy backends a version needs to take all traffic; default 1
+	MinHealthy int
+}
+
+// WithVersionRollout enables version-based routing of the regular pool
+func WithVersionRollout(r VersionRollout) Option {
+	return func(lb *LoadBalancer) {
+		if r.Label == "" {
+			r.Label = "version"
+		}
+		r.MinHealthy = max(r.MinHealthy, 1)
+		lb.rollout = &rollout{VersionRollout: r}
+	}
+}
+
+// rolloutCheckInterval is how often requests re-evaluate the versions' health
+const rolloutCheckInterval = time.Second
+
+type rollout struct {
+	VersionRollout
+	// target is the version all traffic goes to, "" while none qualifies
+	target atomic.Pointer[string]
+
+	mu      sync.Mutex
+	checked time.Time
+}
+
+// RolloutVersion returns the version all regular traffic goes to, or "" while no version has
+// enough healthy backends or WithVersionRollout is not used
+func (lb *LoadBalancer) RolloutVersion() string {
+	if lb.rollout == nil {
+		return ""
+	}
+	if v := lb.rollout.target.Load(); v != nil {
+		return *v
+	}
+	return ""
+}
+
+// evaluateRollout picks the newest version with enough healthy backends
+func (lb *LoadBalancer) evaluateRollout(now time.Time) {
+	r := lb.rollout
+	if !r.mu.TryLock() {
+		return
+	}
+	defer r.mu.Unlock()
+	if now.Sub(r.checked) < rolloutCheckInterval {
+		return
+	}
+	r.checked = now
+
+	servers := lb.Servers()
+	healthy := make(map[string]int)
+	lb.stateMu.Lock()
+	for _, server := range servers {
+		if v := LabelsOf(server)[r.Label]; v != "" && lb.lastAlive[server.Address()] {
+			healthy[v]++
+		}
+	}
+	lb.stateMu.Unlock()
+	target := ""
+	for v, n := range healthy {
+		if n >= r.MinHealthy && (target == "" || compareVersions(v, target) > 0) {
+			target = v
+		}
+	}
+	if prev := lb.RolloutVersion(); prev != target {
+		r.target.Store(&target)
+		if target == "" {
+			lb.logger.Warn("no version has enough healthy backends; routing to the whole pool", "previous", prev, "min_healthy", r.MinHealthy)
+		} else {
+			lb.logger.Info("routing all traffic to version", "version", target, "previous", prev)
+		}
+	}
+}
+
+// compareVersions orders versions such as "v1.10.2" and "1.9": a leading v is ignored, and the
+// parts between dots and dashes are compared as numbers where both are numeric and as strings
+// otherwise. A version with more parts is the newer when the others are equal.
+func compareVersions(a, b string) int {
+	split := func(s string) []string {
+		return strings.FieldsFunc(strings.TrimPrefix(s, "v"), func(r rune) bool { return r == '.' || r == '-' })
+	}
+	pa, pb := split(a), split(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		na, errA := strconv.Atoi(pa[i])
+		nb, errB := strconv.Atoi(pb[i])
+		switch {
+		case errA == nil && errB == nil:
+			if na != nb {
+				return na - nb
+			}
+		case pa[i] != pb[i]:
+			return strings.Compare(pa[i], pb[i])
+		}
+	}
+	return len(pa) - len(pb)
+}
+
+// rolloutMiddleware restricts requests bound for the regular backends to the target version;
+// requests a route, the canary, the dark launch or the failover sent elsewhere keep their pool
+func (lb *LoadBalancer) rolloutMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lb.evaluateRollout(time.Now())
+		st := stateFrom(req.Context())
+		if v := lb.RolloutVersion(); v != "" && st.pool == nil && st.allowed == nil {
+			st.selector = map[string]string{lb.rollout.Label: v}
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// writeMetrics writes the version traffic is routed to
+func (r *rollout) writeMetrics(w *bufio.Writer) {
+	writeMetricHeader(w, "lb_rollout_version", "gauge", "Always 1; carries the backend version all regular traffic goes to, if any.")
+	if v := r.target.Load(); v != nil && *v != "" {
+		fmt.Fprintf(w, "lb_rollout_version{version=%s} 1\n", labelValue(*v))
+	}
+}
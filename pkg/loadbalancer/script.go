@@ -0,0 +1,256 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/script"
+)
+
+// ScriptRule changes a request, its response or its backend when When holds.
+// Every field except Stop is an expression in the pkg/script language evaluated per request
+// with the variables method, path, host, scheme, query and client_ip and the functions
+// header(name), param(name) and cookie(name). Response header expressions may also use status.
+type ScriptRule struct {
+	// When selects the requests the rule applies to; empty matches every request
+	When string
+	// SetRequestHeaders maps header names to the value forwarded to the backend
+	SetRequestHeaders map[string]string
+	// SetResponseHeaders maps header names to the value returned to the client
+	SetResponseHeaders map[string]string
+	// RewritePath replaces the request path before it is proxied
+	RewritePath string
+	// Backend yields the address of the backend the request should go to
+	Backend string
+	// Labels restricts the request to backends whose labels equal the values these yield, e.g.
+	// {"region": `header("X-Region")`}; a label whose value comes out empty is not checked
+	Labels map[string]string
+	// Stop skips the remaining rules once this one has matched
+	Stop bool
+}
+
+// WithScript adds rules evaluated in order before every request is proxied
+func WithScript(rules ...ScriptRule) Option {
+	return func(lb *LoadBalancer) {
+		lb.scriptRules = append(lb.scriptRules, rules...)
+	}
+}
+
+type compiledRule struct {
+	when            *script.Program
+	requestHeaders  map[string]*script.Program
+	responseHeaders map[string]*script.Program
+	rewritePath     *script.Program
+	backend         *script.Program
+	labels          map[string]*script.Program
+	stop            bool
+}
+
+func compileOptional(src string) (*script.Program, error) {
+	if src == "" {
+		return nil, nil
+	}
+	return script.Compile(src)
+}
+
+func compileHeaders(headers map[string]string) (map[string]*script.Program, error) {
+	out := make(map[string]*script.Program, len(headers))
+	for name, src := range headers {
+		p, err := script.Compile(src)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %w", name, err)
+		}
+		out[http.CanonicalHeaderKey(name)] = p
+	}
+	return out, nil
+}
+
+func compileLabels(labels map[string]string) (map[string]*script.Program, error) {
+	out := make(map[string]*script.Program, len(labels))
+	for name, src := range labels {
+		p, err := script.Compile(src)
+		if err != nil {
+			return nil, fmt.Errorf("label %s: %w", name, err)
+		}
+		out[name] = p
+	}
+	return out, nil
+}
+
+func compileScriptRule(r ScriptRule) (c compiledRule, err error) {
+	if c.when, err = compileOptional(r.When); err != nil {
+		return c, err
+	}
+	if c.rewritePath, err = compileOptional(r.RewritePath); err != nil {
+		return c, err
+	}
+	if c.backend, err = compileOptional(r.Backend); err != nil {
+		return c, err
+	}
+	if c.requestHeaders, err = compileHeaders(r.SetRequestHeaders); err != nil {
+		return c, err
+	}
+	if c.responseHeaders, err = compileHeaders(r.SetResponseHeaders); err != nil {
+		return c, err
+	}
+	if c.labels, err = compileLabels(r.Labels); err != nil {
+		return c, err
+	}
+	c.stop = r.Stop
+	return c, nil
+}
+
+func compileScriptRules(rules []ScriptRule) ([]compiledRule, error) {
+	out := make([]compiledRule, 0, len(rules))
+	for i, r := range rules {
+		c, err := compileScriptRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("script rule %d: %w", i, err)
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// requestEnv exposes req to script expressions
+func requestEnv(req *http.Request) script.Env {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return script.Env{
+		"method":    req.Method,
+		"path":      req.URL.Path,
+		"host":      req.Host,
+		"scheme":    scheme,
+		"query":     req.URL.RawQuery,
+		"client_ip": clientIP(req),
+		"header": script.Func(func(args ...any) (any, error) {
+			return req.Header.Get(script.ToString(arg(args, 0))), nil
+		}),
+		"param": script.Func(func(args ...any) (any, error) {
+			return req.URL.Query().Get(script.ToString(arg(args, 0))), nil
+		}),
+		"cookie": script.Func(func(args ...any) (any, error) {
+			c, err := req.Cookie(script.ToString(arg(args, 0)))
+			if err != nil {
+				return "", nil
+			}
+			return c.Value, nil
+		}),
+	}
+}
+
+func arg(args []any, i int) any {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+// scriptMiddleware applies the compiled rules to each request
+func (lb *LoadBalancer) scriptMiddleware(rules []compiledRule) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			env := requestEnv(req)
+			var respHeaders []map[string]*script.Program
+			for _, r := range rules {
+				if r.when != nil {
+					ok, err := r.when.EvalBool(env)
+					if err != nil {
+						lb.logger.Warn("script rule failed", "error", err)
+						continue
+					}
+					if !ok {
+						continue
+					}
+				}
+				for name, p := range r.requestHeaders {
+					if v, err := p.EvalString(env); err == nil {
+						req.Header.Set(name, v)
+					} else {
+						lb.logger.Warn("script rule failed", "error", err)
+					}
+				}
+				if r.rewritePath != nil {
+					if v, err := r.rewritePath.EvalString(env); err == nil {
+						req.URL.Path, req.URL.RawPath = v, ""
+						env["path"] = v
+					} else {
+						lb.logger.Warn("script rule failed", "error", err)
+					}
+				}
+				if r.backend != nil {
+					if v, err := r.backend.EvalString(env); err == nil && v != "" {
+						stateFrom(req.Context()).pinned = v
+					} else if err != nil {
+						lb.logger.Warn("script rule failed", "error", err)
+					}
+				}
+				for name, p := range r.labels {
+					v, err := p.EvalString(env)
+					if err != nil {
+						lb.logger.Warn("script rule failed", "error", err)
+						continue
+					}
+					if v == "" {
+						continue
+					}
+					st := stateFrom(req.Context())
+					if st.selector == nil {
+						st.selector = make(map[string]string)
+					}
+					st.selector[name] = v
+				}
+				if len(r.responseHeaders) > 0 {
+					respHeaders = append(respHeaders, r.responseHeaders)
+				}
+				if r.stop {
+					break
+				}
+			}
+			if len(respHeaders) > 0 {
+				rw = &scriptResponseWriter{ResponseWriter: rw, lb: lb, env: env, headers: respHeaders}
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// scriptResponseWriter sets scripted response headers just before the status line is sent
+type scriptResponseWriter struct {
+	http.ResponseWriter
+	lb          *LoadBalancer
+	env         script.Env
+	headers     []map[string]*script.Program
+	wroteHeader bool
+}
+
+func (w *scriptResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.env["status"] = float64(code)
+		for _, set := range w.headers {
+			for name, p := range set {
+				if v, err := p.EvalString(w.env); err == nil {
+					w.Header().Set(name, v)
+				} else {
+					w.lb.logger.Warn("script rule failed", "error", err)
+				}
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *scriptResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *scriptResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,104 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Scrub removes sensitive values from what the balancer writes down about requests: traffic
+// recordings, the query string in the access log and debug logs. Proxied requests are not
+// changed.
+type Scrub struct {
+	// Headers name the headers whose values are replaced; default Authorization,
+	// Proxy-Authorization, Cookie and X-Api-Key
+	Headers []string
+	// QueryParams are path.Match patterns, matched case-insensitively, of the query parameters
+	// whose values are replaced, e.g. "token" or "*_key"
+	QueryParams []string
+	// Replacement stands in for a removed value; default "REDACTED"
+	Replacement string
+}
+
+// WithScrubbing removes sensitive headers and query parameters from recordings and logs
+func WithScrubbing(s Scrub) Option {
+	return func(lb *LoadBalancer) {
+		if s.Headers == nil {
+			s.Headers = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Api-Key"}
+		}
+		s.Headers, s.QueryParams = slices.Clone(s.Headers), slices.Clone(s.QueryParams)
+		for i, h := range s.Headers {
+			s.Headers[i] = http.CanonicalHeaderKey(h)
+		}
+		for i, p := range s.QueryParams {
+			s.QueryParams[i] = strings.ToLower(p)
+		}
+		if s.Replacement == "" {
+			s.Replacement = "REDACTED"
+		}
+		lb.scrub = &s
+	}
+}
+
+// header replaces the values of the scrubbed headers in h
+func (s *Scrub) header(h http.Header) {
+	if s == nil {
+		return
+	}
+	for _, name := range s.Headers {
+		for i := range h[name] {
+			h[name][i] = s.Replacement
+		}
+	}
+}
+
+func (s *Scrub) validate() error {
+	for _, pattern := range s.QueryParams {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("scrub query parameter pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// query returns the raw query with the values of matching parameters replaced. The other
+// parameters are kept as they were, in their order, so the result still reads like the original.
+func (s *Scrub) query(raw string) string {
+	if s == nil || raw == "" || len(s.QueryParams) == 0 {
+		return raw
+	}
+	parts := strings.Split(raw, "&")
+	for i, part := range parts {
+		key, _, _ := strings.Cut(part, "=")
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		if s.matchesParam(strings.ToLower(name)) {
+			parts[i] = key + "=" + url.QueryEscape(s.Replacement)
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func (s *Scrub) matchesParam(name string) bool {
+	for _, pattern := range s.QueryParams {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// uri returns the request URI of u with its query scrubbed
+func (s *Scrub) uri(u *url.URL) string {
+	uri := u.RequestURI()
+	if s == nil || u.RawQuery == "" {
+		return uri
+	}
+	p, _, _ := strings.Cut(uri, "?")
+	return p + "?" + s.query(u.RawQuery)
+}
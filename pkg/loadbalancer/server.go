@@ -0,0 +1,423 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+// Server is a backend that the load balancer can forward requests to
+type Server interface {
+	Address() string
+	IsAlive(ctx context.Context) bool
+	Serve(rw http.ResponseWriter, req *http.Request)
+}
+
+// Weighted is implemented by servers that carry a relative share of traffic
+type Weighted interface {
+	Weight() int
+}
+
+// ConnectionCounter is implemented by servers that track their in-flight requests
+type ConnectionCounter interface {
+	ActiveConnections() int64
+}
+
+// WeightSetter is implemented by servers whose weight can change at runtime
+type WeightSetter interface {
+	Weighted
+	SetWeight(weight int)
+}
+
+// Labeled is implemented by servers that carry key/value metadata
+type Labeled interface {
+	Labels() map[string]string
+}
+
+// LabelSetter is implemented by servers whose labels can change at runtime
+type LabelSetter interface {
+	Labeled
+	SetLabels(labels map[string]string)
+}
+
+// Annotated is implemented by servers that carry a free-form note for operators, such as why
+// they are drained or who to ask about them
+type Annotated interface {
+	Note() string
+	SetNote(note string)
+}
+
+// WeightOf returns the server's weight, or 1 when it does not implement Weighted
+func WeightOf(s Server) int {
+	if w, ok := s.(Weighted); ok {
+		return w.Weight()
+	}
+	return 1
+}
+
+// ActiveConnectionsOf returns the server's in-flight requests, or 0 when it does not implement ConnectionCounter
+func ActiveConnectionsOf(s Server) int64 {
+	if c, ok := s.(ConnectionCounter); ok {
+		return c.ActiveConnections()
+	}
+	return 0
+}
+
+// LabelsOf returns the server's labels, or nil when it does not implement Labeled
+func LabelsOf(s Server) map[string]string {
+	if l, ok := s.(Labeled); ok {
+		return l.Labels()
+	}
+	return nil
+}
+
+// NoteOf returns the server's note, or "" when it does not implement Annotated
+func NoteOf(s Server) string {
+	if a, ok := s.(Annotated); ok {
+		return a.Note()
+	}
+	return ""
+}
+
+// SimpleServer is a Server that proxies to a single backend URL
+type SimpleServer struct {
+	addr   string
+	target *url.URL
+	client *http.Client
+	proxy  *httputil.ReverseProxy
+
+	weight atomic.Int64
+	// ownLabels are set by WithLabels or SetLabels; labels adds extLabels, the ones learned
+	// from discovery
+	labelMu   sync.Mutex
+	ownLabels map[string]string
+	extLabels map[string]string
+	labels    atomic.Pointer[map[string]string]
+	note      atomic.Pointer[string]
+	misconfig atomic.Pointer[string]
+	host      string
+	// healthURL is what IsAlive probes; nil means the backend URL itself
+	healthURL *url.URL
+	egress    *url.URL
+	verify    *BackendTLS
+	timeouts  *UpstreamTimeouts
+	source    *Source
+	protocol  HTTPVersion
+	maxActive int
+	recycle   Recycling
+	signer    RequestSigner
+	auth      *BackendAuth
+	active    atomic.Int64
+	// keepAlive, when set, tunes the upstream connections, which conns then counts
+	keepAlive *net.KeepAliveConfig
+	conns     atomic.Int64
+	logger    *slog.Logger
+}
+
+// ServerOption configures a SimpleServer
+type ServerOption func(*SimpleServer)
+
+// WithWeight sets the server's relative weight; values below 1 are treated as 1
+func WithWeight(weight int) ServerOption {
+	return func(s *SimpleServer) {
+		s.weight.Store(int64(max(weight, 1)))
+	}
+}
+
+// WithServerLogger sets the logger for the server's events, such as failed upstream calls; the
+// default is slog.Default(). A balancer passes its own to the servers it builds.
+func WithServerLogger(logger *slog.Logger) ServerOption {
+	return func(s *SimpleServer) {
+		s.logger = logger
+	}
+}
+
+// WithLabels attaches metadata such as region or version to the server
+func WithLabels(labels map[string]string) ServerOption {
+	return func(s *SimpleServer) {
+		s.ownLabels = maps.Clone(labels)
+		s.labels.Store(&s.ownLabels)
+	}
+}
+
+// WithNote attaches a note for operators, shown with the backend on the admin port
+func WithNote(note string) ServerOption {
+	return func(s *SimpleServer) {
+		s.note.Store(&note)
+	}
+}
+
+// WithDirector adds a request rewrite that runs after the default director has pointed the
+// request at the backend, for per-upstream headers, auth or path changes
+func WithDirector(director func(*http.Request)) ServerOption {
+	return func(s *SimpleServer) {
+		base := s.proxy.Director
+		s.proxy.Director = func(req *http.Request) {
+			base(req)
+			director(req)
+		}
+	}
+}
+
+// WithModifyResponse sets a hook that may rewrite or reject the backend's response.
+// Returning an error makes the proxy answer with 502.
+func WithModifyResponse(modify func(*http.Response) error) ServerOption {
+	return func(s *SimpleServer) {
+		base := s.proxy.ModifyResponse
+		if base == nil {
+			s.proxy.ModifyResponse = modify
+			return
+		}
+		s.proxy.ModifyResponse = func(resp *http.Response) error {
+			if err := base(resp); err != nil {
+				return err
+			}
+			return modify(resp)
+		}
+	}
+}
+
+// WithServerTransport sets the RoundTripper used for both proxied requests and health checks
+// of this server, overriding the load balancer's transport
+func WithServerTransport(transport http.RoundTripper) ServerOption {
+	return func(s *SimpleServer) {
+		s.proxy.Transport = transport
+		s.client.Transport = transport
+	}
+}
+
+// NewSimpleServer creates a SimpleServer for the backend at addr.
+// Errors wrap ErrInvalidBackendURL.
+func NewSimpleServer(addr string, opts ...ServerOption) (*SimpleServer, error) {
+	return newSimpleServer(addr, nil, opts...)
+}
+
+// newSimpleServer builds a SimpleServer, using transport when it is non-nil
+func newSimpleServer(addr string, transport http.RoundTripper, opts ...ServerOption) (*SimpleServer, error) {
+	serverURL, err := parseBackendURL(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	h2c := serverURL.Scheme == schemeH2C
+	if h2c {
+		serverURL.Scheme = "http"
+	}
+	if transport == nil {
+		transport = newUpstreamTransport(h2c)
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(serverURL)
+	proxy.Transport = transport
+
+	s := &SimpleServer{
+		addr:   addr,
+		target: serverURL,
+		client: &http.Client{Transport: transport},
+		proxy:  proxy,
+		logger: slog.Default(),
+	}
+	s.weight.Store(1)
+	proxy.ErrorHandler = s.proxyError
+	proxy.ModifyResponse = prepareResponse
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.protocol != HTTPAuto {
+		if err := s.useHTTPVersion(s.protocol); err != nil {
+			return nil, err
+		}
+	}
+	if s.timeouts != nil {
+		if err := s.useTimeouts(*s.timeouts); err != nil {
+			return nil, err
+		}
+	}
+	if s.source != nil {
+		if err := s.useSource(*s.source); err != nil {
+			return nil, err
+		}
+	}
+	if s.verify != nil {
+		if err := s.useBackendTLS(*s.verify); err != nil {
+			return nil, err
+		}
+	}
+	if s.egress != nil {
+		if err := s.useProxy(s.egress); err != nil {
+			return nil, err
+		}
+	}
+	if s.keepAlive != nil {
+		if err := s.useKeepAlive(*s.keepAlive); err != nil {
+			return nil, err
+		}
+	}
+	if s.recycle.enabled() {
+		if err := s.useRecycling(s.recycle); err != nil {
+			return nil, err
+		}
+	}
+	if s.auth != nil {
+		if err := s.auth.validate(); err != nil {
+			return nil, err
+		}
+		s.useAuth(s.auth)
+	}
+	if s.signer != nil {
+		s.useSigner(s.signer)
+	}
+	return s, nil
+}
+
+// parseBackendURL validates addr as an absolute http, https or h2c URL
+func parseBackendURL(addr string) (*url.URL, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %v", ErrInvalidBackendURL, addr, err)
+	}
+	switch u.Scheme {
+	case "http", "https", schemeH2C:
+	default:
+		return nil, fmt.Errorf("%w %q: unsupported scheme %q", ErrInvalidBackendURL, addr, u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%w %q: missing host", ErrInvalidBackendURL, addr)
+	}
+	return u, nil
+}
+
+// Address returns the backend address the server was created with
+func (s *SimpleServer) Address() string {
+	return s.addr
+}
+
+// Weight returns the server's relative weight
+func (s *SimpleServer) Weight() int {
+	return int(s.weight.Load())
+}
+
+// SetWeight changes the server's relative weight at runtime; values below 1 are treated as 1
+func (s *SimpleServer) SetWeight(weight int) {
+	s.weight.Store(int64(max(weight, 1)))
+}
+
+// ActiveConnections returns the number of requests currently being proxied
+func (s *SimpleServer) ActiveConnections() int64 {
+	return s.active.Load()
+}
+
+// Labels returns the server's metadata; callers must not modify it
+func (s *SimpleServer) Labels() map[string]string {
+	if l := s.labels.Load(); l != nil {
+		return *l
+	}
+	return nil
+}
+
+// SetLabels replaces the server's own labels; labels learned from discovery stay underneath
+func (s *SimpleServer) SetLabels(labels map[string]string) {
+	s.labelMu.Lock()
+	defer s.labelMu.Unlock()
+	s.ownLabels = maps.Clone(labels)
+	s.mergeLabels()
+}
+
+// setDiscoveredLabels makes the labels the server's own ones plus any of extra it doesn't set
+func (s *SimpleServer) setDiscoveredLabels(extra map[string]string) {
+	s.labelMu.Lock()
+	defer s.labelMu.Unlock()
+	s.extLabels = maps.Clone(extra)
+	s.mergeLabels()
+}
+
+func (s *SimpleServer) mergeLabels() {
+	merged := maps.Clone(s.extLabels)
+	if merged == nil {
+		merged = make(map[string]string)
+	}
+	maps.Copy(merged, s.ownLabels)
+	if len(merged) == 0 {
+		merged = nil
+	}
+	s.labels.Store(&merged)
+}
+
+// Note returns the server's note
+func (s *SimpleServer) Note() string {
+	if n := s.note.Load(); n != nil {
+		return *n
+	}
+	return ""
+}
+
+// SetNote replaces the server's note; "" clears it
+func (s *SimpleServer) SetNote(note string) {
+	s.note.Store(&note)
+}
+
+// IsAlive checks the server health by sending a GET request bound to ctx
+func (s *SimpleServer) IsAlive(ctx context.Context) bool {
+	target := s.target
+	if s.healthURL != nil {
+		target = s.healthURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return false
+	}
+	if s.host != "" {
+		req.Host = s.host
+	}
+	s.authorize(req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		s.noteMisconfig(protocolMismatch(s.target.Scheme, err, nil))
+		return false
+	}
+	defer resp.Body.Close()
+	s.noteMisconfig(protocolMismatch(s.target.Scheme, nil, resp))
+	return resp.StatusCode == http.StatusOK
+}
+
+// proxyError answers 502, or 504 for a timeout, for a failed upstream call, unless the balancer
+// can retry the request elsewhere, in which case it only hands the error back.
+// A call cancelled because the client left, or an operator cut the request off, is neither
+// retried nor blamed on the backend.
+func (s *SimpleServer) proxyError(rw http.ResponseWriter, req *http.Request, err error) {
+	if clientAborted(req) {
+		rw.WriteHeader(StatusClientClosedRequest)
+		return
+	}
+	if requestCancelled(req) {
+		// answered by the balancer once the request unwinds
+		return
+	}
+	uerr := &UpstreamError{Kind: ClassifyUpstreamError(err), Server: s.addr, Err: err}
+	if reason := protocolMismatch(s.target.Scheme, err, nil); reason != "" {
+		s.noteMisconfig(reason)
+	}
+	st := stateFrom(req.Context())
+	st.upstreamErr = uerr
+	if st.retryable {
+		return
+	}
+	s.logger.Warn("proxy error", "server", s.addr, "kind", uerr.Kind, "error", err)
+	rw.Header().Set(upstreamErrorHeader, string(uerr.Kind))
+	rw.WriteHeader(uerr.Kind.Status())
+}
+
+// Serve forwards the request to the backend server.
+// The upstream call is tied to the request context, so it is abandoned when the client goes away.
+func (s *SimpleServer) Serve(rw http.ResponseWriter, req *http.Request) {
+	s.active.Add(1)
+	defer s.active.Add(-1)
+	s.proxy.ServeHTTP(rw, req)
+}
@@ -0,0 +1,504 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigSnapshots keeps a history of the balancer's runtime configuration on disk: the pool as
+// changed through the admin API, and which backends are draining. A snapshot is taken every
+// Interval when something changed since the last one, and the admin port gets endpoints to
+// list, compare and restore them.
+type ConfigSnapshots struct {
+	// Dir holds the snapshots, one JSON file each
+	Dir string
+	// Interval is how often the configuration is looked at; default 5m
+	Interval time.Duration
+	// Keep is how many snapshots are kept, the oldest being deleted first; default 48
+	Keep int
+	// Token is a bearer token the snapshot endpoints accept besides the WithAdminToken one;
+	// without either, every call is refused, as snapshots hold the whole configuration
+	Token string
+}
+
+// WithConfigSnapshots snapshots the runtime configuration and enables GET /snapshots,
+// GET /snapshots/{id}, GET /snapshots/{id}/diff, POST /snapshots and
+// POST /snapshots/{id}/restore on the admin handler
+func WithConfigSnapshots(cfg ConfigSnapshots) Option {
+	return func(lb *LoadBalancer) {
+		if cfg.Interval <= 0 {
+			cfg.Interval = 5 * time.Minute
+		}
+		if cfg.Keep <= 0 {
+			cfg.Keep = 48
+		}
+		lb.snapshots = &cfg
+	}
+}
+
+func (c *ConfigSnapshots) validate() error {
+	if c.Dir == "" {
+		return errors.New("config snapshots without a directory")
+	}
+	return nil
+}
+
+// RuntimeConfig is the part of the configuration that changes while the balancer runs.
+// Backends found by discovery are left out, since discovery brings them back by itself.
+type RuntimeConfig struct {
+	Backends []RuntimeBackend `json:"backends"`
+	// Draining lists the backends taken out of rotation
+	Draining []string `json:"draining,omitempty"`
+}
+
+// RuntimeBackend is a pool member as a snapshot records it
+type RuntimeBackend struct {
+	URL string `json:"url"`
+	// Weight is the configured weight, not one set for now by capacity reports or Prometheus
+	Weight    int               `json:"weight"`
+	HealthURL string            `json:"health_url,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Note      string            `json:"note,omitempty"`
+}
+
+// Snapshot is one saved RuntimeConfig
+type Snapshot struct {
+	ID       string        `json:"id"`
+	Time     time.Time     `json:"time"`
+	Balancer string        `json:"balancer"`
+	Reason   string        `json:"reason"`
+	Config   RuntimeConfig `json:"config"`
+}
+
+// SnapshotDiff is what changes going from one configuration to another
+type SnapshotDiff struct {
+	Added   []RuntimeBackend `json:"added,omitempty"`
+	Removed []RuntimeBackend `json:"removed,omitempty"`
+	Changed []BackendChange  `json:"changed,omitempty"`
+	// DrainStarted and DrainEnded list the backends that start or stop draining
+	DrainStarted []string `json:"drain_started,omitempty"`
+	DrainEnded   []string `json:"drain_ended,omitempty"`
+}
+
+// BackendChange is one field of a backend that differs
+type BackendChange struct {
+	URL   string `json:"url"`
+	Field string `json:"field"`
+	From  any    `json:"from"`
+	To    any    `json:"to"`
+}
+
+// RuntimeConfig captures the current runtime configuration
+func (lb *LoadBalancer) RuntimeConfig() RuntimeConfig {
+	lb.mu.Lock()
+	servers := slices.Clone(lb.serverList)
+	discovered := make(map[string]bool, len(lb.discovered))
+	for key := range lb.discovered {
+		discovered[key] = true
+	}
+	lb.mu.Unlock()
+
+	cfg := RuntimeConfig{Backends: make([]RuntimeBackend, 0, len(servers))}
+	for _, server := range servers {
+		if discovered[canonicalAddr(server.Address())] {
+			continue
+		}
+		b := RuntimeBackend{
+			URL:    server.Address(),
+			Weight: lb.configuredWeight(server),
+			Labels: LabelsOf(server),
+			Note:   NoteOf(server),
+		}
+		if s, ok := server.(*SimpleServer); ok && s.healthURL != nil {
+			b.HealthURL = s.healthURL.String()
+		}
+		cfg.Backends = append(cfg.Backends, b)
+		if lb.isDraining(server.Address()) {
+			cfg.Draining = append(cfg.Draining, server.Address())
+		}
+	}
+	return cfg
+}
+
+// configuredWeight returns the weight of server that capacity reports and Prometheus weights
+// stand in for while they apply
+func (lb *LoadBalancer) configuredWeight(server Server) int {
+	addr := server.Address()
+	lb.stateMu.Lock()
+	st, reported := lb.capacity[addr]
+	lb.stateMu.Unlock()
+	if lb.promWeights != nil {
+		lb.promWeights.mu.Lock()
+		base, ok := lb.promWeights.base[addr]
+		lb.promWeights.mu.Unlock()
+		if ok {
+			return base
+		}
+	}
+	if reported {
+		return st.base
+	}
+	return WeightOf(server)
+}
+
+// DiffRuntimeConfig returns what changes going from one configuration to the other
+func DiffRuntimeConfig(from, to RuntimeConfig) SnapshotDiff {
+	var d SnapshotDiff
+	old := make(map[string]RuntimeBackend, len(from.Backends))
+	for _, b := range from.Backends {
+		old[canonicalAddr(b.URL)] = b
+	}
+	seen := make(map[string]bool, len(to.Backends))
+	for _, b := range to.Backends {
+		key := canonicalAddr(b.URL)
+		seen[key] = true
+		prev, ok := old[key]
+		if !ok {
+			d.Added = append(d.Added, b)
+			continue
+		}
+		if prev.Weight != b.Weight {
+			d.Changed = append(d.Changed, BackendChange{URL: b.URL, Field: "weight", From: prev.Weight, To: b.Weight})
+		}
+		if prev.HealthURL != b.HealthURL {
+			d.Changed = append(d.Changed, BackendChange{URL: b.URL, Field: "health_url", From: prev.HealthURL, To: b.HealthURL})
+		}
+		if !maps.Equal(prev.Labels, b.Labels) {
+			d.Changed = append(d.Changed, BackendChange{URL: b.URL, Field: "labels", From: prev.Labels, To: b.Labels})
+		}
+		if prev.Note != b.Note {
+			d.Changed = append(d.Changed, BackendChange{URL: b.URL, Field: "note", From: prev.Note, To: b.Note})
+		}
+	}
+	for _, b := range from.Backends {
+		if !seen[canonicalAddr(b.URL)] {
+			d.Removed = append(d.Removed, b)
+		}
+	}
+	for _, addr := range to.Draining {
+		if !slices.Contains(from.Draining, addr) {
+			d.DrainStarted = append(d.DrainStarted, addr)
+		}
+	}
+	for _, addr := range from.Draining {
+		if !slices.Contains(to.Draining, addr) {
+			d.DrainEnded = append(d.DrainEnded, addr)
+		}
+	}
+	return d
+}
+
+// TakeSnapshot saves the current runtime configuration, deleting the oldest snapshots beyond
+// Keep
+func (lb *LoadBalancer) TakeSnapshot(reason string) (Snapshot, error) {
+	if lb.snapshots == nil {
+		return Snapshot{}, errors.New("loadbalancer: config snapshots are not enabled")
+	}
+	lb.stateMu.Lock()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	if !now.After(lb.lastSnapshot) {
+		now = lb.lastSnapshot.Add(time.Millisecond)
+	}
+	lb.lastSnapshot = now
+	lb.stateMu.Unlock()
+	s := Snapshot{
+		ID:       now.Format("20060102T150405.000Z"),
+		Time:     now,
+		Balancer: lb.name,
+		Reason:   reason,
+		Config:   lb.RuntimeConfig(),
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if err := os.MkdirAll(lb.snapshots.Dir, 0o700); err != nil {
+		return Snapshot{}, err
+	}
+	tmp := filepath.Join(lb.snapshots.Dir, "."+s.ID+".json")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return Snapshot{}, err
+	}
+	if err := os.Rename(tmp, lb.snapshotPath(s.ID)); err != nil {
+		return Snapshot{}, err
+	}
+	ids, err := lb.snapshotIDs()
+	if err != nil {
+		return s, err
+	}
+	for _, id := range ids[:max(len(ids)-lb.snapshots.Keep, 0)] {
+		os.Remove(lb.snapshotPath(id))
+	}
+	return s, nil
+}
+
+// Snapshots lists the saved snapshots, oldest first, without their configurations
+func (lb *LoadBalancer) Snapshots() ([]Snapshot, error) {
+	ids, err := lb.snapshotIDs()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Snapshot, 0, len(ids))
+	for _, id := range ids {
+		s, err := lb.LoadSnapshot(id)
+		if err != nil {
+			continue
+		}
+		s.Config = RuntimeConfig{}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+// LoadSnapshot reads the snapshot with the given ID
+func (lb *LoadBalancer) LoadSnapshot(id string) (Snapshot, error) {
+	if lb.snapshots == nil {
+		return Snapshot{}, errors.New("loadbalancer: config snapshots are not enabled")
+	}
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return Snapshot{}, fmt.Errorf("snapshot %q: %w", id, os.ErrNotExist)
+	}
+	data, err := os.ReadFile(lb.snapshotPath(id))
+	if err != nil {
+		return Snapshot{}, err
+	}
+	var s Snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return Snapshot{}, fmt.Errorf("snapshot %s: %w", id, err)
+	}
+	return s, nil
+}
+
+// RestoreSnapshot makes the runtime configuration what the snapshot recorded: backends it
+// doesn't have are removed, the ones it has are added or updated, and drains are started or
+// ended to match. The configuration before the restore is snapshotted first, so a restore can
+// itself be undone.
+func (lb *LoadBalancer) RestoreSnapshot(id string) (SnapshotDiff, error) {
+	s, err := lb.LoadSnapshot(id)
+	if err != nil {
+		return SnapshotDiff{}, err
+	}
+	if _, err := lb.TakeSnapshot("before restoring " + id); err != nil {
+		return SnapshotDiff{}, fmt.Errorf("snapshotting the current configuration: %w", err)
+	}
+	diff := DiffRuntimeConfig(lb.RuntimeConfig(), s.Config)
+	var errs []error
+	for _, b := range diff.Removed {
+		if err := lb.RemoveBackend(b.URL); err != nil && !errors.Is(err, ErrUnknownBackend) {
+			errs = append(errs, err)
+		}
+	}
+	for _, b := range diff.Added {
+		opts := []ServerOption{WithWeight(b.Weight), WithLabels(b.Labels), WithNote(b.Note)}
+		if b.HealthURL != "" {
+			opts = append(opts, WithHealthPath(b.HealthURL))
+		}
+		if _, err := lb.AddBackend(b.URL, opts...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, c := range diff.Changed {
+		server := lb.member(c.URL)
+		if server == nil {
+			continue
+		}
+		if err := lb.applyChange(server, c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, addr := range diff.DrainStarted {
+		if err := lb.StartDrain(addr); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, addr := range diff.DrainEnded {
+		if err := lb.ResumeBackend(addr); err != nil && !errors.Is(err, ErrUnknownBackend) {
+			errs = append(errs, err)
+		}
+	}
+	lb.logger.Info("config snapshot restored", "snapshot", id, "added", len(diff.Added), "removed", len(diff.Removed), "changed", len(diff.Changed))
+	return diff, errors.Join(errs...)
+}
+
+// applyChange sets one field of server to the value a snapshot recorded
+func (lb *LoadBalancer) applyChange(server Server, c BackendChange) error {
+	switch c.Field {
+	case "weight":
+		if ws, ok := server.(WeightSetter); ok {
+			lb.restoreWeight(server.Address(), ws, c.To.(int))
+			return nil
+		}
+	case "labels":
+		if ls, ok := server.(LabelSetter); ok {
+			ls.SetLabels(c.To.(map[string]string))
+			return nil
+		}
+	case "note":
+		if a, ok := server.(Annotated); ok {
+			a.SetNote(c.To.(string))
+			return nil
+		}
+	}
+	return fmt.Errorf("backend %s: %s can't be restored in place", server.Address(), c.Field)
+}
+
+func (lb *LoadBalancer) snapshotPath(id string) string {
+	return filepath.Join(lb.snapshots.Dir, id+".json")
+}
+
+// snapshotIDs lists the IDs of the saved snapshots, oldest first
+func (lb *LoadBalancer) snapshotIDs() ([]string, error) {
+	entries, err := os.ReadDir(lb.snapshots.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if id, ok := strings.CutSuffix(e.Name(), ".json"); ok && !strings.HasPrefix(id, ".") && e.Type().IsRegular() {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// snapshotLoop takes a snapshot every Interval when the configuration changed since the
+// latest one
+func (lb *LoadBalancer) snapshotLoop(ctx context.Context) {
+	ticker := time.NewTicker(lb.snapshots.Interval)
+	defer ticker.Stop()
+	for {
+		if lb.snapshotChanged() {
+			if _, err := lb.TakeSnapshot("scheduled"); err != nil {
+				lb.logger.Warn("config snapshot failed", "error", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// snapshotChanged reports whether the configuration differs from the latest snapshot
+func (lb *LoadBalancer) snapshotChanged() bool {
+	ids, err := lb.snapshotIDs()
+	if err != nil || len(ids) == 0 {
+		return true
+	}
+	latest, err := lb.LoadSnapshot(ids[len(ids)-1])
+	if err != nil {
+		return true
+	}
+	d := DiffRuntimeConfig(latest.Config, lb.RuntimeConfig())
+	return len(d.Added)+len(d.Removed)+len(d.Changed)+len(d.DrainStarted)+len(d.DrainEnded) > 0
+}
+
+// serveSnapshots handles GET /snapshots
+func (lb *LoadBalancer) serveSnapshots(rw http.ResponseWriter, req *http.Request) {
+	if !lb.authorized(rw, req, lb.snapshots.Token) {
+		return
+	}
+	list, err := lb.Snapshots()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(rw, list)
+}
+
+// serveSnapshot handles GET /snapshots/{id}
+func (lb *LoadBalancer) serveSnapshot(rw http.ResponseWriter, req *http.Request) {
+	if !lb.authorized(rw, req, lb.snapshots.Token) {
+		return
+	}
+	s, ok := lb.snapshotOf(rw, req.PathValue("id"))
+	if ok {
+		writeJSON(rw, s)
+	}
+}
+
+// serveSnapshotDiff handles GET /snapshots/{id}/diff: what restoring the snapshot would change,
+// or with ?from=, what changed from that snapshot to this one
+func (lb *LoadBalancer) serveSnapshotDiff(rw http.ResponseWriter, req *http.Request) {
+	if !lb.authorized(rw, req, lb.snapshots.Token) {
+		return
+	}
+	s, ok := lb.snapshotOf(rw, req.PathValue("id"))
+	if !ok {
+		return
+	}
+	from := lb.RuntimeConfig()
+	if id := req.URL.Query().Get("from"); id != "" {
+		base, ok := lb.snapshotOf(rw, id)
+		if !ok {
+			return
+		}
+		from = base.Config
+	}
+	writeJSON(rw, DiffRuntimeConfig(from, s.Config))
+}
+
+// serveTakeSnapshot handles POST /snapshots
+func (lb *LoadBalancer) serveTakeSnapshot(rw http.ResponseWriter, req *http.Request) {
+	if !lb.authorized(rw, req, lb.snapshots.Token) {
+		return
+	}
+	reason := req.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "manual"
+	}
+	s, err := lb.TakeSnapshot(reason)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Location", "/snapshots/"+s.ID)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusCreated)
+	writeJSON(rw, s)
+}
+
+// serveRestoreSnapshot handles POST /snapshots/{id}/restore, answering with what changed
+func (lb *LoadBalancer) serveRestoreSnapshot(rw http.ResponseWriter, req *http.Request) {
+	if !lb.authorized(rw, req, lb.snapshots.Token) {
+		return
+	}
+	if _, ok := lb.snapshotOf(rw, req.PathValue("id")); !ok {
+		return
+	}
+	diff, err := lb.RestoreSnapshot(req.PathValue("id"))
+	if err != nil {
+		http.Error(rw, "restored with errors: "+err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(rw, diff)
+}
+
+// snapshotOf loads the snapshot id, answering 404 when there is none
+func (lb *LoadBalancer) snapshotOf(rw http.ResponseWriter, id string) (Snapshot, bool) {
+	s, err := lb.LoadSnapshot(id)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		http.Error(rw, "no snapshot "+strconv.Quote(id), http.StatusNotFound)
+		return s, false
+	case err != nil:
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return s, false
+	}
+	return s, true
+}
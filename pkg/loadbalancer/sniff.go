@@ -0,0 +1,256 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/metrics"
+)
+
+// ProtocolSniffing serves HTTP, HTTPS and raw TCP on the one listening port, telling them apart
+// by the first bytes each connection sends: a TLS handshake record, an HTTP method, or
+// anything else. It is for environments that expose a single port.
+type ProtocolSniffing struct {
+	// TCPBackends, as host:port, take the connections that are neither HTTP nor TLS the
+	// balancer terminates. Without TLS termination, TLS connections are passed through to them
+	// untouched as well. They are tried in turn until one accepts the connection; without
+	// any, such connections are closed.
+	TCPBackends []string
+	// Timeout is how long a connection may stay silent before it is sent to the TCP backends,
+	// for protocols where the server speaks first; default 1s
+	Timeout time.Duration
+	// DialTimeout bounds connecting to a TCP backend; default 5s
+	DialTimeout time.Duration
+}
+
+// WithProtocolSniffing lets the listening port take plain HTTP, TLS and raw TCP connections
+func WithProtocolSniffing(s ProtocolSniffing) Option {
+	return func(lb *LoadBalancer) {
+		if s.Timeout <= 0 {
+			s.Timeout = time.Second
+		}
+		if s.DialTimeout <= 0 {
+			s.DialTimeout = 5 * time.Second
+		}
+		lb.sniffing = &s
+	}
+}
+
+// sniffed protocols, as counted in lb_sniffed_connections_total
+const (
+	sniffedHTTP = "http"
+	sniffedTLS  = "tls"
+	sniffedTCP  = "tcp"
+)
+
+// sniffListener classifies the connections of the listener beneath it. HTTP connections are
+// returned by Accept as they are, TLS ones wrapped for termination, and the rest proxied to
+// the TCP backends.
+type sniffListener struct {
+	net.Listener
+	ctx   context.Context
+	tls   *tls.Config
+	conns chan net.Conn
+	errc  chan error
+	start sync.Once
+
+	cfg    atomic.Pointer[ProtocolSniffing]
+	next   atomic.Uint64
+	counts map[string]*metrics.Counter
+	failed *metrics.Counter
+}
+
+// sniffListener wraps ln for lb's ProtocolSniffing, terminating TLS with cfg when it is set.
+// TCP connections are closed once ctx is done.
+func (lb *LoadBalancer) sniffListener(ctx context.Context, ln net.Listener, cfg *tls.Config) *sniffListener {
+	if cfg != nil {
+		lb.keepTicketKeys(ctx, cfg)
+	}
+	l := &sniffListener{
+		Listener: ln,
+		ctx:      ctx,
+		tls:      cfg,
+		conns:    make(chan net.Conn),
+		errc:     make(chan error, 1),
+		counts:   make(map[string]*metrics.Counter),
+		failed:   metrics.NewCounter(),
+	}
+	for _, p := range []string{sniffedHTTP, sniffedTLS, sniffedTCP} {
+		l.counts[p] = metrics.NewCounter()
+	}
+	l.cfg.Store(lb.sniffing)
+	return l
+}
+
+func (l *sniffListener) Accept() (net.Conn, error) {
+	l.start.Do(func() { go l.acceptLoop() })
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errc:
+		// later calls get the same error
+		l.errc <- err
+		return nil, err
+	}
+}
+
+// acceptLoop sniffs each accepted connection in a goroutine of its own, so a silent client
+// doesn't hold up the others
+func (l *sniffListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.errc <- err
+			return
+		}
+		go l.classify(conn)
+	}
+}
+
+// classify peeks at the first bytes of conn and sends it where it belongs
+func (l *sniffListener) classify(conn net.Conn) {
+	cfg := l.cfg.Load()
+	pc := &peekedConn{Conn: conn, r: bufio.NewReader(conn)}
+	conn.SetReadDeadline(time.Now().Add(cfg.Timeout))
+	proto := sniffProtocol(pc.r)
+	conn.SetReadDeadline(time.Time{})
+	if proto == sniffedTLS && l.tls == nil {
+		proto = sniffedTCP
+	}
+	l.counts[proto].Inc()
+	var out net.Conn = pc
+	switch proto {
+	case sniffedTCP:
+		l.proxyTCP(pc, cfg)
+		return
+	case sniffedTLS:
+		out = tls.Server(pc, l.tls)
+	}
+	select {
+	case l.conns <- out:
+	case <-l.ctx.Done():
+		conn.Close()
+	}
+}
+
+// sniffProtocol tells a TLS handshake record and an HTTP request line from anything else. A
+// request line starts with an upper-case method and a space; reading stops at the first byte
+// that rules one out.
+func sniffProtocol(r *bufio.Reader) string {
+	b, err := r.Peek(1)
+	if err != nil {
+		return sniffedTCP
+	}
+	if b[0] == 0x16 {
+		return sniffedTLS
+	}
+	for n := 1; n <= 8; n++ {
+		b, err := r.Peek(n)
+		if err != nil {
+			return sniffedTCP
+		}
+		switch c := b[n-1]; {
+		case c == ' ' && n > 1:
+			return sniffedHTTP
+		case c < 'A' || c > 'Z':
+			return sniffedTCP
+		}
+	}
+	return sniffedTCP
+}
+
+// proxyTCP connects conn to the first TCP backend that accepts, starting after the one the
+// previous connection went to, and copies bytes both ways until either side is done
+func (l *sniffListener) proxyTCP(conn net.Conn, cfg *ProtocolSniffing) {
+	var upstream net.Conn
+	backends := cfg.TCPBackends
+	start := l.next.Add(1)
+	for i := range backends {
+		addr := backends[(int(start)+i)%len(backends)]
+		dialer := &net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: 30 * time.Second}
+		c, err := dialer.DialContext(l.ctx, "tcp", addr)
+		if err == nil {
+			upstream = c
+			break
+		}
+		l.failed.Inc()
+	}
+	if upstream == nil {
+		conn.Close()
+		return
+	}
+	pipe(l.ctx, conn, upstream)
+}
+
+// pipe copies bytes both ways between conn and upstream until either side is done, then closes
+// both. They are closed early once ctx is done.
+func pipe(ctx context.Context, conn, upstream net.Conn) {
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+		upstream.Close()
+	})
+	defer stop()
+	done := make(chan struct{})
+	go func() {
+		io.Copy(upstream, conn)
+		closeWrite(upstream)
+		close(done)
+	}()
+	io.Copy(conn, upstream)
+	closeWrite(conn)
+	<-done
+	conn.Close()
+	upstream.Close()
+}
+
+// closeWrite half-closes conn where it can, so the peer sees the end of the stream
+func closeWrite(conn net.Conn) {
+	for {
+		switch c := conn.(type) {
+		case interface{ CloseWrite() error }:
+			c.CloseWrite()
+			return
+		case *peekedConn:
+			conn = c.Conn
+		case *switchConn:
+			conn = c.Conn
+		case *limitedConn:
+			conn = c.Conn
+		default:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// swap has TCP connections from now on go to cfg's backends
+func (l *sniffListener) swap(cfg *ProtocolSniffing) {
+	l.cfg.Store(cfg)
+}
+
+// writeMetrics writes the sniffed connections by protocol and the failed TCP dials
+func (l *sniffListener) writeMetrics(w *bufio.Writer) {
+	writeMetricHeader(w, "lb_sniffed_connections_total", "counter", "Connections on the listening port by the protocol they were sniffed as.")
+	for _, p := range []string{sniffedHTTP, sniffedTLS, sniffedTCP} {
+		fmt.Fprintf(w, "lb_sniffed_connections_total{protocol=\"%s\"} %d\n", p, l.counts[p].Value())
+	}
+	writeMetricHeader(w, "lb_tcp_dial_failures_total", "counter", "Failed connection attempts to TCP backends.")
+	fmt.Fprintf(w, "lb_tcp_dial_failures_total %d\n", l.failed.Value())
+}
+
+// peekedConn reads through the buffer its first bytes were peeked into
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
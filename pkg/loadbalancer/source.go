@@ -0,0 +1,107 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Source picks where upstream connections leave the machine, for multi-homed hosts whose
+// egress must use a particular address or network interface
+type Source struct {
+	// IP is the local address connections are bound to
+	IP string
+	// Interface is the network interface connections go out through. On Linux the socket is
+	// bound to the device, which needs CAP_NET_RAW; elsewhere the interface's first address is
+	// used as the local address, preferring IPv4. IP, when also set, must belong to it.
+	Interface string
+}
+
+// WithUpstreamSource applies s to every server the balancer builds itself
+func WithUpstreamSource(s Source) Option {
+	return func(lb *LoadBalancer) {
+		lb.source = &s
+	}
+}
+
+// WithSource makes the server's connections, health checks included, leave from s. It
+// requires the server's transport to be an *http.Transport.
+func WithSource(s Source) ServerOption {
+	return func(srv *SimpleServer) {
+		srv.source = &s
+	}
+}
+
+// useSource gives the server's transport a dialer bound to src, keeping the dial timeout
+func (s *SimpleServer) useSource(src Source) error {
+	base, ok := s.proxy.Transport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("loadbalancer: backend %s uses a %T, which has no dialer settings", s.addr, s.proxy.Transport)
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if s.timeouts != nil && s.timeouts.Dial > 0 {
+		dialer.Timeout = s.timeouts.Dial
+	}
+	var local net.IP
+	if src.IP != "" {
+		if local = net.ParseIP(src.IP); local == nil {
+			return fmt.Errorf("loadbalancer: backend %s: invalid source address %q", s.addr, src.IP)
+		}
+	}
+	if src.Interface != "" {
+		iface, err := net.InterfaceByName(src.Interface)
+		if err != nil {
+			return fmt.Errorf("loadbalancer: backend %s: source interface: %w", s.addr, err)
+		}
+		if local, err = interfaceAddr(iface, local); err != nil {
+			return fmt.Errorf("loadbalancer: backend %s: source interface %s: %w", s.addr, src.Interface, err)
+		}
+		dialer.Control = bindToDevice(iface.Name)
+	}
+	if local != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: local}
+	}
+	t := base.Clone()
+	t.DialContext = dialer.DialContext
+	s.proxy.Transport = t
+	s.client.Transport = t
+	return nil
+}
+
+// interfaceAddr returns want when iface has it, or else the address to bind to for iface:
+// nil where the socket is bound to the device itself, its first address otherwise
+func interfaceAddr(iface *net.Interface, want net.IP) (net.IP, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var v4, v6 net.IP
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipnet.IP
+		switch {
+		case want != nil && ip.Equal(want):
+			return want, nil
+		case ip.To4() != nil && v4 == nil:
+			v4 = ip
+		case ip.To4() == nil && v6 == nil && !ip.IsLinkLocalUnicast():
+			v6 = ip
+		}
+	}
+	switch {
+	case want != nil:
+		return nil, fmt.Errorf("%s is not one of its addresses", want)
+	case bindsDevice:
+		return nil, nil
+	case v4 != nil:
+		return v4, nil
+	case v6 != nil:
+		return v6, nil
+	}
+	return nil, errors.New("no usable address")
+}
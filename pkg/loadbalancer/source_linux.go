@@ -0,0 +1,21 @@
+//go:build linux
+
+package loadbalancer
+
+import "syscall"
+
+// bindsDevice is set where bindToDevice pins sockets to the interface itself
+const bindsDevice = true
+
+// bindToDevice returns a dialer Control function binding sockets to the named interface
+func bindToDevice(name string) func(network, address string, c syscall.RawConn) error {
+	return func(_, _ string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package loadbalancer
+
+import "syscall"
+
+// bindsDevice is unset where sockets can only be given the interface's address
+const bindsDevice = false
+
+// bindToDevice returns nil: binding to a device is Linux-only, so the interface's address
+// stands in for it
+func bindToDevice(string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,131 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/metrics"
+)
+
+// Spillover caps the traffic a route sends to its pool and sends the excess to an overflow
+// pool, such as burst capacity in the cloud. A request spills when the primary pool already
+// has MaxInFlight of the route's requests, or when the route has used its RPS; the two may be
+// combined.
+type Spillover struct {
+	// Pool names the overflow pool
+	Pool string
+	// MaxInFlight is how many of the route's requests the primary pool serves at once; 0 for
+	// no limit
+	MaxInFlight int
+	// RPS is how many of the route's requests per second go to the primary pool; 0 for no limit
+	RPS float64
+	// Burst is how many requests over RPS the primary pool takes at once; default RPS
+	Burst float64
+}
+
+// spillover is the state of one route's Spillover
+type spillover struct {
+	cfg      Spillover
+	route    string
+	primary  *pool
+	overflow *pool
+	inFlight atomic.Int64
+
+	mu     sync.Mutex
+	bucket bucket
+
+	served  *metrics.Counter
+	spilled *metrics.Counter
+}
+
+func newSpillover(route string, primary, overflow *pool, cfg Spillover) (*spillover, error) {
+	if cfg.MaxInFlight <= 0 && cfg.RPS <= 0 {
+		return nil, errors.New("spillover without a concurrency or rate threshold")
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = max(cfg.RPS, 1)
+	}
+	return &spillover{
+		cfg:      cfg,
+		route:    route,
+		primary:  primary,
+		overflow: overflow,
+		bucket:   bucket{tokens: cfg.Burst, last: time.Now()},
+		served:   metrics.NewCounter(),
+		spilled:  metrics.NewCounter(),
+	}, nil
+}
+
+// admit reports whether a request can go to the primary pool, counting it in flight there if
+// so; the caller must call done when it finishes
+func (s *spillover) admit() (ok bool, reason string) {
+	n := s.inFlight.Add(1)
+	if s.cfg.MaxInFlight > 0 && n > int64(s.cfg.MaxInFlight) {
+		s.inFlight.Add(-1)
+		return false, fmt.Sprintf("%d requests in flight", n-1)
+	}
+	if s.cfg.RPS > 0 && !s.take() {
+		s.inFlight.Add(-1)
+		return false, fmt.Sprintf("over %g requests per second", s.cfg.RPS)
+	}
+	return true, ""
+}
+
+func (s *spillover) done() {
+	s.inFlight.Add(-1)
+}
+
+// take takes one request from the rate bucket
+func (s *spillover) take() bool {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := &s.bucket
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*s.cfg.RPS, s.cfg.Burst)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// serve sends req to the primary pool or the overflow pool, serving it with next
+func (s *spillover) serve(next http.Handler, rw http.ResponseWriter, req *http.Request, st *requestState) {
+	ok, reason := s.admit()
+	if ok {
+		s.served.Inc()
+		defer s.done()
+		next.ServeHTTP(rw, req)
+		return
+	}
+	s.spilled.Inc()
+	st.pool, st.poolName, st.strategy = s.overflow.servers, s.overflow.Name, s.overflow.Strategy
+	if tracing(req) {
+		TraceDecision(req, "spilled from pool %s to %s: %s", s.primary.Name, s.overflow.Name, reason)
+	}
+	next.ServeHTTP(rw, req)
+}
+
+// writeMetrics writes the requests the route sent to each pool
+func (s *spillover) writeMetrics(w *bufio.Writer) {
+	fmt.Fprintf(w, "lb_spillover_requests_total{route=%q,pool=%q,target=\"primary\"} %d\n", s.route, s.primary.Name, s.served.Value())
+	fmt.Fprintf(w, "lb_spillover_requests_total{route=%q,pool=%q,target=\"overflow\"} %d\n", s.route, s.overflow.Name, s.spilled.Value())
+}
+
+// writeSpilloverMetrics writes the metrics of every route with a Spillover
+func (lb *LoadBalancer) writeSpilloverMetrics(w *bufio.Writer) {
+	writeMetricHeader(w, "lb_spillover_requests_total", "counter", "Requests of routes with a spillover, by the pool they went to.")
+	for _, s := range lb.spillovers {
+		s.writeMetrics(w)
+	}
+	writeMetricHeader(w, "lb_spillover_in_flight", "gauge", "Requests of routes with a spillover in flight on their primary pool.")
+	for _, s := range lb.spillovers {
+		fmt.Fprintf(w, "lb_spillover_in_flight{route=%q,pool=%q} %d\n", s.route, s.primary.Name, s.inFlight.Load())
+	}
+}
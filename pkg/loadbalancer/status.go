@@ -0,0 +1,182 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatusPage is a public page telling end users whether each service is up. It shows one word
+// per service and nothing about backends, counts or configuration, so it is safe to expose
+// without authentication, unlike the admin endpoints.
+type StatusPage struct {
+	// Path is where the page is served on the balancer's port; default "/status"
+	Path string
+	// Title heads the page; default "Service status"
+	Title string
+	// MaxAge is how long clients and shared caches may reuse the page, and how often it is
+	// recomputed; default 10s
+	MaxAge time.Duration
+}
+
+// ServiceState is a service's health as shown on the status page
+type ServiceState string
+
+// The states a service can be shown in
+const (
+	ServiceUp       ServiceState = "up"
+	ServiceDegraded ServiceState = "degraded"
+	ServiceDown     ServiceState = "down"
+)
+
+// WithStatusPage serves the public status page for this balancer on its own port, ahead of
+// access rules and custom middleware. Group.StatusHandler covers several balancers on one page.
+func WithStatusPage(p StatusPage) Option {
+	return func(lb *LoadBalancer) {
+		lb.statusPage = newStatusPage(p, func() []serviceStatus {
+			return []serviceStatus{{Name: lb.name, State: lb.ServiceState()}}
+		})
+	}
+}
+
+// StatusHandler returns a status page listing every member of the group by name, for mounting
+// wherever end users can reach it. p.Path is ignored.
+func (g *Group) StatusHandler(p StatusPage) http.Handler {
+	return newStatusPage(p, func() []serviceStatus {
+		balancers := g.Balancers()
+		services := make([]serviceStatus, len(balancers))
+		for i, lb := range balancers {
+			services[i] = serviceStatus{Name: lb.name, State: lb.ServiceState()}
+		}
+		return services
+	})
+}
+
+// ServiceState sums up the last observed health of the pool without probing it: up when every
+// backend is healthy, down when none is. The backends are those readiness counts, and a front
+// that only dispatches to tenants sums up theirs.
+func (lb *LoadBalancer) ServiceState() ServiceState {
+	servers := lb.readinessServers()
+	if lb.tenants != nil && len(servers) == 0 {
+		return lb.tenants.serviceState()
+	}
+	switch healthy := lb.observedAlive(servers); {
+	case healthy == 0:
+		return ServiceDown
+	case healthy < len(servers):
+		return ServiceDegraded
+	}
+	return ServiceUp
+}
+
+type serviceStatus struct {
+	Name  string       `json:"name"`
+	State ServiceState `json:"state"`
+}
+
+// renderedStatus is the page as last computed, in both formats
+type renderedStatus struct {
+	at         time.Time
+	html, json []byte
+	etag       string
+}
+
+type statusPage struct {
+	cfg      StatusPage
+	services func() []serviceStatus
+
+	mu       sync.Mutex
+	rendered *renderedStatus
+}
+
+func newStatusPage(p StatusPage, services func() []serviceStatus) *statusPage {
+	if p.Path == "" {
+		p.Path = "/status"
+	}
+	if p.Title == "" {
+		p.Title = "Service status"
+	}
+	if p.MaxAge <= 0 {
+		p.MaxAge = 10 * time.Second
+	}
+	return &statusPage{cfg: p, services: services}
+}
+
+// middleware answers requests for the page's path and passes the rest on
+func (p *statusPage) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != p.cfg.Path {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		p.ServeHTTP(rw, req)
+	})
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>{{.Title}}</title>
+<style>body{font-family:system-ui,sans-serif;max-width:40em;margin:3em auto;padding:0 1em}li{list-style:none;margin:.5em 0}.up{color:#1a7f37}.degraded{color:#9a6700}.down{color:#cf222e}</style></head>
+<body><h1>{{.Title}}</h1><ul>{{range .Services}}<li>{{.Name}}: <strong class="{{.State}}">{{.State}}</strong></li>{{end}}</ul>
+<p><small>Updated {{.Updated}}</small></p></body>
+</html>
+`))
+
+// current returns the page, recomputing it once it is older than MaxAge
+func (p *statusPage) current() *renderedStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if p.rendered != nil && now.Sub(p.rendered.at) < p.cfg.MaxAge {
+		return p.rendered
+	}
+	services := p.services()
+	var html bytes.Buffer
+	statusTemplate.Execute(&html, map[string]any{
+		"Title":    p.cfg.Title,
+		"Services": services,
+		"Updated":  now.UTC().Format(time.RFC1123),
+	})
+	js, _ := json.Marshal(map[string]any{"services": services, "updated": now.UTC()})
+	// the ETag follows the states, not the timestamp, so an unchanged page revalidates
+	states, _ := json.Marshal(services)
+	sum := sha256.Sum256(states)
+	p.rendered = &renderedStatus{at: now, html: html.Bytes(), json: append(js, '\n'), etag: `"` + hex.EncodeToString(sum[:12]) + `"`}
+	return p.rendered
+}
+
+// ServeHTTP writes the page as HTML, or as JSON to clients that accept it
+func (p *statusPage) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r := p.current()
+	body, contentType, etag := r.html, "text/html; charset=utf-8", r.etag
+	if strings.Contains(req.Header.Get("Accept"), "application/json") {
+		body, contentType = r.json, "application/json"
+		etag = strings.TrimSuffix(etag, `"`) + `-json"`
+	}
+	h := rw.Header()
+	h.Set("Cache-Control", "public, max-age="+strconv.Itoa(int(p.cfg.MaxAge.Seconds())))
+	h.Set("Vary", "Accept")
+	h.Set("ETag", etag)
+	if etagMatches(req.Header.Get("If-None-Match"), etag) {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	if req.Method == http.MethodHead {
+		return
+	}
+	rw.Write(body)
+}
@@ -0,0 +1,54 @@
+package loadbalancer_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/lbtest"
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/loadbalancer"
+)
+
+func TestServiceStatePoolsOnly(t *testing.T) {
+	backends := lbtest.StartBackends(t, 2)
+	backends[1].SetAlive(false)
+	lb, err := loadbalancer.New(
+		loadbalancer.WithPools(loadbalancer.Pool{Name: "api", Backends: lbtest.URLs(backends)}),
+		loadbalancer.WithRoutes(loadbalancer.Route{PathPrefix: "/", Pool: "api"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.Ready(context.Background())
+	if got := lb.ServiceState(); got != loadbalancer.ServiceDegraded {
+		t.Errorf("one of two pool members down: %s, want degraded", got)
+	}
+}
+
+func TestServiceStateTenantsOnly(t *testing.T) {
+	a, b := answering(t, "team-a"), answering(t, "team-b")
+	tenantA := newTenant(t, "team-a", []string{"a.example"}, a)
+	tenantB := newTenant(t, "team-b", []string{"b.example"}, b)
+	lb, err := loadbalancer.New(loadbalancer.WithTenants(tenantA, tenantB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe := func() {
+		tenantA.Balancer.Ready(context.Background())
+		tenantB.Balancer.Ready(context.Background())
+	}
+
+	probe()
+	if got := lb.ServiceState(); got != loadbalancer.ServiceUp {
+		t.Errorf("every tenant up: %s, want up", got)
+	}
+	b.SetAlive(false)
+	probe()
+	if got := lb.ServiceState(); got != loadbalancer.ServiceDegraded {
+		t.Errorf("one tenant down: %s, want degraded", got)
+	}
+	a.SetAlive(false)
+	probe()
+	if got := lb.ServiceState(); got != loadbalancer.ServiceDown {
+		t.Errorf("every tenant down: %s, want down", got)
+	}
+}
@@ -0,0 +1,293 @@
+package loadbalancer
+
+import (
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy picks the server that should handle a request.
+// Implementations must be safe for concurrent use and return nil when servers is empty.
+// They may also return nil to decline a request they have no answer for, leaving it to the
+// next strategy of a Chain.
+type Strategy interface {
+	Next(servers []Server, req *http.Request) Server
+}
+
+// RoundRobin cycles through the servers in order
+type RoundRobin struct {
+	index atomic.Uint64
+}
+
+// NewRoundRobin creates a round-robin Strategy
+func NewRoundRobin() *RoundRobin {
+	return &RoundRobin{}
+}
+
+// Next returns the server after the one handed out last
+func (r *RoundRobin) Next(servers []Server, req *http.Request) Server {
+	if len(servers) == 0 {
+		return nil
+	}
+	i := r.index.Add(1) - 1
+	if tracing(req) {
+		TraceDecision(req, "round-robin turn %d picks %d of %d", i, i%uint64(len(servers))+1, len(servers))
+	}
+	return servers[i%uint64(len(servers))]
+}
+
+// LeastConnections sends each request to the server with the fewest in-flight requests
+// relative to its weight, so slow backends get less traffic as their requests pile up.
+// Ties are broken in turn, so an idle pool is still shared evenly.
+type LeastConnections struct {
+	index atomic.Uint64
+}
+
+// NewLeastConnections creates a least-connections Strategy. Servers that don't implement
+// ConnectionCounter count as idle.
+func NewLeastConnections() *LeastConnections {
+	return &LeastConnections{}
+}
+
+// Next returns the least loaded server
+func (l *LeastConnections) Next(servers []Server, req *http.Request) Server {
+	if len(servers) == 0 {
+		return nil
+	}
+	start := int((l.index.Add(1) - 1) % uint64(len(servers)))
+	var best Server
+	var bestActive, bestWeight int64
+	for i := range servers {
+		s := servers[(start+i)%len(servers)]
+		active, weight := ActiveConnectionsOf(s), int64(max(WeightOf(s), 1))
+		// compare active/weight without dividing; +1 so weight still matters when idle
+		if best == nil || (active+1)*bestWeight < (bestActive+1)*weight {
+			best, bestActive, bestWeight = s, active, weight
+		}
+	}
+	if tracing(req) {
+		TraceDecision(req, "least-connections picks %s with %d active for weight %d", best.Address(), bestActive, bestWeight)
+	}
+	return best
+}
+
+// WeightedRoundRobin cycles through the servers giving each a share of requests proportional
+// to its weight. It interleaves them smoothly: weights 5, 1, 1 give a a b a c a a, never five
+// a's in a row. Weights are read on every call, so runtime changes apply at once.
+type WeightedRoundRobin struct {
+	mu      sync.Mutex
+	current map[string]int
+}
+
+// NewWeightedRoundRobin creates a weighted round-robin Strategy. Servers that don't implement
+// Weighted have weight 1.
+func NewWeightedRoundRobin() *WeightedRoundRobin {
+	return &WeightedRoundRobin{current: make(map[string]int)}
+}
+
+// Next returns the server furthest behind its share
+func (w *WeightedRoundRobin) Next(servers []Server, req *http.Request) Server {
+	if len(servers) == 0 {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var best Server
+	total := 0
+	for _, s := range servers {
+		weight := max(WeightOf(s), 1)
+		total += weight
+		w.current[s.Address()] += weight
+		if best == nil || w.current[s.Address()] > w.current[best.Address()] {
+			best = s
+		}
+	}
+	if tracing(req) {
+		TraceDecision(req, "weighted-round-robin picks %s, furthest behind its share: %s", best.Address(), scores(servers, func(i int) float64 { return float64(w.current[servers[i].Address()]) }))
+	}
+	w.current[best.Address()] -= total
+	if len(w.current) > 2*len(servers) {
+		// forget servers that have left the pool
+		present := make(map[string]bool, len(servers))
+		for _, s := range servers {
+			present[s.Address()] = true
+		}
+		for addr := range w.current {
+			if !present[addr] {
+				delete(w.current, addr)
+			}
+		}
+	}
+	return best
+}
+
+// WeightedRandom picks servers at random in proportion to their weights. Deterministic
+// strategies walk the pool in the same order on every balancer instance that starts with the
+// same state, so a fleet of them can hit one backend at the same moment; independent random
+// picks don't line up that way.
+//
+// Weight changes are eased in rather than applied at once, since they tend to reach every
+// instance together, from discovery, capacity reports or Prometheus weights. Each server's
+// effective weight moves towards its weight over Smoothing, and Jitter spreads that time per
+// server and per instance, so the instances shift traffic at slightly different paces.
+type WeightedRandom struct {
+	// Smoothing is how long a weight change takes to mostly apply; zero applies it at once
+	Smoothing time.Duration
+	// Jitter is the fraction, from 0 to 1, by which Smoothing varies between servers and
+	// instances
+	Jitter float64
+
+	mu    sync.Mutex
+	state map[string]*weightedRandomState
+}
+
+type weightedRandomState struct {
+	weight  float64
+	updated time.Time
+	// smoothing is this server's jittered Smoothing
+	smoothing time.Duration
+}
+
+// NewWeightedRandom creates a weighted random Strategy that eases weight changes in over
+// smoothing, varied by up to jitter. Servers that don't implement Weighted have weight 1.
+func NewWeightedRandom(smoothing time.Duration, jitter float64) *WeightedRandom {
+	return &WeightedRandom{Smoothing: smoothing, Jitter: min(max(jitter, 0), 1), state: make(map[string]*weightedRandomState)}
+}
+
+// Next returns a server drawn at random by effective weight
+func (w *WeightedRandom) Next(servers []Server, req *http.Request) Server {
+	if len(servers) == 0 {
+		return nil
+	}
+	w.mu.Lock()
+	now := time.Now()
+	weights := make([]float64, len(servers))
+	total := 0.0
+	for i, s := range servers {
+		weights[i] = w.effectiveWeight(s, now)
+		total += weights[i]
+	}
+	if len(w.state) > 2*len(servers) {
+		// forget servers that have left the pool
+		present := make(map[string]bool, len(servers))
+		for _, s := range servers {
+			present[s.Address()] = true
+		}
+		for addr := range w.state {
+			if !present[addr] {
+				delete(w.state, addr)
+			}
+		}
+	}
+	w.mu.Unlock()
+	r := rand.Float64() * total
+	if tracing(req) {
+		TraceDecision(req, "weighted-random draws %.2f of %.2f over effective weights %s", r, total, scores(servers, func(i int) float64 { return weights[i] }))
+	}
+	for i, s := range servers {
+		if r -= weights[i]; r < 0 {
+			return s
+		}
+	}
+	return servers[len(servers)-1]
+}
+
+// effectiveWeight moves the eased weight of s towards its weight for the time since it was last
+// read. A server seen for the first time starts at its weight.
+func (w *WeightedRandom) effectiveWeight(s Server, now time.Time) float64 {
+	target := float64(max(WeightOf(s), 1))
+	st, ok := w.state[s.Address()]
+	if !ok {
+		smoothing := time.Duration(float64(w.Smoothing) * (1 + w.Jitter*(2*rand.Float64()-1)))
+		w.state[s.Address()] = &weightedRandomState{weight: target, updated: now, smoothing: smoothing}
+		return target
+	}
+	if st.smoothing <= 0 {
+		st.weight = target
+	} else {
+		// exponential approach: about 63% of a change applies within smoothing
+		st.weight += (target - st.weight) * (1 - math.Exp(-float64(now.Sub(st.updated))/float64(st.smoothing)))
+	}
+	st.updated = now
+	return st.weight
+}
+
+// Chain tries its strategies in order, moving to the next when one declines. When a picked
+// server turns out to be down, the chain is asked again without it, so a strategy only hands
+// over once it has nothing healthy left to offer.
+type Chain []Strategy
+
+// NewChain creates a Strategy that falls back through strategies in order
+func NewChain(strategies ...Strategy) Chain {
+	return Chain(strategies)
+}
+
+// Next returns the first server picked by any of the strategies
+func (c Chain) Next(servers []Server, req *http.Request) Server {
+	for _, s := range c {
+		if server := s.Next(servers, req); server != nil {
+			return server
+		}
+		TraceDecision(req, "%s declined", strategyName(s))
+	}
+	return nil
+}
+
+// ConsistentHash sends every request with the same key to the same server, and when servers
+// come or go only the keys of those servers move. The key is the Header value, or the Cookie
+// value when the header is absent; with neither configured it is the client's address.
+// Requests that carry no key are declined, so in a Chain they fall through to the next strategy.
+type ConsistentHash struct {
+	Header string
+	Cookie string
+}
+
+// Next returns the server key maps to, weighted by the servers' weights
+func (h ConsistentHash) Next(servers []Server, req *http.Request) Server {
+	key := h.key(req)
+	if key == "" {
+		TraceDecision(req, "consistent-hash found no key")
+		return nil
+	}
+	addr := hashPick(key, servers)
+	if tracing(req) {
+		TraceDecision(req, "consistent-hash maps key %q to %s", key, addr)
+	}
+	for _, s := range servers {
+		if s.Address() == addr {
+			return s
+		}
+	}
+	return nil
+}
+
+func (h ConsistentHash) key(req *http.Request) string {
+	if h.Header == "" && h.Cookie == "" {
+		return clientKey(clientIP(req))
+	}
+	if h.Header != "" {
+		if v := req.Header.Get(h.Header); v != "" {
+			return v
+		}
+	}
+	if h.Cookie != "" {
+		if c, err := req.Cookie(h.Cookie); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// scores lists each server with its score, to two decimals, for a decision trace
+func scores(servers []Server, score func(i int) float64) string {
+	parts := make([]string, len(servers))
+	for i, s := range servers {
+		parts[i] = s.Address() + "=" + strconv.FormatFloat(math.Round(score(i)*100)/100, 'f', -1, 64)
+	}
+	return strings.Join(parts, " ")
+}
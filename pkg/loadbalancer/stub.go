@@ -0,0 +1,123 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/router"
+)
+
+// Stub answers the requests it matches with a fixed response instead of proxying them, for
+// maintenance pages, well-known endpoints and testing. When several stubs match a request,
+// the most specific one applies.
+type Stub struct {
+	// Host and PathPrefix select the requests; empty values match everything
+	Host       string
+	PathPrefix string
+	// Status is the response status; default 200
+	Status int
+	Header http.Header
+	Body   string
+	// Template makes Body a text/template, executed with the request's Method, Host, Path,
+	// Query, Client, RequestID and Time, and a Header function looking up request headers
+	Template bool
+}
+
+// WithStubs answers matching requests with configured responses
+func WithStubs(stubs ...Stub) Option {
+	return func(lb *LoadBalancer) {
+		lb.stubs = append(lb.stubs, stubs...)
+	}
+}
+
+type compiledStub struct {
+	Stub
+	tmpl *template.Template
+}
+
+// stubData is what a stub template sees
+type stubData struct {
+	req       *http.Request
+	Method    string
+	Host      string
+	Path      string
+	Query     string
+	Client    string
+	RequestID string
+	Time      time.Time
+}
+
+// Header returns the first value of the named request header
+func (d stubData) Header(name string) string {
+	return d.req.Header.Get(name)
+}
+
+// stubMiddleware compiles the stubs into a route table and answers the matching requests
+func (lb *LoadBalancer) stubMiddleware(stubs []Stub) (Middleware, error) {
+	rules := make([]router.Rule[*compiledStub], len(stubs))
+	for i, s := range stubs {
+		if s.Status == 0 {
+			s.Status = http.StatusOK
+		}
+		if s.Status < 100 || s.Status > 599 {
+			return nil, fmt.Errorf("stub %s%s: invalid status %d", s.Host, s.PathPrefix, s.Status)
+		}
+		c := &compiledStub{Stub: s}
+		if s.Template {
+			tmpl, err := template.New(s.Host + s.PathPrefix).Parse(s.Body)
+			if err != nil {
+				return nil, fmt.Errorf("stub %s%s: %w", s.Host, s.PathPrefix, err)
+			}
+			c.tmpl = tmpl
+		}
+		rules[i] = router.Rule[*compiledStub]{Host: s.Host, PathPrefix: s.PathPrefix, Target: c}
+	}
+	table, err := router.Compile(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			stub, ok := table.Match(req.Host, req.URL.Path)
+			if !ok {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			body := []byte(stub.Body)
+			if stub.tmpl != nil {
+				var buf bytes.Buffer
+				err := stub.tmpl.Execute(&buf, stubData{
+					req:       req,
+					Method:    req.Method,
+					Host:      req.Host,
+					Path:      req.URL.Path,
+					Query:     req.URL.RawQuery,
+					Client:    clientIP(req),
+					RequestID: stateFrom(req.Context()).requestID,
+					Time:      time.Now().UTC(),
+				})
+				if err != nil {
+					lb.logger.Error("stub template failed", "stub", stub.Host+stub.PathPrefix, "error", err)
+					http.Error(rw, "stub template failed", http.StatusInternalServerError)
+					return
+				}
+				body = buf.Bytes()
+			}
+			h := rw.Header()
+			for k, v := range stub.Header {
+				h[k] = append([]string(nil), v...)
+			}
+			if h.Get("Content-Type") == "" {
+				h.Set("Content-Type", "text/plain; charset=utf-8")
+			}
+			h.Set("Content-Length", strconv.Itoa(len(body)))
+			rw.WriteHeader(stub.Status)
+			rw.Write(body)
+		})
+	}, nil
+}
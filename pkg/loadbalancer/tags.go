@@ -0,0 +1,75 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"os"
+)
+
+// Pool names as sent in X-LB-Pool
+const (
+	PoolDefault  = "default"
+	PoolCanary   = "canary"
+	PoolDark     = "dark"
+	PoolOverride = "override"
+	// PoolScheduled is the pool of a time rule that doesn't name its own
+	PoolScheduled = "scheduled"
+	// PoolFailover is the remote region of WithRegionFailover
+	PoolFailover = "failover"
+)
+
+// RequestTags adds headers to proxied requests saying how the balancer handled them, so backend
+// logs can be matched with balancer decisions. Values a client sent in these headers are replaced.
+type RequestTags struct {
+	// Instance identifies this balancer; default the host name
+	Instance string
+	// Route names the route a request belongs to; by default its first path segment, e.g. "/api"
+	Route func(*http.Request) string
+	// InstanceHeader, RouteHeader and PoolHeader name the headers; defaults X-LB-Instance,
+	// X-LB-Route and X-LB-Pool. "-" leaves a header out.
+	InstanceHeader string
+	RouteHeader    string
+	PoolHeader     string
+}
+
+// WithRequestTags tags proxied requests with the balancer instance, route and pool
+func WithRequestTags(t RequestTags) Option {
+	return func(lb *LoadBalancer) {
+		if t.Instance == "" {
+			t.Instance, _ = os.Hostname()
+		}
+		if t.Route == nil {
+			t.Route = firstPathSegment
+		}
+		if t.InstanceHeader == "" {
+			t.InstanceHeader = "X-LB-Instance"
+		}
+		if t.RouteHeader == "" {
+			t.RouteHeader = "X-LB-Route"
+		}
+		if t.PoolHeader == "" {
+			t.PoolHeader = "X-LB-Pool"
+		}
+		lb.tags = &t
+	}
+}
+
+// apply sets the tag headers on a request about to be proxied
+func (t *RequestTags) apply(req *http.Request, st *requestState) {
+	pool := st.poolName
+	if pool == "" {
+		pool = PoolDefault
+	}
+	route := st.route
+	if route == "" {
+		route = t.Route(req)
+	}
+	for header, value := range map[string]string{
+		t.InstanceHeader: t.Instance,
+		t.RouteHeader:    route,
+		t.PoolHeader:     pool,
+	} {
+		if header != "-" {
+			req.Header.Set(header, value)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/router"
+)
+
+// Tenant is one team's isolated slice of a shared deployment: its own balancer (pool,
+// strategy, counters, hooks), the hosts it answers for and its own limits and admin token.
+type Tenant struct {
+	Name string
+	// Hosts are the Host patterns routed to the tenant, e.g. "api.team-a.example" or "*.team-a.example"
+	Hosts    []string
+	Balancer *LoadBalancer
+	// MaxInFlight caps concurrent requests for the tenant so it can't starve the others; 0 means unlimited
+	MaxInFlight int64
+	// AdminToken is the bearer token that scopes admin access to this tenant alone
+	AdminToken string
+}
+
+// WithTenants puts tenants behind the balancer: requests for a tenant's hosts go to its balancer
+// once they pass the shared stages (ACL, abuse, rate limits, admission), and everything else
+// carries on to the balancer's own pool. The tenants' background work runs with the balancer's,
+// /metrics carries each tenant's metrics prefixed with its name, and the admin API serves
+// /tenants under the operator token set by WithAdminToken.
+func WithTenants(tenants ...Tenant) Option {
+	return func(lb *LoadBalancer) {
+		lb.tenantDefs = append(lb.tenantDefs, tenants...)
+	}
+}
+
+type tenantState struct {
+	Tenant
+	inFlight atomic.Int64
+	rejected atomic.Uint64
+}
+
+// TenantRouter sends each request to the tenant owning its Host
+type TenantRouter struct {
+	table   *router.Table[*tenantState]
+	tenants map[string]*tenantState
+	order   []string
+}
+
+// NewTenantRouter creates a router over tenants. Tenant names must be unique, every tenant needs
+// a balancer, and no host may belong to two tenants.
+func NewTenantRouter(tenants ...Tenant) (*TenantRouter, error) {
+	tr := &TenantRouter{tenants: make(map[string]*tenantState)}
+	owners := make(map[string]string)
+	var rules []router.Rule[*tenantState]
+	for _, t := range tenants {
+		if t.Name == "" || t.Balancer == nil {
+			return nil, errors.New("loadbalancer: tenant needs a name and a balancer")
+		}
+		if _, dup := tr.tenants[t.Name]; dup {
+			return nil, fmt.Errorf("loadbalancer: duplicate tenant %q", t.Name)
+		}
+		st := &tenantState{Tenant: t}
+		tr.tenants[t.Name] = st
+		tr.order = append(tr.order, t.Name)
+		for _, host := range t.Hosts {
+			key := strings.ToLower(host)
+			if owner, dup := owners[key]; dup {
+				return nil, fmt.Errorf("loadbalancer: host %q belongs to tenants %q and %q", host, owner, t.Name)
+			}
+			owners[key] = t.Name
+			rules = append(rules, router.Rule[*tenantState]{Host: host, Target: st})
+		}
+	}
+	table, err := router.Compile(rules)
+	if err != nil {
+		return nil, err
+	}
+	tr.table = table
+	return tr, nil
+}
+
+// Tenant returns the balancer of the named tenant
+func (tr *TenantRouter) Tenant(name string) (*LoadBalancer, bool) {
+	st, ok := tr.tenants[name]
+	if !ok {
+		return nil, false
+	}
+	return st.Balancer, true
+}
+
+// ServeHTTP dispatches to the tenant's balancer, enforcing its in-flight limit
+func (tr *TenantRouter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	st, ok := tr.table.Match(req.Host, "/")
+	if !ok {
+		http.Error(rw, "Unknown host", http.StatusMisdirectedRequest)
+		return
+	}
+	st.serve(rw, req)
+}
+
+// middleware is ServeHTTP for a balancer in front of the tenants, which serves the hosts no
+// tenant owns itself
+func (tr *TenantRouter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		st, ok := tr.table.Match(req.Host, "/")
+		if !ok {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		st.serve(rw, req)
+	})
+}
+
+func (st *tenantState) serve(rw http.ResponseWriter, req *http.Request) {
+	if n := st.inFlight.Add(1); st.MaxInFlight > 0 && n > st.MaxInFlight {
+		st.inFlight.Add(-1)
+		st.rejected.Add(1)
+		rw.Header().Set("Retry-After", "1")
+		http.Error(rw, "Tenant over capacity", http.StatusServiceUnavailable)
+		return
+	}
+	defer st.inFlight.Add(-1)
+	st.Balancer.ServeHTTP(rw, req)
+}
+
+// ready reports whether any tenant is ready, with the reasons of each when none is
+func (tr *TenantRouter) ready(ctx context.Context) error {
+	var errs []error
+	for _, name := range tr.order {
+		err := tr.tenants[name].Balancer.Ready(ctx)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("tenant %s: %w", name, err))
+	}
+	return errors.Join(errs...)
+}
+
+// serviceState is up when every tenant is, down when every tenant is, and degraded otherwise
+func (tr *TenantRouter) serviceState() ServiceState {
+	var up, down int
+	for _, name := range tr.order {
+		switch tr.tenants[name].Balancer.ServiceState() {
+		case ServiceUp:
+			up++
+		case ServiceDown:
+			down++
+		}
+	}
+	switch len(tr.order) {
+	case up:
+		return ServiceUp
+	case down:
+		return ServiceDown
+	}
+	return ServiceDegraded
+}
+
+// runAsTenant does for a tenant's balancer what Start does apart from serving, under ctx
+// rather than a context of its own, and returns once its background work has ended
+func (lb *LoadBalancer) runAsTenant(ctx context.Context) {
+	if len(lb.discoverers) > 0 {
+		if err := lb.Refresh(ctx); err != nil {
+			lb.logger.Warn("initial discovery failed", "error", err)
+		}
+	}
+	lb.life.mu.Lock()
+	lb.life.ctx = ctx
+	lb.startBackground()
+	lb.life.mu.Unlock()
+	<-ctx.Done()
+	lb.life.bg.Wait()
+}
+
+// writeMetrics adds each tenant's in-flight and rejected counts, then its balancer's own
+// metrics with the tenant's name in front of every metric name
+func (tr *TenantRouter) writeMetrics(w *bufio.Writer) {
+	writeMetricHeader(w, "lb_tenant_in_flight", "gauge", "Requests in flight per tenant.")
+	for _, name := range tr.order {
+		fmt.Fprintf(w, "lb_tenant_in_flight{tenant=%s} %d\n", labelValue(name), tr.tenants[name].inFlight.Load())
+	}
+	writeMetricHeader(w, "lb_tenant_rejected_total", "counter", "Requests refused by a tenant's in-flight limit.")
+	for _, name := range tr.order {
+		fmt.Fprintf(w, "lb_tenant_rejected_total{tenant=%s} %d\n", labelValue(name), tr.tenants[name].rejected.Load())
+	}
+	for _, name := range tr.order {
+		var buf bytes.Buffer
+		tw := bufio.NewWriter(&buf)
+		tr.tenants[name].Balancer.writeMetrics(tw)
+		tw.Flush()
+		prefix := metricNamespace(name) + "_"
+		for line := range strings.Lines(buf.String()) {
+			if rest, ok := strings.CutPrefix(line, "# HELP "); ok {
+				line = "# HELP " + prefix + rest
+			} else if rest, ok := strings.CutPrefix(line, "# TYPE "); ok {
+				line = "# TYPE " + prefix + rest
+			} else if line != "\n" && !strings.HasPrefix(line, "#") {
+				line = prefix + line
+			}
+			w.WriteString(line)
+		}
+	}
+}
+
+// metricNamespace turns a tenant name into a metric name prefix, replacing the characters
+// Prometheus doesn't allow in metric names with underscores
+func metricNamespace(name string) string {
+	ns := []byte(name)
+	for i, c := range ns {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			ns[i] = '_'
+		}
+	}
+	if ns[0] >= '0' && ns[0] <= '9' {
+		return "_" + string(ns)
+	}
+	return string(ns)
+}
+
+// TenantStats is the admin view of one tenant
+type TenantStats struct {
+	Name     string `json:"name"`
+	InFlight int64  `json:"in_flight"`
+	Rejected uint64 `json:"rejected"`
+	Requests uint64 `json:"requests"`
+	Bytes    uint64 `json:"bytes_written"`
+	Backends int    `json:"backends"`
+}
+
+func (st *tenantState) stats() TenantStats {
+	s := st.Balancer.Stats()
+	return TenantStats{
+		Name:     st.Name,
+		InFlight: st.inFlight.Load(),
+		Rejected: st.rejected.Load(),
+		Requests: s.Requests,
+		Bytes:    s.BytesWritten,
+		Backends: len(st.Balancer.Servers()),
+	}
+}
+
+// AdminHandler serves /tenants/{name}/... A request authenticated with a tenant's token can only
+// see that tenant; operatorToken, when set, grants access to every tenant and to GET /tenants.
+func (tr *TenantRouter) AdminHandler(operatorToken string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tenants", func(rw http.ResponseWriter, req *http.Request) {
+		if operatorToken == "" || !tokenMatches(req, operatorToken) {
+			http.Error(rw, "Forbidden", http.StatusForbidden)
+			return
+		}
+		out := make([]TenantStats, 0, len(tr.order))
+		for _, name := range tr.order {
+			out = append(out, tr.tenants[name].stats())
+		}
+		writeJSON(rw, out)
+	})
+	mux.HandleFunc("/tenants/{name}/", func(rw http.ResponseWriter, req *http.Request) {
+		st, ok := tr.tenants[req.PathValue("name")]
+		if !ok {
+			http.NotFound(rw, req)
+			return
+		}
+		if !(st.AdminToken != "" && tokenMatches(req, st.AdminToken)) &&
+			!(operatorToken != "" && tokenMatches(req, operatorToken)) {
+			http.Error(rw, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if strings.TrimPrefix(req.URL.Path, "/tenants/"+st.Name) == "/stats" {
+			writeJSON(rw, st.stats())
+			return
+		}
+		// everything else is the tenant balancer's own admin API
+		http.StripPrefix("/tenants/"+st.Name, st.Balancer.AdminHandler()).ServeHTTP(rw, req)
+	})
+	return mux
+}
+
+// tokenMatches checks the request's bearer token in constant time
+func tokenMatches(req *http.Request, token string) bool {
+	got, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// writeJSON encodes v as the response body
+func writeJSON(rw http.ResponseWriter, v any) {
+	rw.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,201 @@
+package loadbalancer_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/lbtest"
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/loadbalancer"
+)
+
+// answering starts a backend whose responses carry body
+func answering(t *testing.T, body string) *lbtest.Backend {
+	b := lbtest.StartBackends(t, 1)[0]
+	b.SetBehavior(lbtest.Behavior{Alive: true, Body: body})
+	return b
+}
+
+// newTenant builds the balancer of a tenant sending its traffic to backend
+func newTenant(t *testing.T, name string, hosts []string, backend *lbtest.Backend) loadbalancer.Tenant {
+	lb, err := loadbalancer.New(loadbalancer.WithName(name), loadbalancer.WithBackends(backend.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loadbalancer.Tenant{Name: name, Hosts: hosts, Balancer: lb, AdminToken: name + "-token"}
+}
+
+// newFront builds a balancer serving front's backend and the tenants, with the admin token "op"
+func newFront(t *testing.T, front *lbtest.Backend, tenants ...loadbalancer.Tenant) *loadbalancer.LoadBalancer {
+	lb, err := loadbalancer.New(
+		loadbalancer.WithBackends(front.URL),
+		loadbalancer.WithAdminToken("op"),
+		loadbalancer.WithTenants(tenants...),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lb
+}
+
+func get(h http.Handler, host, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	req.Host = host
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestTenantDispatch(t *testing.T) {
+	lb := newFront(t, answering(t, "front"),
+		newTenant(t, "team-a", []string{"a.example", "*.a.example"}, answering(t, "team-a")),
+		newTenant(t, "team-b", []string{"b.example"}, answering(t, "team-b")),
+	)
+	for _, tt := range []struct{ host, want string }{
+		{"a.example", "team-a"},
+		{"api.a.example:8080", "team-a"},
+		{"B.example", "team-b"},
+		{"c.example", "front"},
+		{"", "front"},
+	} {
+		if got := get(lb, tt.host, "/", "").Body.String(); got != tt.want {
+			t.Errorf("host %q: answered by %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestTenantRouterUnknownHost(t *testing.T) {
+	tr, err := loadbalancer.NewTenantRouter(newTenant(t, "team-a", []string{"a.example"}, answering(t, "team-a")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(tr, "a.example", "/", ""); rec.Body.String() != "team-a" {
+		t.Errorf("a.example: %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := get(tr, "other.example", "/", ""); rec.Code != http.StatusMisdirectedRequest {
+		t.Errorf("other.example: status %d, want 421", rec.Code)
+	}
+}
+
+func TestTenantRouterRejectsDuplicates(t *testing.T) {
+	backend := answering(t, "x")
+	tests := []struct {
+		name    string
+		tenants []loadbalancer.Tenant
+	}{
+		{"name", []loadbalancer.Tenant{
+			newTenant(t, "team-a", []string{"a.example"}, backend),
+			newTenant(t, "team-a", []string{"b.example"}, backend),
+		}},
+		{"host", []loadbalancer.Tenant{
+			newTenant(t, "team-a", []string{"shared.example"}, backend),
+			newTenant(t, "team-b", []string{"SHARED.example"}, backend),
+		}},
+		{"balancer", []loadbalancer.Tenant{{Name: "team-a", Hosts: []string{"a.example"}}}},
+	}
+	for _, tt := range tests {
+		if _, err := loadbalancer.NewTenantRouter(tt.tenants...); err == nil {
+			t.Errorf("duplicate %s accepted", tt.name)
+		}
+	}
+}
+
+func TestTenantMaxInFlight(t *testing.T) {
+	backend := answering(t, "team-a")
+	tenant := newTenant(t, "team-a", []string{"a.example"}, backend)
+	tenant.MaxInFlight = 1
+	lb := newFront(t, answering(t, "front"), tenant)
+
+	backend.SetBehavior(lbtest.Behavior{Alive: true, Body: "slow", Latency: 200 * time.Millisecond})
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- get(lb, "a.example", "/", "") }()
+	inFlight := `lb_tenant_in_flight{tenant="team-a"} 1`
+	for deadline := time.Now().Add(time.Second); !strings.Contains(get(lb.AdminHandler(), "", "/metrics", "").Body.String(), inFlight); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the first request never started")
+		}
+	}
+
+	rec := get(lb, "a.example", "/", "")
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("request over the limit: status %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := get(lb, "b.example", "/", ""); rec.Body.String() != "front" {
+		t.Errorf("other hosts were held back by the tenant's limit: %d %q", rec.Code, rec.Body.String())
+	}
+	if first := <-done; first.Body.String() != "slow" {
+		t.Errorf("first request: %d %q", first.Code, first.Body.String())
+	}
+	backend.SetBehavior(lbtest.Healthy)
+	if rec := get(lb, "a.example", "/", ""); rec.Code != http.StatusOK {
+		t.Errorf("request after the first finished: status %d", rec.Code)
+	}
+
+	metrics := get(lb.AdminHandler(), "", "/metrics", "").Body.String()
+	if !strings.Contains(metrics, `lb_tenant_rejected_total{tenant="team-a"} 1`) {
+		t.Errorf("rejection not counted:\n%s", metrics)
+	}
+}
+
+func TestTenantAdminScope(t *testing.T) {
+	lb := newFront(t, answering(t, "front"),
+		newTenant(t, "team-a", []string{"a.example"}, answering(t, "team-a")),
+		newTenant(t, "team-b", []string{"b.example"}, answering(t, "team-b")),
+	)
+	admin := lb.AdminHandler()
+	tests := []struct {
+		path, token string
+		want        int
+	}{
+		{"/tenants", "", http.StatusForbidden},
+		{"/tenants", "team-a-token", http.StatusForbidden},
+		{"/tenants", "op", http.StatusOK},
+		{"/tenants/team-a/stats", "", http.StatusForbidden},
+		{"/tenants/team-a/stats", "team-a-token", http.StatusOK},
+		{"/tenants/team-a/stats", "team-b-token", http.StatusForbidden},
+		{"/tenants/team-a/stats", "op", http.StatusOK},
+		{"/tenants/team-a/backends", "team-a-token", http.StatusOK},
+		{"/tenants/team-a/debug/state", "team-a-token", http.StatusOK},
+		{"/tenants/team-a/debug/state", "team-b-token", http.StatusForbidden},
+		{"/tenants/team-b/debug/state", "op", http.StatusOK},
+		{"/tenants/team-c/stats", "op", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if rec := get(admin, "", tt.path, tt.token); rec.Code != tt.want {
+			t.Errorf("GET %s with %q: status %d, want %d", tt.path, tt.token, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestTenantMetricPrefixes(t *testing.T) {
+	lb := newFront(t, answering(t, "front"),
+		newTenant(t, "team-a", []string{"a.example"}, answering(t, "team-a")),
+		newTenant(t, "1st.team", []string{"first.example"}, answering(t, "first")),
+	)
+	get(lb, "a.example", "/", "")
+	get(lb, "a.example", "/", "")
+	get(lb, "first.example", "/", "")
+
+	metrics := get(lb.AdminHandler(), "", "/metrics", "").Body.String()
+	for _, want := range []string{
+		"\nlb_requests_total 3\n",
+		"# HELP team_a_lb_requests_total ",
+		"# TYPE team_a_lb_requests_total counter\n",
+		"\nteam_a_lb_requests_total 2\n",
+		"\n_1st_team_lb_requests_total 1\n",
+		`lb_tenant_in_flight{tenant="team-a"} 0`,
+		`lb_tenant_rejected_total{tenant="1st.team"} 0`,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("/metrics lacks %q", want)
+		}
+	}
+	if n := strings.Count(metrics, "# TYPE lb_requests_total "); n != 1 {
+		t.Errorf("lb_requests_total declared %d times; a tenant's metrics lack their prefix", n)
+	}
+}
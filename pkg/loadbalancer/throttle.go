@@ -0,0 +1,189 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BandwidthLimit caps the rate at which response bodies are sent to each client
+type BandwidthLimit struct {
+	// BytesPerSecond is the sustained rate allowed per client
+	BytesPerSecond int64
+	// Burst is how many bytes a client may receive at full speed after being idle; defaults to BytesPerSecond
+	Burst int64
+	// Header, when set, names a request header (e.g. an API key) identifying the client;
+	// requests without it are keyed by client IP (IPv6 clients by their /64)
+	Header string
+}
+
+// WithBandwidthLimit throttles responses per client with a token bucket, so one downloader
+// can't saturate the uplink shared by everyone. Concurrent requests of a client share its rate.
+func WithBandwidthLimit(limit BandwidthLimit) Option {
+	return func(lb *LoadBalancer) {
+		lb.bandwidth = limit
+	}
+}
+
+// RouteBandwidthLimit caps the rate at which the responses of a route are sent, all clients and
+// requests together, so bulk transfers such as large downloads can't starve the
+// latency-sensitive routes sharing the uplink. Limits are checked in order and the first one
+// matching the request applies; it stacks with a per-client BandwidthLimit.
+type RouteBandwidthLimit struct {
+	// Host and PathPrefix select the requests the limit applies to; empty values match everything
+	Host       string
+	PathPrefix string
+	// BytesPerSecond is the sustained rate allowed for the route
+	BytesPerSecond int64
+	// Burst is how many bytes the route may send at full speed after being idle; defaults to
+	// BytesPerSecond
+	Burst int64
+}
+
+// WithRouteBandwidthLimits throttles the responses of matching routes as a whole
+func WithRouteBandwidthLimits(limits ...RouteBandwidthLimit) Option {
+	return func(lb *LoadBalancer) {
+		lb.routeRates = append(lb.routeRates, limits...)
+	}
+}
+
+// bucketIdle is how long a full bucket is kept after its client's last write
+const bucketIdle = time.Minute
+
+type throttle struct {
+	limit BandwidthLimit
+	lb    *LoadBalancer
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newThrottle(lb *LoadBalancer, limit BandwidthLimit) *throttle {
+	if limit.Burst <= 0 {
+		limit.Burst = limit.BytesPerSecond
+	}
+	return &throttle{limit: limit, lb: lb, buckets: make(map[string]*bucket), lastSweep: time.Now()}
+}
+
+func (t *throttle) key(req *http.Request) string {
+	if t.limit.Header != "" {
+		if v := req.Header.Get(t.limit.Header); v != "" {
+			return "h:" + v
+		}
+	}
+	return "id:" + t.lb.clientID(req)
+}
+
+// reserve takes n bytes from key's bucket and returns how long to wait before sending them.
+// The bucket may go into debt, which queues concurrent writers fairly.
+func (t *throttle) reserve(key string, n int) time.Duration {
+	rate := float64(t.limit.BytesPerSecond)
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, ok := t.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(t.limit.Burst), last: now}
+		t.buckets[key] = b
+	}
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*rate, float64(t.limit.Burst))
+	b.last = now
+	b.tokens -= float64(n)
+
+	if now.Sub(t.lastSweep) > bucketIdle {
+		t.lastSweep = now
+		for k, other := range t.buckets {
+			if now.Sub(other.last) > bucketIdle {
+				delete(t.buckets, k)
+			}
+		}
+	}
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+func (t *throttle) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(&throttledWriter{ResponseWriter: rw, t: t, key: t.key(req), req: req}, req)
+	})
+}
+
+// throttledWriter paces body writes against the client's bucket
+type throttledWriter struct {
+	http.ResponseWriter
+	t   *throttle
+	key string
+	req *http.Request
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// writing in burst-sized chunks keeps the stream smooth rather than bursty
+		chunk := p[:min(int64(len(p)), w.t.limit.Burst)]
+		if wait := w.t.reserve(w.key, len(chunk)); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-w.req.Context().Done():
+				timer.Stop()
+				return written, w.req.Context().Err()
+			}
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// routeThrottle is a RouteBandwidthLimit with the bucket its route shares
+type routeThrottle struct {
+	RouteBandwidthLimit
+	t *throttle
+}
+
+// routeThrottleMiddleware paces the responses of each route with a limit against the route's
+// single bucket
+func (lb *LoadBalancer) routeThrottleMiddleware(limits []RouteBandwidthLimit) (Middleware, error) {
+	throttles := make([]routeThrottle, len(limits))
+	for i, l := range limits {
+		if l.BytesPerSecond <= 0 {
+			return nil, fmt.Errorf("route bandwidth limit %d: want a positive rate", i)
+		}
+		throttles[i] = routeThrottle{RouteBandwidthLimit: l, t: newThrottle(lb, BandwidthLimit{BytesPerSecond: l.BytesPerSecond, Burst: l.Burst})}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			for i := range throttles {
+				r := &throttles[i]
+				if r.Host != "" && !strings.EqualFold(r.Host, requestHost(req)) {
+					continue
+				}
+				if strings.HasPrefix(req.URL.Path, r.PathPrefix) {
+					rw = &throttledWriter{ResponseWriter: rw, t: r.t, key: "route", req: req}
+					break
+				}
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}, nil
+}
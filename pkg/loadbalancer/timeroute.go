@@ -0,0 +1,107 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/router"
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/schedule"
+)
+
+// TimeRule changes where requests go while a recurring time window is open, e.g. sending
+// after-hours traffic to a cheaper set of backends or answering with a "closed" page.
+// Of the rules matching a request, only those with the most specific Host and PathPrefix are
+// considered, and the first of them whose window is open applies.
+type TimeRule struct {
+	// Host and PathPrefix select the requests; empty values match everything. Host may be a
+	// "*.example.com" wildcard.
+	Host       string
+	PathPrefix string
+	// Schedule is a cron specification of when the window opens and Duration how long it stays open
+	Schedule string
+	Duration time.Duration
+	// Location is the time zone the schedule is read in; default UTC
+	Location *time.Location
+	// Backends restricts matching requests to these backend addresses while the window is open
+	Backends []string
+	// Pool names those backends in X-LB-Pool; default "scheduled"
+	Pool string
+	// Status, when set, answers matching requests directly with Body instead of proxying them
+	Status      int
+	Body        string
+	ContentType string
+}
+
+// WithTimeRules adds time-of-day routing rules
+func WithTimeRules(rules ...TimeRule) Option {
+	return func(lb *LoadBalancer) {
+		lb.timeRules = append(lb.timeRules, rules...)
+	}
+}
+
+type compiledTimeRule struct {
+	TimeRule
+	window *schedule.Window
+}
+
+// compileTimeRules groups the rules by route, keeping their order within each
+func compileTimeRules(rules []TimeRule) (*router.Table[[]*compiledTimeRule], error) {
+	type route struct{ host, prefix string }
+	var routes []route
+	groups := make(map[route][]*compiledTimeRule)
+	for _, r := range rules {
+		if r.Status == 0 && len(r.Backends) == 0 {
+			return nil, fmt.Errorf("time rule %q: needs Backends or Status", r.Schedule)
+		}
+		if r.Status != 0 && (r.Status < 100 || r.Status > 599) {
+			return nil, fmt.Errorf("time rule %q: invalid status %d", r.Schedule, r.Status)
+		}
+		w, err := schedule.NewWindow(r.Schedule, r.Duration, r.Location)
+		if err != nil {
+			return nil, fmt.Errorf("time rule %q: %w", r.Schedule, err)
+		}
+		key := route{strings.ToLower(r.Host), r.PathPrefix}
+		if _, ok := groups[key]; !ok {
+			routes = append(routes, key)
+		}
+		groups[key] = append(groups[key], &compiledTimeRule{TimeRule: r, window: w})
+	}
+	table := make([]router.Rule[[]*compiledTimeRule], len(routes))
+	for i, key := range routes {
+		table[i] = router.Rule[[]*compiledTimeRule]{Host: key.host, PathPrefix: key.prefix, Target: groups[key]}
+	}
+	return router.Compile(table)
+}
+
+func timeMiddleware(rules *router.Table[[]*compiledTimeRule]) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			matched, _ := rules.Match(req.Host, req.URL.Path)
+			now := time.Now()
+			for _, r := range matched {
+				if !r.window.Open(now) {
+					continue
+				}
+				if r.Status != 0 {
+					contentType := r.ContentType
+					if contentType == "" {
+						contentType = "text/plain; charset=utf-8"
+					}
+					rw.Header().Set("Content-Type", contentType)
+					rw.WriteHeader(r.Status)
+					fmt.Fprint(rw, r.Body)
+					return
+				}
+				st := stateFrom(req.Context())
+				st.allowed, st.poolName = r.Backends, r.Pool
+				if st.poolName == "" {
+					st.poolName = PoolScheduled
+				}
+				break
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package loadbalancer_test
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/loadbalancer"
+)
+
+func TestTimeRulesMostSpecific(t *testing.T) {
+	always := func(r loadbalancer.TimeRule) loadbalancer.TimeRule {
+		r.Schedule, r.Duration = "* * * * *", 2*time.Minute
+		return r
+	}
+	lb, err := loadbalancer.New(
+		loadbalancer.WithBackends("http://127.0.0.1:1"),
+		loadbalancer.WithTimeRules(
+			always(loadbalancer.TimeRule{PathPrefix: "/", Status: 503, Body: "closed"}),
+			always(loadbalancer.TimeRule{PathPrefix: "/status", Status: 200, Body: "status"}),
+			// open only in the first minute of the year
+			loadbalancer.TimeRule{Host: "*.example.com", Schedule: "0 0 1 1 *", Duration: time.Minute, Status: 503, Body: "new year"},
+			always(loadbalancer.TimeRule{Host: "*.example.com", Status: 200, Body: "sub"}),
+		),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct{ host, path, want string }{
+		{"other.org", "/", "closed"},
+		{"other.org", "/status/live", "status"},
+		{"a.example.com:8080", "/status", "sub"},
+	} {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Host = tt.host
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		if got := rec.Body.String(); got != tt.want {
+			t.Errorf("%s%s: answered %q, want %q", tt.host, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestTiming follows one request through the balancer and its upstream connection. The
+// trace callbacks may run on the transport's dialing goroutines, hence the lock.
+type requestTiming struct {
+	mu sync.Mutex
+	// proxied is when the request came through the middleware to the proxy, selected when
+	// its first backend was chosen
+	proxied, selected time.Time
+	// sent is when the first attempt went to a backend, attempt when the latest one did
+	sent, attempt time.Time
+	connStart     time.Time
+	tlsStart      time.Time
+	dial, tls     time.Duration
+	firstByte     time.Time
+	done          time.Time
+}
+
+// timingBreakdown splits a request's time into where it went
+type timingBreakdown struct {
+	// Queue is the time from arrival until the first attempt was sent to a backend
+	Queue time.Duration
+	// Dial and TLS are the time spent opening upstream connections, over every attempt
+	Dial time.Duration
+	TLS  time.Duration
+	// TTFB is the time from sending the last attempt until its first response byte
+	TTFB time.Duration
+	// Transfer is the time from the first response byte until the response was relayed
+	Transfer time.Duration
+}
+
+// traceTiming attaches a requestTiming to the request and returns it with a client trace
+// feeding it; a request that is already traced is returned as is
+func traceTiming(req *http.Request, st *requestState) *http.Request {
+	if st.timing != nil {
+		return req
+	}
+	t := &requestTiming{}
+	st.timing = t
+	trace := &httptrace.ClientTrace{
+		ConnectStart: func(string, string) {
+			t.mu.Lock()
+			t.connStart = time.Now()
+			t.mu.Unlock()
+		},
+		ConnectDone: func(string, string, error) {
+			t.mu.Lock()
+			if !t.connStart.IsZero() {
+				t.dial += time.Since(t.connStart)
+				t.connStart = time.Time{}
+			}
+			t.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			t.tlsStart = time.Now()
+			t.mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			if !t.tlsStart.IsZero() {
+				t.tls += time.Since(t.tlsStart)
+				t.tlsStart = time.Time{}
+			}
+			t.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			t.firstByte = time.Now()
+			t.mu.Unlock()
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// reachedProxy marks the request leaving the middleware chain
+func (t *requestTiming) reachedProxy(now time.Time) {
+	t.mu.Lock()
+	t.proxied = now
+	t.mu.Unlock()
+}
+
+// chose marks a backend being selected; only the first selection counts
+func (t *requestTiming) chose(now time.Time) {
+	t.mu.Lock()
+	if t.selected.IsZero() {
+		t.selected = now
+	}
+	t.mu.Unlock()
+}
+
+// serverTiming renders the phases known once the backend's response headers are in, for the
+// Server-Timing header, in milliseconds: lb-route (arrival until the proxy, route matching and
+// the other middleware included), lb-select (choosing a backend), lb-connect (dialing and TLS)
+// and lb-ttfb (waiting for the backend's first byte)
+func (t *requestTiming) serverTiming(start time.Time) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ms := func(d time.Duration) string { return fmt.Sprintf("%.1f", float64(d)/float64(time.Millisecond)) }
+	var route, selection, ttfb time.Duration
+	if !t.proxied.IsZero() {
+		route = t.proxied.Sub(start)
+		if !t.selected.IsZero() {
+			selection = t.selected.Sub(t.proxied)
+		}
+	}
+	if !t.firstByte.IsZero() {
+		ttfb = t.firstByte.Sub(t.attempt)
+	}
+	return "lb-route;dur=" + ms(route) + ", lb-select;dur=" + ms(selection) +
+		", lb-connect;dur=" + ms(t.dial+t.tls) + ", lb-ttfb;dur=" + ms(ttfb)
+}
+
+// stripServerTiming removes the Server-Timing values the balancer added to h, keeping the backend's
+func stripServerTiming(h http.Header) {
+	values := h.Values("Server-Timing")
+	kept := slices.DeleteFunc(slices.Clone(values), func(v string) bool { return strings.HasPrefix(v, "lb-route;") })
+	if len(kept) == len(values) {
+		return
+	}
+	h.Del("Server-Timing")
+	for _, v := range kept {
+		h.Add("Server-Timing", v)
+	}
+}
+
+// begin marks an attempt being sent to a backend
+func (t *requestTiming) begin(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sent.IsZero() {
+		t.sent = now
+	}
+	t.attempt, t.firstByte = now, time.Time{}
+}
+
+// end marks an attempt's response as relayed
+func (t *requestTiming) end(now time.Time) {
+	t.mu.Lock()
+	t.done = now
+	t.mu.Unlock()
+}
+
+// breakdown splits the time since start, the request's arrival; stages that didn't happen,
+// such as the upstream ones of a request answered by the balancer itself, are zero
+func (t *requestTiming) breakdown(start time.Time) timingBreakdown {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var b timingBreakdown
+	if t.sent.IsZero() {
+		b.Queue = time.Since(start)
+		return b
+	}
+	b.Queue = t.sent.Sub(start)
+	b.Dial, b.TLS = t.dial, t.tls
+	if !t.firstByte.IsZero() {
+		b.TTFB = t.firstByte.Sub(t.attempt)
+		if !t.done.IsZero() {
+			b.Transfer = t.done.Sub(t.firstByte)
+		}
+	}
+	return b
+}
+
+// WithServerTiming adds a Server-Timing header to proxied responses, so browser developer
+// tools show where the balancer's share of the latency went. The phases, in milliseconds, are
+// lb-route, lb-select, lb-connect and lb-ttfb. A Server-Timing header from the backend is kept.
+func WithServerTiming() Option {
+	return func(lb *LoadBalancer) {
+		lb.serverTiming = true
+	}
+}
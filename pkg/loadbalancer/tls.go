@@ -0,0 +1,233 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WithTLSConfig terminates TLS on the balancer's listener with cfg. HTTP/2 is offered
+// through ALPN unless cfg sets its own NextProtos. It takes precedence over
+// WithCertificateFiles and WithAutoCert.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(lb *LoadBalancer) {
+		lb.tlsConfig = cfg
+	}
+}
+
+// WithCertificateFiles terminates TLS with the PEM certificate chain and key in the given files.
+// New fails if they can't be loaded. The files are watched, so a renewed certificate is picked
+// up by new handshakes without a restart.
+func WithCertificateFiles(certFile, keyFile string) Option {
+	return func(lb *LoadBalancer) {
+		lb.certFiles = &certFiles{certFile: certFile, keyFile: keyFile}
+	}
+}
+
+// certCheckInterval is how often handshakes look for a renewed certificate file
+const certCheckInterval = 10 * time.Second
+
+// certFiles serves a certificate from disk, reloading it when the files change
+type certFiles struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// load reads the key pair if either file changed since it was last read
+func (c *certFiles) load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checked = time.Now()
+	modTime := time.Time{}
+	for _, path := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	if c.cert != nil && modTime.Equal(c.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("loadbalancer: TLS certificate: %w", err)
+	}
+	c.cert, c.modTime = &cert, modTime
+	return nil
+}
+
+// getCertificate returns the current certificate, keeping the last good one when a reload fails
+func (c *certFiles) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	due := time.Since(c.checked) >= certCheckInterval
+	c.mu.Unlock()
+	if due {
+		// a half-written renewal fails to parse; the next check picks it up
+		c.load()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, nil
+}
+
+// WithHTTPRedirect listens on port for plain HTTP and redirects every request to the same
+// URL over HTTPS on the balancer's port. With WithAutoCert it also answers the ACME HTTP-01
+// challenges there.
+func WithHTTPRedirect(port string) Option {
+	return func(lb *LoadBalancer) {
+		lb.redirectPort = port
+	}
+}
+
+// redirectHandler sends clients to the HTTPS version of the URL they asked for
+func (lb *LoadBalancer) redirectHandler() http.Handler {
+	redirect := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if _, port, _ := net.SplitHostPort(listenAddr(lb.port)); port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		target := "https://" + host + req.URL.RequestURI()
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			http.Redirect(rw, req, target, http.StatusMovedPermanently)
+			return
+		}
+		// keep the method and body of anything else
+		http.Redirect(rw, req, target, http.StatusPermanentRedirect)
+	})
+	if lb.autocert != nil {
+		return lb.autocert.HTTPHandler(redirect)
+	}
+	return redirect
+}
+
+// SessionTickets controls the keys TLS session tickets are encrypted with. Returning clients
+// present a ticket to resume their session without a full handshake.
+//
+// Keys are derived from Secret and the current rotation period, so every instance sharing
+// the secret issues and accepts the same tickets without coordinating, and a client can resume
+// on any of them. Without a secret each instance uses its own random one.
+type SessionTickets struct {
+	// Secret is shared by the instances that should accept each other's tickets
+	Secret string
+	// Rotation is how often a new key starts encrypting tickets; default 1h
+	Rotation time.Duration
+	// Keep is how many earlier keys still decrypt tickets, bounding a ticket's usable
+	// lifetime to about Keep rotations; default 24
+	Keep int
+}
+
+// WithSessionTickets rotates TLS session ticket keys as configured. Without it, crypto/tls
+// still issues tickets and rotates its own per-process keys daily.
+func WithSessionTickets(t SessionTickets) Option {
+	return func(lb *LoadBalancer) {
+		if t.Rotation <= 0 {
+			t.Rotation = time.Hour
+		}
+		if t.Keep <= 0 {
+			t.Keep = 24
+		}
+		if t.Secret == "" {
+			secret := make([]byte, 32)
+			rand.Read(secret)
+			t.Secret = string(secret)
+		}
+		lb.tickets = &t
+	}
+}
+
+// serverTLSConfig returns the TLS configuration for the listener, or nil for plain HTTP
+func (lb *LoadBalancer) serverTLSConfig() *tls.Config {
+	var cfg *tls.Config
+	switch {
+	case lb.tlsConfig != nil:
+		cfg = lb.tlsConfig.Clone()
+	case lb.autocert != nil:
+		cfg = lb.autocert.TLSConfig()
+	case lb.dnsCert != nil:
+		cfg = &tls.Config{GetCertificate: lb.dnsCert.getCertificate}
+	case lb.certFiles != nil:
+		cfg = &tls.Config{GetCertificate: lb.certFiles.getCertificate}
+	default:
+		return nil
+	}
+	if len(cfg.NextProtos) == 0 {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+	fingerprintHellos(cfg)
+	return cfg
+}
+
+// listenTLS wraps ln with cfg and keeps the ticket keys rotating until ctx is done. The rotation
+// belongs to the listener, so it outlives a Handoff along with it.
+func (lb *LoadBalancer) listenTLS(ctx context.Context, ln net.Listener, cfg *tls.Config) net.Listener {
+	lb.keepTicketKeys(ctx, cfg)
+	return tls.NewListener(ln, cfg)
+}
+
+// keepTicketKeys sets cfg's ticket keys and keeps them rotating until ctx is done
+func (lb *LoadBalancer) keepTicketKeys(ctx context.Context, cfg *tls.Config) {
+	if lb.tickets != nil {
+		cfg.SetSessionTicketKeys(lb.tickets.keys(time.Now()))
+		go lb.rotateTicketKeys(ctx, cfg)
+	}
+}
+
+func (lb *LoadBalancer) rotateTicketKeys(ctx context.Context, cfg *tls.Config) {
+	for {
+		now := time.Now()
+		next := now.Truncate(lb.tickets.Rotation).Add(lb.tickets.Rotation)
+		t := time.NewTimer(next.Sub(now))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+			cfg.SetSessionTicketKeys(lb.tickets.keys(time.Now()))
+			lb.logger.Debug("rotated TLS session ticket key")
+		}
+	}
+}
+
+// keys returns the ticket keys valid at now: the current period's first, since it encrypts
+// new tickets, then the ones before it
+func (t *SessionTickets) keys(now time.Time) [][32]byte {
+	period := now.UnixNano() / int64(t.Rotation)
+	keys := make([][32]byte, 0, t.Keep+1)
+	for i := range int64(t.Keep + 1) {
+		keys = append(keys, t.key(period-i))
+	}
+	return slices.Clip(keys)
+}
+
+func (t *SessionTickets) key(period int64) [32]byte {
+	mac := hmac.New(sha256.New, []byte(t.Secret))
+	mac.Write([]byte("session-ticket"))
+	binary.Write(mac, binary.BigEndian, period)
+	var k [32]byte
+	copy(k[:], mac.Sum(nil))
+	return k
+}
@@ -0,0 +1,422 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/metrics"
+)
+
+// Modes of a TransparentProxy, telling how it learns where a connection was headed
+const (
+	// L4Redirect takes connections sent to it by an iptables REDIRECT or DNAT rule and reads
+	// their original destination from the connection tracker (SO_ORIGINAL_DST). Linux only.
+	L4Redirect = "redirect"
+	// L4TProxy takes connections sent to it by an iptables TPROXY rule, which keeps their
+	// original destination as the local address. Linux only, and needs CAP_NET_ADMIN.
+	L4TProxy = "tproxy"
+	// L4SOCKS5 takes SOCKS5 clients, without authentication, and their CONNECT requests
+	L4SOCKS5 = "socks5"
+)
+
+// TransparentProxy balances TCP connections at layer 4 on a port of its own, for a balancer
+// inserted into the path by the network rather than addressed by clients. Each connection goes
+// to the pool configured for the destination it was headed to, tried in turn from the one after
+// the previous connection's backend until one accepts, and bytes are copied both ways untouched.
+//
+// In tproxy mode the balancer can also connect to the backends from the client's own address,
+// so backends see the real client; their replies must then be routed back through the
+// balancer's host, usually by a policy route on the backends or their gateway.
+type TransparentProxy struct {
+	// Port is the port, or host:port, to listen on
+	Port string
+	// Mode is L4Redirect, L4TProxy or L4SOCKS5
+	Mode string
+	// Pools maps an original destination, as ip:port, or :port for any address on that port,
+	// to the TCP backends, as host:port, that take its connections. SOCKS5 clients asking for
+	// a host name are matched by name:port.
+	Pools map[string][]string
+	// Passthrough connects connections whose destination has no pool to that destination
+	// itself, rather than closing them. With redirect rules, it needs them to leave the
+	// balancer's own connections alone, as PREROUTING rules do.
+	Passthrough bool
+	// PreserveClientIP connects to backends from the client's address; tproxy mode only
+	PreserveClientIP bool
+	// DialTimeout bounds connecting to a backend; default 5s
+	DialTimeout time.Duration
+}
+
+// WithTransparentProxy balances TCP connections by their original destination on a listener
+// of their own, beside the HTTP one
+func WithTransparentProxy(t TransparentProxy) Option {
+	return func(lb *LoadBalancer) {
+		if t.DialTimeout <= 0 {
+			t.DialTimeout = 5 * time.Second
+		}
+		lb.transparent = &transparentProxy{TransparentProxy: t}
+	}
+}
+
+// transparentProxy is a TransparentProxy with its pools keyed by canonical destination
+type transparentProxy struct {
+	TransparentProxy
+	pools map[string][]string
+}
+
+var errTransparentUnsupported = errors.New("transparent proxy: redirect and tproxy modes need Linux")
+
+func (t *transparentProxy) validate() error {
+	switch t.Mode {
+	case L4Redirect, L4TProxy:
+		if !transparentSupported {
+			return errTransparentUnsupported
+		}
+	case L4SOCKS5:
+	default:
+		return fmt.Errorf("transparent proxy: unknown mode %q, want redirect, tproxy or socks5", t.Mode)
+	}
+	if t.Port == "" {
+		return errors.New("transparent proxy: no port")
+	}
+	if t.PreserveClientIP && t.Mode != L4TProxy {
+		return errors.New("transparent proxy: preserving client addresses needs tproxy mode")
+	}
+	if len(t.Pools) == 0 && !t.Passthrough {
+		return errors.New("transparent proxy: no pools")
+	}
+	t.pools = make(map[string][]string, len(t.Pools))
+	for dest, backends := range t.Pools {
+		host, port, err := net.SplitHostPort(dest)
+		if err != nil {
+			return fmt.Errorf("transparent proxy: destination %q: %w", dest, err)
+		}
+		if len(backends) == 0 {
+			return fmt.Errorf("transparent proxy: destination %q has no backends", dest)
+		}
+		for _, b := range backends {
+			if _, _, err := net.SplitHostPort(b); err != nil {
+				return fmt.Errorf("transparent proxy: backend %q: %w", b, err)
+			}
+		}
+		t.pools[destKey(host, port)] = backends
+	}
+	return nil
+}
+
+// destKey is the canonical form of a destination, so 10.0.0.1 reached on a dual-stack socket
+// as ::ffff:10.0.0.1 finds its pool
+func destKey(host, port string) string {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		host = addr.Unmap().WithZone("").String()
+	}
+	return net.JoinHostPort(strings.ToLower(host), port)
+}
+
+// pool returns the key and backends of the pool for host:port, preferring one configured for
+// the exact destination over one for any address on the port
+func (t *transparentProxy) pool(host, port string) (string, []string) {
+	key := destKey(host, port)
+	if backends, ok := t.pools[key]; ok {
+		return key, backends
+	}
+	key = ":" + port
+	return key, t.pools[key]
+}
+
+// l4Frontend accepts the connections of a TransparentProxy and proxies them
+type l4Frontend struct {
+	ln net.Listener
+	// ctx ends the connections
+	ctx context.Context
+	// port and mode are those it was started with; a Handoff can't change them
+	port, mode string
+	logger     *slog.Logger
+
+	cfg  atomic.Pointer[transparentProxy]
+	mu   sync.Mutex
+	next map[string]*atomic.Uint64
+	// conns counts connections by the pool they went to, and failed the failed backend dials
+	conns       map[string]*metrics.Counter
+	unmatched   *metrics.Counter
+	passthrough *metrics.Counter
+	failed      *metrics.Counter
+}
+
+// listenTransparent opens lb's transparent proxy listener. Start sets the context whose end
+// closes its connections.
+func (lb *LoadBalancer) listenTransparent(ctx context.Context) (*l4Frontend, error) {
+	t := lb.transparent
+	lc := new(net.ListenConfig)
+	if t.Mode == L4TProxy {
+		lc.Control = transparentControl
+	}
+	ln, err := lc.Listen(ctx, "tcp", listenAddr(t.Port))
+	if err != nil {
+		return nil, err
+	}
+	f := &l4Frontend{
+		ln:          ln,
+		port:        t.Port,
+		mode:        t.Mode,
+		logger:      lb.logger,
+		next:        make(map[string]*atomic.Uint64),
+		conns:       make(map[string]*metrics.Counter),
+		unmatched:   metrics.NewCounter(),
+		passthrough: metrics.NewCounter(),
+		failed:      metrics.NewCounter(),
+	}
+	f.cfg.Store(t)
+	return f, nil
+}
+
+// changed reports whether t needs a listener other than f's
+func (f *l4Frontend) changed(t *transparentProxy) bool {
+	return t == nil || listenAddr(t.Port) != listenAddr(f.port) || t.Mode != f.mode
+}
+
+func (f *l4Frontend) swap(t *transparentProxy) {
+	f.cfg.Store(t)
+}
+
+// serve accepts connections until the listener is closed, handling each in a goroutine of its
+// own
+func (f *l4Frontend) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+// handle finds where conn was headed and connects it to that destination's pool
+func (f *l4Frontend) handle(conn net.Conn) {
+	cfg := f.cfg.Load()
+	var host, port string
+	var socks *bufio.ReadWriter
+	switch cfg.Mode {
+	case L4Redirect:
+		dst, err := originalDst(conn)
+		if err != nil {
+			f.logger.Debug("original destination unknown", "client", conn.RemoteAddr().String(), "error", err)
+			conn.Close()
+			return
+		}
+		host, port = dst.Addr().String(), strconv.Itoa(int(dst.Port()))
+	case L4TProxy:
+		host, port, _ = net.SplitHostPort(conn.LocalAddr().String())
+	case L4SOCKS5:
+		socks = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		var err error
+		host, port, err = socksConnect(socks)
+		if err != nil {
+			f.logger.Debug("SOCKS5 handshake failed", "client", conn.RemoteAddr().String(), "error", err)
+			conn.Close()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+	}
+
+	key, backends := cfg.pool(host, port)
+	switch {
+	case backends != nil:
+		f.counter(key).Inc()
+	case cfg.Passthrough:
+		f.passthrough.Inc()
+		backends = []string{net.JoinHostPort(host, port)}
+	default:
+		f.unmatched.Inc()
+		if socks != nil {
+			socksReply(socks, socksNotAllowed)
+		}
+		conn.Close()
+		return
+	}
+	upstream := f.dial(conn, cfg, key, backends)
+	if upstream == nil {
+		if socks != nil {
+			socksReply(socks, socksRefused)
+		}
+		conn.Close()
+		return
+	}
+	if socks != nil {
+		if err := socksReply(socks, socksSucceeded); err != nil {
+			conn.Close()
+			upstream.Close()
+			return
+		}
+		// the client may have sent data behind its request already
+		conn = &peekedConn{Conn: conn, r: socks.Reader}
+	}
+	pipe(f.ctx, conn, upstream)
+}
+
+// dial connects to the first of backends that accepts, starting after the one the pool's
+// previous connection went to
+func (f *l4Frontend) dial(conn net.Conn, cfg *transparentProxy, key string, backends []string) net.Conn {
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: 30 * time.Second}
+	if cfg.PreserveClientIP {
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			dialer.LocalAddr = &net.TCPAddr{IP: addr.IP}
+			dialer.Control = transparentControl
+		}
+	}
+	start := f.nextFor(key).Add(1)
+	for i := range backends {
+		c, err := dialer.DialContext(f.ctx, "tcp", backends[(int(start)+i)%len(backends)])
+		if err == nil {
+			return c
+		}
+		f.failed.Inc()
+	}
+	return nil
+}
+
+func (f *l4Frontend) nextFor(key string) *atomic.Uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := f.next[key]
+	if n == nil {
+		n = new(atomic.Uint64)
+		f.next[key] = n
+	}
+	return n
+}
+
+func (f *l4Frontend) counter(key string) *metrics.Counter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.conns[key]
+	if c == nil {
+		c = metrics.NewCounter()
+		f.conns[key] = c
+	}
+	return c
+}
+
+func (f *l4Frontend) close() {
+	f.ln.Close()
+}
+
+// writeMetrics writes the connections by destination pool and the failed backend dials
+func (f *l4Frontend) writeMetrics(w *bufio.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	writeMetricHeader(w, "lb_l4_connections_total", "counter", "Connections taken by the transparent proxy, by the destination whose pool they went to.")
+	for _, key := range slices.Sorted(maps.Keys(f.conns)) {
+		fmt.Fprintf(w, "lb_l4_connections_total{destination=%s} %d\n", labelValue(key), f.conns[key].Value())
+	}
+	fmt.Fprintf(w, "lb_l4_connections_total{destination=\"passthrough\"} %d\n", f.passthrough.Value())
+	fmt.Fprintf(w, "lb_l4_connections_total{destination=\"unmatched\"} %d\n", f.unmatched.Value())
+	writeMetricHeader(w, "lb_l4_dial_failures_total", "counter", "Failed connection attempts by the transparent proxy.")
+	fmt.Fprintf(w, "lb_l4_dial_failures_total %d\n", f.failed.Value())
+}
+
+// SOCKS5 reply codes (RFC 1928)
+const (
+	socksSucceeded  = 0x00
+	socksNotAllowed = 0x02
+	socksRefused    = 0x05
+	socksBadCommand = 0x07
+	socksBadAddress = 0x08
+)
+
+// socksConnect reads a SOCKS5 greeting and CONNECT request from rw, accepting clients that
+// offer no authentication, and returns the host and port asked for. Requests it can't serve
+// are answered before the error is returned.
+func socksConnect(rw *bufio.ReadWriter) (host, port string, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(rw, head[:]); err != nil {
+		return "", "", err
+	}
+	if head[0] != 5 {
+		return "", "", fmt.Errorf("SOCKS version %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return "", "", err
+	}
+	if !slices.Contains(methods, 0x00) {
+		rw.Write([]byte{5, 0xff})
+		rw.Flush()
+		return "", "", errors.New("client offers no method without authentication")
+	}
+	if _, err := rw.Write([]byte{5, 0x00}); err != nil {
+		return "", "", err
+	}
+	if err := rw.Flush(); err != nil {
+		return "", "", err
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(rw, req[:]); err != nil {
+		return "", "", err
+	}
+	if req[0] != 5 {
+		return "", "", fmt.Errorf("SOCKS version %d", req[0])
+	}
+	if req[1] != 1 {
+		socksReply(rw, socksBadCommand)
+		return "", "", fmt.Errorf("SOCKS command %d, only CONNECT is supported", req[1])
+	}
+	switch req[3] {
+	case 1, 4:
+		b := make([]byte, 4)
+		if req[3] == 4 {
+			b = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(rw, b); err != nil {
+			return "", "", err
+		}
+		addr, _ := netip.AddrFromSlice(b)
+		host = addr.String()
+	case 3:
+		n, err := rw.ReadByte()
+		if err != nil {
+			return "", "", err
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(rw, b); err != nil {
+			return "", "", err
+		}
+		host = string(b)
+	default:
+		socksReply(rw, socksBadAddress)
+		return "", "", fmt.Errorf("SOCKS address type %d", req[3])
+	}
+	var p [2]byte
+	if _, err := io.ReadFull(rw, p[:]); err != nil {
+		return "", "", err
+	}
+	return host, strconv.Itoa(int(binary.BigEndian.Uint16(p[:]))), nil
+}
+
+// socksReply answers a CONNECT request with code. The bound address is left unset, as clients
+// have no use for it.
+func socksReply(rw *bufio.ReadWriter, code byte) error {
+	if _, err := rw.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return err
+	}
+	return rw.Flush()
+}
@@ -0,0 +1,82 @@
+//go:build linux
+
+package loadbalancer
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// transparentSupported is set where redirect and tproxy modes work
+const transparentSupported = true
+
+const (
+	// soOriginalDst is SO_ORIGINAL_DST, and IP6T_SO_ORIGINAL_DST at the IPv6 level
+	soOriginalDst = 80
+	// ipv6Transparent is IPV6_TRANSPARENT, which package syscall lacks
+	ipv6Transparent = 75
+)
+
+// originalDst returns the destination conn was addressed to before an iptables REDIRECT or
+// DNAT rule sent it to the balancer
+func originalDst(conn net.Conn) (netip.AddrPort, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return netip.AddrPort{}, errors.New("not a TCP connection")
+	}
+	local, _ := tc.LocalAddr().(*net.TCPAddr)
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	var dst netip.AddrPort
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if local != nil && local.IP.To4() != nil {
+			// the kernel fills in a sockaddr_in, which the 16 bytes of an IPv6Mreq hold
+			var mreq *syscall.IPv6Mreq
+			mreq, serr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if serr == nil {
+				a := mreq.Multiaddr
+				dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(a[4:8])), binary.BigEndian.Uint16(a[2:4]))
+			}
+			return
+		}
+		// and at the IPv6 level a sockaddr_in6, which opens an IPv6MTUInfo
+		var info *syscall.IPv6MTUInfo
+		info, serr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+		if serr == nil {
+			// the port is stored in network byte order
+			port := binary.BigEndian.Uint16(binary.NativeEndian.AppendUint16(nil, info.Addr.Port))
+			dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr).Unmap(), port)
+		}
+	})
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return dst, serr
+}
+
+// transparentControl marks a socket transparent, so it can accept connections addressed
+// elsewhere and connect from addresses that aren't the host's
+func transparentControl(network, _ string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		if network == "tcp6" {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6Transparent, 1)
+			if err != nil {
+				return
+			}
+		}
+		// dual-stack sockets take IPv4 traffic too
+		if serr := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TRANSPARENT, 1); network != "tcp6" {
+			err = serr
+		}
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package loadbalancer
+
+import (
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// transparentSupported is unset where only the SOCKS5 mode works
+const transparentSupported = false
+
+func originalDst(net.Conn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errTransparentUnsupported
+}
+
+func transparentControl(string, string, syscall.RawConn) error {
+	return errTransparentUnsupported
+}
@@ -0,0 +1,90 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// schemeH2C marks a backend that speaks cleartext HTTP/2 with prior knowledge
+const schemeH2C = "h2c"
+
+// newUpstreamTransport builds the transport used to reach a single backend.
+// TLS backends negotiate HTTP/2 through ALPN and h2c backends use it directly, so many
+// concurrent client requests are multiplexed over a handful of backend connections.
+// Backends that only speak HTTP/1.1 fall back to a pooled keep-alive transport.
+// Like http.DefaultTransport it honours the standard proxy environment variables.
+func newUpstreamTransport(h2c bool) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ForceAttemptHTTP2 = true
+	t.MaxIdleConnsPerHost = 64
+	t.HTTP2 = &http.HTTP2Config{
+		// open another connection only once every stream slot on the existing ones is busy
+		StrictMaxConcurrentRequests: false,
+		SendPingTimeout:             30 * time.Second,
+		PingTimeout:                 15 * time.Second,
+	}
+
+	protocols := new(http.Protocols)
+	if h2c {
+		protocols.SetUnencryptedHTTP2(true)
+	} else {
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+	}
+	t.Protocols = protocols
+	return t
+}
+
+// UpstreamTimeouts bound the stages of a call to a backend; a zero value keeps the stage's default
+type UpstreamTimeouts struct {
+	// Dial bounds opening a connection; default 30s
+	Dial time.Duration
+	// TLSHandshake bounds the handshake with an https backend; default 10s
+	TLSHandshake time.Duration
+	// ResponseHeader bounds the wait for the response headers once the request is sent; by
+	// default there is no limit besides the client's. Failing it counts as response_header_timeout.
+	ResponseHeader time.Duration
+	// IdleConn is how long an unused keep-alive connection is kept; default 90s
+	IdleConn time.Duration
+}
+
+// WithUpstreamTimeouts applies t to every server the balancer builds itself
+func WithUpstreamTimeouts(t UpstreamTimeouts) Option {
+	return func(lb *LoadBalancer) {
+		lb.timeouts = &t
+	}
+}
+
+// WithTimeouts sets the server's transport timeouts. It requires the server's transport to be
+// an *http.Transport.
+func WithTimeouts(t UpstreamTimeouts) ServerOption {
+	return func(s *SimpleServer) {
+		s.timeouts = &t
+	}
+}
+
+// useTimeouts gives the server's transport the non-zero timeouts of t
+func (s *SimpleServer) useTimeouts(t UpstreamTimeouts) error {
+	base, ok := s.proxy.Transport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("loadbalancer: backend %s uses a %T, which has no timeout settings", s.addr, s.proxy.Transport)
+	}
+	tr := base.Clone()
+	if t.Dial > 0 {
+		tr.DialContext = (&net.Dialer{Timeout: t.Dial, KeepAlive: 30 * time.Second}).DialContext
+	}
+	if t.TLSHandshake > 0 {
+		tr.TLSHandshakeTimeout = t.TLSHandshake
+	}
+	if t.ResponseHeader > 0 {
+		tr.ResponseHeaderTimeout = t.ResponseHeader
+	}
+	if t.IdleConn > 0 {
+		tr.IdleConnTimeout = t.IdleConn
+	}
+	s.proxy.Transport = tr
+	s.client.Transport = tr
+	return nil
+}
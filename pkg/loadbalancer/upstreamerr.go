@@ -0,0 +1,151 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// upstreamErrorHeader names the failure class on error responses the balancer generates
+const upstreamErrorHeader = "X-LB-Error"
+
+// UpstreamErrorKind classifies a failed call to a backend
+type UpstreamErrorKind string
+
+// The kinds of upstream failure, as shown in X-LB-Error, logs and Stats.UpstreamErrors
+const (
+	UpstreamDNS           UpstreamErrorKind = "dns"
+	UpstreamRefused       UpstreamErrorKind = "connection_refused"
+	UpstreamDialTimeout   UpstreamErrorKind = "dial_timeout"
+	UpstreamDial          UpstreamErrorKind = "dial_error"
+	UpstreamTLS           UpstreamErrorKind = "tls"
+	UpstreamReset         UpstreamErrorKind = "connection_reset"
+	UpstreamHeaderTimeout UpstreamErrorKind = "response_header_timeout"
+	UpstreamTimeout       UpstreamErrorKind = "timeout"
+	UpstreamProtocol      UpstreamErrorKind = "protocol"
+	UpstreamBodyCopy      UpstreamErrorKind = "body_copy"
+	UpstreamUnclassified  UpstreamErrorKind = "unclassified"
+)
+
+// UpstreamInvalidResponse is a response a ResponseRule rejected
+const UpstreamInvalidResponse UpstreamErrorKind = "invalid_response"
+
+var upstreamErrorKinds = []UpstreamErrorKind{
+	UpstreamDNS, UpstreamRefused, UpstreamDialTimeout, UpstreamDial, UpstreamTLS, UpstreamReset,
+	UpstreamHeaderTimeout, UpstreamTimeout, UpstreamProtocol, UpstreamBodyCopy, UpstreamInvalidResponse,
+	UpstreamUnclassified,
+}
+
+// Status is the status code a client gets for the failure: 504 for timeouts, otherwise 502
+func (k UpstreamErrorKind) Status() int {
+	switch k {
+	case UpstreamDialTimeout, UpstreamHeaderTimeout, UpstreamTimeout:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// connectionFailure reports whether the backend itself could not be reached, as opposed to
+// failing one request
+func (k UpstreamErrorKind) connectionFailure() bool {
+	switch k {
+	case UpstreamDNS, UpstreamRefused, UpstreamDialTimeout, UpstreamDial, UpstreamReset:
+		return true
+	}
+	return false
+}
+
+// UpstreamError is a failed call to a backend, passed to OnRetry hooks
+type UpstreamError struct {
+	Kind   UpstreamErrorKind
+	Server string
+	Err    error
+}
+
+func (e *UpstreamError) Error() string {
+	return string(e.Kind) + ": " + e.Err.Error()
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// ClassifyUpstreamError tells what kind of failure err, returned by a transport, is
+func ClassifyUpstreamError(err error) UpstreamErrorKind {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return UpstreamDNS
+	case isTLSError(err), strings.Contains(err.Error(), plainAnswerToTLS):
+		return UpstreamTLS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return UpstreamRefused
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		if opErr.Timeout() {
+			return UpstreamDialTimeout
+		}
+		return UpstreamDial
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		// EOF here means the backend closed the connection instead of answering
+		return UpstreamReset
+	case errors.Is(err, errLearnedTimeout), strings.Contains(err.Error(), "timeout awaiting response headers"):
+		// http.Transport's ResponseHeaderTimeout error is not exported
+		return UpstreamHeaderTimeout
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return UpstreamTimeout
+	case strings.Contains(err.Error(), "malformed HTTP"):
+		return UpstreamProtocol
+	}
+	return UpstreamUnclassified
+}
+
+func isTLSError(err error) bool {
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
+
+// noteUpstreamError counts a failed backend call by kind, overall and for the backend
+func (lb *LoadBalancer) noteUpstreamError(err *UpstreamError) {
+	lb.upstreamErrors[err.Kind].Inc()
+	lb.backendMetricsFor(err.Server).errors[err.Kind].Inc()
+}
+
+// notedBody records the first error reading a backend's response body, which the proxy
+// can only report by aborting the half-sent response
+type notedBody struct {
+	io.ReadCloser
+	st *requestState
+}
+
+func (b *notedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && b.st.bodyErr == nil {
+		b.st.bodyErr = err
+	}
+	return n, err
+}
+
+// noteBodyError watches the response body for read errors
+func noteBodyError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// the proxy needs the raw connection behind an upgrade's body
+		return nil
+	}
+	resp.Body = &notedBody{ReadCloser: resp.Body, st: stateFrom(resp.Request.Context())}
+	return nil
+}
@@ -0,0 +1,273 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/metrics"
+)
+
+// What a RedirectPolicy does with the redirects backends answer with
+const (
+	// RedirectPass relays redirects unchanged, as without a policy
+	RedirectPass = "pass"
+	// RedirectRewrite points Location headers naming a backend's own address at the host the
+	// client asked for instead, so clients aren't sent to addresses they can't reach
+	RedirectRewrite = "rewrite"
+	// RedirectFollow follows redirects to a backend on the balancer's side, relaying only the
+	// final response; redirects it doesn't follow are rewritten
+	RedirectFollow = "follow"
+)
+
+// RedirectPolicy says what happens to the 3xx responses backends send with a Location, for
+// backends that don't know the public address they are served under. A redirect is followed
+// only when its Location is relative or names a backend, never another site, and only when the
+// request it repeats has no body or the redirect turns it into a GET; the others are relayed.
+// Policies are checked in order and the first one matching the request applies.
+type RedirectPolicy struct {
+	// Host and PathPrefix select the requests the policy applies to; empty values match everything
+	Host       string
+	PathPrefix string
+	// Mode is RedirectPass, RedirectRewrite or RedirectFollow
+	Mode string
+	// MaxHops is how many redirects RedirectFollow follows for one request before relaying the
+	// next one; default 5
+	MaxHops int
+}
+
+// WithRedirectPolicies adds policies for backend redirects
+func WithRedirectPolicies(policies ...RedirectPolicy) Option {
+	return func(lb *LoadBalancer) {
+		if lb.redirects == nil {
+			lb.redirects = &upstreamRedirects{rewritten: metrics.NewCounter(), followed: metrics.NewCounter()}
+		}
+		for _, p := range policies {
+			if p.MaxHops <= 0 {
+				p.MaxHops = 5
+			}
+			lb.redirects.policies = append(lb.redirects.policies, p)
+		}
+	}
+}
+
+// upstreamRedirects holds the redirect policies and counts what they did
+type upstreamRedirects struct {
+	policies            []RedirectPolicy
+	rewritten, followed *metrics.Counter
+}
+
+func (r *upstreamRedirects) validate() error {
+	for i, p := range r.policies {
+		switch p.Mode {
+		case RedirectPass, RedirectRewrite, RedirectFollow:
+		default:
+			return fmt.Errorf("redirect policy %d: unknown mode %q, want pass, rewrite or follow", i, p.Mode)
+		}
+	}
+	return nil
+}
+
+// policy returns the first policy for req, or nil
+func (r *upstreamRedirects) policy(req *http.Request) *RedirectPolicy {
+	for i := range r.policies {
+		p := &r.policies[i]
+		if p.Host != "" && !strings.EqualFold(p.Host, requestHost(req)) {
+			continue
+		}
+		if strings.HasPrefix(req.URL.Path, p.PathPrefix) {
+			return p
+		}
+	}
+	return nil
+}
+
+// redirectPolicy returns the policy for req, or nil when its redirects are relayed unchanged
+func (lb *LoadBalancer) redirectPolicy(req *http.Request) *RedirectPolicy {
+	if lb.redirects == nil {
+		return nil
+	}
+	if p := lb.redirects.policy(req); p != nil && p.Mode != RedirectPass {
+		return p
+	}
+	return nil
+}
+
+// serveRedirects sends req to server under policy p, following its redirects to backends for
+// as long as p allows
+func (lb *LoadBalancer) serveRedirects(rw http.ResponseWriter, req *http.Request, server Server, p *RedirectPolicy) {
+	before := rw.Header().Clone()
+	for hop := 0; ; hop++ {
+		w := &redirectWriter{ResponseWriter: rw, lb: lb, req: req, server: server, before: before, follow: p.Mode == RedirectFollow && hop < p.MaxHops}
+		server.Serve(w, req)
+		if w.next == nil {
+			return
+		}
+		lb.redirects.followed.Inc()
+		lb.logger.Debug("following backend redirect", "server", server.Address(), "location", w.next.URL.String(), "to", w.nextServer.Address())
+		req, server = w.next, w.nextServer
+	}
+}
+
+// redirectWriter rewrites or swallows the redirect of one hop
+type redirectWriter struct {
+	http.ResponseWriter
+	lb     *LoadBalancer
+	req    *http.Request
+	server Server
+	// before are the headers set ahead of the backend's, restored when its redirect is followed
+	before http.Header
+	follow bool
+	seen   bool
+	// next and nextServer are the request and backend the redirect is followed to
+	next       *http.Request
+	nextServer Server
+}
+
+func (w *redirectWriter) WriteHeader(code int) {
+	if w.seen || code < 200 {
+		if w.next == nil {
+			w.ResponseWriter.WriteHeader(code)
+		}
+		return
+	}
+	w.seen = true
+	if loc := w.Header().Get("Location"); isRedirect(code) && loc != "" && stateFrom(w.req.Context()).upstreamErr == nil {
+		w.redirect(code, loc)
+	}
+	if w.next == nil {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+// redirect follows the redirect to loc or rewrites it, when it points at a backend
+func (w *redirectWriter) redirect(code int, loc string) {
+	// resolved against the path alone, so a relative location stays on the backend even for a
+	// request in absolute form
+	base := &url.URL{Path: w.req.URL.Path, RawPath: w.req.URL.RawPath}
+	target, err := base.Parse(loc)
+	if err != nil {
+		return
+	}
+	server := w.server
+	if target.Host != "" {
+		if server = w.lb.backendAt(target); server == nil {
+			// somewhere else entirely
+			return
+		}
+	}
+	if w.follow {
+		if next := followRequest(w.req, code, target); next != nil {
+			w.next, w.nextServer = next, server
+			clear(w.Header())
+			maps.Copy(w.Header(), w.before)
+			return
+		}
+	}
+	if target.Host != "" {
+		target.Scheme, target.Host = "http", w.req.Host
+		if w.req.TLS != nil {
+			target.Scheme = "https"
+		}
+		w.Header().Set("Location", target.String())
+		w.lb.redirects.rewritten.Inc()
+	}
+}
+
+func (w *redirectWriter) Write(p []byte) (int, error) {
+	if !w.seen {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.next != nil {
+		// drop the redirect's body; the proxy still reads it to the end
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// FlushError keeps a followed redirect from being committed by the proxy's flushes
+func (w *redirectWriter) FlushError() error {
+	if w.next != nil {
+		return nil
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *redirectWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func isRedirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// followRequest returns the request repeating req at target after a redirect with code, as
+// browsers do, or nil when it can't be repeated because its body is gone
+func followRequest(req *http.Request, code int, target *url.URL) *http.Request {
+	method := req.Method
+	switch {
+	case code == http.StatusSeeOther && method != http.MethodHead:
+		method = http.MethodGet
+	case (code == http.StatusMovedPermanently || code == http.StatusFound) && method == http.MethodPost:
+		method = http.MethodGet
+	}
+	next := req.Clone(req.Context())
+	next.Method = method
+	next.URL.Path, next.URL.RawPath, next.URL.RawQuery = target.Path, target.RawPath, target.RawQuery
+	next.RequestURI = target.RequestURI()
+	if method != req.Method {
+		next.Body, next.ContentLength = http.NoBody, 0
+		for _, h := range []string{"Content-Type", "Content-Length", "Content-Encoding"} {
+			next.Header.Del(h)
+		}
+	} else if req.ContentLength != 0 {
+		// the body was sent on the first hop and isn't kept
+		return nil
+	}
+	return next
+}
+
+// backendAt returns the backend, regular or pooled, that u's host names, or nil
+func (lb *LoadBalancer) backendAt(u *url.URL) Server {
+	host := defaultPort(u.Scheme, u.Host)
+	for _, s := range append(lb.Servers(), lb.poolServers()...) {
+		if ss, ok := s.(*SimpleServer); ok {
+			if strings.EqualFold(defaultPort(ss.target.Scheme, ss.target.Host), host) ||
+				(ss.host != "" && strings.EqualFold(defaultPort(ss.target.Scheme, ss.host), host)) {
+				return s
+			}
+			continue
+		}
+		if t, err := url.Parse(s.Address()); err == nil && strings.EqualFold(defaultPort(t.Scheme, t.Host), host) {
+			return s
+		}
+	}
+	return nil
+}
+
+// defaultPort adds the scheme's port to a host without one
+func defaultPort(scheme, host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	if scheme == "https" {
+		return net.JoinHostPort(strings.Trim(host, "[]"), "443")
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), "80")
+}
+
+// writeMetrics writes the backend redirects rewritten and followed
+func (r *upstreamRedirects) writeMetrics(w *bufio.Writer) {
+	writeMetricHeader(w, "lb_upstream_redirects_total", "counter", "Backend redirects rewritten to the public host or followed by the balancer.")
+	fmt.Fprintf(w, "lb_upstream_redirects_total{action=\"rewritten\"} %d\n", r.rewritten.Value())
+	fmt.Fprintf(w, "lb_upstream_redirects_total{action=\"followed\"} %d\n", r.followed.Value())
+}
@@ -0,0 +1,216 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errInvalidResponse is the error of an UpstreamError for a response a ResponseRule rejected
+var errInvalidResponse = errors.New("backend response rejected by a response rule")
+
+// ResponseRule rejects backend responses that are clearly broken, such as an HTML error page
+// on a JSON API route. A rejected response never reaches the client: the request is retried
+// on another backend when the retry policy allows it, and otherwise answered with Status. The
+// backend that sent it gets no new requests for Penalty. Rules are checked in order and the
+// first one matching the request applies.
+type ResponseRule struct {
+	// Host and PathPrefix select the requests the rule applies to; empty values match everything
+	Host       string
+	PathPrefix string
+	// RejectStatus are the statuses never acceptable from a backend on these routes
+	RejectStatus []int
+	// ContentTypes, when set, are the media types a response must have, e.g. "application/json"
+	// or "image/*"; 204 and 304 responses, which have no body, are exempt
+	ContentTypes []string
+	// RequireHeaders must all be present on the response
+	RequireHeaders []string
+	// MaxBytes rejects responses whose Content-Length is larger. A response without one, such
+	// as a stream, is relayed until it exceeds MaxBytes and then cut off, which the client sees
+	// as a connection closed mid-body since its status has already been sent.
+	MaxBytes int64
+	// Status answers a rejected response; default 502
+	Status int
+	// Penalty pauses the backend after a rejection; default 10s, negative for no pause
+	Penalty time.Duration
+}
+
+// WithResponseRules adds rules checking responses before they are relayed
+func WithResponseRules(rules ...ResponseRule) Option {
+	return func(lb *LoadBalancer) {
+		lb.respRules = append(lb.respRules, rules...)
+	}
+}
+
+func compileResponseRules(rules []ResponseRule) ([]ResponseRule, error) {
+	out := make([]ResponseRule, len(rules))
+	for i, r := range rules {
+		if r.Status == 0 {
+			r.Status = http.StatusBadGateway
+		}
+		if r.Status < 400 || r.Status > 599 {
+			return nil, fmt.Errorf("response rule %d: invalid status %d", i, r.Status)
+		}
+		if r.Penalty == 0 {
+			r.Penalty = 10 * time.Second
+		}
+		r.ContentTypes = slices.Clone(r.ContentTypes)
+		for j, ct := range r.ContentTypes {
+			r.ContentTypes[j] = strings.ToLower(strings.TrimSpace(ct))
+		}
+		out[i] = r
+	}
+	return out, nil
+}
+
+// responseRule returns the first rule for req, or nil
+func (lb *LoadBalancer) responseRule(req *http.Request) *ResponseRule {
+	for i := range lb.respChecks {
+		r := &lb.respChecks[i]
+		if r.Host != "" && !strings.EqualFold(r.Host, requestHost(req)) {
+			continue
+		}
+		if strings.HasPrefix(req.URL.Path, r.PathPrefix) {
+			return r
+		}
+	}
+	return nil
+}
+
+// check returns why a response with status and header breaks the rule, or "" when it doesn't
+func (r *ResponseRule) check(status int, header http.Header) string {
+	if slices.Contains(r.RejectStatus, status) {
+		return "status " + strconv.Itoa(status)
+	}
+	if len(r.ContentTypes) > 0 && status != http.StatusNoContent && status != http.StatusNotModified {
+		mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+		if err != nil || !slices.ContainsFunc(r.ContentTypes, func(want string) bool { return mediaTypeMatches(want, mediaType) }) {
+			return "content type " + strconv.Quote(header.Get("Content-Type"))
+		}
+	}
+	for _, h := range r.RequireHeaders {
+		if header.Get(h) == "" {
+			return "missing header " + h
+		}
+	}
+	if r.MaxBytes > 0 {
+		if n, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && n > r.MaxBytes {
+			return "content length " + strconv.FormatInt(n, 10)
+		}
+	}
+	return ""
+}
+
+// mediaTypeMatches compares a media type with a pattern that may end in /*
+func mediaTypeMatches(pattern, mediaType string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(mediaType, prefix+"/")
+	}
+	return pattern == mediaType
+}
+
+// validatingWriter holds back a response's head until the rule has checked it
+type validatingWriter struct {
+	http.ResponseWriter
+	lb     *LoadBalancer
+	rule   *ResponseRule
+	req    *http.Request
+	server Server
+	// before are the headers set ahead of the backend's, restored when its response is dropped
+	before   http.Header
+	checked  bool
+	rejected bool
+	// written counts the body bytes relayed, for MaxBytes
+	written int64
+}
+
+func (w *validatingWriter) WriteHeader(code int) {
+	if w.checked || code < 200 {
+		// informational responses pass untouched
+		if !w.rejected {
+			w.ResponseWriter.WriteHeader(code)
+		}
+		return
+	}
+	w.checked = true
+	st := stateFrom(w.req.Context())
+	reason := ""
+	if st.upstreamErr == nil {
+		// the balancer's own error for a failed call is not the backend's response
+		reason = w.rule.check(code, w.Header())
+	}
+	if reason == "" {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.rejected = true
+	w.lb.penalize(w.server, w.rule.Penalty, reason)
+	st.upstreamErr = &UpstreamError{Kind: UpstreamInvalidResponse, Server: w.server.Address(), Err: fmt.Errorf("%w: %s", errInvalidResponse, reason)}
+	clear(w.Header())
+	maps.Copy(w.Header(), w.before)
+	if st.retryable {
+		return
+	}
+	w.Header().Set(upstreamErrorHeader, string(UpstreamInvalidResponse))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.ResponseWriter.WriteHeader(w.rule.Status)
+	fmt.Fprintln(w.ResponseWriter, http.StatusText(w.rule.Status))
+}
+
+func (w *validatingWriter) Write(p []byte) (int, error) {
+	if !w.checked {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.rejected {
+		// drop the broken body; the proxy still reads it to the end
+		return len(p), nil
+	}
+	if w.rule.MaxBytes > 0 && w.written+int64(len(p)) > w.rule.MaxBytes {
+		return 0, w.cutOff()
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// cutOff gives up on a response that grew past MaxBytes; the error it returns makes the proxy
+// abort the response
+func (w *validatingWriter) cutOff() error {
+	reason := "body over " + strconv.FormatInt(w.rule.MaxBytes, 10) + " bytes"
+	w.lb.penalize(w.server, w.rule.Penalty, reason)
+	w.lb.noteUpstreamError(&UpstreamError{Kind: UpstreamInvalidResponse, Server: w.server.Address(), Err: fmt.Errorf("%w: %s", errInvalidResponse, reason)})
+	return fmt.Errorf("%w: %s", errInvalidResponse, reason)
+}
+
+// FlushError keeps a rejected response from being committed by the proxy's flushes
+func (w *validatingWriter) FlushError() error {
+	if w.rejected {
+		return nil
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *validatingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// penalize pauses server for d after it sent a broken response
+func (lb *LoadBalancer) penalize(server Server, d time.Duration, reason string) {
+	lb.logger.Warn("backend response rejected", "server", server.Address(), "reason", reason, "pause", max(d, 0))
+	if d <= 0 {
+		return
+	}
+	until := time.Now().Add(d)
+	lb.stateMu.Lock()
+	if until.After(lb.backoff[server.Address()]) {
+		lb.backoff[server.Address()] = until
+	}
+	lb.stateMu.Unlock()
+}
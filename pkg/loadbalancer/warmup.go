@@ -0,0 +1,184 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WarmUp sends a burst of requests to a backend before it takes traffic, so caches, JITs and
+// connection pools are primed by the balancer rather than by real clients. It runs for backends
+// added by discovery and for backends recovering from a failed health check; until it succeeds
+// the backend is kept out of rotation.
+type WarmUp struct {
+	// Paths are requested in turn; default "/"
+	Paths []string
+	// Count is how many times each path is requested; default 1
+	Count int
+	// Concurrency is the number of warm-up requests in flight at once; default 1
+	Concurrency int
+	// MaxLatency fails the warm-up when any request takes longer; default 2s
+	MaxLatency time.Duration
+	// RetryAfter is how long a backend that failed its warm-up waits before the next one; default 10s
+	RetryAfter time.Duration
+}
+
+// WithWarmUp enables warm-up requests for new and recovering backends
+func WithWarmUp(w WarmUp) Option {
+	return func(lb *LoadBalancer) {
+		if len(w.Paths) == 0 {
+			w.Paths = []string{"/"}
+		}
+		if w.Count <= 0 {
+			w.Count = 1
+		}
+		if w.Concurrency <= 0 {
+			w.Concurrency = 1
+		}
+		if w.MaxLatency <= 0 {
+			w.MaxLatency = 2 * time.Second
+		}
+		if w.RetryAfter <= 0 {
+			w.RetryAfter = 10 * time.Second
+		}
+		lb.warmCfg = &w
+	}
+}
+
+// warmState tracks a backend that has not passed its warm-up yet
+type warmState struct {
+	server  Server
+	running bool
+	retryAt time.Time
+}
+
+// warmUp holds server out of rotation and starts warming it, unless that is already under way
+func (lb *LoadBalancer) warmUp(server Server) {
+	if lb.warmCfg == nil {
+		return
+	}
+	lb.stateMu.Lock()
+	defer lb.stateMu.Unlock()
+	if _, ok := lb.warming[server.Address()]; ok {
+		return
+	}
+	lb.warming[server.Address()] = &warmState{server: server, running: true}
+	go lb.runWarmUp(server)
+}
+
+// warmingUp reports whether addr is still held back, restarting a failed warm-up once it is due
+func (lb *LoadBalancer) warmingUp(addr string) bool {
+	if lb.warmCfg == nil {
+		return false
+	}
+	lb.stateMu.Lock()
+	defer lb.stateMu.Unlock()
+	ws, ok := lb.warming[addr]
+	if !ok {
+		return false
+	}
+	if !ws.running && time.Now().After(ws.retryAt) {
+		ws.running = true
+		go lb.runWarmUp(ws.server)
+	}
+	return true
+}
+
+func (lb *LoadBalancer) runWarmUp(server Server) {
+	err := lb.warmUpRequests(server)
+	lb.stateMu.Lock()
+	defer lb.stateMu.Unlock()
+	if err == nil {
+		delete(lb.warming, server.Address())
+		lb.logger.Info("backend warmed up", "server", server.Address())
+		return
+	}
+	if ws, ok := lb.warming[server.Address()]; ok {
+		ws.running = false
+		ws.retryAt = time.Now().Add(lb.warmCfg.RetryAfter)
+	}
+	lb.logger.Warn("backend warm-up failed", "server", server.Address(), "error", err)
+}
+
+// warmUpRequests sends the configured requests and returns the first failure
+func (lb *LoadBalancer) warmUpRequests(server Server) error {
+	cfg := lb.warmCfg
+	paths := make(chan string)
+	go func() {
+		defer close(paths)
+		for range cfg.Count {
+			for _, p := range cfg.Paths {
+				paths <- p
+			}
+		}
+	}()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for range cfg.Concurrency {
+		wg.Go(func() {
+			for p := range paths {
+				if err := warmUpOne(server, p, cfg.MaxLatency); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		})
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func warmUpOne(server Server, path string, maxLatency time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), maxLatency)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "loadbalancer-warmup")
+	start := time.Now()
+	rec := &statusRecorder{}
+	server.Serve(rec, req)
+	if elapsed := time.Since(start); elapsed > maxLatency || ctx.Err() != nil {
+		return fmt.Errorf("GET %s took %v, over %v", path, elapsed.Round(time.Millisecond), maxLatency)
+	}
+	if rec.status >= http.StatusBadRequest {
+		return fmt.Errorf("GET %s: status %d", path, rec.status)
+	}
+	return nil
+}
+
+// statusRecorder discards a response, keeping only its status
+type statusRecorder struct {
+	header http.Header
+	status int
+}
+
+func (r *statusRecorder) Header() http.Header {
+	if r.header == nil {
+		r.header = make(http.Header)
+	}
+	return r.header
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return len(p), nil
+}
@@ -0,0 +1,56 @@
+// Package metrics provides low-contention counters for the load balancer hot path.
+package metrics
+
+import (
+	"math/rand/v2"
+	"runtime"
+	"sync/atomic"
+)
+
+// cacheLineSize is the padding unit used to keep counter shards apart
+const cacheLineSize = 128
+
+// counterShard holds one slice of a counter on its own cache line
+type counterShard struct {
+	n atomic.Uint64
+	_ [cacheLineSize - 8]byte
+}
+
+// Counter is a monotonically increasing counter split across shards.
+// Writers pick a shard with the runtime's per-thread random source, so hot
+// paths never fight over a single cache line; readers sum every shard.
+type Counter struct {
+	shards []counterShard
+	mask   uint32
+}
+
+// NewCounter creates a counter with one shard per CPU, rounded up to a power of two
+func NewCounter() *Counter {
+	n := 1
+	for n < runtime.GOMAXPROCS(0) {
+		n <<= 1
+	}
+	return &Counter{
+		shards: make([]counterShard, n),
+		mask:   uint32(n - 1),
+	}
+}
+
+// Add increments the counter by delta
+func (c *Counter) Add(delta uint64) {
+	c.shards[rand.Uint32()&c.mask].n.Add(delta)
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Value aggregates all shards; it is meant to be called at scrape time, not per request
+func (c *Counter) Value() uint64 {
+	var total uint64
+	for i := range c.shards {
+		total += c.shards[i].n.Load()
+	}
+	return total
+}
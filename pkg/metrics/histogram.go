@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// DefaultBuckets are upper bounds in seconds suited to HTTP response times
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram counts observations into fixed buckets and keeps their count and sum
+type Histogram struct {
+	bounds []float64
+	// counts holds one slot per bound plus one for values above the last bound
+	counts []atomic.Uint64
+	sum    atomic.Uint64
+}
+
+// NewHistogram creates a histogram with the given ascending upper bounds
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]atomic.Uint64, len(bounds)+1),
+	}
+}
+
+// Observe records one value
+func (h *Histogram) Observe(v float64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// HistogramSnapshot is a histogram's state at one moment
+type HistogramSnapshot struct {
+	Bounds []float64
+	// Cumulative holds, for each bound, the number of values at or below it
+	Cumulative []uint64
+	Count      uint64
+	Sum        float64
+}
+
+// Snapshot reads the histogram; concurrent observations may be split between the counts and the sum
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Bounds:     h.bounds,
+		Cumulative: make([]uint64, len(h.bounds)),
+		Sum:        math.Float64frombits(h.sum.Load()),
+	}
+	for i := range h.counts {
+		s.Count += h.counts[i].Load()
+		if i < len(h.bounds) {
+			s.Cumulative[i] = s.Count
+		}
+	}
+	return s
+}
+
+// Quantile estimates the q-quantile, 0 < q <= 1, by interpolating within the bucket it falls in.
+// Values above the last bound are reported as that bound; without observations it returns 0.
+func (s HistogramSnapshot) Quantile(q float64) float64 {
+	if s.Count == 0 || len(s.Bounds) == 0 {
+		return 0
+	}
+	rank := q * float64(s.Count)
+	var below uint64
+	lower := 0.0
+	for i, n := range s.Cumulative {
+		if float64(n) >= rank {
+			in := n - below
+			if in == 0 {
+				return s.Bounds[i]
+			}
+			return lower + (s.Bounds[i]-lower)*(rank-float64(below))/float64(in)
+		}
+		below, lower = n, s.Bounds[i]
+	}
+	return s.Bounds[len(s.Bounds)-1]
+}
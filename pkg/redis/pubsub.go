@@ -0,0 +1,81 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Subscription receives messages published to a set of channels over its own connection
+type Subscription struct {
+	client *Client
+	once   sync.Once
+}
+
+// Message is one published payload
+type Message struct {
+	Channel string
+	Payload string
+}
+
+// Subscribe opens a dedicated connection subscribed to channels. Close it when done;
+// cancelling ctx also closes it.
+func (c *Client) Subscribe(ctx context.Context, channels ...string) (*Subscription, error) {
+	sub := &Subscription{client: NewClient(c.opts)}
+	conn := sub.client
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if err := conn.connect(ctx); err != nil {
+		return nil, err
+	}
+	args := []any{"SUBSCRIBE"}
+	for _, ch := range channels {
+		args = append(args, ch)
+	}
+	// every channel is confirmed with its own reply
+	if _, err := conn.roundTrip(ctx, args); err != nil {
+		conn.conn.Close()
+		return nil, err
+	}
+	for range channels[1:] {
+		if _, err := conn.readReply(); err != nil {
+			conn.conn.Close()
+			return nil, err
+		}
+	}
+	// the subscription outlives the setup call; clear the setup deadline
+	conn.conn.SetDeadline(time.Time{})
+	go func() {
+		<-ctx.Done()
+		sub.Close()
+	}()
+	return sub, nil
+}
+
+// Receive blocks until a message arrives or the subscription is closed
+func (s *Subscription) Receive() (Message, error) {
+	for {
+		reply, err := s.client.readReply()
+		if err != nil {
+			return Message{}, err
+		}
+		parts, ok := reply.([]any)
+		if !ok || len(parts) != 3 {
+			return Message{}, fmt.Errorf("redis: unexpected push %v", reply)
+		}
+		if kind, _ := parts[0].(string); kind != "message" {
+			continue
+		}
+		channel, _ := parts[1].(string)
+		payload, _ := parts[2].(string)
+		return Message{Channel: channel, Payload: payload}, nil
+	}
+}
+
+// Close ends the subscription
+func (s *Subscription) Close() error {
+	var err error
+	s.once.Do(func() { err = s.client.conn.Close() })
+	return err
+}
@@ -0,0 +1,231 @@
+// Package redis is a minimal RESP client covering the handful of commands the balancer's
+// distributed features need (leases, shared state). It keeps a single connection per Client
+// and redials transparently after errors.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrNil is returned when Redis replies with a nil bulk string or array
+var ErrNil = errors.New("redis: nil reply")
+
+// Error is an error reply sent by the server
+type Error string
+
+func (e Error) Error() string { return "redis: " + string(e) }
+
+// Options configures a Client
+type Options struct {
+	Addr     string
+	Password string
+	DB       int
+	// DialTimeout bounds connection setup when the context has no deadline; default 5s
+	DialTimeout time.Duration
+}
+
+// Client issues commands over one connection; it is safe for concurrent use but serializes commands
+type Client struct {
+	opts Options
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// NewClient creates a Client; the connection is opened lazily
+func NewClient(opts Options) *Client {
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	return &Client{opts: opts}
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// Do sends a command and returns its reply: string, int64, []any or nil, or an Error
+func (c *Client) Do(ctx context.Context, args ...any) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.connect(ctx); err != nil {
+		return nil, err
+	}
+	reply, err := c.roundTrip(ctx, args)
+	var replyErr Error
+	if err != nil && !errors.As(err, &replyErr) && !errors.Is(err, ErrNil) {
+		// the stream may be out of sync; start over on the next call
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+func (c *Client) connect(ctx context.Context) error {
+	if c.conn != nil {
+		return nil
+	}
+	dialCtx := ctx
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, c.opts.DialTimeout)
+		defer cancel()
+	}
+	conn, err := new(net.Dialer).DialContext(dialCtx, "tcp", c.opts.Addr)
+	if err != nil {
+		return err
+	}
+	c.conn, c.rd = conn, bufio.NewReader(conn)
+	if c.opts.Password != "" {
+		if _, err := c.roundTrip(ctx, []any{"AUTH", c.opts.Password}); err != nil {
+			c.conn.Close()
+			c.conn = nil
+			return err
+		}
+	}
+	if c.opts.DB != 0 {
+		if _, err := c.roundTrip(ctx, []any{"SELECT", c.opts.DB}); err != nil {
+			c.conn.Close()
+			c.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) roundTrip(ctx context.Context, args []any) (any, error) {
+	deadline, _ := ctx.Deadline()
+	c.conn.SetDeadline(deadline)
+
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, a := range args {
+		s := toArg(a)
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(s)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, s...)
+		buf = append(buf, '\r', '\n')
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func toArg(a any) string {
+	switch v := a.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case time.Duration:
+		return strconv.FormatInt(v.Milliseconds(), 10)
+	}
+	return fmt.Sprint(a)
+}
+
+func (c *Client) readLine() (string, error) {
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: malformed reply %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+func (c *Client) readReply() (any, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, ErrNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, ErrNil
+		}
+		out := make([]any, n)
+		for i := range out {
+			v, err := c.readReply()
+			if err != nil && !errors.Is(err, ErrNil) {
+				return nil, err
+			}
+			out[i] = v
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// String runs a command whose reply is a bulk or simple string
+func (c *Client) String(ctx context.Context, args ...any) (string, error) {
+	v, err := c.Do(ctx, args...)
+	if err != nil {
+		return "", err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("redis: expected string reply, got %T", v)
+	}
+	return s, nil
+}
+
+// Int runs a command whose reply is an integer
+func (c *Client) Int(ctx context.Context, args ...any) (int64, error) {
+	v, err := c.Do(ctx, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := v.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: expected integer reply, got %T", v)
+	}
+	return n, nil
+}
@@ -0,0 +1,206 @@
+// Package router compiles host and path rules into a structure that resolves requests
+// in time proportional to the path length.
+package router
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Rule describes a host/path rule resolved to a target.
+// Host may be an exact name, a "*.example.com" wildcard, or empty for any host.
+// Exactly one of PathPrefix or PathRegex should be set; an empty rule matches everything.
+type Rule[T any] struct {
+	Host       string
+	PathPrefix string
+	PathRegex  string
+	Target     T
+}
+
+// Table is the compiled form of a rule list.
+// Lookups cost one map probe per host form plus a walk of the path through a radix tree,
+// so match time depends on the path length rather than on the number of prefix rules.
+// Regex rules are the exception: each one is tried in turn.
+type Table[T any] struct {
+	exact    map[string]*hostRoutes[T]
+	wildcard map[string]*hostRoutes[T]
+	any      *hostRoutes[T]
+}
+
+// hostRoutes holds the path rules that apply to one host pattern
+type hostRoutes[T any] struct {
+	prefixes radixTree[T]
+	regexes  []*regexp.Regexp
+	targets  []T // the target of each regex rule
+}
+
+// Compile builds a Table from rules. Within a host, regex rules are tried first
+// in declaration order, then the longest matching path prefix wins. Of rules with the
+// same host and path prefix, the first declared is kept.
+func Compile[T any](rules []Rule[T]) (*Table[T], error) {
+	rt := &Table[T]{
+		exact:    make(map[string]*hostRoutes[T]),
+		wildcard: make(map[string]*hostRoutes[T]),
+	}
+	for _, rule := range rules {
+		hr := rt.hostRoutesFor(strings.ToLower(rule.Host))
+		if rule.PathRegex != "" {
+			if rule.PathPrefix != "" {
+				return nil, fmt.Errorf("route for host %q sets both a path prefix and a path regex", rule.Host)
+			}
+			re, err := regexp.Compile(rule.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf("route for host %q: %w", rule.Host, err)
+			}
+			hr.regexes = append(hr.regexes, re)
+			hr.targets = append(hr.targets, rule.Target)
+			continue
+		}
+		hr.prefixes.insert(rule.PathPrefix, rule.Target)
+	}
+	return rt, nil
+}
+
+func (rt *Table[T]) hostRoutesFor(host string) *hostRoutes[T] {
+	var table map[string]*hostRoutes[T]
+	switch {
+	case host == "" || host == "*":
+		if rt.any == nil {
+			rt.any = &hostRoutes[T]{}
+		}
+		return rt.any
+	case strings.HasPrefix(host, "*."):
+		table, host = rt.wildcard, host[2:]
+	default:
+		table = rt.exact
+	}
+	hr, ok := table[host]
+	if !ok {
+		hr = &hostRoutes[T]{}
+		table[host] = hr
+	}
+	return hr
+}
+
+func (hr *hostRoutes[T]) match(path string) (T, bool) {
+	// one at a time, so the first rule declared wins rather than the one matching leftmost
+	for i, re := range hr.regexes {
+		if re.MatchString(path) {
+			return hr.targets[i], true
+		}
+	}
+	return hr.prefixes.longestPrefix(path)
+}
+
+// Match resolves host and path to the target of the most specific rule
+func (rt *Table[T]) Match(host, path string) (T, bool) {
+	host = strings.ToLower(stripPort(host))
+	if hr, ok := rt.exact[host]; ok {
+		if target, ok := hr.match(path); ok {
+			return target, true
+		}
+	}
+	for h := host; ; {
+		dot := strings.IndexByte(h, '.')
+		if dot < 0 {
+			break
+		}
+		h = h[dot+1:]
+		if hr, ok := rt.wildcard[h]; ok {
+			if target, ok := hr.match(path); ok {
+				return target, true
+			}
+		}
+	}
+	if rt.any != nil {
+		return rt.any.match(path)
+	}
+	var zero T
+	return zero, false
+}
+
+// stripPort removes an optional port, and the brackets of an IPv6 literal, from a Host header value
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// radixTree is a compressed prefix tree supporting longest-prefix lookups
+type radixTree[T any] struct {
+	root radixNode[T]
+}
+
+type radixNode[T any] struct {
+	prefix   string
+	children []*radixNode[T]
+	value    T
+	hasValue bool
+}
+
+// insert adds key, unless it is already there: the value inserted first is kept
+func (t *radixTree[T]) insert(key string, value T) {
+	n := &t.root
+	for {
+		if key == "" {
+			if !n.hasValue {
+				n.value, n.hasValue = value, true
+			}
+			return
+		}
+		child := n.child(key[0])
+		if child == nil {
+			n.children = append(n.children, &radixNode[T]{prefix: key, value: value, hasValue: true})
+			return
+		}
+		common := commonPrefixLen(key, child.prefix)
+		if common < len(child.prefix) {
+			// split the child so the shared part becomes an inner node
+			split := &radixNode[T]{
+				prefix:   child.prefix[common:],
+				children: child.children,
+				value:    child.value,
+				hasValue: child.hasValue,
+			}
+			*child = radixNode[T]{prefix: child.prefix[:common], children: []*radixNode[T]{split}}
+		}
+		n, key = child, key[common:]
+	}
+}
+
+func (t *radixTree[T]) longestPrefix(key string) (T, bool) {
+	n := &t.root
+	best, found := n.value, n.hasValue
+	for key != "" {
+		child := n.child(key[0])
+		if child == nil || !strings.HasPrefix(key, child.prefix) {
+			break
+		}
+		key = key[len(child.prefix):]
+		n = child
+		if n.hasValue {
+			best, found = n.value, true
+		}
+	}
+	return best, found
+}
+
+func (n *radixNode[T]) child(b byte) *radixNode[T] {
+	for _, c := range n.children {
+		if c.prefix[0] == b {
+			return c
+		}
+	}
+	return nil
+}
+
+func commonPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,112 @@
+package router
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	rules := []Rule[string]{
+		{PathPrefix: "/", Target: "default"},
+		{PathPrefix: "/api", Target: "api"},
+		{PathPrefix: "/api/v2", Target: "api-v2"},
+		{PathRegex: `\.png$`, Target: "png"},
+		// matches further left in /files/x.png than the png rule, but was declared after it
+		{PathRegex: `^/files/`, Target: "files"},
+		{PathRegex: `/f`, Target: "late"},
+		{Host: "example.com", PathPrefix: "/api", Target: "example-api"},
+		{Host: "example.com", PathRegex: `/v[0-9]+/`, Target: "example-versioned"},
+		{Host: "*.example.com", PathPrefix: "/", Target: "sub"},
+		{Host: "*.example.com", PathPrefix: "/api", Target: "sub-api"},
+		{Host: "deep.sub.example.com", PathPrefix: "/only", Target: "deep"},
+	}
+	table, err := Compile(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host, path string
+		want       string
+	}{
+		{"other.org", "/", "default"},
+		{"other.org", "/apix", "api"},
+		{"other.org", "/api/v2/users", "api-v2"},
+		{"other.org", "/api/v1/users", "api"},
+		{"other.org", "/files/x.png", "png"},
+		{"other.org", "/files/x.txt", "files"},
+		{"other.org", "/ff", "late"},
+		{"other.org:8080", "/api", "api"},
+		{"example.com", "/api/users", "example-api"},
+		// regex rules of a host come before its prefixes
+		{"example.com", "/api/v1/users", "example-versioned"},
+		// a host with no matching rule of its own falls back to the catch-all
+		{"example.com", "/files/x.png", "png"},
+		{"EXAMPLE.com", "/api", "example-api"},
+		{"a.example.com", "/", "sub"},
+		{"a.example.com", "/api/x", "sub-api"},
+		{"deep.sub.example.com", "/only/this", "deep"},
+		{"deep.sub.example.com", "/api", "sub-api"},
+		{"[::1]:8080", "/api", "api"},
+	}
+	for _, tt := range tests {
+		got, ok := table.Match(tt.host, tt.path)
+		if !ok || got != tt.want {
+			t.Errorf("Match(%q, %q) = %q, %v; want %q", tt.host, tt.path, got, ok, tt.want)
+		}
+	}
+}
+
+func TestMatchNothing(t *testing.T) {
+	table, err := Compile([]Rule[string]{
+		{Host: "example.com", PathPrefix: "/api", Target: "api"},
+		{Host: "example.com", PathRegex: `^/x$`, Target: "x"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct{ host, path string }{
+		{"example.com", "/"},
+		{"example.com", "/xy"},
+		{"other.org", "/api"},
+	} {
+		if got, ok := table.Match(tt.host, tt.path); ok {
+			t.Errorf("Match(%q, %q) = %q, want no match", tt.host, tt.path, got)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule[string]
+	}{
+		{"prefix and regex", Rule[string]{PathPrefix: "/a", PathRegex: "^/a"}},
+		{"bad regex", Rule[string]{PathRegex: "("}},
+	}
+	for _, tt := range tests {
+		if _, err := Compile([]Rule[string]{tt.rule}); err == nil {
+			t.Errorf("%s: Compile succeeded", tt.name)
+		}
+	}
+}
+
+func TestDuplicateRulesKeepFirst(t *testing.T) {
+	table, err := Compile([]Rule[string]{
+		{Host: "example.com", PathPrefix: "/api", Target: "first"},
+		{Host: "*.example.com", PathPrefix: "/", Target: "first-wildcard"},
+		{Host: "EXAMPLE.com", PathPrefix: "/api", Target: "second"},
+		{Host: "*.example.com", PathPrefix: "/", Target: "second-wildcard"},
+		// a prefix that ends inside an existing node, then the same again
+		{Host: "example.com", PathPrefix: "/a", Target: "first-short"},
+		{Host: "example.com", PathPrefix: "/a", Target: "second-short"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct{ host, path, want string }{
+		{"example.com", "/api/x", "first"},
+		{"example.com", "/about", "first-short"},
+		{"a.example.com", "/", "first-wildcard"},
+	} {
+		if got, _ := table.Match(tt.host, tt.path); got != tt.want {
+			t.Errorf("Match(%q, %q) = %q, want %q", tt.host, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package schedule
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Window is a recurring period that opens on a schedule and stays open for a duration.
+// It caches its answer for the current minute, so it is cheap to consult on every request.
+type Window struct {
+	schedule *Schedule
+	duration time.Duration
+	location *time.Location
+
+	mu     sync.Mutex
+	minute time.Time
+	open   bool
+}
+
+// NewWindow parses spec into a window of length d read in loc; a nil loc means UTC
+func NewWindow(spec string, d time.Duration, loc *time.Location) (*Window, error) {
+	if d <= 0 {
+		return nil, errors.New("schedule: window duration must be positive")
+	}
+	s, err := Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	return &Window{schedule: s, duration: d, location: loc}, nil
+}
+
+// Open reports whether the window is open at t
+func (w *Window) Open(t time.Time) bool {
+	minute := t.Truncate(time.Minute)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !minute.Equal(w.minute) {
+		_, w.open = w.schedule.Active(t.In(w.location), w.duration)
+		w.minute = minute
+	}
+	return w.open
+}
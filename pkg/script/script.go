@@ -0,0 +1,579 @@
+// Package script implements the small expression language used in config to make per-request
+// decisions, such as header values, path rewrites and backend choices.
+//
+// Expressions support string, number and boolean literals, variables supplied by the caller,
+// the operators ! - * / + == != < <= > >= && || and function calls. Built-in functions are
+// lower, upper, trim, startsWith, endsWith, contains, matches, replace and len.
+//
+//	startsWith(path, "/api/") && header("X-Beta") == "1"
+package script
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Func is a function callable from an expression
+type Func func(args ...any) (any, error)
+
+// Env resolves the variables and functions an expression refers to.
+// Values must be string, float64 or bool; funcs must be Func.
+type Env map[string]any
+
+// Program is a compiled expression, safe for concurrent use
+type Program struct {
+	src  string
+	root node
+}
+
+// Compile parses src into a Program
+func Compile(src string) (*Program, error) {
+	p := &parser{lex: lexer{src: src}}
+	p.next()
+	root, err := p.parseExpr(0)
+	if err != nil {
+		return nil, fmt.Errorf("script %q: %w", src, err)
+	}
+	if p.tok.kind != tokEOF {
+		return nil, fmt.Errorf("script %q: unexpected %q at offset %d", src, p.tok.text, p.tok.pos)
+	}
+	return &Program{src: src, root: root}, nil
+}
+
+// MustCompile is like Compile but panics on error
+func MustCompile(src string) *Program {
+	p, err := Compile(src)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// String returns the source the program was compiled from
+func (p *Program) String() string {
+	return p.src
+}
+
+// Eval runs the program against env
+func (p *Program) Eval(env Env) (any, error) {
+	v, err := p.root.eval(env)
+	if err != nil {
+		return nil, fmt.Errorf("script %q: %w", p.src, err)
+	}
+	return v, nil
+}
+
+// EvalBool runs the program and reports whether the result is truthy
+func (p *Program) EvalBool(env Env) (bool, error) {
+	v, err := p.Eval(env)
+	if err != nil {
+		return false, err
+	}
+	return Truthy(v), nil
+}
+
+// EvalString runs the program and formats the result as a string
+func (p *Program) EvalString(env Env) (string, error) {
+	v, err := p.Eval(env)
+	if err != nil {
+		return "", err
+	}
+	return ToString(v), nil
+}
+
+// Truthy reports whether v counts as true: true, a non-empty string or a non-zero number
+func Truthy(v any) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case float64:
+		return v != 0
+	}
+	return false
+}
+
+// ToString formats v the way string concatenation does
+func ToString(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprint(v)
+}
+
+// lexer
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+)
+
+type token struct {
+	kind tokKind
+	text string
+	pos  int
+}
+
+type lexer struct {
+	src string
+	pos int
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) && strings.IndexByte(" \t\r\n", l.src[l.pos]) >= 0 {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+	c := l.src[l.pos]
+	switch {
+	case c == '"' || c == '\'':
+		l.pos++
+		var sb strings.Builder
+		for l.pos < len(l.src) && l.src[l.pos] != c {
+			if l.src[l.pos] == '\\' && l.pos+1 < len(l.src) {
+				l.pos++
+				switch l.src[l.pos] {
+				case 'n':
+					sb.WriteByte('\n')
+				case 't':
+					sb.WriteByte('\t')
+				default:
+					sb.WriteByte(l.src[l.pos])
+				}
+			} else {
+				sb.WriteByte(l.src[l.pos])
+			}
+			l.pos++
+		}
+		if l.pos >= len(l.src) {
+			return token{}, fmt.Errorf("unterminated string at offset %d", start)
+		}
+		l.pos++
+		return token{kind: tokString, text: sb.String(), pos: start}, nil
+	case c >= '0' && c <= '9':
+		for l.pos < len(l.src) && (l.src[l.pos] >= '0' && l.src[l.pos] <= '9' || l.src[l.pos] == '.') {
+			l.pos++
+		}
+		return token{kind: tokNumber, text: l.src[start:l.pos], pos: start}, nil
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		for l.pos < len(l.src) && isIdentByte(l.src[l.pos]) {
+			l.pos++
+		}
+		return token{kind: tokIdent, text: l.src[start:l.pos], pos: start}, nil
+	}
+	for _, op := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "(", ")", ","} {
+		if strings.HasPrefix(l.src[l.pos:], op) {
+			l.pos += len(op)
+			return token{kind: tokOp, text: op, pos: start}, nil
+		}
+	}
+	return token{}, fmt.Errorf("unexpected character %q at offset %d", c, start)
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '.' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// parser is a precedence-climbing parser over the token stream
+
+type parser struct {
+	lex lexer
+	tok token
+	err error
+}
+
+func (p *parser) next() {
+	if p.err != nil {
+		return
+	}
+	p.tok, p.err = p.lex.next()
+}
+
+var precedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3,
+	"<": 4, "<=": 4, ">": 4, ">=": 4,
+	"+": 5, "-": 5,
+	"*": 6, "/": 6,
+}
+
+func (p *parser) parseExpr(minPrec int) (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if p.err != nil {
+			return nil, p.err
+		}
+		prec, ok := precedence[p.tok.text]
+		if p.tok.kind != tokOp || !ok || prec <= minPrec {
+			return left, nil
+		}
+		op := p.tok.text
+		p.next()
+		right, err := p.parseExpr(prec)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.tok.kind == tokOp && (p.tok.text == "!" || p.tok.text == "-") {
+		op := p.tok.text
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: op, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	tok := p.tok
+	switch tok.kind {
+	case tokString:
+		p.next()
+		return literalNode{tok.text}, nil
+	case tokNumber:
+		p.next()
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", tok.text)
+		}
+		return literalNode{f}, nil
+	case tokIdent:
+		p.next()
+		switch tok.text {
+		case "true":
+			return literalNode{true}, nil
+		case "false":
+			return literalNode{false}, nil
+		}
+		if p.tok.kind == tokOp && p.tok.text == "(" {
+			return p.parseCall(tok.text)
+		}
+		return varNode(tok.text), nil
+	case tokOp:
+		if tok.text == "(" {
+			p.next()
+			inner, err := p.parseExpr(0)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return inner, nil
+		}
+	case tokEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+}
+
+func (p *parser) parseCall(name string) (node, error) {
+	p.next() // (
+	call := &callNode{name: name}
+	for !(p.tok.kind == tokOp && p.tok.text == ")") {
+		if len(call.args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+	}
+	p.next() // )
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	// precompile constant patterns so matches() doesn't compile a regexp per request
+	if name == "matches" && len(call.args) == 2 {
+		if lit, ok := call.args[1].(literalNode); ok {
+			pattern, _ := lit.v.(string)
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, err
+			}
+			call.re = re
+		}
+	}
+	return call, nil
+}
+
+func (p *parser) expect(op string) error {
+	if p.err != nil {
+		return p.err
+	}
+	if p.tok.kind != tokOp || p.tok.text != op {
+		return fmt.Errorf("expected %q at offset %d", op, p.tok.pos)
+	}
+	p.next()
+	return p.err
+}
+
+// AST
+
+type node interface {
+	eval(env Env) (any, error)
+}
+
+type literalNode struct{ v any }
+
+func (n literalNode) eval(Env) (any, error) { return n.v, nil }
+
+type varNode string
+
+func (n varNode) eval(env Env) (any, error) {
+	v, ok := env[string(n)]
+	if !ok {
+		return nil, fmt.Errorf("undefined variable %q", string(n))
+	}
+	return v, nil
+}
+
+type unaryNode struct {
+	op      string
+	operand node
+}
+
+func (n *unaryNode) eval(env Env) (any, error) {
+	v, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		return !Truthy(v), nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("cannot negate %T", v)
+	}
+	return -f, nil
+}
+
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+func (n *binaryNode) eval(env Env) (any, error) {
+	l, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "&&":
+		if !Truthy(l) {
+			return false, nil
+		}
+		r, err := n.right.eval(env)
+		return Truthy(r), err
+	case "||":
+		if Truthy(l) {
+			return true, nil
+		}
+		r, err := n.right.eval(env)
+		return Truthy(r), err
+	}
+
+	r, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return equal(l, r), nil
+	case "!=":
+		return !equal(l, r), nil
+	case "+":
+		lf, lok := l.(float64)
+		rf, rok := r.(float64)
+		if lok && rok {
+			return lf + rf, nil
+		}
+		return ToString(l) + ToString(r), nil
+	}
+
+	if ls, ok := l.(string); ok {
+		rs, ok := r.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare string with %T", r)
+		}
+		switch n.op {
+		case "<":
+			return ls < rs, nil
+		case "<=":
+			return ls <= rs, nil
+		case ">":
+			return ls > rs, nil
+		case ">=":
+			return ls >= rs, nil
+		}
+		return nil, fmt.Errorf("operator %s not defined on strings", n.op)
+	}
+
+	lf, err := toNumber(l)
+	if err != nil {
+		return nil, err
+	}
+	rf, err := toNumber(r)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "<":
+		return lf < rf, nil
+	case "<=":
+		return lf <= rf, nil
+	case ">":
+		return lf > rf, nil
+	case ">=":
+		return lf >= rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		if rf == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return lf / rf, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", n.op)
+}
+
+func equal(l, r any) bool {
+	if lf, ok := l.(float64); ok {
+		if rs, ok := r.(string); ok {
+			// header and query values are strings, so let "5" == 5 hold
+			rf, err := strconv.ParseFloat(rs, 64)
+			return err == nil && lf == rf
+		}
+	}
+	if ls, ok := l.(string); ok {
+		if _, ok := r.(float64); ok {
+			return equal(r, ls)
+		}
+	}
+	return l == r
+}
+
+func toNumber(v any) (float64, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a number", v)
+		}
+		return f, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("%T is not a number", v)
+}
+
+type callNode struct {
+	name string
+	args []node
+	re   *regexp.Regexp
+}
+
+func (n *callNode) eval(env Env) (any, error) {
+	args := make([]any, len(n.args))
+	for i, a := range n.args {
+		v, err := a.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	if fn, ok := env[n.name].(Func); ok {
+		return fn(args...)
+	}
+	if n.re != nil {
+		return n.re.MatchString(ToString(args[0])), nil
+	}
+	builtin, ok := builtins[n.name]
+	if !ok {
+		return nil, fmt.Errorf("undefined function %q", n.name)
+	}
+	if builtin.arity >= 0 && len(args) != builtin.arity {
+		return nil, fmt.Errorf("%s takes %d arguments, got %d", n.name, builtin.arity, len(args))
+	}
+	return builtin.fn(args...)
+}
+
+type builtinFunc struct {
+	arity int
+	fn    Func
+}
+
+func stringFunc1(fn func(string) string) builtinFunc {
+	return builtinFunc{1, func(args ...any) (any, error) { return fn(ToString(args[0])), nil }}
+}
+
+func stringPred2(fn func(string, string) bool) builtinFunc {
+	return builtinFunc{2, func(args ...any) (any, error) { return fn(ToString(args[0]), ToString(args[1])), nil }}
+}
+
+var builtins = map[string]builtinFunc{
+	"lower":      stringFunc1(strings.ToLower),
+	"upper":      stringFunc1(strings.ToUpper),
+	"trim":       stringFunc1(strings.TrimSpace),
+	"startsWith": stringPred2(strings.HasPrefix),
+	"endsWith":   stringPred2(strings.HasSuffix),
+	"contains":   stringPred2(strings.Contains),
+	"len": {1, func(args ...any) (any, error) {
+		return float64(len(ToString(args[0]))), nil
+	}},
+	"replace": {3, func(args ...any) (any, error) {
+		return strings.ReplaceAll(ToString(args[0]), ToString(args[1]), ToString(args[2])), nil
+	}},
+	"matches": {2, func(args ...any) (any, error) {
+		re, err := regexp.Compile(ToString(args[1]))
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString(ToString(args[0])), nil
+	}},
+}
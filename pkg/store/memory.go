@@ -0,0 +1,145 @@
+package store
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is a Store local to the process, for single instances and tests
+type Memory struct {
+	mu       sync.Mutex
+	entries  map[string]memoryEntry
+	watchers map[*memoryWatcher]struct{}
+	sets     int
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+type memoryWatcher struct {
+	prefix string
+	ch     chan Event
+}
+
+// sweepEvery is how many writes pass between scans for expired entries
+const sweepEvery = 1024
+
+var _ Store = (*Memory)(nil)
+
+// NewMemory creates an empty Memory store
+func NewMemory() *Memory {
+	return &Memory{
+		entries:  make(map[string]memoryEntry),
+		watchers: make(map[*memoryWatcher]struct{}),
+	}
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+func expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+// Get implements Store
+func (m *Memory) Get(_ context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok || e.expired(time.Now()) {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), e.value...), nil
+}
+
+// Set implements Store
+func (m *Memory) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	value = append([]byte(nil), value...)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.write(key, memoryEntry{value: value, expires: expiry(ttl)})
+	m.notify(Event{Key: key, Value: value})
+	return nil
+}
+
+// Delete implements Store
+func (m *Memory) Delete(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.entries[key]; ok {
+		delete(m.entries, key)
+		m.notify(Event{Key: key, Deleted: true})
+	}
+	return nil
+}
+
+// Incr implements Store
+func (m *Memory) Incr(_ context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	var n int64
+	if ok && !e.expired(time.Now()) {
+		var err error
+		if n, err = strconv.ParseInt(string(e.value), 10, 64); err != nil {
+			return 0, err
+		}
+	} else {
+		e = memoryEntry{expires: expiry(ttl)}
+	}
+	n += delta
+	e.value = strconv.AppendInt(nil, n, 10)
+	m.write(key, e)
+	return n, nil
+}
+
+// Watch implements Store
+func (m *Memory) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	w := &memoryWatcher{prefix: prefix, ch: make(chan Event, watchBuffer)}
+	m.mu.Lock()
+	m.watchers[w] = struct{}{}
+	m.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		m.mu.Lock()
+		delete(m.watchers, w)
+		close(w.ch)
+		m.mu.Unlock()
+	}()
+	return w.ch, nil
+}
+
+// write stores e and occasionally drops expired entries; m.mu must be held
+func (m *Memory) write(key string, e memoryEntry) {
+	m.entries[key] = e
+	if m.sets++; m.sets%sweepEvery == 0 {
+		now := time.Now()
+		for k, e := range m.entries {
+			if e.expired(now) {
+				delete(m.entries, k)
+			}
+		}
+	}
+}
+
+// notify delivers ev to matching watchers without blocking; m.mu must be held
+func (m *Memory) notify(ev Event) {
+	for w := range m.watchers {
+		if !strings.HasPrefix(ev.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.ch <- ev:
+		default:
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/redis"
+)
+
+// incrScript increments a counter and sets its expiry only when the increment created it
+const incrScript = `
+local n = redis.call('INCRBY', KEYS[1], ARGV[1])
+if tonumber(ARGV[2]) > 0 and redis.call('PTTL', KEYS[1]) == -1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return n`
+
+// Redis is a Store shared by every instance pointed at the same server. Keys are namespaced
+// by a prefix, and changes are announced on a pub/sub channel so Watch works without
+// keyspace notifications being enabled on the server.
+type Redis struct {
+	client *redis.Client
+	prefix string
+}
+
+var _ Store = (*Redis)(nil)
+
+// redisEvent is the payload published for every change
+type redisEvent struct {
+	Key     string `json:"k"`
+	Value   []byte `json:"v,omitempty"`
+	Deleted bool   `json:"d,omitempty"`
+}
+
+// NewRedis creates a Store over client with every key prefixed by prefix, e.g. "lb:"
+func NewRedis(client *redis.Client, prefix string) *Redis {
+	return &Redis{client: client, prefix: prefix}
+}
+
+func (r *Redis) channel() string {
+	return r.prefix + "__events"
+}
+
+// Get implements Store
+func (r *Redis) Get(ctx context.Context, key string) ([]byte, error) {
+	v, err := r.client.String(ctx, "GET", r.prefix+key)
+	if errors.Is(err, redis.ErrNil) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(v), nil
+}
+
+// Set implements Store
+func (r *Redis) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	args := []any{"SET", r.prefix + key, value}
+	if ttl > 0 {
+		args = append(args, "PX", ttl)
+	}
+	if _, err := r.client.Do(ctx, args...); err != nil {
+		return err
+	}
+	return r.publish(ctx, redisEvent{Key: key, Value: value})
+}
+
+// Delete implements Store
+func (r *Redis) Delete(ctx context.Context, key string) error {
+	n, err := r.client.Int(ctx, "DEL", r.prefix+key)
+	if err != nil || n == 0 {
+		return err
+	}
+	return r.publish(ctx, redisEvent{Key: key, Deleted: true})
+}
+
+// Incr implements Store
+func (r *Redis) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	return r.client.Int(ctx, "EVAL", incrScript, 1, r.prefix+key, delta, ttl)
+}
+
+func (r *Redis) publish(ctx context.Context, ev redisEvent) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.Int(ctx, "PUBLISH", r.channel(), payload)
+	return err
+}
+
+// Watch implements Store
+func (r *Redis) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	sub, err := r.client.Subscribe(ctx, r.channel())
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan Event, watchBuffer)
+	go func() {
+		defer close(ch)
+		defer sub.Close()
+		for {
+			msg, err := sub.Receive()
+			if err != nil {
+				return
+			}
+			var ev redisEvent
+			if json.Unmarshal([]byte(msg.Payload), &ev) != nil || !strings.HasPrefix(ev.Key, prefix) {
+				continue
+			}
+			select {
+			case ch <- Event{Key: ev.Key, Value: ev.Value, Deleted: ev.Deleted}:
+			default:
+			}
+		}
+	}()
+	return ch, nil
+}
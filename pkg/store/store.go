@@ -0,0 +1,41 @@
+// Package store defines the shared-state abstraction used by the balancer's distributed
+// features (sticky sessions, rate limits, cluster state) together with an in-process
+// implementation and one backed by Redis.
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned by Get when the key does not exist or has expired
+var ErrNotFound = errors.New("store: key not found")
+
+// Event describes a change to a watched key
+type Event struct {
+	Key   string
+	Value []byte
+	// Deleted is set when the key was removed; expiry is not reported
+	Deleted bool
+}
+
+// Store is a key-value store with per-key expiry. Implementations are safe for concurrent use.
+type Store interface {
+	// Get returns the value stored at key or ErrNotFound
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set stores value at key; a ttl of zero means the key never expires
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Delete removes key; deleting a missing key is not an error
+	Delete(ctx context.Context, key string) error
+	// Incr atomically adds delta to the integer at key and returns the result.
+	// A missing key starts at zero; ttl applies when the key is created.
+	// Counter updates are not delivered to watchers.
+	Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+	// Watch delivers changes to keys starting with prefix until ctx is done.
+	// Slow receivers may miss events.
+	Watch(ctx context.Context, prefix string) (<-chan Event, error)
+}
+
+// watchBuffer is the number of events queued for a watcher before new ones are dropped
+const watchBuffer = 64
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package systemd
+
+// Listeners always returns nil: socket activation only exists on Unix systems
+func Listeners() ([]Listener, error) {
+	return nil, nil
+}
@@ -0,0 +1,11 @@
+// Package systemd implements the receiving side of systemd socket activation, so the balancer
+// can be started by a .socket unit and restarted without closing the listening socket.
+package systemd
+
+import "net"
+
+// Listener is a socket handed over by systemd together with its FileDescriptorName
+type Listener struct {
+	Name string
+	net.Listener
+}
@@ -0,0 +1,135 @@
+// Package traffic defines the on-disk format for recorded requests and provides an asynchronous
+// recorder and a reader for it. A recording is a file of JSON objects, one per line.
+package traffic
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Record is one sampled request and the response the balancer returned for it
+type Record struct {
+	Time          time.Time     `json:"time"`
+	Method        string        `json:"method"`
+	Host          string        `json:"host"`
+	URI           string        `json:"uri"`
+	Header        http.Header   `json:"header,omitempty"`
+	Body          []byte        `json:"body,omitempty"`
+	BodyTruncated bool          `json:"body_truncated,omitempty"`
+	Backend       string        `json:"backend,omitempty"`
+	Status        int           `json:"status"`
+	ResponseSize  int64         `json:"response_size"`
+	ResponseBody  []byte        `json:"response_body,omitempty"`
+	Duration      time.Duration `json:"duration_ns"`
+}
+
+// ErrClosed is returned when writing to a closed Recorder
+var ErrClosed = errors.New("traffic: recorder closed")
+
+// recorderQueue is the number of records buffered before new ones are dropped
+const recorderQueue = 1024
+
+// Recorder writes records in the background so the request path never waits on disk
+type Recorder struct {
+	w       *bufio.Writer
+	closer  io.Closer
+	queue   chan *Record
+	done    chan struct{}
+	dropped atomic.Uint64
+	once    sync.Once
+	mu      sync.RWMutex
+	closed  bool
+	err     error
+}
+
+// NewRecorder starts a Recorder writing to w. If w is an io.Closer it is closed by Close.
+func NewRecorder(w io.Writer) *Recorder {
+	r := &Recorder{
+		w:     bufio.NewWriter(w),
+		queue: make(chan *Record, recorderQueue),
+		done:  make(chan struct{}),
+	}
+	if c, ok := w.(io.Closer); ok {
+		r.closer = c
+	}
+	go r.loop()
+	return r
+}
+
+func (r *Recorder) loop() {
+	defer close(r.done)
+	enc := json.NewEncoder(r.w)
+	for rec := range r.queue {
+		if err := enc.Encode(rec); err != nil && r.err == nil {
+			r.err = err
+		}
+		if len(r.queue) == 0 {
+			r.w.Flush()
+		}
+	}
+}
+
+// Record queues rec for writing. It never blocks: when the queue is full the record is dropped.
+func (r *Recorder) Record(rec *Record) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return ErrClosed
+	}
+	select {
+	case r.queue <- rec:
+	default:
+		r.dropped.Add(1)
+	}
+	return nil
+}
+
+// Dropped returns the number of records discarded because the writer fell behind
+func (r *Recorder) Dropped() uint64 {
+	return r.dropped.Load()
+}
+
+// Close flushes queued records and closes the underlying writer
+func (r *Recorder) Close() error {
+	r.once.Do(func() {
+		r.mu.Lock()
+		r.closed = true
+		close(r.queue)
+		r.mu.Unlock()
+		<-r.done
+		if err := r.w.Flush(); err != nil && r.err == nil {
+			r.err = err
+		}
+		if r.closer != nil {
+			if err := r.closer.Close(); err != nil && r.err == nil {
+				r.err = err
+			}
+		}
+	})
+	return r.err
+}
+
+// Reader reads records back from a recording
+type Reader struct {
+	dec *json.Decoder
+}
+
+// NewReader creates a Reader over a recording
+func NewReader(r io.Reader) *Reader {
+	return &Reader{dec: json.NewDecoder(bufio.NewReader(r))}
+}
+
+// Next returns the next record, or io.EOF at the end of the recording
+func (r *Reader) Next() (*Record, error) {
+	var rec Record
+	if err := r.dec.Decode(&rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/traffic"
+)
+
+// replayResult is the outcome of replaying one record
+type replayResult struct {
+	rec     *traffic.Record
+	status  int
+	size    int64
+	bodyOK  bool
+	err     error
+	latency time.Duration
+}
+
+// replayReport aggregates replay results
+type replayReport struct {
+	mu            sync.Mutex
+	total         int
+	matched       int
+	statusDiffs   int
+	bodyDiffs     int
+	errors        int
+	truncated     int
+	latencies     []time.Duration
+	verbose       bool
+	out           io.Writer
+	statusChanges map[string]int
+}
+
+func (r *replayReport) add(res replayResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.total++
+	if res.rec.BodyTruncated {
+		r.truncated++
+	}
+	switch {
+	case res.err != nil:
+		r.errors++
+		if r.verbose {
+			fmt.Fprintf(r.out, "ERROR  %s %s: %v\n", res.rec.Method, res.rec.URI, res.err)
+		}
+		return
+	case res.status != res.rec.Status:
+		r.statusDiffs++
+		r.statusChanges[fmt.Sprintf("%d -> %d", res.rec.Status, res.status)]++
+		if r.verbose {
+			fmt.Fprintf(r.out, "STATUS %s %s: recorded %d, got %d\n", res.rec.Method, res.rec.URI, res.rec.Status, res.status)
+		}
+	case !res.bodyOK || res.size != res.rec.ResponseSize:
+		r.bodyDiffs++
+		if r.verbose {
+			fmt.Fprintf(r.out, "BODY   %s %s: recorded %d bytes, got %d\n", res.rec.Method, res.rec.URI, res.rec.ResponseSize, res.size)
+		}
+	default:
+		r.matched++
+	}
+	r.latencies = append(r.latencies, res.latency)
+}
+
+func (r *replayReport) print(elapsed time.Duration) {
+	fmt.Fprintf(r.out, "replayed %d requests in %s\n", r.total, elapsed.Round(time.Millisecond))
+	fmt.Fprintf(r.out, "  matched:          %d\n", r.matched)
+	fmt.Fprintf(r.out, "  status differs:   %d\n", r.statusDiffs)
+	for change, n := range r.statusChanges {
+		fmt.Fprintf(r.out, "    %s: %d\n", change, n)
+	}
+	fmt.Fprintf(r.out, "  body differs:     %d\n", r.bodyDiffs)
+	fmt.Fprintf(r.out, "  errors:           %d\n", r.errors)
+	if r.truncated > 0 {
+		fmt.Fprintf(r.out, "  truncated bodies: %d (sent as recorded)\n", r.truncated)
+	}
+	if len(r.latencies) > 0 {
+		slices.Sort(r.latencies)
+		pct := func(p float64) time.Duration { return r.latencies[int(float64(len(r.latencies)-1)*p)] }
+		fmt.Fprintf(r.out, "  latency p50/p95/p99: %s / %s / %s\n",
+			pct(0.50).Round(time.Microsecond), pct(0.95).Round(time.Microsecond), pct(0.99).Round(time.Microsecond))
+	}
+}
+
+// hopHeaders are not replayed because they describe the original connection
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length"}
+
+func replayOne(client *http.Client, target string, rec *traffic.Record) replayResult {
+	res := replayResult{rec: rec}
+	req, err := http.NewRequest(rec.Method, strings.TrimSuffix(target, "/")+rec.URI, bytes.NewReader(rec.Body))
+	if err != nil {
+		res.err = err
+		return res
+	}
+	req.Header = rec.Header.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	req.Host = rec.Host
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	defer resp.Body.Close()
+	prefix := make([]byte, len(rec.ResponseBody))
+	n, _ := io.ReadFull(resp.Body, prefix)
+	rest, err := io.Copy(io.Discard, resp.Body)
+	res.latency = time.Since(start)
+	res.status = resp.StatusCode
+	res.size = int64(n) + rest
+	res.bodyOK = bytes.Equal(prefix[:n], rec.ResponseBody)
+	res.err = err
+	return res
+}
+
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	file := fs.String("file", "", "recorded traffic file (required)")
+	var targets stringList
+	fs.Var(&targets, "target", "base URL to replay against; may be repeated to spread load over a pool")
+	speed := fs.Float64("speed", 1, "playback speed relative to the recording; 0 sends as fast as possible")
+	concurrency := fs.Int("concurrency", 8, "maximum requests in flight")
+	timeout := fs.Duration("timeout", 30*time.Second, "per-request timeout")
+	verbose := fs.Bool("v", false, "print every difference")
+	fs.Parse(args)
+
+	if *file == "" || len(targets) == 0 {
+		return errors.New("usage: replay -file traffic.jsonl -target http://host:port [-speed 1] [-concurrency 8]")
+	}
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	client := &http.Client{
+		Timeout: *timeout,
+		// report the backend's own redirects instead of following them
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	report := &replayReport{verbose: *verbose, out: os.Stdout, statusChanges: make(map[string]int)}
+
+	work := make(chan *traffic.Record)
+	var wg sync.WaitGroup
+	var next atomic.Uint64
+	for i := 0; i < max(*concurrency, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rec := range work {
+				target := targets[(next.Add(1)-1)%uint64(len(targets))]
+				report.add(replayOne(client, target, rec))
+			}
+		}()
+	}
+
+	start := time.Now()
+	reader := traffic.NewReader(f)
+	var first time.Time
+	for {
+		rec, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			close(work)
+			wg.Wait()
+			return fmt.Errorf("read %s: %w", *file, err)
+		}
+		if first.IsZero() {
+			first = rec.Time
+		}
+		if *speed > 0 {
+			// keep the recording's inter-arrival times, scaled by speed
+			due := time.Duration(float64(rec.Time.Sub(first)) / *speed)
+			if wait := due - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		work <- rec
+	}
+	close(work)
+	wg.Wait()
+	report.print(time.Since(start))
+	return nil
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/loadbalancer"
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/systemd"
+	"github.com/kishan-sin1/simple-go-loadbalancer/pkg/traffic"
+)
+
+func runServe(args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return serve(ctx, args)
+}
+
+// serveFlags are the flags of lb serve
+type serveFlags struct {
+	balancerFlags
+	recordPath    string
+	recordSample  float64
+	recordMaxBody int
+	reloadCheck   time.Duration
+	accessLog     string
+	accessQuery   bool
+	accessToken   string
+	accessKafka   bool
+	accessBuffer  int
+	requestID     string
+	scrub         bool
+	scrubHeaders  stringList
+	scrubQuery    stringList
+	logLevel      slog.Level
+	journal       bool
+	journalSize   int
+	journalFile   string
+
+	kubeIngressClass string
+	kubeGateway      string
+	kubeNamespace    string
+	kubeTLS          bool
+	kubeInterval     time.Duration
+	kubeAPI          string
+	kubeToken        string
+	kubeCA           string
+}
+
+func (f *serveFlags) register(fs *flag.FlagSet) {
+	f.balancerFlags.register(fs)
+	fs.StringVar(&f.recordPath, "record", "", "append sampled requests to this file for replay")
+	fs.Float64Var(&f.recordSample, "record-sample", 0.01, "fraction of requests recorded with -record")
+	fs.IntVar(&f.recordMaxBody, "record-max-body", 64<<10, "maximum body bytes stored per recorded request and response")
+	fs.StringVar(&f.accessLog, "access-log", "", "write a JSON access log line per request to stdout, stderr, a file, syslog (the local daemon), syslog://host:port, syslog+tcp://host:port or an http(s) collector URL; disabled when empty")
+	fs.BoolVar(&f.accessQuery, "access-log-query", false, "include the query string in -access-log lines, scrubbed as -scrub-query says")
+	fs.StringVar(&f.accessToken, "access-log-token", os.Getenv("LB_ACCESS_LOG_TOKEN"), "bearer token sent to an http(s) -access-log (default $LB_ACCESS_LOG_TOKEN)")
+	fs.BoolVar(&f.accessKafka, "access-log-kafka", false, "the http(s) -access-log is a Kafka REST Proxy topic URL, such as http://kafka-rest:8082/topics/access-log")
+	fs.IntVar(&f.accessBuffer, "access-log-buffer", 4096, "access log lines queued for writing in the background, dropping lines when full; 0 writes them as requests finish")
+	fs.BoolVar(&f.scrub, "scrub", false, "replace the Authorization, Proxy-Authorization, Cookie and X-Api-Key headers in recordings, and the -scrub-query parameters in recordings and logs, with REDACTED")
+	fs.Var(&f.scrubHeaders, "scrub-header", "header scrubbed instead of the -scrub defaults; implies -scrub; may be repeated")
+	fs.Var(&f.scrubQuery, "scrub-query", "query parameter scrubbed from recordings and logs, or a pattern such as '*token*'; implies -scrub; may be repeated")
+	fs.StringVar(&f.requestID, "request-id-header", "X-Request-ID", "header carrying the request ID that -access-log logs and passes to backends")
+	fs.TextVar(&f.logLevel, "log-level", slog.LevelInfo, "least severe level logged: debug, info, warn or error")
+	fs.BoolVar(&f.journal, "journal", false, "keep a journal of the requests in flight, dumped on a handler panic, SIGQUIT, SIGABRT or when shutdown cuts requests off")
+	fs.IntVar(&f.journalSize, "journal-size", 256, "requests the -journal holds before overwriting the oldest")
+	fs.StringVar(&f.journalFile, "journal-file", "stderr", "where -journal dumps go: stdout, stderr or a file appended to")
+	fs.StringVar(&f.kubeIngressClass, "kube-ingress-class", "", "serve the Kubernetes Ingresses of this class, routing their hosts and paths to the ready endpoints of their Services")
+	fs.StringVar(&f.kubeGateway, "kube-gateway", "", "namespace/name of a Gateway API Gateway whose HTTPRoutes are served like -kube-ingress-class Ingresses")
+	fs.StringVar(&f.kubeNamespace, "kube-namespace", "", "only serve the Ingresses and HTTPRoutes of this namespace; default all")
+	fs.BoolVar(&f.kubeTLS, "kube-tls", false, "terminate TLS on -port with the certificates of the Ingresses' and the Gateway's TLS secrets")
+	fs.DurationVar(&f.kubeInterval, "kube-interval", 10*time.Second, "how often the Kubernetes resources are read again")
+	fs.StringVar(&f.kubeAPI, "kube-api", "", "Kubernetes API server URL, such as http://127.0.0.1:8001 for kubectl proxy; default the in-cluster one")
+	fs.StringVar(&f.kubeToken, "kube-token-file", "", "file holding the bearer token for -kube-api; default the pod's service account token in a cluster")
+	fs.StringVar(&f.kubeCA, "kube-ca", "", "PEM bundle of the CAs signing -kube-api's certificate; default the service account's in a cluster")
+	fs.DurationVar(&f.reloadCheck, "reload-check", 10*time.Second, "time a reloaded configuration gets to become ready before the last good one is restored; 0 disables the check")
+}
+
+// kube reports whether the routes come from Kubernetes resources
+func (f *serveFlags) kube() bool {
+	return f.kubeIngressClass != "" || f.kubeGateway != ""
+}
+
+// build is balancerFlags.build, without the default backends when the routes come from
+// Kubernetes resources
+func (f *serveFlags) build(extra ...loadbalancer.Option) (*loadbalancer.LoadBalancer, error) {
+	f.routedOnly = f.kube()
+	return f.balancerFlags.build(extra...)
+}
+
+// serve runs the balancer described by args until ctx is cancelled
+func serve(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var sf serveFlags
+	sf.register(fs)
+	if err := sf.parse(fs, args); err != nil {
+		return err
+	}
+
+	slog.SetLogLoggerLevel(sf.logLevel)
+
+	var extra []loadbalancer.Option
+	if sf.scrub || len(sf.scrubHeaders) > 0 || len(sf.scrubQuery) > 0 {
+		extra = append(extra, loadbalancer.WithScrubbing(loadbalancer.Scrub{
+			Headers:     sf.scrubHeaders,
+			QueryParams: sf.scrubQuery,
+		}))
+	}
+	if sf.accessLog != "" {
+		sink, err := openAccessLog(&sf)
+		if err != nil {
+			return err
+		}
+		if sf.accessBuffer > 0 {
+			sink = loadbalancer.NewAsyncSink(sink, sf.accessBuffer)
+		}
+		if c, ok := sink.(io.Closer); ok {
+			defer c.Close()
+		}
+		extra = append(extra, loadbalancer.WithAccessLog(loadbalancer.AccessLog{
+			Sink:            sink,
+			RequestIDHeader: sf.requestID,
+			Query:           sf.accessQuery,
+		}))
+	}
+	if sf.recordPath != "" {
+		f, err := os.OpenFile(sf.recordPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return err
+		}
+		rec := traffic.NewRecorder(f)
+		defer rec.Close()
+		extra = append(extra, loadbalancer.WithRecorder(rec, loadbalancer.RecordOptions{
+			SampleRate: sf.recordSample,
+			MaxBody:    sf.recordMaxBody,
+		}))
+	}
+	if sf.journal {
+		out, closeJournal, err := openLog(sf.journalFile)
+		if err != nil {
+			return err
+		}
+		defer closeJournal()
+		extra = append(extra, loadbalancer.WithRequestJournal(loadbalancer.RequestJournal{Size: sf.journalSize, Output: out}))
+	}
+	listeners, err := systemd.Listeners()
+	if err != nil {
+		return err
+	}
+	if len(listeners) > 0 {
+		// socket activation: systemd owns the port and keeps it open across restarts
+		extra = append(extra, loadbalancer.WithListener(listeners[0]))
+		for _, ln := range listeners[1:] {
+			ln.Close()
+		}
+	}
+
+	var ctl *kubeController
+	if sf.kube() {
+		if ctl, err = newKubeController(&sf); err != nil {
+			return err
+		}
+		if sf.kubeTLS {
+			extra = append(extra, loadbalancer.WithTLSConfig(ctl.tlsConfig()))
+		}
+	}
+
+	r := &reloader{args: args, extra: extra, good: sf.configData, check: sf.reloadCheck}
+	if sf.config != "" {
+		r.extra = append(r.extra, loadbalancer.WithReload(r.reload))
+	}
+	if ctl != nil {
+		// the first read must succeed, or there is nothing to serve
+		cfg, err := ctl.load(ctx)
+		if err != nil {
+			return err
+		}
+		ctl.current, r.kube = cfg, kubeOptions(cfg)
+	}
+	lb, err := sf.build(slices.Concat(r.extra, r.kube)...)
+	if err != nil {
+		return err
+	}
+	group, err := loadbalancer.NewGroup(lb)
+	if err != nil {
+		return err
+	}
+	r.group = group
+	if sf.config != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		go r.reloadOn(ctx, hup)
+	}
+	if ctl != nil {
+		go ctl.run(ctx, r)
+	}
+	if sf.journal {
+		fatal := make(chan os.Signal, 1)
+		signal.Notify(fatal, syscall.SIGQUIT, syscall.SIGABRT)
+		defer signal.Stop(fatal)
+		go dumpJournalOn(ctx, group, fatal)
+	}
+	return group.Run(ctx, sf.shutdownGrace)
+}
+
+// dumpJournalOn dumps the request journal of every balancer when a fatal signal arrives, then
+// lets the signal take its default course: a goroutine dump and exit
+func dumpJournalOn(ctx context.Context, group *loadbalancer.Group, fatal <-chan os.Signal) {
+	select {
+	case <-ctx.Done():
+		return
+	case sig := <-fatal:
+		for _, lb := range group.Balancers() {
+			if err := lb.DumpJournal("signal: " + sig.String()); err != nil {
+				slog.Error("dumping the request journal failed", "error", err)
+			}
+		}
+		signal.Reset(sig)
+		if p, err := os.FindProcess(os.Getpid()); err == nil {
+			p.Signal(sig)
+		}
+	}
+}
+
+// openLog opens a log destination: stdout, stderr or a file appended to
+func openLog(dest string) (io.Writer, func() error, error) {
+	switch dest {
+	case "stdout":
+		return os.Stdout, func() error { return nil }, nil
+	case "stderr":
+		return os.Stderr, func() error { return nil }, nil
+	}
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f.Close, nil
+}
+
+// openAccessLog opens the sink -access-log names
+func openAccessLog(sf *serveFlags) (loadbalancer.LogSink, error) {
+	dest := sf.accessLog
+	if sf.accessKafka && !strings.HasPrefix(dest, "http://") && !strings.HasPrefix(dest, "https://") {
+		return nil, errors.New("-access-log-kafka needs an http(s) -access-log")
+	}
+	switch {
+	case dest == "stdout":
+		return loadbalancer.NewWriterSink(os.Stdout), nil
+	case dest == "stderr":
+		return loadbalancer.NewWriterSink(os.Stderr), nil
+	case dest == "syslog":
+		return &loadbalancer.SyslogSink{}, nil
+	case strings.HasPrefix(dest, "syslog://"):
+		return &loadbalancer.SyslogSink{Network: "udp", Address: strings.TrimPrefix(dest, "syslog://")}, nil
+	case strings.HasPrefix(dest, "syslog+tcp://"):
+		return &loadbalancer.SyslogSink{Network: "tcp", Address: strings.TrimPrefix(dest, "syslog+tcp://")}, nil
+	case strings.HasPrefix(dest, "http://"), strings.HasPrefix(dest, "https://"):
+		return &loadbalancer.HTTPSink{URL: dest, Token: sf.accessToken, KafkaREST: sf.accessKafka}, nil
+	}
+	sink, err := loadbalancer.OpenFileSink(dest)
+	if err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+// reloader rebuilds the balancer from the command line and the re-read config file, and hands
+// the running one's listeners over to it. A configuration that was ready before a reload and
+// isn't within check afterwards is replaced again by the last good one, kept in good and kube.
+type reloader struct {
+	mu    sync.Mutex
+	args  []string
+	extra []loadbalancer.Option
+	// kube are the routes and pools read from the cluster in controller mode
+	kube  []loadbalancer.Option
+	group *loadbalancer.Group
+	good  []byte
+	check time.Duration
+}
+
+func (r *reloader) reload(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rebuild(ctx, r.kube)
+}
+
+// applyKube rebuilds the balancer with kube, the routes and pools read from the cluster
+func (r *reloader) applyKube(ctx context.Context, kube []loadbalancer.Option) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rebuild(ctx, kube)
+}
+
+func (r *reloader) rebuild(ctx context.Context, kube []loadbalancer.Option) error {
+	current := r.group.Balancers()[0]
+	wasReady := current.Ready(ctx) == nil
+	next, sf, err := r.build(nil, kube)
+	if err != nil {
+		return err
+	}
+	if err := r.group.Replace(ctx, next); err != nil {
+		return err
+	}
+	if wasReady && r.check > 0 {
+		if err := awaitReady(ctx, next, r.check); err != nil {
+			return r.rollback(ctx, err)
+		}
+	}
+	r.good, r.kube = sf.configData, kube
+	slog.Info("configuration reloaded", "config", sf.config)
+	return nil
+}
+
+// build builds a balancer from the command line, config data, or the file when data is nil,
+// and kube
+func (r *reloader) build(data []byte, kube []loadbalancer.Option) (*loadbalancer.LoadBalancer, *serveFlags, error) {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	var sf serveFlags
+	sf.register(fs)
+	if err := sf.parseWith(fs, r.args, data); err != nil {
+		return nil, nil, err
+	}
+	lb, err := sf.build(slices.Concat(r.extra, kube)...)
+	return lb, &sf, err
+}
+
+// rollback restores the last good configuration after the reloaded one failed with cause
+func (r *reloader) rollback(ctx context.Context, cause error) error {
+	slog.Error("reloaded configuration is not ready; restoring the last good one", "error", cause)
+	prev, _, err := r.build(r.good, r.kube)
+	if err == nil {
+		err = r.group.Replace(ctx, prev)
+	}
+	if err != nil {
+		slog.Error("rollback failed; the reloaded configuration stays in place", "error", err)
+		return fmt.Errorf("%w; rollback failed: %w", cause, err)
+	}
+	slog.Warn("configuration rolled back")
+	return fmt.Errorf("%w; rolled back to the last good configuration", cause)
+}
+
+// awaitReady waits up to timeout for lb to become ready and returns its last readiness error
+func awaitReady(ctx context.Context, lb *loadbalancer.LoadBalancer, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	tick := time.NewTicker(250 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		err := lb.Ready(ctx)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-tick.C:
+		}
+	}
+}
+
+// reloadOn reloads for every signal until ctx is done; a failed reload keeps the running configuration
+func (r *reloader) reloadOn(ctx context.Context, signals <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			if err := r.reload(ctx); err != nil {
+				slog.Error("reload failed; keeping the running configuration", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+func runService([]string) error {
+	return errors.New("service mode is only available on Windows; use systemd on Linux")
+}
@@ -0,0 +1,154 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceUsage = "usage: service install|remove|start|stop|run [-name lb] [serve flags]"
+
+// runService manages the Windows service. "run" is what the service control manager invokes;
+// the serve flags given to "install" are stored in the service's command line.
+func runService(args []string) error {
+	if len(args) == 0 {
+		return errors.New(serviceUsage)
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("service "+action, flag.ExitOnError)
+	name := fs.String("name", "lb", "Windows service name")
+	fs.Parse(args[1:])
+	serveArgs := fs.Args()
+
+	switch action {
+	case "install":
+		return installService(*name, serveArgs)
+	case "remove":
+		return removeService(*name)
+	case "start":
+		return controlService(*name, func(s *mgr.Service) error { return s.Start() })
+	case "stop":
+		return controlService(*name, func(s *mgr.Service) error {
+			_, err := s.Control(svc.Stop)
+			return err
+		})
+	case "run":
+		return svc.Run(*name, &lbService{name: *name, args: serveArgs})
+	}
+	return errors.New(serviceUsage)
+}
+
+func installService(name string, serveArgs []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", name)
+	}
+	cmdArgs := append([]string{"service", "run", "-name", name, "--"}, serveArgs...)
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: "Load balancer (" + name + ")",
+		StartType:   mgr.StartAutomatic,
+	}, cmdArgs...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("install event log source: %w", err)
+	}
+	fmt.Printf("service %s installed\n", name)
+	return nil
+}
+
+func removeService(name string) error {
+	err := controlService(name, func(s *mgr.Service) error { return s.Delete() })
+	if err != nil {
+		return err
+	}
+	eventlog.Remove(name)
+	fmt.Printf("service %s removed\n", name)
+	return nil
+}
+
+func controlService(name string, fn func(*mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("open service %s: %w", name, err)
+	}
+	defer s.Close()
+	return fn(s)
+}
+
+// lbService adapts serve to the service control manager's start/stop protocol
+type lbService struct {
+	name string
+	args []string
+}
+
+func (s *lbService) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	elog, err := eventlog.Open(s.name)
+	if err == nil {
+		defer elog.Close()
+	}
+	report := func(msg string) {
+		if elog != nil {
+			elog.Error(1, msg)
+		}
+	}
+
+	status <- svc.Status{State: svc.StartPending}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- serve(ctx, s.args) }()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-errc:
+			if err != nil {
+				report(err.Error())
+				return false, 1
+			}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				// serve drains in-flight requests before returning
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32((15 * time.Second).Milliseconds())}
+				cancel()
+				if err := <-errc; err != nil {
+					report(err.Error())
+					return false, 1
+				}
+				return false, 0
+			}
+		}
+	}
+}